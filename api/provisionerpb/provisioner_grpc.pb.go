@@ -0,0 +1,204 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: provisioner.proto
+
+package provisionerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Provisioner_Provision_FullMethodName         = "/provisioner.v1.Provisioner/Provision"
+	Provisioner_GetStatus_FullMethodName         = "/provisioner.v1.Provisioner/GetStatus"
+	Provisioner_RotateCertificate_FullMethodName = "/provisioner.v1.Provisioner/RotateCertificate"
+)
+
+// ProvisionerClient is the client API for Provisioner service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProvisionerClient interface {
+	Provision(ctx context.Context, in *ProvisionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error)
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	RotateCertificate(ctx context.Context, in *RotateCertificateRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error)
+}
+
+type provisionerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProvisionerClient(cc grpc.ClientConnInterface) ProvisionerClient {
+	return &provisionerClient{cc}
+}
+
+func (c *provisionerClient) Provision(ctx context.Context, in *ProvisionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Provisioner_ServiceDesc.Streams[0], Provisioner_Provision_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ProvisionRequest, ProgressEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Provisioner_ProvisionClient = grpc.ServerStreamingClient[ProgressEvent]
+
+func (c *provisionerClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Status)
+	err := c.cc.Invoke(ctx, Provisioner_GetStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *provisionerClient) RotateCertificate(ctx context.Context, in *RotateCertificateRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Provisioner_ServiceDesc.Streams[1], Provisioner_RotateCertificate_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RotateCertificateRequest, ProgressEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Provisioner_RotateCertificateClient = grpc.ServerStreamingClient[ProgressEvent]
+
+// ProvisionerServer is the server API for Provisioner service.
+// All implementations must embed UnimplementedProvisionerServer
+// for forward compatibility.
+type ProvisionerServer interface {
+	Provision(*ProvisionRequest, grpc.ServerStreamingServer[ProgressEvent]) error
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	RotateCertificate(*RotateCertificateRequest, grpc.ServerStreamingServer[ProgressEvent]) error
+	mustEmbedUnimplementedProvisionerServer()
+}
+
+// UnimplementedProvisionerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedProvisionerServer struct{}
+
+func (UnimplementedProvisionerServer) Provision(*ProvisionRequest, grpc.ServerStreamingServer[ProgressEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method Provision not implemented")
+}
+func (UnimplementedProvisionerServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedProvisionerServer) RotateCertificate(*RotateCertificateRequest, grpc.ServerStreamingServer[ProgressEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method RotateCertificate not implemented")
+}
+func (UnimplementedProvisionerServer) mustEmbedUnimplementedProvisionerServer() {}
+func (UnimplementedProvisionerServer) testEmbeddedByValue()                     {}
+
+// UnsafeProvisionerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProvisionerServer will
+// result in compilation errors.
+type UnsafeProvisionerServer interface {
+	mustEmbedUnimplementedProvisionerServer()
+}
+
+func RegisterProvisionerServer(s grpc.ServiceRegistrar, srv ProvisionerServer) {
+	// If the following call pancis, it indicates UnimplementedProvisionerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Provisioner_ServiceDesc, srv)
+}
+
+func _Provisioner_Provision_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ProvisionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProvisionerServer).Provision(m, &grpc.GenericServerStream[ProvisionRequest, ProgressEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Provisioner_ProvisionServer = grpc.ServerStreamingServer[ProgressEvent]
+
+func _Provisioner_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProvisionerServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Provisioner_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProvisionerServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Provisioner_RotateCertificate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RotateCertificateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProvisionerServer).RotateCertificate(m, &grpc.GenericServerStream[RotateCertificateRequest, ProgressEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Provisioner_RotateCertificateServer = grpc.ServerStreamingServer[ProgressEvent]
+
+// Provisioner_ServiceDesc is the grpc.ServiceDesc for Provisioner service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Provisioner_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "provisioner.v1.Provisioner",
+	HandlerType: (*ProvisionerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _Provisioner_GetStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Provision",
+			Handler:       _Provisioner_Provision_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "RotateCertificate",
+			Handler:       _Provisioner_RotateCertificate_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "provisioner.proto",
+}
@@ -0,0 +1,264 @@
+// Package provisioningtest provides a fake of the local provisioning gRPC API,
+// so applications that onboard the device through it can be tested without
+// AWS IoT or MQTT. The fake plays back scripted outcomes and serves them over
+// an in-memory connection with the generated provisionerpb client.
+package provisioningtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/humblenginr/aws-claim-provisioning/api/provisionerpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// Stages a real provisioning run reports, in order
+var ProvisionStages = []string{"validate", "connect", "create-certificate", "register-thing", "verify"}
+
+// Stages a real certificate rotation reports, in order
+var RotationStages = []string{"connect", "create-certificate", "register-thing"}
+
+// Stages a real certificate rotation with -rotation-overlap reports, in order:
+// the replacement is verified before the old certificate is kept active
+var OverlapRotationStages = []string{"connect", "create-certificate", "register-thing", "verify"}
+
+// Outcome scripts one Provision or RotateCertificate call
+type Outcome struct {
+	// Stages reported before the final event, the real ones if nil
+	Stages []string
+
+	// Delay before each event, to exercise timeouts and progress display
+	Delay time.Duration
+
+	// Error the final event carries, such as AWS IoT's rejection, or empty
+	// for success
+	Error string
+
+	// Refuse the call with ABORTED, as when another operation is running
+	Busy bool
+
+	// Thing name and certificate ID reported by GetStatus once the call
+	// succeeds
+	ThingName     string
+	CertificateID string
+}
+
+// Succeed returns the outcome of a call that provisions the device as
+// thingName
+func Succeed(thingName, certificateID string) Outcome {
+	return Outcome{ThingName: thingName, CertificateID: certificateID}
+}
+
+// Reject returns the outcome of a call AWS IoT rejects with message
+func Reject(message string) Outcome {
+	return Outcome{Error: message}
+}
+
+// Busy returns the outcome of a call made while another operation runs
+func Busy() Outcome {
+	return Outcome{Busy: true}
+}
+
+// Fake implements provisionerpb.ProvisionerServer. Calls play back the
+// scripted outcomes in order, the last one repeating; unscripted calls
+// succeed. The zero value is an unprovisioned device.
+type Fake struct {
+	provisionerpb.UnimplementedProvisionerServer
+
+	mu         sync.Mutex
+	provisions []Outcome
+	rotations  []Outcome
+	status     *provisionerpb.Status
+	overlap    bool
+	calls      map[string]int
+
+	server   *grpc.Server
+	listener *bufconn.Listener
+}
+
+// New returns a fake for an unprovisioned device
+func New() *Fake {
+	return &Fake{}
+}
+
+// ScriptProvision sets the outcomes of the following Provision calls
+func (f *Fake) ScriptProvision(outcomes ...Outcome) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.provisions = outcomes
+	return f
+}
+
+// ScriptRotation sets the outcomes of the following RotateCertificate calls
+func (f *Fake) ScriptRotation(outcomes ...Outcome) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotations = outcomes
+	return f
+}
+
+// SetStatus sets what GetStatus reports, such as an already provisioned or
+// quarantined device
+func (f *Fake) SetStatus(s *provisionerpb.Status) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = proto.Clone(s).(*provisionerpb.Status)
+	return f
+}
+
+// SetRotationOverlap makes rotations report the stages of a service run with
+// -rotation-overlap, OverlapRotationStages, unless their outcome sets others
+func (f *Fake) SetRotationOverlap(overlap bool) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overlap = overlap
+	return f
+}
+
+// Calls returns how often the RPC was called: "Provision", "GetStatus", or
+// "RotateCertificate"
+func (f *Fake) Calls(rpc string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[rpc]
+}
+
+// Dial starts serving the fake in memory and returns a client connection to
+// it. Close stops it.
+func (f *Fake) Dial() (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	if f.server == nil {
+		f.listener = bufconn.Listen(1 << 20)
+		f.server = grpc.NewServer()
+		provisionerpb.RegisterProvisionerServer(f.server, f)
+		go f.server.Serve(f.listener)
+	}
+	listener := f.listener
+	f.mu.Unlock()
+
+	return grpc.NewClient("passthrough:///provisioningtest",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// Close stops serving the fake
+func (f *Fake) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.server != nil {
+		f.server.Stop()
+		f.server, f.listener = nil, nil
+	}
+}
+
+func (f *Fake) Provision(_ *provisionerpb.ProvisionRequest, stream provisionerpb.Provisioner_ProvisionServer) error {
+	return f.play("Provision", &f.provisions, ProvisionStages, stream)
+}
+
+func (f *Fake) RotateCertificate(_ *provisionerpb.RotateCertificateRequest, stream provisionerpb.Provisioner_RotateCertificateServer) error {
+	f.mu.Lock()
+	stages := RotationStages
+	if f.overlap {
+		stages = OverlapRotationStages
+	}
+	f.mu.Unlock()
+	return f.play("RotateCertificate", &f.rotations, stages, stream)
+}
+
+func (f *Fake) GetStatus(context.Context, *provisionerpb.GetStatusRequest) (*provisionerpb.Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count("GetStatus")
+	return f.currentStatus(), nil
+}
+
+// play streams the next scripted outcome of script and updates the status as
+// the real service would
+func (f *Fake) play(rpc string, script *[]Outcome, stages []string, stream grpc.ServerStreamingServer[provisionerpb.ProgressEvent]) error {
+	f.mu.Lock()
+	f.count(rpc)
+	var outcome Outcome
+	if len(*script) > 0 {
+		outcome = (*script)[0]
+		if len(*script) > 1 {
+			*script = (*script)[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	if outcome.Busy {
+		return status.Error(codes.Aborted, "provisioning already in progress")
+	}
+	if outcome.Stages != nil {
+		stages = outcome.Stages
+	}
+	last := ""
+	for _, stage := range stages {
+		if err := wait(stream.Context(), outcome.Delay); err != nil {
+			return err
+		}
+		last = stage
+		if err := stream.Send(&provisionerpb.ProgressEvent{Stage: stage}); err != nil {
+			return err
+		}
+	}
+	if err := wait(stream.Context(), outcome.Delay); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	current := f.currentStatus()
+	if outcome.Error != "" {
+		current.LastError = outcome.Error
+	} else {
+		last = "complete"
+		current.State, current.FlowState, current.LastError, current.QuarantinedUntil = "provisioned", "verified", "", ""
+		if outcome.ThingName != "" {
+			current.ThingName = outcome.ThingName
+		}
+		if outcome.CertificateID != "" {
+			current.CertificateId = outcome.CertificateID
+		}
+	}
+	f.status = current
+	f.mu.Unlock()
+
+	return stream.Send(&provisionerpb.ProgressEvent{Stage: last, Done: true, Error: outcome.Error})
+}
+
+// currentStatus returns a copy of the status, an unprovisioned device if none
+// was set
+func (f *Fake) currentStatus() *provisionerpb.Status {
+	if f.status == nil {
+		return &provisionerpb.Status{State: "unprovisioned", FlowState: "unprovisioned"}
+	}
+	return proto.Clone(f.status).(*provisionerpb.Status)
+}
+
+func (f *Fake) count(rpc string) {
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[rpc]++
+}
+
+// wait sleeps for d unless ctx ends first
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
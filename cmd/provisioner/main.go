@@ -0,0 +1,9 @@
+// Command provisioner provisions a device with AWS IoT fleet provisioning,
+// and runs the subcommands of the README
+package main
+
+import "github.com/humblenginr/aws-claim-provisioning/internal/provisioner"
+
+func main() {
+	provisioner.Main()
+}
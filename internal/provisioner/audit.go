@@ -0,0 +1,336 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Audit events
+const (
+	AuditAttemptStarted      = "attempt-started"
+	AuditCertificateCreated  = "certificate-created"
+	AuditThingRegistered     = "thing-registered"
+	AuditIdentityVerified    = "identity-verified"
+	AuditAttemptFailed       = "attempt-failed"
+	AuditCertificateRotated  = "certificate-rotated"
+	AuditDeprovisioned       = "deprovisioned"
+	AuditChildProvisioned    = "child-provisioned"    // A child device was provisioned through the gateway
+	AuditCredentialsLost     = "credentials-lost"     // The permanent credentials were deleted or damaged
+	AuditClaimRefused        = "claim-refused"        // AWS IoT refused a claim from -claim-dir
+	AuditCertificateOrphaned = "certificate-orphaned" // Abandoned unregistered when -deadline passed
+	AuditOrphanDeleted       = "orphan-deleted"       // Deleted by cleanup-orphans
+	AuditFingerprintMismatch = "fingerprint-mismatch" // A claim was not pinned, or the permanent certificate was swapped
+	AuditDeviceReplaced      = "device-replaced"      // A replacement unit took over the thing, see rma import
+	AuditThingReconciled     = "thing-reconciled"     // Changed template parameters were applied to the thing
+	AuditCertificateRevoked  = "certificate-revoked"  // A certificate replaced by rotation was revoked, see -rotation-overlap
+	AuditLogPruned           = "log-pruned"           // Heads the log once older entries were pruned, see -audit-max-entries
+)
+
+// An entry in the audit log. Each entry carries the hash of the one before it,
+// so editing or removing an entry breaks the chain, and the log's head records
+// the last, so removing the newest entries does too.
+type auditEntry struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Serial        string    `json:"serial,omitempty"`
+	CertificateID string    `json:"certificateId,omitempty"`
+	ThingName     string    `json:"thingName,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Pruned        int       `json:"pruned,omitempty"` // Entries pruned so far, in a log-pruned entry
+	Prev          string    `json:"prev"`
+	Hash          string    `json:"hash"`
+}
+
+// hash returns the SHA-256 of the entry with its own hash left out
+func (e auditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// The head of the audit log, kept next to it. The chain alone does not show
+// that entries were cut off its end, or that a prefix was swapped for a
+// log-pruned entry of someone else's making, so the head records the last
+// entry, how many were appended, and the log-pruned entry heading the log. It
+// is not kept in the provisioning state, which deprovisioning removes while
+// the log stays.
+type auditHead struct {
+	Entries int    `json:"entries"`          // Appended, pruned ones included
+	Hash    string `json:"hash"`             // Of the last entry
+	Pruned  string `json:"pruned,omitempty"` // Hash of the log-pruned entry heading the log
+}
+
+// auditHeadPath returns the path of the head of the audit log at path
+func auditHeadPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".head"
+}
+
+// loadAuditHead returns the head of the audit log at path, or nil if there is
+// none
+func loadAuditHead(path string, files FilePermissions) (*auditHead, error) {
+	data, err := files.fs().ReadFile(auditHeadPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log head: %v", err)
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("failed to parse audit log head: %v", err)
+	}
+	return &head, nil
+}
+
+// save writes the head of the audit log at path
+func (h auditHead) save(path string, files FilePermissions) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log head: %v", err)
+	}
+	if err := files.write(auditHeadPath(path), data, true); err != nil {
+		return fmt.Errorf("failed to save audit log head: %v", err)
+	}
+	return nil
+}
+
+// appendAuditEntry chains the entry to the last one in the log, appends it
+// with the time of clock, and moves the head to it. A log written before heads
+// were kept is counted once to start one.
+func appendAuditEntry(path string, entry auditEntry, files FilePermissions, clock Clock) error {
+	last, err := lastAuditLine(files.fs(), path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	if last != nil {
+		var prev auditEntry
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("failed to parse last audit log entry: %v", err)
+		}
+		entry.Prev = prev.Hash
+	}
+	head, err := loadAuditHead(path, files)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		head = &auditHead{}
+		if exists {
+			if head, err = countAuditLog(path, files); err != nil {
+				return err
+			}
+		}
+	}
+
+	entry.Time = clock.Now().UTC()
+	if entry.Hash, err = entry.hash(); err != nil {
+		return fmt.Errorf("failed to hash audit log entry: %v", err)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log entry: %v", err)
+	}
+
+	f, err := files.fs().OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, files.KeyMode)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	if !exists {
+		if err := files.apply(path, true); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	// A head that no longer matched the log is not brought back in line, so
+	// verification keeps reporting it
+	head.Entries++
+	head.Hash = entry.Hash
+	return head.save(path, files)
+}
+
+// countAuditLog returns the head of an audit log that has none, without
+// checking the chain
+func countAuditLog(path string, files FilePermissions) (*auditHead, error) {
+	entries, err := readAuditLog(path, files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	head := &auditHead{}
+	for i, entry := range entries {
+		if i == 0 && entry.Event == AuditLogPruned {
+			head.Entries = entry.Pruned
+			head.Pruned = entry.Hash
+			continue
+		}
+		head.Entries++
+		head.Hash = entry.Hash
+	}
+	return head, nil
+}
+
+// recordAudit appends an entry to the audit log in the output directory. A
+// failure is logged rather than returned so it can't strand a device halfway
+// through provisioning.
+func recordAudit(cfg Config, entry auditEntry) {
+	entry.Serial = cfg.SerialNumber
+	path := cfg.outputPath(auditLogFile)
+	if err := appendAuditEntry(path, entry, cfg.Files, cfg.clock()); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	if _, err := pruneAuditLog(path, cfg.AuditRetention, cfg.Files, cfg.clock()); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// verifyAuditLog checks the hash chain of the audit log against its head,
+// returning the number of entries. A log-pruned entry heading the log stands
+// in for the pruned entries: the chain goes on from the last of them.
+func verifyAuditLog(path string, files FilePermissions) (int, error) {
+	f, err := files.fs().OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	head, err := loadAuditHead(path, files)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil {
+		return 0, fmt.Errorf("audit log has no head %s; a log written before heads were kept gets one with its next entry", auditHeadPath(path))
+	}
+
+	count := 0
+	appended := 0
+	prev := ""
+	prunedHead := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		count++
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, fmt.Errorf("entry %d is not valid JSON: %v", count, err)
+		}
+		pruned := count == 1 && entry.Event == AuditLogPruned
+		if entry.Prev != prev && !pruned {
+			return count, fmt.Errorf("entry %d does not follow the previous entry", count)
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return count, err
+		}
+		if hash != entry.Hash {
+			return count, fmt.Errorf("entry %d has been modified", count)
+		}
+		prev = entry.Hash
+		appended++
+		if pruned {
+			prev = entry.Prev
+			prunedHead = entry.Hash
+			appended = entry.Pruned
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	if prunedHead != head.Pruned {
+		return count, fmt.Errorf("the entries before entry 1 were not pruned as recorded")
+	}
+	if prev != head.Hash || appended != head.Entries {
+		return count, fmt.Errorf("the log holds %d entries up to %.12s, its head records %d up to %.12s", appended, prev, head.Entries, head.Hash)
+	}
+	return count, nil
+}
+
+// readAuditLog returns the entries of the audit log, without checking the
+// chain
+func readAuditLog(path string, files FilePermissions) ([]auditEntry, error) {
+	f, err := files.fs().OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("audit log entry %d is not valid JSON: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// lastAuditLine returns the last line of the audit log. The log grows with
+// every rotation for the life of the device, so only its end is read when the
+// file system allows it.
+func lastAuditLine(fsys FileSystem, path string) ([]byte, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, statErr := f.Stat()
+	readerAt, ok := f.(io.ReaderAt)
+	if statErr != nil || !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return lastLine(data), nil
+	}
+	size := info.Size()
+	for chunk := int64(4096); ; chunk *= 2 {
+		offset := max(size-chunk, 0)
+		tail := make([]byte, size-offset)
+		if _, err := readerAt.ReadAt(tail, offset); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		// The line is whole once the tail holds the newline before it
+		if offset == 0 || bytes.LastIndexByte(bytes.TrimRight(tail, "\n"), '\n') >= 0 {
+			return lastLine(tail), nil
+		}
+	}
+}
+
+// lastLine returns the last non-empty line of data, or nil
+func lastLine(data []byte) []byte {
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil
+	}
+	return data[bytes.LastIndexByte(data, '\n')+1:]
+}
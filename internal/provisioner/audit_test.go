@@ -0,0 +1,207 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAuditLog appends n entries to a new audit log in memory
+func writeAuditLog(t *testing.T, n int) (FilePermissions, *MemoryFS) {
+	t.Helper()
+	files, mem := memoryFiles()
+	for i := range n {
+		entry := auditEntry{Event: AuditAttemptStarted, CertificateID: fmt.Sprintf("cert-%d", i)}
+		if err := appendAuditEntry(auditLogFile, entry, files, systemClock{}); err != nil {
+			t.Fatalf("appendAuditEntry: %v", err)
+		}
+	}
+	return files, mem
+}
+
+// auditLines returns the lines of the audit log
+func auditLines(t *testing.T, mem *MemoryFS) []string {
+	t.Helper()
+	return strings.SplitAfter(strings.TrimSuffix(mustRead(t, mem, auditLogFile), "\n"), "\n")
+}
+
+func TestAuditLogVerifies(t *testing.T) {
+	files, mem := writeAuditLog(t, 5)
+	count, err := verifyAuditLog(auditLogFile, files)
+	if err != nil || count != 5 {
+		t.Fatalf("verifyAuditLog = %d, %v, want 5 entries", count, err)
+	}
+	entries, err := readAuditLog(auditLogFile, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Prev != "" {
+		t.Errorf("first entry chains to %q", entries[0].Prev)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Prev != entries[i-1].Hash {
+			t.Errorf("entry %d does not chain to entry %d", i+1, i)
+		}
+	}
+	if info, _ := mem.Stat(auditLogFile); info.Mode().Perm() != 0600 {
+		t.Errorf("audit log mode = %v, want the key mode 0600", info.Mode().Perm())
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+	}{
+		{
+			name: "edited entry",
+			tamper: func(lines []string) []string {
+				lines[2] = strings.Replace(lines[2], "cert-2", "cert-X", 1)
+				return lines
+			},
+		},
+		{
+			name:   "removed entry",
+			tamper: func(lines []string) []string { return append(lines[:2], lines[3:]...) },
+		},
+		{
+			name:   "truncated",
+			tamper: func(lines []string) []string { return lines[:3] },
+		},
+		{
+			name: "appended copy",
+			tamper: func(lines []string) []string {
+				return append(lines, lines[len(lines)-1])
+			},
+		},
+		{
+			name: "prefix replaced by a log-pruned entry",
+			tamper: func(lines []string) []string {
+				var kept auditEntry
+				if err := json.Unmarshal([]byte(lines[3]), &kept); err != nil {
+					panic(err)
+				}
+				marker := auditEntry{Event: AuditLogPruned, Pruned: 3, Prev: kept.Prev}
+				marker.Hash, _ = marker.hash()
+				line, _ := json.Marshal(marker)
+				return append([]string{string(line) + "\n"}, lines[3:]...)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, mem := writeAuditLog(t, 5)
+			lines := tt.tamper(auditLines(t, mem))
+			mem.WriteFile(auditLogFile, []byte(strings.Join(lines, "")), 0600)
+			if _, err := verifyAuditLog(auditLogFile, files); err == nil {
+				t.Error("tampered audit log verified")
+			}
+		})
+	}
+}
+
+func TestAuditLogMissingHead(t *testing.T) {
+	files, mem := writeAuditLog(t, 3)
+	mem.Remove(auditHeadPath(auditLogFile))
+	if _, err := verifyAuditLog(auditLogFile, files); err == nil {
+		t.Fatal("audit log without a head verified")
+	}
+
+	// The next entry starts one, counting the log as it is
+	if err := appendAuditEntry(auditLogFile, auditEntry{Event: AuditAttemptStarted}, files, systemClock{}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := verifyAuditLog(auditLogFile, files); err != nil || count != 4 {
+		t.Errorf("verifyAuditLog = %d, %v, want 4 entries", count, err)
+	}
+}
+
+func TestAuditLogPruned(t *testing.T) {
+	files, mem := writeAuditLog(t, 6)
+	pruned, err := pruneAuditLog(auditLogFile, AuditRetention{MaxEntries: 2}, files, systemClock{})
+	if err != nil || pruned != 4 {
+		t.Fatalf("pruneAuditLog = %d, %v, want 4 pruned", pruned, err)
+	}
+	if count, err := verifyAuditLog(auditLogFile, files); err != nil || count != 3 {
+		t.Fatalf("verifyAuditLog after pruning = %d, %v, want the log-pruned entry and 2 more", count, err)
+	}
+
+	// Chaining and pruning go on from the log-pruned entry
+	for range 3 {
+		if err := appendAuditEntry(auditLogFile, auditEntry{Event: AuditAttemptStarted}, files, systemClock{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pruned, err := pruneAuditLog(auditLogFile, AuditRetention{MaxEntries: 2}, files, systemClock{}); err != nil || pruned != 3 {
+		t.Fatalf("second pruneAuditLog = %d, %v, want 3 pruned", pruned, err)
+	}
+	if _, err := verifyAuditLog(auditLogFile, files); err != nil {
+		t.Fatalf("verifyAuditLog after pruning twice: %v", err)
+	}
+	entries, _ := readAuditLog(auditLogFile, files)
+	if entries[0].Event != AuditLogPruned || entries[0].Pruned != 7 {
+		t.Errorf("log-pruned entry = %+v, want 7 pruned", entries[0])
+	}
+
+	// Dropping the log-pruned entry, as if nothing had been pruned, is caught
+	lines := auditLines(t, mem)
+	mem.WriteFile(auditLogFile, []byte(strings.Join(lines[1:], "")), 0600)
+	if _, err := verifyAuditLog(auditLogFile, files); err == nil {
+		t.Error("audit log without its log-pruned entry verified")
+	}
+}
+
+// TestAuditLogPrunedByAge appends entries an hour apart on a ManualClock, so
+// their ages are measured on the clock that stamped them
+func TestAuditLogPrunedByAge(t *testing.T) {
+	files, _ := memoryFiles()
+	clock := NewManualClock(testStart)
+	for range 5 {
+		if err := appendAuditEntry(auditLogFile, auditEntry{Event: AuditAttemptStarted}, files, clock); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+	}
+	// The entries are 5 to 1 hours old
+	pruned, err := pruneAuditLog(auditLogFile, AuditRetention{MaxAge: 150 * time.Minute}, files, clock)
+	if err != nil || pruned != 3 {
+		t.Fatalf("pruneAuditLog = %d, %v, want 3 pruned", pruned, err)
+	}
+	entries, _ := readAuditLog(auditLogFile, files)
+	if len(entries) != 3 || !entries[0].Time.Equal(clock.Now()) || !entries[1].Time.Equal(testStart.Add(3*time.Hour)) {
+		t.Errorf("entries after pruning = %+v, want the log-pruned entry and the last 2", entries)
+	}
+}
+
+func TestLastAuditLine(t *testing.T) {
+	// Lines longer than the first chunk read from the end
+	long := strings.Repeat("x", 5000)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "empty", content: "", want: ""},
+		{name: "one line", content: "a\n", want: "a"},
+		{name: "no trailing newline", content: "a\nb", want: "b"},
+		{name: "blank lines after", content: "a\nb\n\n", want: "b"},
+		{name: "long last line", content: "a\n" + long + "\n", want: long},
+		{name: "long log", content: strings.Repeat(long+"\n", 4) + "last\n", want: "last"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryFS()
+			mem.WriteFile(auditLogFile, []byte(tt.content), 0600)
+			got, err := lastAuditLine(mem, auditLogFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte(tt.want)) && !(len(got) == 0 && tt.want == "") {
+				t.Errorf("lastAuditLine = %.20q, want %.20q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+//go:build noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+)
+
+// Built without the AWS SDK, for devices that only provision over MQTT: the
+// control plane commands and features calling AWS APIs are left out, see
+// validate
+const awsSDK = false
+
+var errNoAWS = errors.New("not available in this build, which leaves out the AWS SDK (built with -tags noaws)")
+
+func verifyCloudState(ctx context.Context, cfg Config, state *provisioningState, certPEM []byte) error {
+	return errNoAWS
+}
+
+func kmsDecryptDataKey(cfg Config, blob []byte) ([]byte, error) {
+	return nil, errNoAWS
+}
+
+func kmsGenerateDataKey(cfg Config) (plaintext, blob []byte, err error) {
+	return nil, nil, errNoAWS
+}
+
+func reconcileThing(cfg Config, state *provisioningState, params map[string]string) (bool, error) {
+	return false, errNoAWS
+}
+
+func revokeCertificate(cfg Config, certificateID string) (bool, error) {
+	return false, errNoAWS
+}
+
+func fetchTemplateBody(ctx context.Context, cfg Config) ([]byte, error) {
+	return nil, errNoAWS
+}
+
+// validate rejects -inventory-table in this build
+func writeInventory(cfg Config, result *ProvisioningResult) error {
+	return nil
+}
+
+func shipEvents(cfg Config, thingName string, events []provisioningEvent) error {
+	return errNoAWS
+}
+
+func newThingNameCheck(cfg Config) (func(name string) (bool, error), error) {
+	return nil, errNoAWS
+}
+
+// validate rejects -attach-policy in this build
+func attachCertificatePolicies(cfg Config, state *provisioningState, policies []string) error {
+	return errNoAWS
+}
+
+func newSNSNotifier(cfg Config, topicARN string) (Notifier, error) {
+	return nil, errNoAWS
+}
+
+func runAuditClaimPolicyCommand(args []string) error { return errNoAWS }
+func runBootstrapClaimCommand(args []string) error   { return errNoAWS }
+func runCanaryCommand(args []string) error           { return errNoAWS }
+func runCARegisterCommand(args []string) error       { return errNoAWS }
+func runClaimRotateCommand(args []string) error      { return errNoAWS }
+func runCleanupOrphansCommand(args []string) error   { return errNoAWS }
+func runDeprovisionCommand(args []string) error      { return errNoAWS }
+func runFindThingCommand(args []string) error        { return errNoAWS }
+func runHookSimulateCommand(args []string) error     { return errNoAWS }
+func runPreflightClaimCommand(args []string) error   { return errNoAWS }
+func runRMAImportCommand(args []string) error        { return errNoAWS }
+func runSoakCommand(args []string) error             { return errNoAWS }
+func runTemplateCommand(args []string) error         { return errNoAWS }
@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"time"
+)
+
+// Exponential backoff with jitter. Randomising part of every delay keeps a fleet
+// of devices that lost connectivity at the same moment from retrying in lockstep.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64 // Fraction of each delay that is randomised, between 0 and 1
+
+	random Random // Of the run (see Config.withRandom), the system's if nil
+}
+
+// source returns where the jitter is drawn from
+func (b Backoff) source() Random {
+	if b.random != nil {
+		return b.random
+	}
+	return systemRandom{}
+}
+
+// Delay returns how long to wait before retry number attempt (starting at 0)
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Min
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+
+	// Equal jitter: keep (1 - Jitter) of the delay, randomise the rest
+	if b.Jitter > 0 && delay > 0 {
+		spread := time.Duration(float64(delay) * b.Jitter)
+		delay = delay - spread + randomDuration(b.source(), spread)
+	}
+	return delay
+}
+
+// extraJitter returns a random delay of up to Jitter times the un-jittered delay
+// for attempt, for clients that apply their own backoff without randomisation
+func (b Backoff) extraJitter(attempt int) time.Duration {
+	base := Backoff{Min: b.Min, Max: b.Max, random: b.random}.Delay(attempt)
+	spread := time.Duration(float64(base) * b.Jitter)
+	if spread <= 0 {
+		return 0
+	}
+	return randomDuration(b.source(), spread)
+}
+
+// ThrottledDelay returns a delay spread evenly between Min and Max, used when
+// AWS IoT is throttling. Devices throttled together, typically after a fleet
+// wide outage, back off the longest and no longer retry in the same window.
+func (b Backoff) ThrottledDelay() time.Duration {
+	if b.Max <= b.Min {
+		return b.Max
+	}
+	return b.Min + randomDuration(b.source(), b.Max-b.Min)
+}
+
+// isThrottled reports whether err says AWS IoT is throttling requests
+func isThrottled(err error) bool {
+	return ClassifyError(err) == ErrorThrottled
+}
@@ -0,0 +1,95 @@
+package provisioner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{name: "first", backoff: Backoff{Min: time.Second, Max: time.Minute}, attempt: 0, want: time.Second},
+		{name: "doubles", backoff: Backoff{Min: time.Second, Max: time.Minute}, attempt: 3, want: 8 * time.Second},
+		{name: "capped", backoff: Backoff{Min: time.Second, Max: time.Minute}, attempt: 6, want: time.Minute},
+		{name: "many attempts", backoff: Backoff{Min: time.Second, Max: time.Minute}, attempt: 1000, want: time.Minute},
+		{name: "min above max", backoff: Backoff{Min: time.Hour, Max: time.Minute}, attempt: 0, want: time.Minute},
+		{name: "no delay", backoff: Backoff{Max: time.Minute, Jitter: 0.5}, attempt: 5, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.backoff.Delay(tt.attempt); got != tt.want {
+				t.Errorf("Delay(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tests := []struct {
+		jitter  float64
+		attempt int
+		base    time.Duration
+	}{
+		{jitter: 0.2, attempt: 0, base: time.Second},
+		{jitter: 0.5, attempt: 2, base: 4 * time.Second},
+		{jitter: 1, attempt: 10, base: time.Minute},
+	}
+	for _, tt := range tests {
+		backoff := Backoff{Min: time.Second, Max: time.Minute, Jitter: tt.jitter, random: NewSeededRandom(1)}
+		lowest := tt.base - time.Duration(float64(tt.base)*tt.jitter)
+		for range 100 {
+			if got := backoff.Delay(tt.attempt); got < lowest || got > tt.base {
+				t.Errorf("jitter %g: Delay(%d) = %s, want between %s and %s", tt.jitter, tt.attempt, got, lowest, tt.base)
+			}
+		}
+
+		// The same seed gives the same delays
+		a := Backoff{Min: time.Second, Max: time.Minute, Jitter: tt.jitter, random: NewSeededRandom(7)}
+		b := Backoff{Min: time.Second, Max: time.Minute, Jitter: tt.jitter, random: NewSeededRandom(7)}
+		for range 10 {
+			if da, db := a.Delay(tt.attempt), b.Delay(tt.attempt); da != db {
+				t.Errorf("jitter %g: seeded delays differ, %s and %s", tt.jitter, da, db)
+			}
+		}
+	}
+}
+
+func TestBackoffThrottledDelay(t *testing.T) {
+	backoff := Backoff{Min: time.Second, Max: time.Minute, random: NewSeededRandom(1)}
+	for range 100 {
+		if got := backoff.ThrottledDelay(); got < time.Second || got > time.Minute {
+			t.Errorf("ThrottledDelay() = %s, want between 1s and 1m", got)
+		}
+	}
+	if got := (Backoff{Min: time.Minute, Max: time.Second}).ThrottledDelay(); got != time.Second {
+		t.Errorf("ThrottledDelay() with min above max = %s, want the max", got)
+	}
+}
+
+// TestBackoffSleep waits out backoff delays on a ManualClock, as the retries
+// of a run do
+func TestBackoffSleep(t *testing.T) {
+	clock := NewManualClock(testStart)
+	backoff := Backoff{Min: time.Second, Max: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		for attempt := range 5 {
+			sleepWithWatchdog(clock, backoff.Delay(attempt))
+		}
+		close(done)
+	}()
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if wait := nextWait(t, clock); wait != want {
+			t.Errorf("slept %s, want %s", wait, want)
+		}
+		clock.Advance(want)
+	}
+	<-done
+	if elapsed := clock.Now().Sub(testStart); elapsed != 25*time.Second {
+		t.Errorf("backoff took %s, want 25s", elapsed)
+	}
+}
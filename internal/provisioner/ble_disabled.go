@@ -0,0 +1,10 @@
+//go:build noble
+
+package provisioner
+
+import "errors"
+
+// Built without Bluetooth, for devices without a radio or BlueZ
+func runBLECommand(args []string) error {
+	return errors.New("BLE onboarding is not available in this build (built with -tags noble)")
+}
@@ -0,0 +1,100 @@
+package provisioner
+
+import (
+	"fmt"
+	"time"
+)
+
+// isTerminal reports whether err is a failure retrying cannot fix, such as the
+// template not existing or the claim not being authorized (see ClassifyError)
+func isTerminal(err error) bool {
+	return ClassifyError(err) == ErrorTerminal
+}
+
+// QuarantineError is returned instead of provisioning while the circuit
+// breaker is open after repeated terminal failures
+type QuarantineError struct {
+	Until     time.Time
+	Failures  int
+	LastError string
+}
+
+func (e *QuarantineError) Error() string {
+	return fmt.Sprintf("quarantined until %s after %d terminal failures, last error: %s", e.Until.Format(time.RFC3339), e.Failures, e.LastError)
+}
+
+// failed records a failed run. Consecutive terminal failures, threshold of
+// them at least, quarantine the device so it stops hammering AWS IoT with
+// requests that cannot succeed. A threshold of 0 disables quarantine.
+func (s *provisioningState) failed(err error, threshold int, quarantine time.Duration, now time.Time) {
+	s.LastError = err.Error()
+	s.LastErrorCode = ErrorCodeOf(err)
+	if !isTerminal(err) {
+		s.TerminalFailures = 0
+		return
+	}
+	s.TerminalFailures++
+	if threshold > 0 && s.TerminalFailures >= threshold {
+		until := now.UTC().Add(quarantine)
+		s.QuarantinedUntil = &until
+	}
+}
+
+// quarantine returns the error to fail with while the device is quarantined
+// at now, or nil if it is not
+func (s *provisioningState) quarantine(now time.Time) *QuarantineError {
+	if s.QuarantinedUntil == nil || now.After(*s.QuarantinedUntil) {
+		return nil
+	}
+	return &QuarantineError{Until: *s.QuarantinedUntil, Failures: s.TerminalFailures, LastError: s.LastError}
+}
+
+// clearQuarantine resets the circuit breaker
+func (s *provisioningState) clearQuarantine() {
+	s.TerminalFailures = 0
+	s.QuarantinedUntil = nil
+}
+
+// LockoutError is returned instead of provisioning while the device is locked
+// out after using up its attempt budget
+type LockoutError struct {
+	Until     time.Time
+	Attempts  int
+	LastError string
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("locked out until %s after %d failed attempts, last error: %s", e.Until.Format(time.RFC3339), e.Attempts, e.LastError)
+}
+
+// attemptFailed counts a failed attempt of any class against the budget, and
+// locks the device out once budget of them failed since it last provisioned
+// or was last locked out. Unlike quarantine, it bounds the cellular data and
+// AWS IoT requests a device that can never succeed spends, whatever the
+// reason. A budget of 0 disables it.
+func (s *provisioningState) attemptFailed(budget int, lockout time.Duration, now time.Time) {
+	// The lockout ended, a new budget starts
+	if s.LockedOutUntil != nil && now.After(*s.LockedOutUntil) {
+		s.clearLockout()
+	}
+	s.FailedAttempts++
+	if budget > 0 && s.FailedAttempts >= budget {
+		until := now.UTC().Add(lockout)
+		s.LockedOutUntil = &until
+	}
+}
+
+// lockout returns the error to fail with while the device is locked out at
+// now, or nil if it is not
+func (s *provisioningState) lockout(now time.Time) *LockoutError {
+	if s.LockedOutUntil == nil || now.After(*s.LockedOutUntil) {
+		return nil
+	}
+	return &LockoutError{Until: *s.LockedOutUntil, Attempts: s.FailedAttempts, LastError: s.LastError}
+}
+
+// clearLockout restores the full attempt budget
+func (s *provisioningState) clearLockout() {
+	s.FailedAttempts = 0
+	s.LockedOutUntil = nil
+}
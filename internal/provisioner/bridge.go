@@ -0,0 +1,133 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Message types of the bridge protocol
+const (
+	bridgeProvision   = "provision"   // MCU: provision with a CSR
+	bridgePing        = "ping"        // MCU: check the bridge is up
+	bridgePong        = "pong"        // Bridge: reply to ping
+	bridgeProgress    = "progress"    // Bridge: a provisioning stage was entered
+	bridgeCertificate = "certificate" // Bridge: the issued certificate
+	bridgeError       = "error"       // Bridge: the request failed
+)
+
+// One line of the bridge protocol: a JSON object terminated by a newline. The
+// MCU sets ID and the bridge echoes it in every message about the request.
+type bridgeMessage struct {
+	ID   int    `json:"id,omitempty"`
+	Type string `json:"type"`
+
+	// provision requests
+	Serial     string            `json:"serial,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	CSR        string            `json:"csr,omitempty"`
+
+	// progress and error messages
+	Stage   string     `json:"stage,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Class   ErrorClass `json:"class,omitempty"`
+
+	// certificate messages
+	ThingName      string `json:"thingName,omitempty"`
+	CertificateID  string `json:"certificateId,omitempty"`
+	CertificatePEM string `json:"certificatePem,omitempty"`
+	Endpoint       string `json:"endpoint,omitempty"`
+}
+
+// Provisions MCUs over a line based JSON protocol on behalf of their CSRs,
+// each in its own directory under dir (see provisionChild)
+type bridge struct {
+	cfg Config
+	dir string
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// serve handles requests read from r until it fails or reaches EOF. Requests
+// are handled one at a time.
+func (b *bridge) serve(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxOnboardingValue)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var request bridgeMessage
+		if err := json.Unmarshal(line, &request); err != nil {
+			b.send(bridgeMessage{Type: bridgeError, Message: fmt.Sprintf("invalid message: %v", err), Class: ErrorTerminal})
+			continue
+		}
+		switch request.Type {
+		case bridgePing:
+			b.send(bridgeMessage{ID: request.ID, Type: bridgePong})
+		case bridgeProvision:
+			b.provision(request)
+		default:
+			b.send(bridgeMessage{ID: request.ID, Type: bridgeError, Message: fmt.Sprintf("unknown message type %q", request.Type), Class: ErrorTerminal})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// A line too long for the buffer can't be resynchronised reliably
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("bridge message longer than %d bytes", maxOnboardingValue)
+		}
+		return fmt.Errorf("failed to read from bridge: %v", err)
+	}
+	return nil
+}
+
+// provision runs fleet provisioning for a request and replies with the
+// certificate or the error
+func (b *bridge) provision(request bridgeMessage) {
+	log.Printf("Bridge request %d: provisioning %s", request.ID, request.Serial)
+	// The key stays on the MCU, so the bridge never sends one over the line
+	if request.CSR == "" {
+		b.send(bridgeMessage{ID: request.ID, Type: bridgeError, Message: "csr is required", Class: ErrorTerminal})
+		return
+	}
+	progress := func(stage Stage, message string) {
+		b.send(bridgeMessage{ID: request.ID, Type: bridgeProgress, Stage: string(stage), Message: message})
+	}
+	child := childRequest{Serial: request.Serial, Template: request.Template, Parameters: request.Parameters, CSR: request.CSR}
+	result, certPEM, _, err := provisionChild(b.cfg, b.dir, child, progress)
+	if err != nil {
+		log.Printf("Bridge request %d failed: %v", request.ID, err)
+		b.send(bridgeMessage{ID: request.ID, Type: bridgeError, Message: err.Error(), Class: childErrorClass(err)})
+		return
+	}
+	b.send(bridgeMessage{
+		ID:             request.ID,
+		Type:           bridgeCertificate,
+		ThingName:      result.ThingName,
+		CertificateID:  result.CertificateID,
+		CertificatePEM: string(certPEM),
+		Endpoint:       result.Endpoint,
+	})
+}
+
+// send writes a message as one line
+func (b *bridge) send(message bridgeMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Warning: failed to marshal bridge message: %v", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.out.Write(append(data, '\n')); err != nil {
+		log.Printf("Warning: failed to write to bridge: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build nocbor
+
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Built without the CBOR codec: -payload-format cbor is rejected, see validate
+const cborPayloads = false
+
+var errNoCBOR = errors.New("CBOR payloads are not available in this build (built with -tags nocbor)")
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return nil, errNoCBOR }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return errNoCBOR }
+func (cborCodec) TopicSuffix() string                        { return "cbor" }
+func (cborCodec) Text(data []byte) string                    { return fmt.Sprintf("%x", data) }
@@ -0,0 +1,150 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Longest chain built from the device certificate up to its root
+const maxChainLength = 5
+
+// parseCertificates returns the certificates in PEM data, skipping other
+// blocks and certificates that fail to parse
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// buildChain returns the chain from the device certificate to its root: the
+// certificates in certPEM, intermediates found in the -intermediates file or
+// fetched from the issuer URLs the certificates name, and the root CA that
+// signed the last of them. An incomplete chain is returned with a warning.
+func buildChain(cfg Config, certPEM []byte) ([]*x509.Certificate, error) {
+	chain := parseCertificates(certPEM)
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found in the device certificate")
+	}
+
+	var intermediates []*x509.Certificate
+	if cfg.IntermediatesFile != "" {
+		data, err := cfg.Files.fs().ReadFile(cfg.IntermediatesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read intermediates: %v", err)
+		}
+		intermediates = parseCertificates(data)
+	}
+	rootPEM, err := loadRootCAs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	roots := parseCertificates(rootPEM)
+
+	for len(chain) < maxChainLength {
+		last := chain[len(chain)-1]
+		if last.CheckSignatureFrom(last) == nil {
+			return chain, nil // Self-signed: the root is in place
+		}
+		if issuer := findIssuer(last, roots); issuer != nil {
+			return append(chain, issuer), nil
+		}
+		issuer := findIssuer(last, intermediates)
+		if issuer == nil {
+			issuer = fetchIssuer(last)
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+	}
+	log.Printf("Warning: could not complete the chain of the device certificate, the issuer of %q was not found", chain[len(chain)-1].Subject)
+	return chain, nil
+}
+
+// findIssuer returns the certificate among candidates that signed cert
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// fetchIssuer downloads the issuer of cert from its Authority Information
+// Access URLs
+func fetchIssuer(cert *x509.Certificate) *x509.Certificate {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, url := range cert.IssuingCertificateURL {
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Printf("Warning: failed to fetch issuer certificate %s: %v", url, err)
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			log.Printf("Warning: failed to fetch issuer certificate %s: %s %v", url, resp.Status, err)
+			continue
+		}
+
+		// Issuer URLs serve DER, some serve PEM
+		candidates := parseCertificates(data)
+		if issuer, err := x509.ParseCertificate(data); err == nil {
+			candidates = append(candidates, issuer)
+		}
+		if issuer := findIssuer(cert, candidates); issuer != nil {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// writeChain writes the chain of the device certificate and, if configured,
+// the bundle of the chain followed by the private key. Without a key, as when
+// provisioning from a CSR, no bundle is written.
+func writeChain(cfg Config, certPEM, keyPEM []byte) error {
+	if !cfg.Chain && !cfg.Bundle {
+		return nil
+	}
+	chain, err := buildChain(cfg, certPEM)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	if cfg.Chain {
+		if err := cfg.Files.write(cfg.outputPath(permanentChainFile), buf.Bytes(), false); err != nil {
+			return fmt.Errorf("failed to write certificate chain: %v", err)
+		}
+	}
+	if cfg.Bundle && len(keyPEM) > 0 {
+		buf.Write(keyPEM)
+		defer clear(buf.Bytes())
+		if err := cfg.Files.write(cfg.outputPath(permanentBundleFile), buf.Bytes(), true); err != nil {
+			return fmt.Errorf("failed to write certificate bundle: %v", err)
+		}
+	}
+	log.Printf("Device certificate chain has %d certificates", len(chain))
+	return nil
+}
@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Name of the CSR kept in a child device's directory
+const childCSRFile = "device.csr"
+
+// Serial numbers accepted for child devices, which also name their directories
+var childSerialPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$`)
+
+// Device provisioned through this host rather than by itself
+type childRequest struct {
+	Serial     string
+	Template   string            // Replaces -template if set
+	Parameters map[string]string // Replace -param if set
+	CSR        string            // PEM; without one the key is generated by AWS IoT
+}
+
+// Error in a child's request itself, which repeating it cannot fix
+type childRequestError struct {
+	err error
+}
+
+func (e *childRequestError) Error() string {
+	return e.err.Error()
+}
+
+// childErrorClass classifies a failure to provision a child
+func childErrorClass(err error) ErrorClass {
+	var requestErr *childRequestError
+	if errors.As(err, &requestErr) {
+		return ErrorTerminal
+	}
+	return ClassifyError(err)
+}
+
+// provisionChild runs fleet provisioning for a child device with this host's
+// claim, and returns the issued certificate and, unless the child sent a CSR,
+// its private key. Each child gets a directory under dir named after its
+// serial number, holding its credentials, identity, and state, so a request
+// repeated after a lost reply resumes the flow or returns the same
+// credentials.
+func provisionChild(cfg Config, dir string, request childRequest, progress ProgressFunc) (*ProvisioningResult, []byte, []byte, error) {
+	if !childSerialPattern.MatchString(request.Serial) {
+		return nil, nil, nil, &childRequestError{fmt.Errorf("invalid serial number %q", request.Serial)}
+	}
+	cfg.SerialNumber = request.Serial
+	if request.Template != "" {
+		cfg.TemplateName = request.Template
+	}
+	if len(request.Parameters) > 0 {
+		cfg.TemplateParameters = request.Parameters
+	}
+	cfg.OutputDir = filepath.Join(dir, request.Serial)
+	cfg.CSRFile = filepath.Join(cfg.OutputDir, childCSRFile)
+	cfg.HealthFile = ""
+	if err := cfg.validate(); err != nil {
+		return nil, nil, nil, &childRequestError{err}
+	}
+	if request.CSR != "" {
+		if err := checkCSR([]byte(request.CSR), "CSR of "+request.Serial); err != nil {
+			return nil, nil, nil, &childRequestError{err}
+		}
+	}
+
+	fsys := cfg.Files.fs()
+	if err := fsys.MkdirAll(cfg.OutputDir, 0700); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create device directory: %v", err)
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Once a certificate is issued, a child asking again with another key
+	// would get a certificate for the old one, so it has to be deprovisioned
+	// first
+	existing, err := fsys.ReadFile(cfg.CSRFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, fmt.Errorf("failed to read CSR: %v", err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(existing), bytes.TrimSpace([]byte(request.CSR))) {
+		if state.State != FlowUnprovisioned {
+			return nil, nil, nil, &childRequestError{fmt.Errorf("%s was already provisioned with another key, deprovision it first", request.Serial)}
+		}
+		if request.CSR == "" {
+			fsys.Remove(cfg.CSRFile)
+		} else if err := cfg.Files.write(cfg.CSRFile, []byte(request.CSR), false); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to write CSR: %v", err)
+		}
+	}
+	if request.CSR == "" {
+		cfg.CSRFile = ""
+	}
+
+	result, err := runOnce(cfg, progress)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certPEM, err := fsys.ReadFile(result.CertificateFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read issued certificate: %v", err)
+	}
+	var keyPEM []byte
+	if result.PrivateKeyFile != "" {
+		if keyPEM, err = fsys.ReadFile(result.PrivateKeyFile); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read issued private key: %v", err)
+		}
+	}
+	return result, certPEM, keyPEM, nil
+}
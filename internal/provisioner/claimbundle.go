@@ -0,0 +1,226 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Largest claim bundle or signature downloaded
+const maxClaimBundleSize = 1 << 20
+
+// fetchClaimBundle downloads the claim certificate and key at first boot, so
+// factory images don't need to embed them. The bundle is the PEM certificate
+// and key encrypted with AES-256-GCM (a 12 byte nonce followed by the
+// ciphertext). Its detached signature, over the encrypted bundle, is checked
+// against -claim-bundle-public-key before anything is decrypted. The
+// credentials are only kept in memory.
+func fetchClaimBundle(cfg Config) (secret, secret, error) {
+	publicKey, err := readPublicKey(cfg.Files.fs(), cfg.ClaimBundlePublicKey)
+	if err != nil {
+		return secret{}, secret{}, err
+	}
+	wrappingKey, err := readWrappingKey(cfg.Files.fs(), cfg.ClaimBundleKey)
+	if err != nil {
+		return secret{}, secret{}, err
+	}
+	defer clear(wrappingKey)
+
+	signatureURL := cfg.ClaimBundleSignatureURL
+	if signatureURL == "" {
+		signatureURL = cfg.ClaimBundleURL + ".sig"
+	}
+	client := &http.Client{Timeout: cfg.ConnectTimeout}
+	bundle, err := download(client, cfg.ClaimBundleURL, cfg.clock())
+	if err != nil {
+		return secret{}, secret{}, fmt.Errorf("failed to download claim bundle: %v", err)
+	}
+	signature, err := download(client, signatureURL, cfg.clock())
+	if err != nil {
+		return secret{}, secret{}, fmt.Errorf("failed to download claim bundle signature: %v", err)
+	}
+	// Signatures are often stored base64 encoded
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+	if err := verifySignature(publicKey, bundle, signature); err != nil {
+		return secret{}, secret{}, fmt.Errorf("claim bundle signature is invalid: %v", err)
+	}
+
+	block, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return secret{}, secret{}, fmt.Errorf("invalid claim bundle key: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return secret{}, secret{}, fmt.Errorf("invalid claim bundle key: %v", err)
+	}
+	if len(bundle) < gcm.NonceSize() {
+		return secret{}, secret{}, fmt.Errorf("claim bundle is too short")
+	}
+	plaintext, err := gcm.Open(nil, bundle[:gcm.NonceSize()], bundle[gcm.NonceSize():], nil)
+	if err != nil {
+		return secret{}, secret{}, fmt.Errorf("failed to decrypt claim bundle: %v", err)
+	}
+	defer clear(plaintext)
+
+	source := redactURL(cfg.ClaimBundleURL)
+	cert, key, err := splitClaimPEM(secret{source: source}, plaintext)
+	if err != nil {
+		return secret{}, secret{}, err
+	}
+	log.Printf("Fetched claim credentials from %s", source)
+	return cert, key, nil
+}
+
+// splitClaimPEM splits the PEM blocks of a claim bundle into the certificate
+// and the key, both taking the source of from
+func splitClaimPEM(from secret, data []byte) (secret, secret, error) {
+	cert, key := from, from
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		encoded := pem.EncodeToMemory(block)
+		clear(block.Bytes)
+		if block.Type == "CERTIFICATE" {
+			cert.data = append(cert.data, encoded...)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key.data = append(key.data, encoded...)
+			clear(encoded)
+		}
+	}
+	if cert.data == nil || key.data == nil {
+		clear(key.data)
+		return secret{}, secret{}, fmt.Errorf("claim bundle %s must hold a certificate and a private key", from.source)
+	}
+	return cert, key, nil
+}
+
+// download fetches an HTTPS URL, waiting on clock between attempts
+func download(client *http.Client, rawURL string, clock Clock) ([]byte, error) {
+	if !strings.HasPrefix(rawURL, "https://") {
+		return nil, fmt.Errorf("%s is not an HTTPS URL", redactURL(rawURL))
+	}
+	var data []byte
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			clock.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var resp *http.Response
+		if resp, err = client.Get(rawURL); err != nil {
+			continue
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxClaimBundleSize+1))
+		resp.Body.Close()
+		switch {
+		case err != nil:
+		case resp.StatusCode != http.StatusOK:
+			err = fmt.Errorf("%s returned %s", redactURL(rawURL), resp.Status)
+			// Expired or wrong presigned URLs won't start working
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return nil, err
+			}
+		case len(data) > maxClaimBundleSize:
+			return nil, fmt.Errorf("%s is larger than %d bytes", redactURL(rawURL), maxClaimBundleSize)
+		default:
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// redactURL drops the query of a URL, which holds the credentials of a
+// presigned URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "claim bundle URL"
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// readPublicKey reads a PEM encoded public key, or the key of a certificate
+func readPublicKey(fsys FileSystem, path string) (crypto.PublicKey, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claim bundle public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not hold a PEM encoded public key", path)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// readWrappingKey reads a 32 byte AES key stored raw, hex, or base64 encoded
+func readWrappingKey(fsys FileSystem, path string) ([]byte, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claim bundle key: %v", err)
+	}
+	defer clear(data)
+	if len(data) == 32 {
+		return bytes.Clone(data), nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("claim bundle key %s must be 32 bytes, raw or hex or base64 encoded", path)
+}
+
+// verifySignature checks a signature over data: ECDSA or RSA PKCS #1 v1.5 over
+// its SHA-256 digest, or Ed25519 over the data itself
+func verifySignature(key crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("ECDSA verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return fmt.Errorf("Ed25519 verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// A claim from -claim-dir that provisioning may use
+type claimCandidate struct {
+	cert, key secret
+	leaf      *x509.Certificate
+	id        string // Certificate ID in AWS IoT
+}
+
+// loadClaimCandidates reads the claim bundles in cfg.ClaimDir, PEM files each
+// holding a claim certificate and its key, and returns those that are
+// usable, the most recently issued first. Bundles that don't parse, are
+// expired or not valid yet, or hold a claim AWS IoT refused before (see
+// provisioningState.RefusedClaims) are skipped with a warning. Claims are
+// rotated by adding a bundle before the old claim is revoked, so devices with
+// either firmware keep provisioning.
+func loadClaimCandidates(cfg Config, rootCA secret, refused []string) ([]claimCandidate, error) {
+	fsys := cfg.Files.fs()
+	entries, err := fsys.ReadDir(cfg.ClaimDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list claim bundles: %v", err)
+	}
+	var candidates []claimCandidate
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		bundle := newSecret(fsys, "", filepath.Join(cfg.ClaimDir, entry.Name()))
+		candidate, err := loadClaimCandidate(bundle, rootCA, cfg.clock().Now())
+		if err != nil {
+			log.Printf("Warning: skipping claim bundle: %v", err)
+			continue
+		}
+		if slices.Contains(refused, candidate.id) {
+			clear(candidate.key.data)
+			log.Printf("Warning: skipping claim bundle %s, AWS IoT refused its certificate %s", bundle.source, candidate.id)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no usable claim bundle in %s", cfg.ClaimDir)
+	}
+	slices.SortStableFunc(candidates, func(a, b claimCandidate) int {
+		return b.leaf.NotBefore.Compare(a.leaf.NotBefore)
+	})
+	return candidates, nil
+}
+
+// loadClaimCandidate reads and checks one claim bundle, valid at now
+func loadClaimCandidate(bundle secret, rootCA secret, now time.Time) (claimCandidate, error) {
+	data, err := bundle.fs.ReadFile(bundle.source)
+	if err != nil {
+		return claimCandidate{}, fmt.Errorf("cannot read %s: %v", bundle.source, err)
+	}
+	defer clear(data)
+	cert, key, err := splitClaimPEM(bundle, data)
+	if err != nil {
+		return claimCandidate{}, err
+	}
+	if err := validateClaimCredentials(cert, key, rootCA, now); err != nil {
+		clear(key.data)
+		return claimCandidate{}, err
+	}
+	leaf, _ := parseCertificatePEM(cert.data)
+	return claimCandidate{cert: cert, key: key, leaf: leaf, id: certificateID(leaf)}, nil
+}
+
+// claimRefused reports whether AWS IoT refused a connection for the claim
+// certificate itself, as it does once the claim is revoked or deactivated,
+// rather than for a passing reason
+func claimRefused(err error) bool {
+	if errors.Is(err, packets.ErrorRefusedNotAuthorised) || errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) {
+		return true
+	}
+	return isTerminal(err)
+}
+
+// refuseClaim records that AWS IoT refused the claim with the certificate ID,
+// so later runs skip it
+func (s *provisioningState) refuseClaim(id string) error {
+	if !slices.Contains(s.RefusedClaims, id) {
+		s.RefusedClaims = append(s.RefusedClaims, id)
+	}
+	return s.save()
+}
+
+// connectClaim connects with the first claim of candidates AWS IoT accepts.
+// When it refuses a claim from -claim-dir, the claim is recorded in the state
+// and the next one tried. cert and key are set to the claim connected with,
+// and the loaded certificate is returned for the caller to zero once the
+// transport is closed.
+func connectClaim(cfg Config, state *provisioningState, candidates []claimCandidate, clientID string, cert, key *secret) (Transport, tls.Certificate, error) {
+	for i, candidate := range candidates {
+		claimCert, err := keyPair(candidate.cert, candidate.key)
+		if err != nil {
+			return nil, tls.Certificate{}, fmt.Errorf("failed to load claim certificates: %v", err)
+		}
+		transport, err := connectTransport(cfg, claimCert, clientID)
+		if err == nil {
+			if cfg.ClaimDir != "" {
+				log.Printf("Connected with claim bundle %s", candidate.cert.source)
+			}
+			*cert, *key = candidate.cert, candidate.key
+			return transport, claimCert, nil
+		}
+		zeroPrivateKey(&claimCert)
+		if cfg.ClaimDir == "" || !claimRefused(err) || i == len(candidates)-1 {
+			return nil, tls.Certificate{}, err
+		}
+		log.Printf("Warning: AWS IoT refused claim bundle %s (%v), trying %s", candidate.cert.source, err, candidates[i+1].cert.source)
+		recordAudit(cfg, auditEntry{Event: AuditClaimRefused, CertificateID: candidate.id, Error: err.Error()})
+		if err := state.refuseClaim(candidate.id); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil, tls.Certificate{}, fmt.Errorf("no claim to connect with")
+}
@@ -0,0 +1,131 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// IoT policy document
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// claimPolicy returns the least privilege policy for a claim certificate: it
+// may connect and use the certificate creation and template provisioning
+// topics, and nothing else
+func claimPolicy(cfg Config, accountID string) policyDocument {
+	arn := fmt.Sprintf("arn:%s:iot:%s:%s", cfg.partition().ID, cfg.Region, accountID)
+	var topicArns, replyArns, filterArns []string
+	for _, api := range []string{topicCreateCertificate, fmt.Sprintf(topicRegisterThing, cfg.TemplateName)} {
+		topic, accepted, rejected := apiTopics(cfg.codec(), api)
+		topicArns = append(topicArns, arn+":topic/"+topic)
+		replyArns = append(replyArns, arn+":topic/"+accepted, arn+":topic/"+rejected)
+		filterArns = append(filterArns, arn+":topicfilter/"+accepted, arn+":topicfilter/"+rejected)
+	}
+	return policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			{Effect: "Allow", Action: []string{"iot:Connect"}, Resource: []string{arn + ":client/*"}},
+			{Effect: "Allow", Action: []string{"iot:Publish"}, Resource: topicArns},
+			{Effect: "Allow", Action: []string{"iot:Receive"}, Resource: replyArns},
+			{Effect: "Allow", Action: []string{"iot:Subscribe"}, Resource: filterArns},
+		},
+	}
+}
+
+// claimPolicyName is the name of the claim policy for the configured template
+func claimPolicyName(cfg Config) string {
+	return cfg.TemplateName + "-claim-policy"
+}
+
+// accountID returns the AWS account of the caller
+func accountID(ctx context.Context, client *sts.Client) (string, error) {
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to determine AWS account: %v", err)
+	}
+	return aws.ToString(identity.Account), nil
+}
+
+// ensurePolicy creates the policy unless one with the same name exists, which
+// is then reused as is
+func ensurePolicy(ctx context.Context, client *iot.Client, name string, document policyDocument) error {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy: %v", err)
+	}
+	_, err = client.CreatePolicy(ctx, &iot.CreatePolicyInput{
+		PolicyName:     aws.String(name),
+		PolicyDocument: aws.String(string(data)),
+	})
+	var exists *types.ResourceAlreadyExistsException
+	if errors.As(err, &exists) {
+		log.Printf("Policy %s already exists, reusing it", name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create policy %s: %v", name, err)
+	}
+	log.Printf("Created policy %s", name)
+	return nil
+}
+
+// Claim certificate created through the AWS IoT control plane
+type claimCertificate struct {
+	CertificateID  string
+	CertificateArn string
+	CertificatePem string
+	PrivateKey     string
+}
+
+// createClaimCertificate creates an active certificate and attaches the claim
+// policy to it, creating the policy if needed
+func createClaimCertificate(ctx context.Context, client *iot.Client, stsClient *sts.Client, cfg Config) (*claimCertificate, policyDocument, error) {
+	account, err := accountID(ctx, stsClient)
+	if err != nil {
+		return nil, policyDocument{}, err
+	}
+	policy := claimPolicy(cfg, account)
+	policyName := claimPolicyName(cfg)
+	if err := ensurePolicy(ctx, client, policyName, policy); err != nil {
+		return nil, policyDocument{}, err
+	}
+
+	created, err := client.CreateKeysAndCertificate(ctx, &iot.CreateKeysAndCertificateInput{SetAsActive: true})
+	if err != nil {
+		return nil, policyDocument{}, fmt.Errorf("failed to create claim certificate: %v", err)
+	}
+	cert := &claimCertificate{
+		CertificateID:  aws.ToString(created.CertificateId),
+		CertificateArn: aws.ToString(created.CertificateArn),
+		CertificatePem: aws.ToString(created.CertificatePem),
+		PrivateKey:     aws.ToString(created.KeyPair.PrivateKey),
+	}
+
+	_, err = client.AttachPolicy(ctx, &iot.AttachPolicyInput{
+		PolicyName: aws.String(policyName),
+		Target:     aws.String(cert.CertificateArn),
+	})
+	if err != nil {
+		return nil, policyDocument{}, fmt.Errorf("failed to attach policy %s to certificate %s: %v", policyName, cert.CertificateID, err)
+	}
+	log.Printf("Created claim certificate %s with policy %s", cert.CertificateID, policyName)
+	return cert, policy, nil
+}
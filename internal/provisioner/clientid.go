@@ -0,0 +1,76 @@
+package provisioner
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWS IoT rejects client IDs longer than this
+const maxClientIDLength = 128
+
+// renderClientID expands a client ID template. Supported placeholders:
+//
+//	{serial}  the device serial number
+//	{random}  8 random hex characters, different on every run
+func renderClientID(template, serial string, random Random) (string, error) {
+	clientID := strings.NewReplacer(
+		"{serial}", serial,
+		"{random}", randomHex(random, 4),
+	).Replace(template)
+
+	if clientID == "" {
+		return "", fmt.Errorf("client ID template %q renders an empty client ID", template)
+	}
+	if len(clientID) > maxClientIDLength {
+		return "", fmt.Errorf("client ID %q is longer than %d characters", clientID, maxClientIDLength)
+	}
+	return clientID, nil
+}
+
+// ClientIDConflictError reports that another client is connected with the same
+// client ID. AWS IoT drops the older connection whenever a client ID is reused,
+// so two clients sharing one keep disconnecting each other.
+type ClientIDConflictError struct {
+	ClientID string
+}
+
+func (e *ClientIDConflictError) Error() string {
+	return fmt.Sprintf("connection repeatedly taken over: another client is connected with client ID %q (add {random} to the -client-id template to make it unique)", e.ClientID)
+}
+
+// A connection dropped within takeoverWindow of being made counts as a takeover;
+// takeoverDrops consecutive takeovers are reported as a client ID conflict
+const (
+	takeoverWindow = 5 * time.Second
+	takeoverDrops  = 3
+)
+
+// takeoverDetector recognises the disconnect pattern AWS IoT produces when two
+// clients share a client ID: every connection is dropped shortly after it is made
+type takeoverDetector struct {
+	mu          sync.Mutex
+	connectedAt time.Time
+	quickDrops  int
+}
+
+// connected records that a connection was established
+func (d *takeoverDetector) connected() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connectedAt = time.Now()
+}
+
+// lost records a dropped connection and reports whether the drops look like
+// another client taking over the client ID
+func (d *takeoverDetector) lost() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.connectedAt) < takeoverWindow {
+		d.quickDrops++
+	} else {
+		d.quickDrops = 0
+	}
+	return d.quickDrops >= takeoverDrops
+}
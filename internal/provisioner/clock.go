@@ -0,0 +1,90 @@
+package provisioner
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time the program goes by: request timeouts, retry backoff,
+// certificate expiry checks, quarantine and lockout, and the periodic checks
+// of serve. Tests and simulations can replace it, with a ManualClock for
+// example, to fast-forward through delays that take hours on a device. It
+// must be safe for concurrent use.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel receiving the time once d has passed
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the real time, the default
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// ManualClock is a Clock that only moves when advanced, so tests control
+// what has timed out or expired
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewManualClock returns a ManualClock set to start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Sleep blocks until the clock is advanced by d
+func (c *ManualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the clock forward by d, waking what waits until then
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// clock returns the time the run goes by
+func (c *Config) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return systemClock{}
+}
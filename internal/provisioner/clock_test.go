@@ -0,0 +1,88 @@
+package provisioner
+
+import (
+	"testing"
+	"time"
+)
+
+// testStart is when the ManualClocks of tests start
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// nextWait waits for something to wait on the clock, and returns how long
+// until the earliest waiter is woken
+func nextWait(t *testing.T, c *ManualClock) time.Duration {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		if len(c.waiters) > 0 {
+			earliest := c.waiters[0].at
+			for _, w := range c.waiters[1:] {
+				if w.at.Before(earliest) {
+					earliest = w.at
+				}
+			}
+			now := c.now
+			c.mu.Unlock()
+			return earliest.Sub(now)
+		}
+		c.mu.Unlock()
+	}
+	t.Fatal("nothing waits on the clock")
+	return 0
+}
+
+// advanceUntilDone advances the clock to each waiter in turn until done
+// receives. Waiters left behind by requests answered before they timed out
+// are woken as well, which only moves the clock on.
+func advanceUntilDone(t *testing.T, c *ManualClock, done <-chan error) error {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Millisecond):
+		}
+		if c.waiting() > 0 {
+			c.Advance(nextWait(t, c))
+		}
+	}
+	t.Fatal("still waiting after advancing the clock for 5s")
+	return nil
+}
+
+// waiting returns how many waiters the clock has yet to wake
+func (c *ManualClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func TestManualClock(t *testing.T) {
+	clock := NewManualClock(testStart)
+	short, long := clock.After(time.Second), clock.After(time.Minute)
+	select {
+	case now := <-clock.After(0):
+		if !now.Equal(testStart) {
+			t.Errorf("After(0) fired at %s", now)
+		}
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+
+	clock.Advance(time.Second - time.Nanosecond)
+	if clock.waiting() != 2 {
+		t.Fatalf("%d waiters before a second passed, want 2", clock.waiting())
+	}
+	clock.Advance(time.Nanosecond)
+	if now := <-short; !now.Equal(testStart.Add(time.Second)) {
+		t.Errorf("one second waiter woken at %s", now)
+	}
+	if clock.waiting() != 1 {
+		t.Errorf("%d waiters after a second, want 1", clock.waiting())
+	}
+
+	clock.Advance(time.Hour)
+	if now := <-long; !now.Equal(testStart.Add(time.Hour + time.Second)) {
+		t.Errorf("one minute waiter woken at %s, want the time it was advanced to", now)
+	}
+}
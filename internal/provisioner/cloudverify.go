@@ -0,0 +1,112 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Built with the AWS SDK, see aws_disabled.go
+const awsSDK = true
+
+// Session name of assumed roles, identifying the tool in CloudTrail
+const roleSessionName = "claim-provisioning"
+
+// loadAWSConfig loads the SDK configuration for the configured region from the
+// default credential chain (environment, shared config, instance role), or the
+// configured profile, assuming the configured role with those credentials.
+// It fails if no credentials are available.
+func loadAWSConfig(ctx context.Context, cfg Config) (aws.Config, error) {
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(cfg.Region)}
+	if cfg.AWSProfile != "" {
+		options = append(options, awsconfig.WithSharedConfigProfile(cfg.AWSProfile))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	if cfg.AssumeRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = roleSessionName
+			if cfg.ExternalID != "" {
+				o.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	if _, err := awsCfg.Credentials.Retrieve(ctx); err != nil {
+		if cfg.AssumeRoleARN != "" {
+			return aws.Config{}, fmt.Errorf("failed to assume role %s: %v", cfg.AssumeRoleARN, err)
+		}
+		return aws.Config{}, fmt.Errorf("no AWS credentials available: %v", err)
+	}
+	return awsCfg, nil
+}
+
+// newIoTClient creates an AWS IoT control plane client (see loadAWSConfig)
+func newIoTClient(ctx context.Context, cfg Config) (*iot.Client, error) {
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return iot.NewFromConfig(awsCfg), nil
+}
+
+// verifyCloudState checks that AWS IoT agrees with what the device believes:
+// the thing exists, the certificate is active, matches the local one, and is
+// attached to the thing, and at least one policy is attached to it. Missing
+// AWS credentials skip the check; any drift is an error.
+func verifyCloudState(ctx context.Context, cfg Config, state *provisioningState, certPEM []byte) error {
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		log.Printf("Warning: skipping cloud verification: %v", err)
+		return nil
+	}
+
+	if _, err := client.DescribeThing(ctx, &iot.DescribeThingInput{ThingName: aws.String(state.ThingName)}); err != nil {
+		return fmt.Errorf("thing %s not found in AWS IoT: %v", state.ThingName, err)
+	}
+
+	described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(state.CertificateID)})
+	if err != nil {
+		return fmt.Errorf("certificate %s not found in AWS IoT: %v", state.CertificateID, err)
+	}
+	certificate := described.CertificateDescription
+	if certificate.Status != types.CertificateStatusActive {
+		return fmt.Errorf("certificate %s is %s in AWS IoT, expected ACTIVE", state.CertificateID, certificate.Status)
+	}
+	if strings.TrimSpace(aws.ToString(certificate.CertificatePem)) != strings.TrimSpace(string(certPEM)) {
+		return fmt.Errorf("certificate %s in AWS IoT differs from the local certificate", state.CertificateID)
+	}
+	certificateArn := aws.ToString(certificate.CertificateArn)
+
+	principals, err := client.ListThingPrincipals(ctx, &iot.ListThingPrincipalsInput{ThingName: aws.String(state.ThingName)})
+	if err != nil {
+		return fmt.Errorf("failed to list principals of thing %s: %v", state.ThingName, err)
+	}
+	if !slices.Contains(principals.Principals, certificateArn) {
+		return fmt.Errorf("certificate %s is not attached to thing %s", state.CertificateID, state.ThingName)
+	}
+
+	policies, err := client.ListAttachedPolicies(ctx, &iot.ListAttachedPoliciesInput{Target: aws.String(certificateArn)})
+	if err != nil {
+		return fmt.Errorf("failed to list policies of certificate %s: %v", state.CertificateID, err)
+	}
+	if len(policies.Policies) == 0 {
+		return fmt.Errorf("no policy is attached to certificate %s", state.CertificateID)
+	}
+
+	log.Printf("Cloud state verified: thing %s, certificate %s active with %d policies", state.ThingName, state.CertificateID, len(policies.Policies))
+	return nil
+}
@@ -0,0 +1,203 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// Events waiting for the device to be able to ship them, one JSON document
+// per line
+const cloudWatchPendingFile = "cloudwatch-pending.jsonl"
+
+// Most events kept waiting: the oldest are dropped beyond it
+const maxPendingEvents = 100
+
+// CloudWatch Logs rejects events older than 14 days, and batches spanning
+// more than a day
+const (
+	cloudWatchMaxAge  = 14 * 24 * time.Hour
+	cloudWatchMaxSpan = 24 * time.Hour
+)
+
+// Provisioning events and metrics shipped to CloudWatch with the device's own
+// credentials, see reportToCloudWatch
+type CloudWatch struct {
+	LogGroup            string // Log group the events go to, in a stream per thing
+	Namespace           string // Namespace of the metrics
+	CredentialsEndpoint string // AWS IoT credentials provider endpoint
+	RoleAlias           string // Role alias the device certificate is exchanged through
+}
+
+// Outcome of a provisioning run, as shipped to CloudWatch
+type provisioningEvent struct {
+	Time       time.Time     `json:"time"`
+	Serial     string        `json:"serial"`
+	ThingName  string        `json:"thingName,omitempty"`
+	Outcome    string        `json:"outcome"` // "provisioned" or "failed"
+	Error      string        `json:"error,omitempty"`
+	ErrorClass ErrorClass    `json:"errorClass,omitempty"`
+	ErrorCode  ErrorCode     `json:"errorCode,omitempty"`
+	DurationMS int64         `json:"durationMs"`
+	Stages     []StageTiming `json:"stages,omitempty"`
+	Latencies  *Latencies    `json:"latencies,omitempty"`
+	// End of the device certificate's validity, which shorter-lived
+	// certificates bring closer
+	CertificateNotAfter *time.Time `json:"certificateNotAfter,omitempty"`
+}
+
+// newProvisioningEvent describes a run that started at started and ended with
+// result, or err if it failed
+func newProvisioningEvent(cfg Config, started time.Time, result *ProvisioningResult, err error) provisioningEvent {
+	event := provisioningEvent{
+		Time:       time.Now().UTC(),
+		Serial:     cfg.SerialNumber,
+		DurationMS: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		event.Outcome = "failed"
+		event.Error = err.Error()
+		event.ErrorClass = ClassifyError(err)
+		event.ErrorCode = ErrorCodeOf(err)
+		return event
+	}
+	event.Outcome = "provisioned"
+	event.ThingName = result.ThingName
+	event.Stages = result.Stages
+	event.Latencies = result.Latencies
+	event.CertificateNotAfter = result.CertificateNotAfter
+	return event
+}
+
+// emf renders the event as a CloudWatch embedded metric format document: the
+// run counted as provisioned or failed, and its duration and latencies, by
+// outcome. The other fields are searchable in CloudWatch Logs Insights.
+func (e provisioningEvent) emf(namespace string) ([]byte, error) {
+	doc := map[string]interface{}{
+		"Outcome":     e.Outcome,
+		"Serial":      e.Serial,
+		"Provisioned": 0,
+		"Failed":      0,
+		"DurationMs":  e.DurationMS,
+	}
+	metrics := []map[string]string{
+		{"Name": "Provisioned", "Unit": "Count"},
+		{"Name": "Failed", "Unit": "Count"},
+		{"Name": "DurationMs", "Unit": "Milliseconds"},
+	}
+	if e.Outcome == "failed" {
+		doc["Failed"] = 1
+		doc["Error"] = e.Error
+		doc["ErrorClass"] = e.ErrorClass
+		doc["ErrorCode"] = e.ErrorCode
+	} else {
+		doc["Provisioned"] = 1
+		doc["ThingName"] = e.ThingName
+	}
+	if e.Stages != nil {
+		doc["Stages"] = e.Stages
+	}
+	if e.CertificateNotAfter != nil {
+		doc["CertificateNotAfter"] = e.CertificateNotAfter.Format(time.RFC3339)
+		doc["CertificateValidityDays"] = math.Round(e.CertificateNotAfter.Sub(e.Time).Hours()/24*10) / 10
+		metrics = append(metrics, map[string]string{"Name": "CertificateValidityDays", "Unit": "None"})
+	}
+	if l := e.Latencies; l != nil {
+		for _, latency := range []struct {
+			name string
+			ms   int64
+		}{
+			{"TLSConnectMs", l.TLSConnectMS},
+			{"CreateCertificateMs", l.CreateCertificateMS},
+			{"RegisterThingMs", l.RegisterThingMS},
+		} {
+			// Steps a resumed run skipped would skew the statistics
+			if latency.ms == 0 {
+				continue
+			}
+			doc[latency.name] = latency.ms
+			metrics = append(metrics, map[string]string{"Name": latency.name, "Unit": "Milliseconds"})
+		}
+	}
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": e.Time.UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{{"Outcome"}},
+			"Metrics":    metrics,
+		}},
+	}
+	return json.Marshal(doc)
+}
+
+// reportToCloudWatch ships the run's event, if any, and those of earlier runs
+// still waiting, once the device is provisioned as thingName: the device
+// certificate is exchanged for credentials through the role alias, so events
+// of runs before that, and any that fail to ship, wait in the output
+// directory for the next successful run. Failures are only logged.
+func reportToCloudWatch(cfg Config, thingName string, event *provisioningEvent) {
+	if cfg.CloudWatch.LogGroup == "" {
+		return
+	}
+	path := cfg.outputPath(cloudWatchPendingFile)
+	events, err := loadPendingEvents(cfg.Files.fs(), path)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if event != nil {
+		events = append(events, *event)
+	}
+	if len(events) == 0 {
+		return
+	}
+	if thingName != "" {
+		err := shipEvents(cfg, thingName, events)
+		if err == nil {
+			if err := cfg.Files.fs().Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Warning: failed to remove shipped CloudWatch events: %v", err)
+			}
+			return
+		}
+		log.Printf("Warning: %v, keeping the events until the next run", err)
+	}
+	if len(events) > maxPendingEvents {
+		events = events[len(events)-maxPendingEvents:]
+	}
+	var buf bytes.Buffer
+	for _, event := range events {
+		data, _ := json.Marshal(event)
+		buf.Write(append(data, '\n'))
+	}
+	if err := cfg.Files.write(path, buf.Bytes(), false); err != nil {
+		log.Printf("Warning: failed to keep CloudWatch events: %v", err)
+	}
+}
+
+// loadPendingEvents reads the events waiting to be shipped, none if the file
+// does not exist
+func loadPendingEvents(fsys FileSystem, path string) ([]provisioningEvent, error) {
+	data, err := fsys.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending CloudWatch events: %v", err)
+	}
+	var events []provisioningEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event provisioningEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A line cut short by a power loss loses that event only
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
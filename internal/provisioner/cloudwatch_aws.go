@@ -0,0 +1,86 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// shipEvents puts the events in the thing's log stream of the log group, with
+// credentials for the device certificate. CloudWatch extracts the metrics of
+// the embedded metric format as it receives them.
+func shipEvents(cfg Config, thingName string, events []provisioningEvent) error {
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificate for CloudWatch: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	provider, err := NewIoTCredentialsProvider(cfg, cert, cfg.CloudWatch.CredentialsEndpoint, cfg.CloudWatch.RoleAlias, thingName)
+	if err != nil {
+		return err
+	}
+	client := cloudwatchlogs.NewFromConfig(aws.Config{
+		Region:      cfg.Region,
+		Credentials: aws.NewCredentialsCache(provider),
+	}, func(o *cloudwatchlogs.Options) {
+		// Without it the events are stored as plain JSON
+		o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("x-amzn-logs-format", "json/emf"))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	group, stream := aws.String(cfg.CloudWatch.LogGroup), aws.String(thingName)
+	_, err = client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{LogGroupName: group, LogStreamName: stream})
+	var exists *types.ResourceAlreadyExistsException
+	if err != nil && !errors.As(err, &exists) {
+		return fmt.Errorf("failed to create CloudWatch log stream %s: %v", thingName, err)
+	}
+
+	slices.SortStableFunc(events, func(a, b provisioningEvent) int { return a.Time.Compare(b.Time) })
+	var batch []types.InputLogEvent
+	put := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{LogGroupName: group, LogStreamName: stream, LogEvents: batch}); err != nil {
+			return fmt.Errorf("failed to put CloudWatch log events: %v", err)
+		}
+		batch = nil
+		return nil
+	}
+	dropped := 0
+	for _, event := range events {
+		if time.Since(event.Time) > cloudWatchMaxAge {
+			dropped++
+			continue
+		}
+		if len(batch) > 0 && event.Time.Sub(time.UnixMilli(*batch[0].Timestamp)) >= cloudWatchMaxSpan {
+			if err := put(); err != nil {
+				return err
+			}
+		}
+		message, err := event.emf(cfg.CloudWatch.Namespace)
+		if err != nil {
+			return fmt.Errorf("failed to marshal CloudWatch event: %v", err)
+		}
+		batch = append(batch, types.InputLogEvent{Message: aws.String(string(message)), Timestamp: aws.Int64(event.Time.UnixMilli())})
+	}
+	if err := put(); err != nil {
+		return err
+	}
+	if dropped > 0 {
+		log.Printf("Warning: dropped %d CloudWatch events older than CloudWatch Logs accepts", dropped)
+	}
+	log.Printf("Shipped %d provisioning events to CloudWatch log group %s", len(events)-dropped, cfg.CloudWatch.LogGroup)
+	return nil
+}
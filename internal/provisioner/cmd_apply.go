@@ -0,0 +1,39 @@
+package provisioner
+
+import (
+	"flag"
+	"fmt"
+)
+
+// runApplyCommand converges the device to a bootstrap manifest and prints
+// what differed, as + (created), ~ (changed), = (already as described), or ✗
+// (could not be converged)
+func runApplyCommand(args []string) error {
+	cfg := defaultConfig()
+	var manifestFile string
+	dryRun := false
+
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&manifestFile, "manifest", "", "Bootstrap manifest describing the device once brought up (required)")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "Only report what would change")
+	fs.Parse(args)
+
+	if manifestFile == "" {
+		return fmt.Errorf("-manifest is required")
+	}
+	manifest, err := loadManifest(cfg.Files.fs(), manifestFile)
+	if err != nil {
+		return err
+	}
+	cfg = manifest.Identity.apply(cfg)
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	diff, err := convergeManifest(cfg, manifest, dryRun)
+	for _, change := range diff {
+		fmt.Println(change)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package provisioner
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// runAuditCommand verifies the hash chain of the audit log
+func runAuditCommand(args []string) error {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory holding the audit log")
+	cfg.AuditRetention.registerFlags(fs)
+	fs.Parse(args)
+	if r := cfg.AuditRetention; r.MaxEntries < 0 || r.MaxAge < 0 || r.MaxBytes < 0 {
+		return fmt.Errorf("audit log retention limits must not be negative")
+	}
+
+	path := cfg.outputPath(auditLogFile)
+	count, err := verifyAuditLog(path, cfg.Files)
+	if err != nil {
+		return fmt.Errorf("audit log %s failed verification: %v", path, err)
+	}
+	fmt.Printf("Audit log %s verified: %d entries\n", path, count)
+	if entries, err := readAuditLog(path, cfg.Files); err == nil && len(entries) > 0 && entries[0].Event == AuditLogPruned {
+		fmt.Printf("%d older entries pruned, last on %s\n", entries[0].Pruned, entries[0].Time.Format(time.RFC3339))
+	}
+
+	// Verified first, so pruning does not hide a broken chain
+	pruned, err := pruneAuditLog(path, cfg.AuditRetention, cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d entries\n", pruned)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+)
+
+// IoT policy document as written by hand, where Action and Resource may be a
+// string or a list, and statements may use NotAction and NotResource
+type auditedPolicy struct {
+	Statement auditedStatements `json:"Statement"`
+}
+
+type auditedStatement struct {
+	Effect      string        `json:"Effect"`
+	Action      policyStrings `json:"Action"`
+	NotAction   policyStrings `json:"NotAction"`
+	Resource    policyStrings `json:"Resource"`
+	NotResource policyStrings `json:"NotResource"`
+}
+
+// A single statement is not always put in a list
+type auditedStatements []auditedStatement
+
+func (s *auditedStatements) UnmarshalJSON(data []byte) error {
+	var one auditedStatement
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = auditedStatements{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]auditedStatement)(s))
+}
+
+// A string or a list of strings
+type policyStrings []string
+
+func (p *policyStrings) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*p = policyStrings{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(p))
+}
+
+// runAuditClaimPolicyCommand checks the policies attached to the claim
+// certificate against the least privilege claim policy, and lists every
+// permission they grant beyond connecting and the certificate creation and
+// template provisioning topics. Any finding fails the command, so it can gate
+// a release or run on a schedule.
+func runAuditClaimPolicyCommand(args []string) error {
+	cfg := defaultConfig()
+	id := ""
+
+	fs := flag.NewFlagSet("audit-claim-policy", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the fleet")
+	fs.StringVar(&cfg.TemplateName, "template", cfg.TemplateName, "Provisioning template the claim is used with")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", cfg.PayloadFormat, "Payload format the devices provision with, as -payload-format")
+	fs.StringVar(&cfg.ClaimCertFile, "claim-cert", cfg.ClaimCertFile, "Claim certificate whose policies to audit")
+	fs.StringVar(&id, "certificate-id", id, "ID of the claim certificate in AWS IoT, instead of -claim-cert")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := validateTemplateName(cfg.TemplateName); err != nil {
+		return err
+	}
+	if codecs[cfg.PayloadFormat] == nil {
+		return fmt.Errorf("unsupported payload format %q: use one of %s", cfg.PayloadFormat, strings.Join(payloadFormats(), ", "))
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	if id == "" {
+		cert, err := readSecret(cfg.Files.fs(), envClaimCert, cfg.ClaimCertFile)
+		if err == nil {
+			err = cert.open(cfg)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read claim certificate: %v", err)
+		}
+		parsed, err := parseCertificatePEM(cert.data)
+		if err != nil {
+			return fmt.Errorf("failed to parse claim certificate %s: %v", cert.source, err)
+		}
+		id = certificateID(parsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(id)})
+	if err != nil {
+		return fmt.Errorf("claim certificate %s not found in AWS IoT: %v", id, err)
+	}
+	certificateArn := aws.ToString(described.CertificateDescription.CertificateArn)
+	// The policy is expected in the account and region of the certificate
+	parsedArn, err := arn.Parse(certificateArn)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate ARN %s: %v", certificateArn, err)
+	}
+	cfg.Region = parsedArn.Region
+	expected := claimPolicy(cfg, parsedArn.AccountID)
+
+	var policyNames []string
+	policies := iot.NewListAttachedPoliciesPaginator(client, &iot.ListAttachedPoliciesInput{Target: aws.String(certificateArn)})
+	for policies.HasMorePages() {
+		page, err := policies.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list policies of certificate %s: %v", id, err)
+		}
+		for _, policy := range page.Policies {
+			policyNames = append(policyNames, aws.ToString(policy.PolicyName))
+		}
+	}
+	fmt.Printf("Claim certificate %s (%s)\n", id, described.CertificateDescription.Status)
+	if len(policyNames) == 0 {
+		fmt.Println("No policies attached, devices cannot provision with this claim")
+		return nil
+	}
+
+	findings := 0
+	for _, name := range policyNames {
+		policy, err := client.GetPolicy(ctx, &iot.GetPolicyInput{PolicyName: aws.String(name)})
+		if err != nil {
+			return fmt.Errorf("failed to get policy %s: %v", name, err)
+		}
+		problems, err := auditClaimPolicy(aws.ToString(policy.PolicyDocument), expected)
+		if err != nil {
+			return fmt.Errorf("policy %s: %v", name, err)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("✓ %s: only provisioning permissions\n", name)
+			continue
+		}
+		fmt.Printf("✗ %s:\n", name)
+		for _, problem := range problems {
+			fmt.Printf("    %s\n", problem)
+		}
+		findings += len(problems)
+	}
+	if findings > 0 {
+		return fmt.Errorf("claim policies grant %d permissions beyond provisioning with template %s, compare with the policy bootstrap-claim creates", findings, cfg.TemplateName)
+	}
+	return nil
+}
+
+// auditClaimPolicy returns what the Allow statements of document grant
+// beyond the expected claim policy. Deny statements only take permissions
+// away and are not audited.
+func auditClaimPolicy(document string, expected policyDocument) ([]string, error) {
+	var policy auditedPolicy
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy document: %v", err)
+	}
+	// Resources each provisioning action is needed on
+	needed := map[string][]string{}
+	for _, statement := range expected.Statement {
+		for _, action := range statement.Action {
+			needed[strings.ToLower(action)] = append(needed[strings.ToLower(action)], statement.Resource...)
+		}
+	}
+	clients := strings.TrimSuffix(needed["iot:connect"][0], "*")
+
+	var problems []string
+	for i, statement := range policy.Statement {
+		if !strings.EqualFold(statement.Effect, "Allow") {
+			continue
+		}
+		at := fmt.Sprintf("statement %d", i+1)
+		if len(statement.NotAction) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: NotAction allows every action but %s", at, strings.Join(statement.NotAction, ", ")))
+		}
+		if len(statement.NotResource) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: NotResource allows every resource but %s", at, strings.Join(statement.NotResource, ", ")))
+		}
+		for _, action := range statement.Action {
+			resources, ok := needed[strings.ToLower(action)]
+			switch {
+			case strings.ContainsAny(action, "*?"):
+				problems = append(problems, fmt.Sprintf("%s: action %s is a wildcard, allow iot:Connect, iot:Publish, iot:Subscribe, and iot:Receive only", at, action))
+				continue
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s: action %s is not needed to provision", at, action))
+				continue
+			}
+			for _, resource := range statement.Resource {
+				switch {
+				case slices.Contains(resources, resource):
+				// Any client ID may connect, as devices choose their own
+				case strings.EqualFold(action, "iot:Connect") && strings.HasPrefix(resource, clients) && !strings.ContainsAny(resource, "*?"):
+				case strings.ContainsAny(resource, "*?"):
+					problems = append(problems, fmt.Sprintf("%s: %s on %s is a wildcard broader than the provisioning topics", at, action, resource))
+				default:
+					problems = append(problems, fmt.Sprintf("%s: %s on %s is not needed to provision", at, action, resource))
+				}
+			}
+		}
+	}
+	return problems, nil
+}
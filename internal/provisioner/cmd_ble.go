@@ -0,0 +1,212 @@
+//go:build !noble
+
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// UUIDs of the BLE onboarding service and its characteristics, which differ
+// only in the third and fourth bytes
+var (
+	bleBaseUUID       = bluetooth.NewUUID([16]byte{0x5a, 0x3c, 0x00, 0x00, 0x8f, 0x1e, 0x4d, 0x6b, 0x9c, 0x2a, 0x7e, 0x4b, 0x1d, 0x0f, 0x6a, 0x21})
+	bleServiceUUID    = bleBaseUUID.Replace16BitComponent(0x0001)
+	bleSSIDUUID       = bleBaseUUID.Replace16BitComponent(0x0002) // Write: Wi-Fi SSID
+	blePassphraseUUID = bleBaseUUID.Replace16BitComponent(0x0003) // Write: Wi-Fi passphrase
+	bleClaimCertUUID  = bleBaseUUID.Replace16BitComponent(0x0004) // Write: claim certificate
+	bleClaimKeyUUID   = bleBaseUUID.Replace16BitComponent(0x0005) // Write: claim private key
+	bleControlUUID    = bleBaseUUID.Replace16BitComponent(0x0006) // Write: "provision" or "reset"
+	bleStatusUUID     = bleBaseUUID.Replace16BitComponent(0x0007) // Read and notify: onboardingStatus
+)
+
+// How long the final status stays readable
+const bleFinalStatusLinger = 3 * time.Second
+
+// BLE GATT service a mobile app onboards the device through
+type bleOnboarding struct {
+	cfg         Config
+	wifiCommand string
+	status      bluetooth.Characteristic
+	done        chan *ProvisioningResult
+
+	mu                                    sync.Mutex
+	ssid, passphrase, claimCert, claimKey []byte
+	running                               bool
+}
+
+// runBLECommand advertises the onboarding service until the device is
+// provisioned. The app writes the Wi-Fi credentials and, optionally, claim
+// credentials, then writes "provision" to the control characteristic and
+// follows the progress on the status characteristic. A failed attempt can be
+// retried from the app.
+func runBLECommand(args []string) error {
+	cfg := defaultConfig()
+	name := ""
+	wifiCommand := defaultWiFiCommand
+
+	fs := flag.NewFlagSet("ble", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&name, "ble-name", name, "Name to advertise (default Provision-<serial>)")
+	fs.StringVar(&wifiCommand, "wifi-command", wifiCommand, "Command that joins the Wi-Fi network in $WIFI_SSID with $WIFI_PASSPHRASE")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if name == "" {
+		name = "Provision-" + cfg.SerialNumber
+	}
+	if state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); err == nil && state.State == FlowVerified {
+		log.Printf("Device is already provisioned as %s", state.ThingName)
+		return nil
+	}
+
+	adapter := bluetooth.DefaultAdapter
+	if err := adapter.Enable(); err != nil {
+		return fmt.Errorf("failed to enable Bluetooth adapter: %v", err)
+	}
+	b := &bleOnboarding{cfg: cfg, wifiCommand: wifiCommand, done: make(chan *ProvisioningResult, 1)}
+	err := adapter.AddService(&bluetooth.Service{
+		UUID: bleServiceUUID,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{UUID: bleSSIDUUID, Flags: bluetooth.CharacteristicWritePermission, WriteEvent: b.writer(&b.ssid)},
+			{UUID: blePassphraseUUID, Flags: bluetooth.CharacteristicWritePermission, WriteEvent: b.writer(&b.passphrase)},
+			{UUID: bleClaimCertUUID, Flags: bluetooth.CharacteristicWritePermission, WriteEvent: b.writer(&b.claimCert)},
+			{UUID: bleClaimKeyUUID, Flags: bluetooth.CharacteristicWritePermission, WriteEvent: b.writer(&b.claimKey)},
+			{UUID: bleControlUUID, Flags: bluetooth.CharacteristicWritePermission, WriteEvent: b.control},
+			{
+				Handle: &b.status,
+				UUID:   bleStatusUUID,
+				Value:  b.encode(onboardingStatus{Stage: onboardingWaiting}),
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register BLE onboarding service: %v", err)
+	}
+
+	adv := adapter.DefaultAdvertisement()
+	if err := adv.Configure(bluetooth.AdvertisementOptions{LocalName: name, ServiceUUIDs: []bluetooth.UUID{bleServiceUUID}}); err != nil {
+		return fmt.Errorf("failed to configure BLE advertisement: %v", err)
+	}
+	if err := adv.Start(); err != nil {
+		return fmt.Errorf("failed to start BLE advertisement: %v", err)
+	}
+	defer adv.Stop()
+	log.Printf("Advertising BLE onboarding service as %s", name)
+	sdNotify("STATUS=Waiting for BLE onboarding")
+	go keepWatchdog()
+
+	result := <-b.done
+	// Give the app time to read the final status before the service goes away
+	time.Sleep(bleFinalStatusLinger)
+	fmt.Printf("Provisioned as %s\n", result.ThingName)
+	return nil
+}
+
+// writer returns a write handler storing the written value in field. Values
+// longer than the MTU arrive as several writes at increasing offsets.
+func (b *bleOnboarding) writer(field *[]byte) bluetooth.WriteEvent {
+	return func(_ bluetooth.Connection, offset int, value []byte) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if offset == 0 {
+			clear(*field)
+			*field = nil
+		}
+		if offset > len(*field) || offset+len(value) > maxOnboardingValue {
+			log.Printf("Warning: ignoring BLE write at offset %d of %d bytes", offset, len(value))
+			return
+		}
+		*field = append((*field)[:offset], value...)
+	}
+}
+
+// control handles the commands written to the control characteristic
+func (b *bleOnboarding) control(_ bluetooth.Connection, _ int, value []byte) {
+	switch command := strings.TrimSpace(string(value)); command {
+	case "provision":
+		b.start()
+	case "reset":
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if !b.running {
+			b.reset()
+		}
+	default:
+		log.Printf("Warning: unknown BLE onboarding command %q", command)
+	}
+}
+
+// start provisions the device with the written settings, unless it is already
+// being provisioned
+func (b *bleOnboarding) start() {
+	b.mu.Lock()
+	if b.running {
+		b.mu.Unlock()
+		return
+	}
+	b.running = true
+	request := onboardingRequest{
+		SSID:       string(b.ssid),
+		Passphrase: bytes.Clone(b.passphrase),
+		ClaimCert:  bytes.Clone(b.claimCert),
+		ClaimKey:   bytes.Clone(b.claimKey),
+	}
+	b.mu.Unlock()
+
+	log.Println("Provisioning requested over BLE")
+	go func() {
+		defer request.zero()
+		result, err := onboard(b.cfg, b.wifiCommand, request, b.progress)
+		if err != nil {
+			log.Printf("BLE onboarding failed: %v", err)
+			b.notify(onboardingStatus{Stage: onboardingFailed, Message: err.Error()})
+			b.mu.Lock()
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		b.notify(onboardingStatus{Stage: string(StageComplete), ThingName: result.ThingName})
+		b.mu.Lock()
+		b.reset()
+		b.mu.Unlock()
+		b.done <- result
+	}()
+}
+
+// reset clears the written settings, with b.mu held
+func (b *bleOnboarding) reset() {
+	for _, field := range []*[]byte{&b.ssid, &b.passphrase, &b.claimCert, &b.claimKey} {
+		clear(*field)
+		*field = nil
+	}
+}
+
+// progress reports each provisioning stage on the status characteristic
+func (b *bleOnboarding) progress(stage Stage, message string) {
+	b.notify(onboardingStatus{Stage: string(stage), Message: message})
+}
+
+// notify sets the status characteristic, notifying subscribed apps
+func (b *bleOnboarding) notify(status onboardingStatus) {
+	if _, err := b.status.Write(b.encode(status)); err != nil {
+		log.Printf("Warning: failed to update BLE status: %v", err)
+	}
+}
+
+// encode marshals a status document
+func (b *bleOnboarding) encode(status onboardingStatus) []byte {
+	data, _ := json.Marshal(status)
+	return data
+}
@@ -0,0 +1,71 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// runBootstrapClaimCommand creates a claim certificate with the least privilege
+// claim policy and writes it where the provisioner expects it, printing the
+// policy it attached
+func runBootstrapClaimCommand(args []string) error {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("bootstrap-claim", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the fleet")
+	fs.StringVar(&cfg.TemplateName, "template", cfg.TemplateName, "Provisioning template the claim may use")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", cfg.PayloadFormat, "Payload format whose provisioning topics the claim may use, as -payload-format")
+	fs.StringVar(&cfg.ClaimCertFile, "claim-cert", cfg.ClaimCertFile, "Where to write the claim certificate")
+	fs.StringVar(&cfg.ClaimKeyFile, "claim-key", cfg.ClaimKeyFile, "Where to write the claim private key")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := validateTemplateName(cfg.TemplateName); err != nil {
+		return err
+	}
+	if codecs[cfg.PayloadFormat] == nil {
+		return fmt.Errorf("unsupported payload format %q: use one of %s", cfg.PayloadFormat, strings.Join(payloadFormats(), ", "))
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	// Check before creating anything so a failed run does not leave an unused claim behind
+	for _, path := range []string{cfg.ClaimCertFile, cfg.ClaimKeyFile} {
+		if _, err := cfg.Files.fs().Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, refusing to overwrite it", path)
+		}
+	}
+
+	ctx := context.Background()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	claim, policy, err := createClaimCertificate(ctx, iot.NewFromConfig(awsCfg), sts.NewFromConfig(awsCfg), cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Files.write(cfg.ClaimCertFile, []byte(claim.CertificatePem), false); err != nil {
+		return fmt.Errorf("failed to write claim certificate: %v", err)
+	}
+	if err := cfg.Files.write(cfg.ClaimKeyFile, []byte(claim.PrivateKey), true); err != nil {
+		return fmt.Errorf("failed to write claim private key: %v", err)
+	}
+
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy: %v", err)
+	}
+	fmt.Printf("Claim certificate %s written to %s and %s\n", claim.CertificateID, cfg.ClaimCertFile, cfg.ClaimKeyFile)
+	fmt.Printf("Attached policy %s:\n%s\n", claimPolicyName(cfg), data)
+	return nil
+}
@@ -0,0 +1,56 @@
+package provisioner
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runBridgeCommand provisions companion MCUs over a serial line: the MCU sends
+// its serial number, template parameters, and a CSR, and gets back the issued
+// certificate. The private key never leaves the MCU. See bridgeMessage for the
+// protocol.
+func runBridgeCommand(args []string) error {
+	cfg := defaultConfig()
+	port := ""
+	baud := 115200
+	dir := ""
+
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&port, "serial-port", port, "Serial device the MCU is connected to, or - for stdin and stdout")
+	fs.IntVar(&baud, "baud", baud, "Baud rate of the serial device")
+	fs.StringVar(&dir, "bridge-dir", dir, "Directory with a subdirectory per provisioned MCU (default bridge in -output-dir)")
+	fs.Parse(args)
+
+	if port == "" {
+		return fmt.Errorf("usage: bridge -serial-port /dev/ttyS1 [flags]")
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.WipeClaim || cfg.Mode != ModeFleet {
+		return fmt.Errorf("the bridge only supports fleet provisioning, without -wipe-claim as every MCU shares the claim")
+	}
+	if dir == "" {
+		dir = filepath.Join(cfg.OutputDir, "bridge")
+	}
+
+	var in io.Reader = os.Stdin
+	b := &bridge{cfg: cfg, dir: dir, out: os.Stdout}
+	if port != "-" {
+		serial, err := openSerialPort(port, baud)
+		if err != nil {
+			return err
+		}
+		defer serial.Close()
+		in, b.out = serial, serial
+	}
+	log.Printf("Bridging provisioning requests on %s", port)
+	sdNotify("READY=1\nSTATUS=Bridging provisioning requests on " + port)
+	go keepWatchdog()
+	return b.serve(in)
+}
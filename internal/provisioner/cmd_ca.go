@@ -0,0 +1,136 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// runCARegisterCommand registers the CA of -ca-cert and -ca-key in AWS IoT
+// with auto-registration enabled, so devices with certificates it signs are
+// registered when they first connect. A CA that is already registered is
+// activated and has auto-registration enabled instead.
+func runCARegisterCommand(args []string) error {
+	cfg := defaultConfig()
+	jitpTemplate := ""
+
+	fs := flag.NewFlagSet("ca-register", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the fleet")
+	fs.StringVar(&cfg.CACertFile, "ca-cert", cfg.CACertFile, "CA certificate to register")
+	fs.StringVar(&cfg.CAKeyFile, "ca-key", cfg.CAKeyFile, "Private key of the CA, to prove possession of it")
+	fs.StringVar(&jitpTemplate, "jitp-template", jitpTemplate, "JITP provisioning template to attach to the CA; without one, register devices with a JITR rule")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if cfg.CACertFile == "" || cfg.CAKeyFile == "" {
+		return fmt.Errorf("-ca-cert and -ca-key are required")
+	}
+	if jitpTemplate != "" {
+		if err := validateTemplateName(jitpTemplate); err != nil {
+			return err
+		}
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	ca, caCert, err := loadCA(cfg)
+	if err != nil {
+		return err
+	}
+	defer zeroPrivateKey(&ca)
+
+	ctx := context.Background()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	var registration *types.RegistrationConfig
+	if jitpTemplate != "" {
+		registration = &types.RegistrationConfig{TemplateName: aws.String(jitpTemplate)}
+	}
+
+	// AWS IoT checks possession of the CA key with a certificate it signed
+	// for the account's registration code
+	code, err := client.GetRegistrationCode(ctx, &iot.GetRegistrationCodeInput{})
+	if err != nil {
+		return fmt.Errorf("failed to get registration code: %v", err)
+	}
+	verificationPEM, err := verificationCertificate(caCert, ca.PrivateKey.(crypto.Signer), aws.ToString(code.RegistrationCode))
+	if err != nil {
+		return err
+	}
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}))
+	registered, err := client.RegisterCACertificate(ctx, &iot.RegisterCACertificateInput{
+		CaCertificate:           aws.String(caPEM),
+		VerificationCertificate: aws.String(string(verificationPEM)),
+		SetAsActive:             true,
+		AllowAutoRegistration:   true,
+		RegistrationConfig:      registration,
+	})
+	var exists *types.ResourceAlreadyExistsException
+	switch {
+	case errors.As(err, &exists):
+		id := certificateID(caCert)
+		if _, err := client.UpdateCACertificate(ctx, &iot.UpdateCACertificateInput{
+			CertificateId:             aws.String(id),
+			NewStatus:                 types.CACertificateStatusActive,
+			NewAutoRegistrationStatus: types.AutoRegistrationStatusEnable,
+			RegistrationConfig:        registration,
+		}); err != nil {
+			return fmt.Errorf("failed to update CA certificate %s: %v", id, err)
+		}
+		fmt.Printf("CA certificate %s was already registered, activated it with auto-registration enabled\n", id)
+	case err != nil:
+		return fmt.Errorf("failed to register CA certificate: %v", err)
+	default:
+		fmt.Printf("Registered CA certificate %s with auto-registration enabled\n", aws.ToString(registered.CertificateId))
+	}
+	if jitpTemplate != "" {
+		fmt.Printf("Devices are provisioned with template %s when they first connect\n", jitpTemplate)
+	} else {
+		fmt.Println("Device certificates are registered as PENDING_ACTIVATION when they first connect; activate them with a rule on $aws/events/certificates/registered/#")
+	}
+	return nil
+}
+
+// verificationCertificate issues the certificate proving possession of the
+// CA key: its common name is the registration code, its key thrown away
+func verificationCertificate(caCert *x509.Certificate, caKey crypto.Signer, registrationCode string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate verification key: %v", err)
+	}
+	defer zeroBigInt(key.D)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: registrationCode},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign verification certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
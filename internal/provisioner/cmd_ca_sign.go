@@ -0,0 +1,135 @@
+package provisioner
+
+import (
+	"crypto"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runCASignCommand issues device certificates signed by the CA in bulk, for
+// devices onboarded with -mode jit. It reads serial numbers from the first
+// column of a CSV file and writes each device's certificate and key to a
+// directory named after it, laid out as the device's output directory, plus
+// a manifest of what was issued.
+func runCASignCommand(args []string) error {
+	cfg := defaultConfig()
+	in, out := "", "devices"
+
+	fs := flag.NewFlagSet("ca-sign", flag.ExitOnError)
+	fs.StringVar(&cfg.CACertFile, "ca-cert", cfg.CACertFile, "CA certificate registered in AWS IoT")
+	fs.StringVar(&cfg.CAKeyFile, "ca-key", cfg.CAKeyFile, "Private key of the CA")
+	fs.StringVar(&in, "in", in, "CSV file with a serial number in the first column of each row, - for stdin")
+	fs.StringVar(&out, "out", out, "Directory to write a directory per device to")
+	fs.Parse(args)
+
+	if cfg.CACertFile == "" || cfg.CAKeyFile == "" || in == "" {
+		return fmt.Errorf("-ca-cert, -ca-key, and -in are required")
+	}
+	serials, err := readSerials(cfg.Files.fs(), in)
+	if err != nil {
+		return err
+	}
+	ca, caCert, err := loadCA(cfg)
+	if err != nil {
+		return err
+	}
+	defer zeroPrivateKey(&ca)
+	if err := cfg.Files.fs().MkdirAll(out, 0700); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	manifest := [][]string{{"serial", "certificateId", "notAfter"}}
+	issued, skipped := 0, 0
+	for _, serial := range serials {
+		dir := filepath.Join(out, serial)
+		certFile := filepath.Join(dir, permanentCertFile)
+		// Rerunning a batch keeps what was issued before
+		if _, err := cfg.Files.fs().Stat(certFile); err == nil {
+			skipped++
+			continue
+		}
+		if err := cfg.Files.fs().MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", serial, err)
+		}
+		certPEM, keyPEM, err := signDeviceCertificate(caCert, ca.PrivateKey.(crypto.Signer), serial)
+		if err != nil {
+			return fmt.Errorf("%s: %v", serial, err)
+		}
+		// Key first: a rerun skips devices with a certificate, so one cut
+		// short between the two files is issued again
+		err = cfg.Files.write(filepath.Join(dir, permanentKeyFile), keyPEM, true)
+		keyPEM.zero()
+		if err != nil {
+			return fmt.Errorf("failed to write private key of %s: %v", serial, err)
+		}
+		if err := cfg.Files.write(certFile, certPEM, false); err != nil {
+			return fmt.Errorf("failed to write certificate of %s: %v", serial, err)
+		}
+		leaf, _ := parseCertificatePEM(certPEM)
+		manifest = append(manifest, []string{serial, certificateID(leaf), leaf.NotAfter.Format(time.RFC3339)})
+		issued++
+	}
+
+	if issued > 0 {
+		var buf strings.Builder
+		writer := csv.NewWriter(&buf)
+		writer.WriteAll(manifest)
+		path := filepath.Join(out, "manifest-"+time.Now().UTC().Format("20060102T150405Z")+".csv")
+		if err := cfg.Files.write(path, []byte(buf.String()), false); err != nil {
+			return fmt.Errorf("failed to write manifest: %v", err)
+		}
+		fmt.Printf("Manifest written to %s\n", path)
+	}
+	fmt.Printf("Issued %d device certificates signed by %s into %s", issued, caCert.Subject, out)
+	if skipped > 0 {
+		fmt.Printf(", %d devices already had one", skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+// readSerials reads the serial numbers from the first column of a CSV file,
+// skipping a header row starting with "serial" and empty rows. Serial numbers
+// must be unique and usable as directory names.
+func readSerials(fsys FileSystem, path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		data, err := fsys.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read serial numbers: %v", err)
+		}
+		r = strings.NewReader(string(data))
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	var serials []string
+	seen := map[string]bool{}
+	for i, record := range records {
+		serial := strings.TrimSpace(record[0])
+		if serial == "" || (i == 0 && strings.EqualFold(serial, "serial")) {
+			continue
+		}
+		if serial != filepath.Base(serial) || serial == "." || serial == ".." || strings.ContainsFunc(serial, func(r rune) bool { return r < ' ' }) {
+			return nil, fmt.Errorf("%s row %d: serial number %q cannot name a directory", path, i+1, serial)
+		}
+		if seen[serial] {
+			return nil, fmt.Errorf("%s row %d: duplicate serial number %q", path, i+1, serial)
+		}
+		seen[serial] = true
+		serials = append(serials, serial)
+	}
+	if len(serials) == 0 {
+		return nil, fmt.Errorf("%s lists no serial numbers", path)
+	}
+	return serials, nil
+}
@@ -0,0 +1,191 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcome of a canary, written to -report for CI
+type canaryReport struct {
+	Time          time.Time     `json:"time"`
+	Template      string        `json:"template"`
+	Serial        string        `json:"serial"`
+	ThingName     string        `json:"thingName,omitempty"`
+	CertificateID string        `json:"certificateId,omitempty"`
+	Passed        bool          `json:"passed"`
+	Checks        []canaryCheck `json:"checks"`
+	ErrorCode     ErrorCode     `json:"errorCode,omitempty"` // Of a failed provisioning run
+	DurationMS    int64         `json:"durationMs"`
+}
+
+type canaryCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// runCanaryCommand gates a template change: it provisions a disposable device
+// end to end with the template, verifying its identity as a real device
+// would, checks the thing name and device configuration it was given, and
+// deprovisions it. It returns an error if any check failed or anything was
+// left behind, so a deployment pipeline can stop before devices meet the
+// template.
+func runCanaryCommand(args []string) error {
+	cfg := defaultConfig()
+	prefix := "canary-"
+	dir := ""
+	reportFile := ""
+	expectThingName := ""
+	expectConfig := map[string]string{}
+	keep := false
+
+	fs := flag.NewFlagSet("canary", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&prefix, "serial-prefix", prefix, "Prefix of the canary's serial number, followed by the time and a random suffix")
+	fs.StringVar(&dir, "canary-dir", dir, "Directory for the canary's credentials (default a temporary directory, removed afterwards)")
+	fs.StringVar(&reportFile, "report", reportFile, "File to write the outcome to as JSON")
+	fs.StringVar(&expectThingName, "expect-thing-name", expectThingName, "Thing name the template must give the canary, with {serial} replaced")
+	fs.Func("expect-config", "Device configuration key the template must return, as key=value; repeatable", func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected key=value, got %q", s)
+		}
+		expectConfig[key] = value
+		return nil
+	})
+	fs.BoolVar(&keep, "keep", keep, "Leave the canary provisioned, to look into a failure")
+	fs.Parse(args)
+
+	cfg = cfg.withRandom()
+	cfg.SerialNumber = prefix + time.Now().UTC().Format("20060102T150405") + "-" + randomHex(cfg.random(), 3)
+	cfg.SerialSource = SerialFlag
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.Mode != ModeFleet {
+		return fmt.Errorf("canary needs -mode %s", ModeFleet)
+	}
+	if cfg.WipeClaim {
+		return fmt.Errorf("-wipe-claim would leave the fleet without its claim after the canary")
+	}
+	// The canary provisions on behalf of a test device: hooks, health, appliers,
+	// and start-up behaviour belong to a real one
+	cfg.Hooks = Hooks{}
+	cfg.HealthFile = ""
+	cfg.Appliers.Names = nil
+	cfg.RetryForever = false
+	cfg.WaitNetwork = false
+	cfg.StartupJitter = 0
+	if dir == "" {
+		temp, err := os.MkdirTemp("", "canary-")
+		if err != nil {
+			return fmt.Errorf("failed to create canary directory: %v", err)
+		}
+		if !keep {
+			defer os.RemoveAll(temp)
+		}
+		dir = temp
+	} else if err := cfg.Files.fs().MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create canary directory: %v", err)
+	}
+	cfg.OutputDir = dir
+
+	// Fail before the canary is provisioned if it could not be removed
+	ctx := context.Background()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	report := canaryReport{Time: started.UTC(), Template: cfg.TemplateName, Serial: cfg.SerialNumber}
+	check := func(name string, passed bool, detail string, args ...interface{}) {
+		c := canaryCheck{Name: name, Passed: passed, Detail: fmt.Sprintf(detail, args...)}
+		report.Checks = append(report.Checks, c)
+		mark := "✓"
+		if !passed {
+			mark = "✗"
+		}
+		fmt.Printf("%s %s: %s\n", mark, c.Name, c.Detail)
+	}
+
+	fmt.Printf("Provisioning canary %s with template %s\n", cfg.SerialNumber, cfg.TemplateName)
+	result, err := runOnce(cfg, nil)
+	record := soakRecord{Serial: cfg.SerialNumber}
+	if err != nil {
+		report.ErrorCode = ErrorCodeOf(err)
+		check("provision", false, "[%s] %v", report.ErrorCode, err)
+		// A run that failed after registering only left the thing in its state
+		if state, stateErr := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); stateErr == nil {
+			record.ThingName = state.ThingName
+			if state.CertificateID != "" {
+				record.Certificates = append(record.Certificates, state.CertificateID)
+			}
+		}
+	} else {
+		report.ThingName, report.CertificateID = result.ThingName, result.CertificateID
+		record.ThingName = result.ThingName
+		record.Certificates = append(record.Certificates, result.CertificateID)
+		check("provision", true, "provisioned as %s and verified in %s", result.ThingName, time.Since(started).Round(time.Millisecond))
+		if expectThingName != "" {
+			want := strings.ReplaceAll(expectThingName, "{serial}", cfg.SerialNumber)
+			check("thing name", result.ThingName == want, "got %s, want %s", result.ThingName, want)
+		}
+		keys := make([]string, 0, len(expectConfig))
+		for key := range expectConfig {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			want := expectConfig[key]
+			value, ok := result.DeviceConfiguration[key]
+			got := fmt.Sprint(value)
+			if !ok {
+				got = "nothing"
+			}
+			check("device configuration "+key, ok && got == want, "got %s, want %s", got, want)
+		}
+	}
+
+	if keep {
+		fmt.Printf("Left the canary provisioned in %s, remove it with deprovision -output-dir %s\n", dir, dir)
+	} else {
+		err := soakDeprovision(ctx, cfg, client, &record)
+		switch {
+		case err != nil:
+			check("deprovision", false, "%v", err)
+		case len(record.Orphans) > 0:
+			check("deprovision", false, "left %s behind", strings.Join(record.Orphans, ", "))
+		case record.ThingName != "":
+			check("deprovision", true, "%s and its certificates deleted", record.ThingName)
+		}
+	}
+
+	report.Passed = true
+	for _, c := range report.Checks {
+		report.Passed = report.Passed && c.Passed
+	}
+	report.DurationMS = time.Since(started).Milliseconds()
+	if reportFile != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = cfg.Files.write(reportFile, append(data, '\n'), false)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write canary report: %v", err)
+		}
+	}
+	if !report.Passed {
+		return fmt.Errorf("✗ canary failed with template %s", cfg.TemplateName)
+	}
+	fmt.Printf("✓ Canary passed with template %s\n", cfg.TemplateName)
+	return nil
+}
@@ -0,0 +1,189 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	iottypes "github.com/aws/aws-sdk-go-v2/service/iot/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Name of the manifest kept next to the claim credentials in S3
+const claimManifestName = "manifest.json"
+
+// Claim distribution manifest. Devices fetch the current claim; retiring
+// claims stay active until their grace period ends.
+type claimManifest struct {
+	Current  *claimManifestEntry  `json:"current,omitempty"`
+	Retiring []claimManifestEntry `json:"retiring,omitempty"`
+}
+
+type claimManifestEntry struct {
+	CertificateID  string    `json:"certificateId"`
+	CertificateArn string    `json:"certificateArn"`
+	CertificateKey string    `json:"certificateKey"` // S3 object key of the certificate
+	PrivateKeyKey  string    `json:"privateKeyKey"`  // S3 object key of the private key
+	CreatedAt      time.Time `json:"createdAt"`
+	RetireAfter    time.Time `json:"retireAfter,omitempty"`
+}
+
+// runClaimRotateCommand rotates the fleet's claim certificate: it creates a new
+// claim with the least privilege claim policy, publishes it to S3 encrypted
+// with KMS, and deactivates claims whose grace period has ended. Run it on a
+// schedule to retire old claims.
+func runClaimRotateCommand(args []string) error {
+	cfg := defaultConfig()
+	var bucket, prefix, kmsKey string
+	grace := 30 * 24 * time.Hour
+	retireOnly := false
+
+	fs := flag.NewFlagSet("claim-rotate", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the fleet")
+	fs.StringVar(&cfg.TemplateName, "template", cfg.TemplateName, "Provisioning template the claim may use")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", cfg.PayloadFormat, "Payload format whose provisioning topics the claim may use, as -payload-format")
+	fs.StringVar(&bucket, "bucket", "", "S3 bucket the claim credentials are distributed from")
+	fs.StringVar(&prefix, "prefix", "claim", "S3 key prefix for the claim credentials and manifest")
+	fs.StringVar(&kmsKey, "kms-key", "", "KMS key ID or ARN used to encrypt the claim credentials")
+	fs.DurationVar(&grace, "grace", grace, "How long the previous claim stays active after rotation")
+	fs.BoolVar(&retireOnly, "retire-only", retireOnly, "Only deactivate claims whose grace period has ended")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	if bucket == "" || kmsKey == "" {
+		return fmt.Errorf("-bucket and -kms-key are required")
+	}
+	if err := validateTemplateName(cfg.TemplateName); err != nil {
+		return err
+	}
+	if codecs[cfg.PayloadFormat] == nil {
+		return fmt.Errorf("unsupported payload format %q: use one of %s", cfg.PayloadFormat, strings.Join(payloadFormats(), ", "))
+	}
+
+	ctx := context.Background()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	iotClient := iot.NewFromConfig(awsCfg)
+	s3Client := s3.NewFromConfig(awsCfg)
+	manifestKey := path.Join(prefix, claimManifestName)
+
+	manifest, err := loadClaimManifest(ctx, s3Client, bucket, manifestKey)
+	if err != nil {
+		return err
+	}
+
+	if !retireOnly {
+		claim, _, err := createClaimCertificate(ctx, iotClient, sts.NewFromConfig(awsCfg), cfg)
+		if err != nil {
+			return err
+		}
+		entry := claimManifestEntry{
+			CertificateID:  claim.CertificateID,
+			CertificateArn: claim.CertificateArn,
+			CertificateKey: path.Join(prefix, claim.CertificateID, "claim_cert.pem"),
+			PrivateKeyKey:  path.Join(prefix, claim.CertificateID, "claim_key.pem"),
+			CreatedAt:      time.Now().UTC(),
+		}
+		if err := putEncrypted(ctx, s3Client, bucket, entry.CertificateKey, kmsKey, []byte(claim.CertificatePem)); err != nil {
+			return err
+		}
+		if err := putEncrypted(ctx, s3Client, bucket, entry.PrivateKeyKey, kmsKey, []byte(claim.PrivateKey)); err != nil {
+			return err
+		}
+
+		if manifest.Current != nil {
+			previous := *manifest.Current
+			previous.RetireAfter = time.Now().UTC().Add(grace)
+			manifest.Retiring = append(manifest.Retiring, previous)
+			log.Printf("Claim %s retires after %s", previous.CertificateID, previous.RetireAfter.Format(time.RFC3339))
+		}
+		manifest.Current = &entry
+	}
+
+	// Deactivate claims past their grace period
+	var retiring []claimManifestEntry
+	for _, entry := range manifest.Retiring {
+		if time.Now().Before(entry.RetireAfter) {
+			retiring = append(retiring, entry)
+			continue
+		}
+		_, err := iotClient.UpdateCertificate(ctx, &iot.UpdateCertificateInput{
+			CertificateId: aws.String(entry.CertificateID),
+			NewStatus:     iottypes.CertificateStatusInactive,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to deactivate claim %s: %v", entry.CertificateID, err)
+		}
+		log.Printf("Deactivated claim %s", entry.CertificateID)
+	}
+	manifest.Retiring = retiring
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal claim manifest: %v", err)
+	}
+	if err := putEncrypted(ctx, s3Client, bucket, manifestKey, kmsKey, data); err != nil {
+		return err
+	}
+	if manifest.Current != nil {
+		fmt.Printf("Current claim: %s (s3://%s/%s)\n", manifest.Current.CertificateID, bucket, manifestKey)
+	}
+	return nil
+}
+
+// loadClaimManifest reads the manifest, returning an empty one if there is none
+func loadClaimManifest(ctx context.Context, client *s3.Client, bucket, key string) (*claimManifest, error) {
+	object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	var missing *s3types.NoSuchKey
+	if errors.As(err, &missing) {
+		return &claimManifest{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch claim manifest s3://%s/%s: %v", bucket, key, err)
+	}
+	defer object.Body.Close()
+
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claim manifest: %v", err)
+	}
+	var manifest claimManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse claim manifest s3://%s/%s: %v", bucket, key, err)
+	}
+	return &manifest, nil
+}
+
+// putEncrypted uploads an object encrypted with the KMS key
+func putEncrypted(ctx context.Context, client *s3.Client, bucket, key, kmsKey string, data []byte) error {
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: s3types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          aws.String(kmsKey),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %v", bucket, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// runCleanupOrphansCommand deactivates and deletes the certificates this
+// device created that never got a thing attached, which failed runs leave
+// behind in the account. Candidates are the certificates the audit log
+// records as created but never registered and those -deadline-abandon
+// recorded in the state; the device's current certificate is never one, nor
+// one a resumed run could still register. A candidate is only deleted once
+// AWS IoT confirms no thing is attached to it and it is older than -min-age.
+func runCleanupOrphansCommand(args []string) error {
+	cfg := defaultConfig()
+	minAge := time.Hour
+	dryRun := false
+
+	fs := flag.NewFlagSet("cleanup-orphans", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region the device provisions in")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory holding the device's audit log and provisioning state")
+	fs.DurationVar(&minAge, "min-age", minAge, "Leave certificates created more recently alone, as a run may still register them")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "Only list the orphaned certificates")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if minAge < 0 {
+		return fmt.Errorf("-min-age must not be negative")
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	candidates, err := orphanCandidates(cfg, state)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No certificates to clean up")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	deleted, kept := 0, 0
+	var problems []string
+	orphans := len(state.OrphanedCertificates)
+	for _, id := range candidates {
+		check, err := checkOrphan(ctx, client, id)
+		if err != nil {
+			fmt.Printf("✗ %s: %v\n", id, err)
+			problems = append(problems, err.Error())
+			continue
+		}
+		created := check.created.UTC().Format(time.RFC3339)
+		switch {
+		case check.deleted:
+			fmt.Printf("- %s: already deleted\n", id)
+			forgetOrphan(state, id)
+			continue
+		case check.thing != "":
+			fmt.Printf("- %s: attached to thing %s, not orphaned\n", id, check.thing)
+			forgetOrphan(state, id)
+			continue
+		case time.Since(check.created) < minAge:
+			fmt.Printf("- %s: created %s, less than -min-age ago\n", id, created)
+			kept++
+			continue
+		case dryRun:
+			fmt.Printf("✓ %s: orphaned, %s, created %s\n", id, check.status, created)
+			continue
+		}
+		if err := deleteCertificate(ctx, client, "", id); err != nil {
+			fmt.Printf("✗ %s: %v\n", id, err)
+			problems = append(problems, err.Error())
+			continue
+		}
+		fmt.Printf("✓ %s: orphaned, created %s, deleted\n", id, created)
+		deleted++
+		recordAudit(cfg, auditEntry{Event: AuditOrphanDeleted, CertificateID: id})
+		forgetOrphan(state, id)
+	}
+	if !dryRun && len(state.OrphanedCertificates) != orphans {
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("\n%d candidates checked, nothing deleted (dry run)\n", len(candidates))
+	} else {
+		fmt.Printf("\n%d orphaned certificates deleted, %d kept\n", deleted, kept)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d certificates could not be cleaned up", len(problems))
+	}
+	return nil
+}
+
+// orphanCandidates returns the IDs of certificates the device created that may
+// have been left behind: those abandoned at -deadline, and those the audit log
+// records as created but neither registered nor already cleaned up
+func orphanCandidates(cfg Config, state *provisioningState) ([]string, error) {
+	candidates := slices.Clone(state.OrphanedCertificates)
+	entries, err := readAuditLog(cfg.outputPath(auditLogFile), cfg.Files)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	done := map[string]bool{}
+	for _, entry := range entries {
+		switch entry.Event {
+		case AuditThingRegistered, AuditOrphanDeleted, AuditDeprovisioned:
+			done[entry.CertificateID] = true
+		}
+	}
+	for _, entry := range entries {
+		if entry.Event == AuditCertificateCreated && !done[entry.CertificateID] && !slices.Contains(candidates, entry.CertificateID) {
+			candidates = append(candidates, entry.CertificateID)
+		}
+	}
+	// The current certificate is either in use or awaiting registration
+	if state.CertificateID != "" {
+		candidates = slices.DeleteFunc(candidates, func(id string) bool { return id == state.CertificateID })
+	}
+	return candidates, nil
+}
+
+// What AWS IoT knows of a candidate certificate
+type orphanCheck struct {
+	deleted bool
+	thing   string // A thing attached to it, which makes it no orphan
+	status  types.CertificateStatus
+	created time.Time
+}
+
+// checkOrphan looks up a candidate certificate in AWS IoT
+func checkOrphan(ctx context.Context, client *iot.Client, id string) (orphanCheck, error) {
+	described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(id)})
+	if isNotFound(err) {
+		return orphanCheck{deleted: true}, nil
+	}
+	if err != nil {
+		return orphanCheck{}, fmt.Errorf("failed to describe certificate: %v", err)
+	}
+	description := described.CertificateDescription
+	check := orphanCheck{status: description.Status, created: aws.ToTime(description.CreationDate)}
+	things, err := client.ListPrincipalThings(ctx, &iot.ListPrincipalThingsInput{Principal: description.CertificateArn})
+	if err != nil {
+		return orphanCheck{}, fmt.Errorf("failed to list things of certificate: %v", err)
+	}
+	if len(things.Things) > 0 {
+		check.thing = things.Things[0]
+	}
+	return check, nil
+}
+
+// forgetOrphan removes a certificate from the state's orphaned certificates
+func forgetOrphan(state *provisioningState, id string) {
+	state.OrphanedCertificates = slices.DeleteFunc(state.OrphanedCertificates, func(orphan string) bool { return orphan == id })
+}
@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCredentialsCommand prints temporary AWS credentials for the device in the
+// credential_process format, so the AWS CLI and SDKs can use the device identity:
+//
+//	[profile device]
+//	credential_process = /usr/bin/provisioner credentials -endpoint ... -role-alias ... -thing-name ...
+func runCredentialsCommand(args []string) error {
+	cfg := defaultConfig()
+	certFile := permanentCertFile
+	keyFile := permanentKeyFile
+	var endpoint, roleAlias, thingName string
+
+	fs := flag.NewFlagSet("credentials", flag.ExitOnError)
+	fs.StringVar(&certFile, "cert", certFile, "Device certificate")
+	fs.StringVar(&keyFile, "key", keyFile, "Device private key")
+	fs.StringVar(&endpoint, "endpoint", "", "AWS IoT credentials provider endpoint")
+	fs.StringVar(&roleAlias, "role-alias", "", "Role alias to assume")
+	fs.StringVar(&thingName, "thing-name", "", "Thing name sent with the request")
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the endpoint")
+	fs.StringVar(&cfg.RootCAFile, "root-ca", cfg.RootCAFile, "PEM file with the root CA for the endpoint; empty uses the built-in Amazon root CAs")
+	fs.Parse(args)
+
+	if endpoint == "" || roleAlias == "" {
+		return fmt.Errorf("-endpoint and -role-alias are required")
+	}
+
+	cert, err := fileIdentity{fs: cfg.Files.fs(), certFile: certFile, keyFile: keyFile}.TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+
+	provider, err := NewIoTCredentialsProvider(cfg, cert, endpoint, roleAlias, thingName)
+	if err != nil {
+		return err
+	}
+	creds, err := provider.Retrieve(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// https://docs.aws.amazon.com/sdkref/latest/guide/feature-process-credentials.html
+	out := struct {
+		Version         int    `json:"Version"`
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		SessionToken    string `json:"SessionToken"`
+		Expiration      string `json:"Expiration"`
+	}{
+		Version:         1,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expires.UTC().Format(time.RFC3339),
+	}
+	return json.NewEncoder(os.Stdout).Encode(out)
+}
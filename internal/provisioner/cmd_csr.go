@@ -0,0 +1,103 @@
+package provisioner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+)
+
+// runCSRCommand handles the device side of air-gapped provisioning. csr export
+// generates the permanent key on the device and writes a CSR for it, which a
+// connected host provisions with -csr-file. The key never leaves the device.
+func runCSRCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: csr export [flags]")
+	}
+
+	cfg := defaultConfig()
+	csrPath := ""
+
+	fs := flag.NewFlagSet("csr export", flag.ExitOnError)
+	fs.StringVar(&cfg.SerialNumber, "serial", cfg.SerialNumber, "Device serial number, used as the CSR common name")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory for the private key")
+	fs.StringVar(&csrPath, "csr", "", "Where to write the CSR (default device.csr in the output directory)")
+	fs.Parse(args[1:])
+
+	if cfg.SerialNumber == "" {
+		return fmt.Errorf("serial number is required")
+	}
+	if csrPath == "" {
+		csrPath = cfg.outputPath(csrFile)
+	}
+	if cfg.OutputDir != "" {
+		if err := cfg.Files.fs().MkdirAll(cfg.OutputDir, 0700); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+	if err := checkDestination(cfg.Files.fs(), cfg.OutputDir); err != nil {
+		return err
+	}
+	keyPath := cfg.outputPath(permanentKeyFile)
+	if _, err := cfg.Files.fs().Stat(keyPath); err == nil {
+		return fmt.Errorf("%s already exists, refusing to replace the device key", keyPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %v", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cfg.SerialNumber},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %v", err)
+	}
+
+	if err := cfg.Files.write(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), true); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	if err := cfg.Files.write(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), false); err != nil {
+		return fmt.Errorf("failed to write CSR: %v", err)
+	}
+	fmt.Printf("Private key written to %s\n", keyPath)
+	fmt.Printf("CSR written to %s, provision it with -csr-file on a connected host\n", csrPath)
+	return nil
+}
+
+// readCSR reads a PEM certificate signing request and checks its signature
+func readCSR(fsys FileSystem, path string) ([]byte, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSR: %v", err)
+	}
+	if err := checkCSR(data, path); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// checkCSR checks that data is a PEM encoded CSR with a valid signature;
+// source names it in errors
+func checkCSR(data []byte, source string) error {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("%s: not a PEM encoded certificate request", source)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: failed to parse CSR: %v", source, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("%s: invalid CSR signature: %v", source, err)
+	}
+	return nil
+}
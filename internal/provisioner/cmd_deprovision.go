@@ -0,0 +1,148 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// runDeprovisionCommand removes the device from AWS IoT and wipes its local
+// identity, for RMA and refurbishment. It detaches the policies and the thing
+// from the certificate, deactivates and deletes the certificate, deletes the
+// thing, and shreds the credential files. Resources already gone are skipped,
+// so an interrupted run can be repeated. The audit log is kept.
+func runDeprovisionCommand(args []string) error {
+	cfg := defaultConfig()
+	thingName := ""
+	certificateID := ""
+	keepThing := false
+
+	fs := flag.NewFlagSet("deprovision", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region the device is registered in")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory holding the device's credentials and identity")
+	fs.StringVar(&thingName, "thing-name", thingName, "Thing to delete (default from the device identity)")
+	fs.StringVar(&certificateID, "certificate-id", certificateID, "Certificate to delete (default from the device identity)")
+	fs.BoolVar(&keepThing, "keep-thing", keepThing, "Only remove the certificate, keeping the thing and its shadow for the refurbished device")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil {
+		return err
+	}
+	if identity != nil {
+		if thingName == "" {
+			thingName = identity.ThingName
+		}
+		if certificateID == "" {
+			certificateID = identity.CertificateID
+		}
+	}
+	if thingName == "" || certificateID == "" {
+		return fmt.Errorf("device is not provisioned, pass -thing-name and -certificate-id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := deleteCertificate(ctx, client, thingName, certificateID); err != nil {
+		return err
+	}
+	if !keepThing {
+		_, err := client.DeleteThing(ctx, &iot.DeleteThingInput{ThingName: aws.String(thingName)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete thing %s: %v", thingName, err)
+		}
+		log.Printf("Deleted thing %s", thingName)
+	}
+
+	recordAudit(cfg, auditEntry{Event: AuditDeprovisioned, CertificateID: certificateID, ThingName: thingName})
+	if err := removeDeviceFiles(cfg); err != nil {
+		return err
+	}
+	fmt.Printf("Deprovisioned %s, certificate %s deleted\n", thingName, certificateID)
+	return nil
+}
+
+// deleteCertificate detaches a certificate's policies and the thing from it,
+// then deactivates and deletes it. An empty thing name is for a certificate
+// no thing is attached to.
+func deleteCertificate(ctx context.Context, client *iot.Client, thingName, certificateID string) error {
+	described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(certificateID)})
+	if isNotFound(err) {
+		log.Printf("Certificate %s is already deleted", certificateID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to describe certificate %s: %v", certificateID, err)
+	}
+	certificateArn := described.CertificateDescription.CertificateArn
+
+	policies := iot.NewListAttachedPoliciesPaginator(client, &iot.ListAttachedPoliciesInput{Target: certificateArn})
+	for policies.HasMorePages() {
+		page, err := policies.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list policies of certificate %s: %v", certificateID, err)
+		}
+		for _, policy := range page.Policies {
+			if _, err := client.DetachPolicy(ctx, &iot.DetachPolicyInput{PolicyName: policy.PolicyName, Target: certificateArn}); err != nil {
+				return fmt.Errorf("failed to detach policy %s: %v", aws.ToString(policy.PolicyName), err)
+			}
+			log.Printf("Detached policy %s", aws.ToString(policy.PolicyName))
+		}
+	}
+
+	if thingName != "" {
+		_, err = client.DetachThingPrincipal(ctx, &iot.DetachThingPrincipalInput{ThingName: aws.String(thingName), Principal: certificateArn})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to detach certificate %s from thing %s: %v", certificateID, thingName, err)
+		}
+	}
+	// Detaching is eventually consistent; deleting too soon fails with a
+	// DeleteConflictException
+	for attempt := 0; attempt < 10; attempt++ {
+		attached, err := client.ListPrincipalThings(ctx, &iot.ListPrincipalThingsInput{Principal: certificateArn})
+		if err != nil {
+			return fmt.Errorf("failed to list things of certificate %s: %v", certificateID, err)
+		}
+		if len(attached.Things) == 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	if described.CertificateDescription.Status != types.CertificateStatusInactive {
+		_, err = client.UpdateCertificate(ctx, &iot.UpdateCertificateInput{CertificateId: aws.String(certificateID), NewStatus: types.CertificateStatusInactive})
+		if err != nil {
+			return fmt.Errorf("failed to deactivate certificate %s: %v", certificateID, err)
+		}
+		log.Printf("Deactivated certificate %s", certificateID)
+	}
+	if _, err := client.DeleteCertificate(ctx, &iot.DeleteCertificateInput{CertificateId: aws.String(certificateID)}); err != nil {
+		return fmt.Errorf("failed to delete certificate %s: %v", certificateID, err)
+	}
+	log.Printf("Deleted certificate %s", certificateID)
+	return nil
+}
+
+// isNotFound reports whether an AWS IoT call failed because the resource does
+// not exist
+func isNotFound(err error) bool {
+	var notFound *types.ResourceNotFoundException
+	return errors.As(err, &notFound)
+}
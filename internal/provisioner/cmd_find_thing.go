@@ -0,0 +1,162 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// Fleet indexing index of things
+const thingsIndex = "AWS_Things"
+
+// runFindThingCommand looks up the things registered for a serial number
+// through fleet indexing, matching the thing name or the attribute the
+// template stores the serial number in, and shows their certificates and
+// connectivity, to reconcile factory records with AWS IoT
+func runFindThingCommand(args []string) error {
+	cfg := defaultConfig()
+	serial := ""
+	attribute := "SerialNumber"
+
+	fs := flag.NewFlagSet("find-thing", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region the device is registered in")
+	fs.StringVar(&serial, "serial", serial, "Serial number of the device")
+	fs.StringVar(&attribute, "serial-attribute", attribute, "Thing attribute the provisioning template stores the serial number in, empty to match the thing name only")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if serial == "" {
+		return fmt.Errorf("-serial is required")
+	}
+	// Quoted in the query, which has no escape for quotes
+	if strings.ContainsAny(serial, `"\`) {
+		return fmt.Errorf("serial number %q cannot be searched for", serial)
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`thingName:"%s"`, serial)
+	if attribute != "" {
+		query += fmt.Sprintf(` OR attributes.%s:"%s"`, attribute, serial)
+	}
+	var things []types.ThingDocument
+	search := &iot.SearchIndexInput{IndexName: aws.String(thingsIndex), QueryString: aws.String(query)}
+	for {
+		page, err := client.SearchIndex(ctx, search)
+		var notReady *types.IndexNotReadyException
+		switch {
+		case isNotFound(err) || errors.As(err, &notReady):
+			return fmt.Errorf("fleet indexing of things is not enabled or not ready in %s: %v (enable it with `aws iot update-indexing-configuration`)", cfg.Region, err)
+		case err != nil:
+			return fmt.Errorf("failed to search fleet index: %v", err)
+		}
+		things = append(things, page.Things...)
+		if page.NextToken == nil {
+			break
+		}
+		search.NextToken = page.NextToken
+	}
+	if len(things) == 0 {
+		return fmt.Errorf("no thing found for serial number %s", serial)
+	}
+
+	for i, thing := range things {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printThing(ctx, client, thing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printThing shows an indexed thing with its certificates and connectivity
+func printThing(ctx context.Context, client *iot.Client, thing types.ThingDocument) error {
+	name := aws.ToString(thing.ThingName)
+	fmt.Printf("Thing name:     %s\n", name)
+	if thing.ThingTypeName != nil {
+		fmt.Printf("Thing type:     %s\n", aws.ToString(thing.ThingTypeName))
+	}
+	if len(thing.ThingGroupNames) > 0 {
+		fmt.Printf("Thing groups:   %s\n", strings.Join(thing.ThingGroupNames, ", "))
+	}
+	names := make([]string, 0, len(thing.Attributes))
+	for attribute := range thing.Attributes {
+		names = append(names, attribute)
+	}
+	slices.Sort(names)
+	for _, attribute := range names {
+		fmt.Printf("Attribute:      %s=%s\n", attribute, thing.Attributes[attribute])
+	}
+
+	// Connectivity is only indexed when the index includes it
+	if c := thing.Connectivity; c != nil && c.Connected != nil {
+		since := ""
+		if c.Timestamp != nil {
+			since = " since " + time.UnixMilli(*c.Timestamp).UTC().Format(time.RFC3339)
+		}
+		if *c.Connected {
+			fmt.Printf("Connectivity:   connected%s\n", since)
+		} else if reason := aws.ToString(c.DisconnectReason); reason != "" {
+			fmt.Printf("Connectivity:   disconnected%s (%s)\n", since, reason)
+		} else {
+			fmt.Printf("Connectivity:   disconnected%s\n", since)
+		}
+	} else {
+		fmt.Println("Connectivity:   not indexed")
+	}
+
+	principals := iot.NewListThingPrincipalsPaginator(client, &iot.ListThingPrincipalsInput{ThingName: thing.ThingName})
+	found := false
+	for principals.HasMorePages() {
+		page, err := principals.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list principals of thing %s: %v", name, err)
+		}
+		for _, principal := range page.Principals {
+			// Certificate ARNs end in cert/<certificate ID>; other principals,
+			// such as Cognito identities, are not shown
+			if !strings.Contains(principal, ":cert/") {
+				continue
+			}
+			found = true
+			id := path.Base(principal)
+			described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(id)})
+			if err != nil {
+				return fmt.Errorf("failed to describe certificate %s: %v", id, err)
+			}
+			description := described.CertificateDescription
+			line := fmt.Sprintf("%s, %s", id, description.Status)
+			if v := description.Validity; v != nil && v.NotAfter != nil {
+				line += ", expires " + v.NotAfter.UTC().Format(time.RFC3339)
+			}
+			if description.CaCertificateId != nil {
+				line += ", issued by CA " + aws.ToString(description.CaCertificateId)
+			}
+			fmt.Printf("Certificate:    %s\n", line)
+		}
+	}
+	if !found {
+		fmt.Println("Certificate:    none attached")
+	}
+	return nil
+}
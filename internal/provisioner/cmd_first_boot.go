@@ -0,0 +1,121 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// runFirstBootCommand brings up a new device in one go, for an init system to
+// run once on boot: it waits for the clock to be set and for the network,
+// provisions the device (or checks that its existing identity still
+// connects), writes the device configuration the template returned, and runs
+// the first-boot hook. It returns nil once the device is ready.
+func runFirstBootCommand(args []string) error {
+	cfg := defaultConfig()
+	timeSyncTimeout := 2 * time.Minute
+	var configFile string
+
+	fs := flag.NewFlagSet("first-boot", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.DurationVar(&timeSyncTimeout, "time-sync-timeout", timeSyncTimeout, "Time to wait for the clock to be synchronized before going on anyway, 0 to not wait")
+	fs.StringVar(&configFile, "device-config-file", "", "Where to write the device configuration returned by the template, defaults to "+deviceConfigFile+" in -output-dir")
+	fs.StringVar(&cfg.Hooks.FirstBoot, "first-boot-hook", cfg.Hooks.FirstBoot, "Shell command run once the device is ready; failing fails first-boot")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if configFile == "" {
+		configFile = cfg.outputPath(deviceConfigFile)
+	}
+
+	// Certificates are checked against the clock, which devices without an
+	// RTC boot with set to the epoch
+	waitForTimeSync(cfg, timeSyncTimeout)
+	waitForNetwork(cfg)
+
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	if state.State == FlowVerified {
+		if err := verifyExistingIdentity(cfg, state); err != nil {
+			return err
+		}
+	}
+	result, err := run(cfg, nil)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(result.DeviceConfiguration, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal device configuration: %v", err)
+	}
+	if err := cfg.Files.write(configFile, append(data, '\n'), holdsSecrets(result.DeviceConfiguration)); err != nil {
+		return fmt.Errorf("failed to write device configuration: %v", err)
+	}
+	log.Printf("Device configuration written to %s", configFile)
+
+	if err := runHook(cfg, cfg.Hooks.FirstBoot, hookInput{Event: HookFirstBoot, Result: result}); err != nil {
+		return err
+	}
+	log.Printf("First boot complete, device is provisioned as %s", result.ThingName)
+	return nil
+}
+
+// waitForTimeSync blocks until the clock is synchronized or timeout passes.
+// Going on with an unsynchronized clock only risks certificate validation
+// failing, so neither a timeout nor being unable to tell stops first-boot.
+func waitForTimeSync(cfg Config, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	clock := cfg.clock()
+	deadline := clock.Now().Add(timeout)
+	for waited := false; ; waited = true {
+		synced, err := clockSynchronized()
+		if err != nil {
+			log.Printf("Warning: not waiting for time sync: %v", err)
+			return
+		}
+		if synced {
+			if waited {
+				log.Println("Clock is synchronized")
+			}
+			return
+		}
+		if clock.Now().After(deadline) {
+			log.Printf("Warning: clock still not synchronized after %s, going on", timeout)
+			return
+		}
+		if !waited {
+			log.Printf("Waiting for time sync, for up to %s", timeout)
+		}
+		sdNotify("STATUS=Waiting for time sync")
+		sleepWithWatchdog(clock, time.Second)
+	}
+}
+
+// verifyExistingIdentity connects with the permanent identity of an already
+// provisioned device, so a device whose certificate was revoked or whose
+// files are damaged fails its first boot instead of coming up unable to connect
+func verifyExistingIdentity(cfg Config, state *provisioningState) error {
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	// Prefer the endpoint that provisioned the device
+	if state.Endpoint != "" {
+		cfg.Endpoints = append([]string{state.Endpoint}, cfg.Endpoints...)
+	}
+	if err := verifyPermanentIdentity(cfg, cert, state.ThingName, nil); err != nil {
+		return fmt.Errorf("device is provisioned as %s but its identity failed to connect: %w", state.ThingName, err)
+	}
+	log.Printf("Verified the existing identity of %s", state.ThingName)
+	return nil
+}
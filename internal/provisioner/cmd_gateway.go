@@ -0,0 +1,83 @@
+package provisioner
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// runGatewayCommand serves the gateway API until the process is stopped. The
+// gateway must already be provisioned; its claim is used for every child.
+func runGatewayCommand(args []string) error {
+	cfg := defaultConfig()
+	address := ":8766"
+	policyFile := ""
+	tokenFile := ""
+	dir := ""
+	tlsCert, tlsKey := "", ""
+
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&address, "listen", address, "Address to serve the gateway API on")
+	fs.StringVar(&policyFile, "gateway-policy", policyFile, "JSON file listing which children may be provisioned")
+	fs.StringVar(&tokenFile, "gateway-token-file", tokenFile, "File with the bearer token children must present, none if empty")
+	fs.StringVar(&dir, "children-dir", dir, "Directory with a subdirectory per child (default children in -output-dir)")
+	fs.StringVar(&tlsCert, "tls-cert", tlsCert, "Server certificate to serve the API over HTTPS with")
+	fs.StringVar(&tlsKey, "tls-key", tlsKey, "Private key of -tls-cert")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.WipeClaim || cfg.Mode != ModeFleet {
+		return fmt.Errorf("the gateway only supports fleet provisioning, without -wipe-claim as every child shares the claim")
+	}
+	if policyFile == "" {
+		return fmt.Errorf("-gateway-policy is required")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	if state.State != FlowVerified {
+		return fmt.Errorf("the gateway is not provisioned yet, provision it before serving children")
+	}
+	policy, err := loadGatewayPolicy(cfg.Files.fs(), policyFile)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = filepath.Join(cfg.OutputDir, "children")
+	}
+
+	g := &gatewayServer{cfg: cfg, dir: dir, policy: policy, tls: tlsCert != ""}
+	if tokenFile != "" {
+		token, err := cfg.Files.fs().ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read gateway token: %v", err)
+		}
+		if g.token = bytes.TrimSpace(token); len(g.token) == 0 {
+			return fmt.Errorf("gateway token file %s is empty", tokenFile)
+		}
+	}
+
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: g.handler(), ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("Serving gateway API for %s on %s", state.ThingName, l.Addr())
+	sdNotify("READY=1\nSTATUS=Serving gateway API")
+	go keepWatchdog()
+	if g.tls {
+		return server.ServeTLS(l, tlsCert, tlsKey)
+	}
+	return server.Serve(l)
+}
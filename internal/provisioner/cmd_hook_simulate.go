@@ -0,0 +1,195 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Payload AWS IoT sends to a template's pre-provisioning hook
+// https://docs.aws.amazon.com/iot/latest/developerguide/pre-provisioning-hook.html
+type hookPayload struct {
+	ClaimCertificateID string            `json:"claimCertificateId"`
+	CertificateID      string            `json:"certificateId"`
+	CertificatePem     string            `json:"certificatePem"`
+	TemplateArn        string            `json:"templateArn"`
+	ClientID           string            `json:"clientId"`
+	Parameters         map[string]string `json:"parameters"`
+}
+
+// Response expected from the pre-provisioning hook
+type hookResponse struct {
+	AllowProvisioning  bool              `json:"allowProvisioning"`
+	ParameterOverrides map[string]string `json:"parameterOverrides,omitempty"`
+}
+
+// runHookSimulateCommand builds the payload AWS IoT would send to the
+// template's pre-provisioning hook for this device and invokes the Lambda
+// function with it, or only prints it, so the hook's allow/deny logic can be
+// checked without provisioning a device
+func runHookSimulateCommand(args []string) error {
+	cfg := defaultConfig()
+	var certFile, function, account string
+	printOnly := false
+	params := map[string]string{}
+
+	fs := flag.NewFlagSet("hook-simulate", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the template")
+	fs.StringVar(&cfg.TemplateName, "template", cfg.TemplateName, "Provisioning template name")
+	fs.StringVar(&cfg.SerialNumber, "serial", cfg.SerialNumber, "Device serial number, passed to the hook as the SerialNumber parameter")
+	fs.StringVar(&cfg.ClaimCertFile, "claim-cert", cfg.ClaimCertFile, "Claim certificate, PEM or base64 encoded PEM; overridden by $CLAIM_CERT")
+	fs.StringVar(&cfg.ClientIDTemplate, "client-id", cfg.ClientIDTemplate, "MQTT client ID template, see -client-id of the provisioner")
+	fs.Func("param", "Additional template parameter as name=value; repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected name=value, got %q", s)
+		}
+		params[name] = value
+		return nil
+	})
+	cfg.registerFactsFlag(fs)
+	fs.StringVar(&certFile, "cert", "", "Device certificate to send; defaults to a throwaway self-signed certificate")
+	fs.StringVar(&function, "function", "", "Lambda function to invoke; defaults to the template's pre-provisioning hook")
+	fs.StringVar(&account, "account", "", "AWS account of the template; defaults to the caller's account")
+	fs.BoolVar(&printOnly, "print", printOnly, "Print the payload instead of invoking the hook")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := validateTemplateName(cfg.TemplateName); err != nil {
+		return err
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	cfg.TemplateParameters = params
+	params = templateParameters(cfg)
+
+	claimPEM, err := readSecret(cfg.Files.fs(), envClaimCert, cfg.ClaimCertFile)
+	if err != nil {
+		return err
+	}
+	claimCert, err := parseCertificatePEM(claimPEM.data)
+	if err != nil {
+		return fmt.Errorf("failed to parse claim certificate: %v", err)
+	}
+
+	var certPEM []byte
+	if certFile != "" {
+		if certPEM, err = cfg.Files.fs().ReadFile(certFile); err != nil {
+			return fmt.Errorf("failed to read device certificate: %v", err)
+		}
+	} else if certPEM, err = throwawayCertificate(); err != nil {
+		return err
+	}
+	deviceCert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+
+	clientID, err := renderClientID(cfg.ClientIDTemplate, cfg.SerialNumber, cfg.random())
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var awsCfg aws.Config
+	if !printOnly || account == "" {
+		if awsCfg, err = loadAWSConfig(ctx, cfg); err != nil {
+			return err
+		}
+	}
+	if account == "" {
+		if account, err = accountID(ctx, sts.NewFromConfig(awsCfg)); err != nil {
+			return err
+		}
+	}
+
+	payload := hookPayload{
+		ClaimCertificateID: certificateID(claimCert),
+		CertificateID:      certificateID(deviceCert),
+		CertificatePem:     string(certPEM),
+		TemplateArn:        fmt.Sprintf("arn:%s:iot:%s:%s:provisioningtemplate/%s", cfg.partition().ID, cfg.Region, account, cfg.TemplateName),
+		ClientID:           clientID,
+		Parameters:         params,
+	}
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook payload: %v", err)
+	}
+	if printOnly {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if function == "" {
+		described, err := iot.NewFromConfig(awsCfg).DescribeProvisioningTemplate(ctx, &iot.DescribeProvisioningTemplateInput{TemplateName: aws.String(cfg.TemplateName)})
+		if err != nil {
+			return fmt.Errorf("failed to describe template %s: %v", cfg.TemplateName, err)
+		}
+		if described.PreProvisioningHook == nil {
+			return fmt.Errorf("template %s has no pre-provisioning hook, pass -function", cfg.TemplateName)
+		}
+		function = aws.ToString(described.PreProvisioningHook.TargetArn)
+	}
+
+	invoked, err := lambda.NewFromConfig(awsCfg).Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(function),
+		Payload:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to invoke %s: %v", function, err)
+	}
+	if invoked.FunctionError != nil {
+		return fmt.Errorf("hook %s failed (%s): %s", function, aws.ToString(invoked.FunctionError), invoked.Payload)
+	}
+
+	var response hookResponse
+	if err := json.Unmarshal(invoked.Payload, &response); err != nil {
+		return fmt.Errorf("hook %s returned an invalid response %s: %v", function, invoked.Payload, err)
+	}
+	if !response.AllowProvisioning {
+		return fmt.Errorf("✗ hook %s denied provisioning of %s", function, cfg.SerialNumber)
+	}
+	fmt.Printf("✓ Hook %s allowed provisioning of %s\n", function, cfg.SerialNumber)
+	for name, value := range response.ParameterOverrides {
+		fmt.Printf("  %s overridden with %q\n", name, value)
+	}
+	return nil
+}
+
+// throwawayCertificate creates a self-signed certificate standing in for the
+// one AWS IoT would issue to the device
+func throwawayCertificate() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "AWS IoT Certificate"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
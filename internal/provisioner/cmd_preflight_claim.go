@@ -0,0 +1,287 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+)
+
+// Outcome of one claim's smoke test
+type claimPreflight struct {
+	Claim         string        `json:"claim"`                   // Bundle file, or the claim certificate
+	CertificateID string        `json:"certificateId,omitempty"` // Of the claim
+	Serial        string        `json:"serial"`
+	ThingName     string        `json:"thingName,omitempty"`
+	Passed        bool          `json:"passed"`
+	Checks        []canaryCheck `json:"checks"`
+	ErrorCode     ErrorCode     `json:"errorCode,omitempty"` // Of the step that failed
+	DurationMS    int64         `json:"durationMs"`
+}
+
+// Outcome of preflight-claim, written to -report
+type claimPreflightReport struct {
+	Time     time.Time        `json:"time"`
+	Template string           `json:"template"`
+	Passed   bool             `json:"passed"`
+	Claims   []claimPreflight `json:"claims"`
+}
+
+// runPreflightClaimCommand smoke tests a batch of claims before they are
+// flashed into devices: with each, it connects to AWS IoT, creates a
+// certificate and registers a disposable thing with a sandbox template, then
+// deletes both through the SDK. A claim that is revoked, lacks its policy, or
+// is not allowed the template fails here rather than on thousands of units.
+// It returns an error if any claim failed or anything was left behind.
+func runPreflightClaimCommand(args []string) error {
+	cfg := defaultConfig()
+	prefix := "preflight-"
+	reportFile := ""
+
+	fs := flag.NewFlagSet("preflight-claim", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&prefix, "serial-prefix", prefix, "Prefix of the serial numbers the claims register with, followed by the time and a random suffix")
+	fs.StringVar(&reportFile, "report", reportFile, "File to write the outcome to as JSON")
+	fs.Parse(args)
+
+	cfg = cfg.withRandom()
+	serial := func() string {
+		return prefix + time.Now().UTC().Format("20060102T150405") + "-" + randomHex(cfg.random(), 3)
+	}
+	cfg.SerialNumber = serial()
+	cfg.SerialSource = SerialFlag
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	switch {
+	case cfg.Mode != ModeFleet:
+		return fmt.Errorf("preflight-claim needs -mode %s", ModeFleet)
+	case cfg.WipeClaim:
+		return fmt.Errorf("-wipe-claim would shred the claims being checked")
+	case cfg.ClaimBundleURL != "":
+		return fmt.Errorf("preflight-claim checks claim files, download the bundle and pass it instead of -claim-bundle-url")
+	}
+
+	// The batch: bundles given as arguments, else those in -claim-dir, else
+	// -claim-cert and -claim-key
+	fsys := cfg.Files.fs()
+	bundles := fs.Args()
+	if len(bundles) == 0 && cfg.ClaimDir != "" {
+		entries, err := fsys.ReadDir(cfg.ClaimDir)
+		if err != nil {
+			return fmt.Errorf("failed to list claim bundles: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".pem") {
+				bundles = append(bundles, filepath.Join(cfg.ClaimDir, entry.Name()))
+			}
+		}
+		if len(bundles) == 0 {
+			return fmt.Errorf("no claim bundles in %s", cfg.ClaimDir)
+		}
+	}
+	var csr []byte
+	if cfg.CSRFile != "" {
+		var err error
+		if csr, err = readCSR(fsys, cfg.CSRFile); err != nil {
+			return err
+		}
+	}
+
+	// Fail before anything is created if it could not be removed
+	ctx := context.Background()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	report := claimPreflightReport{Time: time.Now().UTC(), Template: cfg.TemplateName, Passed: true}
+	for i := 0; i < max(len(bundles), 1); i++ {
+		cfg.SerialNumber = serial()
+		var result claimPreflight
+		if len(bundles) == 0 {
+			name := newSecret(fsys, envClaimCert, cfg.ClaimCertFile).source
+			result = preflightClaim(ctx, cfg, client, csr, name, func() (claimCandidate, error) {
+				return loadClaimFiles(cfg)
+			})
+		} else {
+			bundle := newSecret(fsys, "", bundles[i])
+			result = preflightClaim(ctx, cfg, client, csr, bundle.source, func() (claimCandidate, error) {
+				return loadClaimCandidate(bundle, secret{}, cfg.clock().Now())
+			})
+		}
+		report.Claims = append(report.Claims, result)
+		report.Passed = report.Passed && result.Passed
+	}
+
+	if reportFile != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = cfg.Files.write(reportFile, append(data, '\n'), false)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write preflight report: %v", err)
+		}
+	}
+	failed := 0
+	for _, result := range report.Claims {
+		if !result.Passed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("✗ %d of %d claims failed with template %s", failed, len(report.Claims), cfg.TemplateName)
+	}
+	fmt.Printf("✓ %d claims passed with template %s\n", len(report.Claims), cfg.TemplateName)
+	return nil
+}
+
+// loadClaimFiles reads and checks the claim of -claim-cert and -claim-key, or
+// of CLAIM_CERT and CLAIM_KEY
+func loadClaimFiles(cfg Config) (claimCandidate, error) {
+	fsys := cfg.Files.fs()
+	cert := newSecret(fsys, envClaimCert, cfg.ClaimCertFile)
+	key := newSecret(fsys, envClaimKey, cfg.ClaimKeyFile)
+	if err := cert.read(); err != nil {
+		return claimCandidate{}, fmt.Errorf("failed to read claim certificate: %v", err)
+	}
+	if err := key.read(); err != nil {
+		return claimCandidate{}, fmt.Errorf("failed to read claim private key: %v", err)
+	}
+	err := cert.open(cfg)
+	if err == nil {
+		err = key.open(cfg)
+	}
+	if err == nil {
+		err = key.resolve(cfg, cert)
+	}
+	if err == nil {
+		err = validateClaimCredentials(cert, key, secret{}, cfg.clock().Now())
+	}
+	if err != nil {
+		clear(key.data)
+		return claimCandidate{}, err
+	}
+	leaf, _ := parseCertificatePEM(cert.data)
+	return claimCandidate{cert: cert, key: key, leaf: leaf, id: certificateID(leaf)}, nil
+}
+
+// preflightClaim provisions a disposable thing with the claim named claim,
+// which load returns, and deprovisions it, printing each step as it is checked
+func preflightClaim(ctx context.Context, cfg Config, client *iot.Client, csr []byte, claim string, load func() (claimCandidate, error)) (result claimPreflight) {
+	started := time.Now()
+	result = claimPreflight{Claim: claim, Serial: cfg.SerialNumber}
+	pass := func(name, detail string, args ...interface{}) {
+		c := canaryCheck{Name: name, Passed: true, Detail: fmt.Sprintf(detail, args...)}
+		result.Checks = append(result.Checks, c)
+		fmt.Printf("  ✓ %s: %s\n", c.Name, c.Detail)
+	}
+	fail := func(name string, err error) {
+		if result.ErrorCode == "" {
+			result.ErrorCode = ErrorCodeOf(err)
+		}
+		c := canaryCheck{Name: name, Detail: fmt.Sprintf("[%s] %v", ErrorCodeOf(err), err)}
+		result.Checks = append(result.Checks, c)
+		fmt.Printf("  ✗ %s: %s\n", c.Name, c.Detail)
+	}
+	defer func() {
+		result.Passed = true
+		for _, c := range result.Checks {
+			result.Passed = result.Passed && c.Passed
+		}
+		result.DurationMS = time.Since(started).Milliseconds()
+	}()
+
+	fmt.Printf("Claim %s, serial %s\n", result.Claim, result.Serial)
+	candidate, err := load()
+	if err != nil {
+		fail("claim", withCode(ErrorCredentialsUnusable, err))
+		return result
+	}
+	defer clear(candidate.key.data)
+	result.CertificateID = candidate.id
+	pass("claim", "certificate %s, valid until %s", candidate.id, candidate.leaf.NotAfter.Format(time.RFC3339))
+
+	clientID, err := renderClientID(cfg.ClientIDTemplate, cfg.SerialNumber, cfg.random())
+	if err != nil {
+		fail("connect", err)
+		return result
+	}
+	cert, err := keyPair(candidate.cert, candidate.key)
+	if err != nil {
+		fail("connect", fmt.Errorf("failed to load claim certificates: %v", err))
+		return result
+	}
+	defer zeroPrivateKey(&cert)
+	connectStarted := time.Now()
+	transport, err := connectTransport(cfg, cert, clientID)
+	if err != nil {
+		if claimRefused(err) {
+			err = fmt.Errorf("AWS IoT refused the claim, which is revoked, inactive, or has no policy allowing the client ID: %w", err)
+		}
+		fail("connect", err)
+		return result
+	}
+	pass("connect", "connected to %s as %s in %s", transport.Endpoint(), clientID, time.Since(connectStarted).Round(time.Millisecond))
+
+	session := newProvisioningSession(transport, cfg)
+	certResponse, err := session.createCertificate(csr)
+	certResponse.PrivateKey.zero()
+	if err != nil {
+		fail("create certificate", err)
+	} else {
+		pass("create certificate", "certificate %s", certResponse.CertificateID)
+		params := templateParameters(cfg)
+		registerResponse, err := session.registerThingWithRetry(certResponse, params, cfg.RegisterRetry)
+		if err != nil {
+			fail("register", err)
+		} else {
+			// The response of the request that registered the certificate
+			// was lost, see claimAndRegister
+			result.ThingName = registerResponse.ThingName
+			if result.ThingName == "" {
+				result.ThingName = params[cfg.ConflictParam]
+			}
+			pass("register", "registered as %s with template %s", result.ThingName, cfg.TemplateName)
+		}
+	}
+	session.close()
+	transport.Disconnect(cfg.DisconnectQuiesce)
+
+	if certResponse.CertificateID != "" {
+		if err := preflightDeprovision(ctx, client, result.ThingName, certResponse.CertificateID); err != nil {
+			fail("deprovision", err)
+		} else if result.ThingName != "" {
+			pass("deprovision", "%s and certificate %s deleted", result.ThingName, certResponse.CertificateID)
+		} else {
+			pass("deprovision", "certificate %s deleted", certResponse.CertificateID)
+		}
+	}
+	return result
+}
+
+// preflightDeprovision deletes the certificate a claim created and the thing
+// it was registered as, if it was
+func preflightDeprovision(ctx context.Context, client *iot.Client, thingName, certificateID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	if err := deleteCertificate(ctx, client, thingName, certificateID); err != nil {
+		return err
+	}
+	if thingName == "" {
+		return nil
+	}
+	_, err := client.DeleteThing(ctx, &iot.DeleteThingInput{ThingName: aws.String(thingName)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete thing %s: %v", thingName, err)
+	}
+	return nil
+}
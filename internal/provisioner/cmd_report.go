@@ -0,0 +1,384 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats of the report command
+const (
+	ReportMarkdown = "markdown"
+	ReportHTML     = "html"
+)
+
+// Summary of the records of bulk runs, for a manufacturing batch record
+type fleetReport struct {
+	Title     string
+	Generated time.Time
+	Sources   []string
+	Attempts  int
+	Succeeded int // Devices whose last attempt succeeded
+	FirstPass int // Devices that succeeded on their first attempt
+	Repeated  int // Devices already provisioned when last attempted
+	Devices   []reportDevice
+	Targets   []reportTarget     // Devices by target, when onboarded to more than one
+	Errors    []reportErrorCount // Of all failed attempts, most frequent first
+	Latencies []reportLatency    // Of the attempts that provisioned a device
+}
+
+// A device of the report, as its last attempt left it
+type reportDevice struct {
+	Serial        string
+	Target        string
+	ThingName     string
+	CertificateID string
+	Attempts      int
+	Duration      time.Duration
+	Repeat        bool
+	Error         string
+}
+
+// Devices of the report onboarded to one target, see stationTarget
+type reportTarget struct {
+	Name                         string
+	Devices, Succeeded, Repeated int
+}
+
+// Failed is the number of the target's devices not provisioned
+func (t reportTarget) Failed() int { return t.Devices - t.Succeeded }
+
+type reportErrorCount struct {
+	Class string
+	Count int
+}
+
+type reportLatency struct {
+	Name               string
+	Count              int
+	P50, P90, P99, Max time.Duration
+}
+
+// Failed reports whether the device is not provisioned
+func (d reportDevice) Failed() bool { return d.Error != "" }
+
+// SuccessRate is the percentage of devices provisioned
+func (r *fleetReport) SuccessRate() float64 { return r.rate(r.Succeeded) }
+
+// FirstPassYield is the percentage of devices provisioned on the first attempt
+func (r *fleetReport) FirstPassYield() float64 { return r.rate(r.FirstPass) }
+
+// Failed is the number of devices not provisioned
+func (r *fleetReport) Failed() int { return len(r.Devices) - r.Succeeded }
+
+func (r *fleetReport) rate(n int) float64 {
+	if len(r.Devices) == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(len(r.Devices))
+}
+
+// runReportCommand summarizes the logs of station and simulate runs, or of
+// any tool writing the same records, into a report to attach to a batch
+// record: success rate and first-pass yield, failures by kind of error,
+// latency percentiles, and a table of the devices.
+func runReportCommand(args []string) error {
+	format := ReportMarkdown
+	title := "Fleet onboarding report"
+	out := "-"
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.StringVar(&format, "format", format, "Report format: markdown or html")
+	fs.StringVar(&title, "title", title, "Title of the report, such as the batch number")
+	fs.StringVar(&out, "report-file", out, "Where to write the report, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s report [flags] station.jsonl...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no logs to report on: give the station.jsonl or simulate.jsonl files")
+	}
+	if format != ReportMarkdown && format != ReportHTML {
+		return fmt.Errorf("unsupported report format %q: use %s or %s", format, ReportMarkdown, ReportHTML)
+	}
+	var records []stationRecord
+	for _, path := range fs.Args() {
+		read, err := readStationRecords(path)
+		if err != nil {
+			return err
+		}
+		records = append(records, read...)
+	}
+	report := newFleetReport(title, fs.Args(), records)
+
+	var buf bytes.Buffer
+	if format == ReportHTML {
+		if err := reportPage.Execute(&buf, report); err != nil {
+			return fmt.Errorf("failed to render report: %v", err)
+		}
+	} else {
+		writeMarkdownReport(&buf, report)
+	}
+	if out == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(out, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Report on %d devices written to %s\n", len(report.Devices), out)
+	return nil
+}
+
+// readStationRecords reads a log of one JSON record per line
+func readStationRecords(path string) ([]stationRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %v", err)
+	}
+	defer f.Close()
+
+	var records []stationRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record stationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d is not a valid record: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return records, nil
+}
+
+// newFleetReport summarizes records in the order they were made. A device
+// attempted more than once is reported as its last attempt left it.
+func newFleetReport(title string, sources []string, records []stationRecord) *fleetReport {
+	report := &fleetReport{Title: title, Generated: time.Now().UTC(), Sources: sources, Attempts: len(records)}
+	slices.SortStableFunc(records, func(a, b stationRecord) int { return a.Time.Compare(b.Time) })
+
+	devices := map[string]*reportDevice{}
+	failures := map[string]int{}
+	latencies := map[string][]time.Duration{}
+	for _, record := range records {
+		device := devices[record.Serial]
+		if device == nil {
+			device = &reportDevice{Serial: record.Serial}
+			devices[record.Serial] = device
+		}
+		device.Attempts++
+		device.Target = record.Target
+		device.Duration = time.Duration(record.DurationMS) * time.Millisecond
+		device.Repeat = record.Repeat
+		device.Error = record.Error
+		if record.Error != "" {
+			class := record.ErrorClass
+			if class == "" {
+				class = record.Error
+			}
+			failures[class]++
+			continue
+		}
+		device.ThingName = record.ThingName
+		device.CertificateID = record.CertificateID
+		if device.Attempts == 1 {
+			report.FirstPass++
+		}
+		if record.Repeat {
+			continue
+		}
+		latencies["total"] = append(latencies["total"], device.Duration)
+		if l := record.Latencies; l != nil {
+			for name, ms := range l.byName() {
+				latencies[name] = append(latencies[name], time.Duration(ms)*time.Millisecond)
+			}
+		}
+	}
+
+	for _, device := range devices {
+		if !device.Failed() {
+			report.Succeeded++
+			if device.Repeat {
+				report.Repeated++
+			}
+		}
+		report.Devices = append(report.Devices, *device)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].Serial < report.Devices[j].Serial })
+
+	targets := map[string]*reportTarget{}
+	for _, device := range report.Devices {
+		target := targets[device.Target]
+		if target == nil {
+			target = &reportTarget{Name: device.Target}
+			targets[device.Target] = target
+		}
+		target.Devices++
+		if !device.Failed() {
+			target.Succeeded++
+			if device.Repeat {
+				target.Repeated++
+			}
+		}
+	}
+	if len(targets) > 1 {
+		for _, target := range targets {
+			report.Targets = append(report.Targets, *target)
+		}
+		sort.Slice(report.Targets, func(i, j int) bool { return report.Targets[i].Name < report.Targets[j].Name })
+	}
+
+	for class, count := range failures {
+		report.Errors = append(report.Errors, reportErrorCount{Class: class, Count: count})
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		if report.Errors[i].Count != report.Errors[j].Count {
+			return report.Errors[i].Count > report.Errors[j].Count
+		}
+		return report.Errors[i].Class < report.Errors[j].Class
+	})
+
+	for _, name := range append([]string{"total"}, latencyNames...) {
+		durations := latencies[name]
+		if len(durations) == 0 {
+			continue
+		}
+		slices.Sort(durations)
+		report.Latencies = append(report.Latencies, reportLatency{
+			Name:  name,
+			Count: len(durations),
+			P50:   percentile(durations, 0.5).Round(time.Millisecond),
+			P90:   percentile(durations, 0.9).Round(time.Millisecond),
+			P99:   percentile(durations, 0.99).Round(time.Millisecond),
+			Max:   durations[len(durations)-1].Round(time.Millisecond),
+		})
+	}
+	return report
+}
+
+// writeMarkdownReport writes the report as GitHub flavoured Markdown
+func writeMarkdownReport(w io.Writer, r *fleetReport) {
+	fmt.Fprintf(w, "# %s\n\n", markdownCell(r.Title))
+	fmt.Fprintf(w, "Generated %s from %s.\n\n", r.Generated.Format(time.RFC3339), markdownCell(strings.Join(r.Sources, ", ")))
+
+	fmt.Fprintf(w, "## Summary\n\n")
+	fmt.Fprintf(w, "| | |\n| --- | --- |\n")
+	fmt.Fprintf(w, "| Devices | %d |\n", len(r.Devices))
+	fmt.Fprintf(w, "| Attempts | %d |\n", r.Attempts)
+	fmt.Fprintf(w, "| Provisioned | %d (%.1f%%) |\n", r.Succeeded, r.SuccessRate())
+	fmt.Fprintf(w, "| First-pass yield | %d (%.1f%%) |\n", r.FirstPass, r.FirstPassYield())
+	fmt.Fprintf(w, "| Already provisioned | %d |\n", r.Repeated)
+	fmt.Fprintf(w, "| Failed | %d |\n\n", r.Failed())
+
+	if len(r.Targets) > 0 {
+		fmt.Fprintf(w, "## Targets\n\n| Target | Devices | Provisioned | Already provisioned | Failed |\n| --- | ---: | ---: | ---: | ---: |\n")
+		for _, t := range r.Targets {
+			fmt.Fprintf(w, "| %s | %d | %d | %d | %d |\n", markdownCell(t.Name), t.Devices, t.Succeeded, t.Repeated, t.Failed())
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(w, "## Errors\n\n| Attempts | Error |\n| ---: | --- |\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(w, "| %d | %s |\n", e.Count, markdownCell(e.Class))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(w, "## Latency\n\n| | Count | p50 | p90 | p99 | Max |\n| --- | ---: | ---: | ---: | ---: | ---: |\n")
+		for _, l := range r.Latencies {
+			fmt.Fprintf(w, "| %s | %d | %s | %s | %s | %s |\n", l.Name, l.Count, l.P50, l.P90, l.P99, l.Max)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "## Devices\n\n| Serial | Result | Thing | Certificate | Attempts | Duration |\n| --- | --- | --- | --- | ---: | ---: |\n")
+	for _, d := range r.Devices {
+		result := "✓ provisioned"
+		switch {
+		case d.Failed():
+			result = "✗ " + d.Error
+		case d.Repeat:
+			result = "✓ already provisioned"
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s | %d | %s |\n", markdownCell(d.Serial), markdownCell(result),
+			markdownCell(d.ThingName), markdownCell(d.CertificateID), d.Attempts, d.Duration)
+	}
+}
+
+// markdownCell escapes text for a Markdown table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+var reportPage = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+td.n { text-align: right; }
+tr.failed td { background: #fdecea; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02T15:04:05Z07:00"}} from {{range $i, $s := .Sources}}{{if $i}}, {{end}}{{$s}}{{end}}.</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Devices</th><td class="n">{{len .Devices}}</td></tr>
+<tr><th>Attempts</th><td class="n">{{.Attempts}}</td></tr>
+<tr><th>Provisioned</th><td class="n">{{.Succeeded}} ({{printf "%.1f" .SuccessRate}}%)</td></tr>
+<tr><th>First-pass yield</th><td class="n">{{.FirstPass}} ({{printf "%.1f" .FirstPassYield}}%)</td></tr>
+<tr><th>Already provisioned</th><td class="n">{{.Repeated}}</td></tr>
+<tr><th>Failed</th><td class="n">{{.Failed}}</td></tr>
+</table>
+{{if .Targets}}
+<h2>Targets</h2>
+<table>
+<tr><th>Target</th><th>Devices</th><th>Provisioned</th><th>Already provisioned</th><th>Failed</th></tr>
+{{range .Targets}}<tr><td>{{.Name}}</td><td class="n">{{.Devices}}</td><td class="n">{{.Succeeded}}</td><td class="n">{{.Repeated}}</td><td class="n">{{.Failed}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Errors}}
+<h2>Errors</h2>
+<table>
+<tr><th>Attempts</th><th>Error</th></tr>
+{{range .Errors}}<tr><td class="n">{{.Count}}</td><td>{{.Class}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Latencies}}
+<h2>Latency</h2>
+<table>
+<tr><th></th><th>Count</th><th>p50</th><th>p90</th><th>p99</th><th>Max</th></tr>
+{{range .Latencies}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td><td class="n">{{.P50}}</td><td class="n">{{.P90}}</td><td class="n">{{.P99}}</td><td class="n">{{.Max}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Devices</h2>
+<table>
+<tr><th>Serial</th><th>Result</th><th>Thing</th><th>Certificate</th><th>Attempts</th><th>Duration</th></tr>
+{{range .Devices}}<tr{{if .Failed}} class="failed"{{end}}><td>{{.Serial}}</td><td>{{if .Failed}}✗ {{.Error}}{{else if .Repeat}}✓ already provisioned{{else}}✓ provisioned{{end}}</td><td>{{.ThingName}}</td><td>{{.CertificateID}}</td><td class="n">{{.Attempts}}</td><td class="n">{{.Duration}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,145 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Bundle rma export writes, by default in the output directory
+const rmaBundleFile = "rma-bundle.json"
+
+// Version of the RMA bundle format
+const rmaBundleVersion = 1
+
+// Provisioning state of a device being replaced, carried to the replacement
+// unit. The private key is left out when it is bound to the old unit's
+// hardware, and the replacement is then issued a certificate of its own.
+type rmaBundle struct {
+	Version             int                    `json:"version"`
+	ExportedAt          time.Time              `json:"exportedAt"`
+	Identity            DeviceIdentity         `json:"identity"`
+	Product             string                 `json:"product,omitempty"`
+	Target              string                 `json:"target,omitempty"`
+	CertificateArn      string                 `json:"certificateArn,omitempty"`
+	DeviceConfiguration map[string]interface{} `json:"deviceConfiguration,omitempty"`
+	CertificatePem      string                 `json:"certificatePem"`
+	PrivateKey          keyMaterial            `json:"privateKey,omitempty"`
+}
+
+// runRMACommand moves a device's provisioning to a replacement unit: rma
+// export on the unit being returned, rma import for the unit replacing it
+func runRMACommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: rma export|import [flags]")
+	}
+	switch args[0] {
+	case "export":
+		return runRMAExportCommand(args[1:])
+	case "import":
+		return runRMAImportCommand(args[1:])
+	}
+	return fmt.Errorf("usage: rma export|import [flags]")
+}
+
+// runRMAExportCommand writes the provisioning state of a verified device to a
+// bundle for rma import. It only reads the output directory, so the unit can
+// keep running until it is swapped.
+func runRMAExportCommand(args []string) error {
+	cfg := defaultConfig()
+	bundlePath := ""
+	hardwareBound := false
+
+	fs := flag.NewFlagSet("rma export", flag.ExitOnError)
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory holding the device's credentials and identity")
+	fs.StringVar(&bundlePath, "bundle", bundlePath, "Where to write the bundle (default rma-bundle.json in the output directory)")
+	fs.BoolVar(&hardwareBound, "hardware-bound", hardwareBound, "Leave out the private key, which is bound to this unit's hardware")
+	fs.Parse(args)
+
+	if bundlePath == "" {
+		bundlePath = cfg.outputPath(rmaBundleFile)
+	}
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return fmt.Errorf("device is not provisioned, nothing to export")
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	if state.State != FlowVerified {
+		return fmt.Errorf("device is %s, finish provisioning before exporting it", state.State)
+	}
+	certPEM, err := cfg.Files.fs().ReadFile(cfg.outputPath(permanentCertFile))
+	if err != nil {
+		return fmt.Errorf("failed to read permanent certificate: %v", err)
+	}
+	if fingerprint := certificateFingerprint(certPEM); identity.CertificateFingerprint != "" && fingerprint != identity.CertificateFingerprint {
+		return fmt.Errorf("permanent certificate is not the one recorded in %s", identityFile)
+	}
+
+	bundle := rmaBundle{
+		Version:             rmaBundleVersion,
+		ExportedAt:          time.Now().UTC(),
+		Identity:            *identity,
+		Product:             state.Product,
+		Target:              state.Target,
+		CertificateArn:      state.CertificateArn,
+		DeviceConfiguration: state.DeviceConfiguration,
+		CertificatePem:      string(certPEM),
+	}
+	// A key made by csr export may not be readable, or only be a handle to a
+	// secure element; without it the bundle is only good for a new certificate
+	if !hardwareBound {
+		key, err := cfg.Files.fs().ReadFile(cfg.outputPath(permanentKeyFile))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("failed to read permanent private key: %v", err)
+		default:
+			bundle.PrivateKey = keyMaterial(key)
+			defer bundle.PrivateKey.zero()
+		}
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal RMA bundle: %v", err)
+	}
+	if err := cfg.Files.write(bundlePath, data, len(bundle.PrivateKey) > 0); err != nil {
+		return fmt.Errorf("failed to write RMA bundle: %v", err)
+	}
+	fmt.Printf("Exported %s to %s\n", identity.ThingName, bundlePath)
+	if len(bundle.PrivateKey) == 0 {
+		fmt.Println("The private key is not included, rma import issues the replacement a new certificate")
+	}
+	return nil
+}
+
+// readRMABundle reads and checks a bundle written by rma export
+func readRMABundle(fsys FileSystem, path string) (*rmaBundle, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RMA bundle: %v", err)
+	}
+	var bundle rmaBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse RMA bundle %s: %v", path, err)
+	}
+	if bundle.DeviceConfiguration, err = decodeDeviceConfiguration(jsonCodec{}, data); err != nil {
+		return nil, fmt.Errorf("failed to parse RMA bundle %s: %v", path, err)
+	}
+	if bundle.Version != rmaBundleVersion {
+		return nil, fmt.Errorf("RMA bundle %s has unsupported version %d", path, bundle.Version)
+	}
+	if bundle.Identity.ThingName == "" || bundle.Identity.CertificateID == "" {
+		return nil, fmt.Errorf("RMA bundle %s has no thing or certificate", path)
+	}
+	return &bundle, nil
+}
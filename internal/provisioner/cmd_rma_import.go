@@ -0,0 +1,216 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// runRMAImportCommand rebinds the thing of an exported device to its
+// replacement unit. Unless -reuse-certificate carries the old credentials
+// over, it issues a certificate for the replacement, from its CSR if the key
+// must not leave it, attaches the old certificate's policies and the thing to
+// it, and retires the old certificate, which left the fleet with the returned
+// unit. The output directory is left registered, so the next run verifies the
+// identity from the replacement.
+func runRMAImportCommand(args []string) error {
+	cfg := defaultConfig()
+	bundlePath := ""
+	serial := ""
+	policies := ""
+	reuse := false
+	keepOld := false
+
+	fs := flag.NewFlagSet("rma import", flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region the device is registered in")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory for the replacement's credentials and identity")
+	fs.StringVar(&bundlePath, "bundle", bundlePath, "Bundle written by rma export (default rma-bundle.json in the output directory)")
+	fs.StringVar(&serial, "serial", serial, "Serial number of the replacement unit (default the exported device's)")
+	fs.StringVar(&cfg.CSRFile, "csr-file", cfg.CSRFile, "Issue the certificate for this CSR from csr export on the replacement, which keeps the key")
+	fs.StringVar(&policies, "policy", policies, "Comma-separated policies to attach when the old certificate is gone (default the old certificate's)")
+	fs.BoolVar(&reuse, "reuse-certificate", reuse, "Install the exported certificate and key instead of issuing a new certificate")
+	fs.BoolVar(&keepOld, "keep-old-certificate", keepOld, "Leave the old certificate attached and active, to retire it later with deprovision")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	if bundlePath == "" {
+		bundlePath = cfg.outputPath(rmaBundleFile)
+	}
+	bundle, err := readRMABundle(cfg.Files.fs(), bundlePath)
+	if err != nil {
+		return err
+	}
+	defer bundle.PrivateKey.zero()
+	if reuse && (cfg.CSRFile != "" || len(bundle.PrivateKey) == 0) {
+		return fmt.Errorf("-reuse-certificate needs the private key in the bundle and no -csr-file")
+	}
+	var csr []byte
+	if cfg.CSRFile != "" {
+		if csr, err = readCSR(cfg.Files.fs(), cfg.CSRFile); err != nil {
+			return err
+		}
+	}
+
+	if cfg.OutputDir != "" {
+		if err := cfg.Files.fs().MkdirAll(cfg.OutputDir, 0700); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+	if err := checkDestination(cfg.Files.fs(), cfg.OutputDir); err != nil {
+		return err
+	}
+	if existing, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("output directory already holds %s, deprovision it first", existing.ThingName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	thingName := bundle.Identity.ThingName
+	oldID := bundle.Identity.CertificateID
+	if _, err := client.DescribeThing(ctx, &iot.DescribeThingInput{ThingName: aws.String(thingName)}); err != nil {
+		return fmt.Errorf("thing %s not found in AWS IoT: %v", thingName, err)
+	}
+	old, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(oldID)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to describe certificate %s: %v", oldID, err)
+	}
+	oldFound := err == nil
+
+	certID, certArn, certPEM := oldID, bundle.CertificateArn, bundle.CertificatePem
+	key := bundle.PrivateKey
+	if reuse {
+		if !oldFound || old.CertificateDescription.Status != types.CertificateStatusActive {
+			return fmt.Errorf("certificate %s is not active in AWS IoT, import with a new certificate", oldID)
+		}
+		certArn = aws.ToString(old.CertificateDescription.CertificateArn)
+	} else {
+		policyNames, err := rmaPolicies(ctx, client, old, policies)
+		if err != nil {
+			return err
+		}
+		if csr != nil {
+			created, err := client.CreateCertificateFromCsr(ctx, &iot.CreateCertificateFromCsrInput{CertificateSigningRequest: aws.String(string(csr)), SetAsActive: true})
+			if err != nil {
+				return fmt.Errorf("failed to create certificate from CSR: %v", err)
+			}
+			certID, certArn, certPEM = aws.ToString(created.CertificateId), aws.ToString(created.CertificateArn), aws.ToString(created.CertificatePem)
+			key = nil
+		} else {
+			created, err := client.CreateKeysAndCertificate(ctx, &iot.CreateKeysAndCertificateInput{SetAsActive: true})
+			if err != nil {
+				return fmt.Errorf("failed to create certificate: %v", err)
+			}
+			certID, certArn, certPEM = aws.ToString(created.CertificateId), aws.ToString(created.CertificateArn), aws.ToString(created.CertificatePem)
+			key = keyMaterial(aws.ToString(created.KeyPair.PrivateKey))
+			defer key.zero()
+		}
+		log.Printf("Created certificate %s for the replacement", certID)
+		for _, name := range policyNames {
+			if _, err := client.AttachPolicy(ctx, &iot.AttachPolicyInput{PolicyName: aws.String(name), Target: aws.String(certArn)}); err != nil {
+				return fmt.Errorf("failed to attach policy %s to certificate %s: %v", name, certID, err)
+			}
+			log.Printf("Attached policy %s", name)
+		}
+	}
+	if _, err := client.AttachThingPrincipal(ctx, &iot.AttachThingPrincipalInput{ThingName: aws.String(thingName), Principal: aws.String(certArn)}); err != nil {
+		return fmt.Errorf("failed to attach certificate %s to thing %s: %v", certID, thingName, err)
+	}
+	log.Printf("Attached certificate %s to thing %s", certID, thingName)
+
+	if err := cfg.Files.write(cfg.outputPath(permanentCertFile), []byte(certPEM), false); err != nil {
+		return fmt.Errorf("failed to write permanent certificate to file: %v", err)
+	}
+	// The replacement that made the CSR already holds its key
+	if len(key) > 0 {
+		if err := cfg.Files.write(cfg.outputPath(permanentKeyFile), key, true); err != nil {
+			return fmt.Errorf("failed to write permanent private key to file: %v", err)
+		}
+	}
+	if err := writeChain(cfg, []byte(certPEM), key); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	identity := bundle.Identity
+	if serial != "" {
+		identity.Serial = serial
+	}
+	identity.CertificateID = certID
+	identity.CertificateFingerprint = certificateFingerprint([]byte(certPEM))
+	identity.CertificateNotAfter = certificateNotAfter([]byte(certPEM))
+	identity.ProvisionedAt = time.Now().UTC()
+	if err := saveIdentity(cfg.outputPath(identityFile), identity, cfg.Files); err != nil {
+		return err
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	state.CertificateID = certID
+	state.CertificateArn = certArn
+	state.ThingName = thingName
+	state.Endpoint = identity.Endpoint
+	state.Product = bundle.Product
+	state.Target = bundle.Target
+	state.DeviceConfiguration = bundle.DeviceConfiguration
+	if err := state.transition(FlowRegistered); err != nil {
+		return err
+	}
+
+	if !reuse && oldFound && !keepOld {
+		if err := deleteCertificate(ctx, client, thingName, oldID); err != nil {
+			return fmt.Errorf("replacement is imported, but the old certificate was not retired: %v", err)
+		}
+	}
+	recordAudit(cfg, auditEntry{Event: AuditDeviceReplaced, CertificateID: certID, ThingName: thingName})
+	fmt.Printf("Imported %s with certificate %s, run the provisioner on the replacement to verify it\n", thingName, certID)
+	return nil
+}
+
+// rmaPolicies returns the policies to attach to the replacement's
+// certificate: those of the old certificate, or the -policy list when it is
+// gone
+func rmaPolicies(ctx context.Context, client *iot.Client, old *iot.DescribeCertificateOutput, policies string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(policies, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if old != nil {
+		pages := iot.NewListAttachedPoliciesPaginator(client, &iot.ListAttachedPoliciesInput{Target: old.CertificateDescription.CertificateArn})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list policies of certificate %s: %v", aws.ToString(old.CertificateDescription.CertificateId), err)
+			}
+			for _, policy := range page.Policies {
+				if name := aws.ToString(policy.PolicyName); !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no policies to attach to the replacement's certificate, pass -policy")
+	}
+	return names, nil
+}
@@ -0,0 +1,134 @@
+package provisioner
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// runServeCommand runs the local API until the process is stopped
+func runServeCommand(args []string) error {
+	cfg := defaultConfig()
+	address := "127.0.0.1:8765"
+	grpcAddress := ""
+	watchInterval := time.Duration(0)
+	rotateBefore := time.Duration(0)
+	heartbeat := Heartbeat{Interval: time.Minute}
+	maxWedges := 0
+	var notifySinks []string
+	notifyAfter := 3
+	notifyExpiry := 72 * time.Hour
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&address, "listen", address, "Address to serve the local API on: host:port, or unix:/path/to/socket")
+	fs.StringVar(&grpcAddress, "grpc-listen", grpcAddress, "Unix socket to serve the gRPC API on (unix:/path/to/socket), disabled if empty")
+	fs.DurationVar(&watchInterval, "watch-credentials", watchInterval, "Check the device credentials this often and provision again with the claim if they are lost or damaged, 0 disables")
+	fs.DurationVar(&rotateBefore, "rotate-before", rotateBefore, "Rotate the device certificate this long before it expires, or halfway through its validity if that is shorter, 0 disables")
+	fs.StringVar(&heartbeat.Topic, "heartbeat-topic", heartbeat.Topic, "Topic to publish a heartbeat to while provisioned, with the -complete-topic placeholders, such as fleet/heartbeat/{thingName}; disabled if empty")
+	fs.DurationVar(&heartbeat.Interval, "heartbeat-interval", heartbeat.Interval, "Time between heartbeats")
+	fs.StringVar(&heartbeat.PayloadTemplate, "heartbeat-payload", heartbeat.PayloadTemplate, "File with the payload template of -heartbeat-topic, replacing the default JSON document")
+	fs.IntVar(&maxWedges, "max-wedges", maxWedges, "Exit after this many MQTT clients in a row are found wedged, for the service manager to restart the process; 0 never exits")
+	fs.Func("notify", "Sink to send alerts of expiring certificates and repeated failures to, as slack=<webhook URL>, pagerduty=<routing key>, sns=<topic ARN>, or webhook=<URL>; repeatable", func(s string) error {
+		notifySinks = append(notifySinks, s)
+		return nil
+	})
+	fs.IntVar(&notifyAfter, "notify-after", notifyAfter, "Alert once this many operations in a row failed, 0 disables")
+	fs.DurationVar(&notifyExpiry, "notify-expiry", notifyExpiry, "Alert when the device certificate expires within this time, or a quarter of its validity if that is shorter; less than -rotate-before. 0 disables")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	// Provisioning again needs the claim
+	if watchInterval > 0 && cfg.WipeClaim {
+		return fmt.Errorf("-watch-credentials cannot provision again after -wipe-claim")
+	}
+	if watchInterval < 0 {
+		return fmt.Errorf("-watch-credentials must not be negative")
+	}
+	if rotateBefore < 0 {
+		return fmt.Errorf("-rotate-before must not be negative")
+	}
+	if maxWedges < 0 {
+		return fmt.Errorf("-max-wedges must not be negative")
+	}
+	if notifyAfter < 0 {
+		return fmt.Errorf("-notify-after must not be negative")
+	}
+	if notifyExpiry < 0 {
+		return fmt.Errorf("-notify-expiry must not be negative")
+	}
+	// Otherwise every rotation would be preceded by an alert
+	if len(notifySinks)+len(cfg.Notifiers) > 0 && rotateBefore > 0 && notifyExpiry >= rotateBefore {
+		return fmt.Errorf("-notify-expiry must be less than -rotate-before")
+	}
+	notifiers := cfg.Notifiers
+	for _, sink := range notifySinks {
+		notifier, err := parseNotifier(cfg, sink)
+		if err != nil {
+			return fmt.Errorf("invalid -notify: %v", err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	// Checked up front, as serve may not provision until much later
+	if err := checkWritable(cfg.withRandom()); err != nil {
+		return err
+	}
+
+	api := newAPIServer(cfg)
+	api.alerts = newAlerter(api.cfg, notifiers)
+	api.alertAfter = notifyAfter
+	if heartbeat.Topic != "" {
+		heartbeats, err := newHeartbeatPublisher(api.cfg, heartbeat)
+		if err != nil {
+			return err
+		}
+		api.heartbeats = heartbeats
+	} else if heartbeat.PayloadTemplate != "" {
+		return fmt.Errorf("-heartbeat-payload needs -heartbeat-topic")
+	}
+	errs := make(chan error, 3)
+	api.cfg.wedges.onWedge = func(consecutive int64) {
+		sdNotify("STATUS=MQTT client wedged, connecting again")
+		if maxWedges > 0 && consecutive >= int64(maxWedges) {
+			select {
+			case errs <- fmt.Errorf("%d MQTT clients in a row wedged, exiting to be restarted", consecutive):
+			default:
+			}
+		}
+	}
+
+	if grpcAddress != "" {
+		if err := serveGRPC(api, grpcAddress, errs); err != nil {
+			return err
+		}
+	}
+
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving local provisioning API on %s", l.Addr())
+	go func() { errs <- http.Serve(l, api.handler()) }()
+	sdNotify("READY=1\nSTATUS=Serving local provisioning API")
+	go keepWatchdog()
+	if watchInterval > 0 {
+		go api.watchCredentials(watchInterval)
+	}
+	if rotateBefore > 0 {
+		go api.rotateBeforeExpiry(rotateBefore)
+	}
+	if api.heartbeats != nil {
+		go api.publishHeartbeats()
+	}
+	if api.alerts != nil && notifyExpiry > 0 {
+		go api.watchExpiry(notifyExpiry)
+	}
+
+	// Either server stopping, or -max-wedges, ends the command
+	return <-errs
+}
@@ -0,0 +1,258 @@
+package provisioner
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome of one simulated device
+type simulatedRun struct {
+	record    stationRecord // For the simulation log, see runReportCommand
+	duration  time.Duration
+	stages    []StageTiming
+	latencies *Latencies
+	err       error
+}
+
+// runSimulateCommand provisions a number of fake devices against a test
+// endpoint for capacity planning. Each device gets its own serial number,
+// client ID, and output directory, and runs the full flow including
+// verification. Devices are started at a fixed rate; the latency percentiles
+// and error distribution are reported at the end.
+func runSimulateCommand(args []string) error {
+	cfg := defaultConfig()
+	devices := 10
+	rate := 1.0
+	concurrency := 50
+	prefix := "sim-"
+	dir := ""
+	pool := true
+	dnsTTL := time.Minute
+
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.IntVar(&devices, "devices", devices, "Number of devices to provision")
+	fs.Float64Var(&rate, "rate", rate, "Devices started per second")
+	fs.IntVar(&concurrency, "concurrency", concurrency, "Most devices provisioning at the same time")
+	fs.StringVar(&prefix, "serial-prefix", prefix, "Prefix of the simulated serial numbers, followed by the device number")
+	fs.StringVar(&dir, "simulate-dir", dir, "Directory for the devices' output directories (default a temporary directory)")
+	fs.BoolVar(&pool, "pool", pool, "Share TLS sessions and DNS lookups between the devices")
+	fs.DurationVar(&dnsTTL, "pool-dns-ttl", dnsTTL, "Time the addresses of an endpoint are reused for with -pool")
+	fs.Parse(args)
+
+	if devices <= 0 || rate <= 0 || concurrency <= 0 {
+		return fmt.Errorf("devices, rate, and concurrency must be positive")
+	}
+	cfg.SerialNumber = prefix + "0"
+	cfg.SerialSource = SerialFlag
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "claim-simulate-"); err != nil {
+			return fmt.Errorf("failed to create simulation directory: %v", err)
+		}
+	}
+	// Hooks and the health file belong to a real device
+	cfg.Hooks = Hooks{}
+	cfg.HealthFile = ""
+	cfg.RetryForever = false
+	if pool {
+		cfg.Pool = NewConnectionPool(concurrency, dnsTTL)
+	}
+
+	fmt.Printf("Provisioning %d devices at %g/s into %s\n", devices, rate, dir)
+	runs := make([]simulatedRun, devices)
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range devices {
+		if i > 0 {
+			<-ticker.C
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			deviceCfg := cfg
+			deviceCfg.SerialNumber = fmt.Sprintf("%s%d", prefix, i)
+			deviceCfg.OutputDir = filepath.Join(dir, deviceCfg.SerialNumber)
+			// Each device draws its own sequence, whichever order they run in
+			if cfg.RandomSeed != 0 {
+				deviceCfg.RandomSeed = cfg.RandomSeed + uint64(i)
+			}
+			began := time.Now()
+			result, err := runOnce(deviceCfg, nil)
+			runs[i] = simulatedRun{duration: time.Since(began), err: err}
+			runs[i].record = stationRecord{Time: began.UTC(), Serial: deviceCfg.SerialNumber, DurationMS: runs[i].duration.Milliseconds()}
+			if err != nil {
+				runs[i].record.Error = err.Error()
+				runs[i].record.ErrorClass = errorClass(err)
+			}
+			if result != nil {
+				runs[i].stages = result.Stages
+				runs[i].latencies = result.Latencies
+				runs[i].record.ThingName = result.ThingName
+				runs[i].record.CertificateID = result.CertificateID
+				runs[i].record.Latencies = result.Latencies
+			}
+		}()
+	}
+	wg.Wait()
+
+	printSimulationReport(runs, time.Since(start), cfg.Pool)
+	if err := writeSimulationLog(cfg, filepath.Join(dir, "simulate.jsonl"), runs); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// writeSimulationLog writes a record of every simulated device, in the
+// format of the station log, for the report command
+func writeSimulationLog(cfg Config, path string, runs []simulatedRun) error {
+	var data bytes.Buffer
+	for _, run := range runs {
+		if err := appendStationRecord(&data, run.record); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Files.write(path, data.Bytes(), false); err != nil {
+		return fmt.Errorf("failed to write simulation log: %v", err)
+	}
+	return nil
+}
+
+// printSimulationReport prints the latency percentiles of successful runs,
+// overall and per stage, how many runs failed with each kind of error, and
+// what the pool, if any, saved
+func printSimulationReport(runs []simulatedRun, elapsed time.Duration, pool *ConnectionPool) {
+	var total []time.Duration
+	stages := map[Stage][]time.Duration{}
+	var stageOrder []Stage
+	latencies := map[string][]time.Duration{}
+	failures := map[string]int{}
+	for _, run := range runs {
+		if run.err != nil {
+			failures[errorClass(run.err)]++
+			continue
+		}
+		total = append(total, run.duration)
+		for _, timing := range run.stages {
+			if _, ok := stages[timing.Stage]; !ok {
+				stageOrder = append(stageOrder, timing.Stage)
+			}
+			stages[timing.Stage] = append(stages[timing.Stage], time.Duration(timing.DurationMS)*time.Millisecond)
+		}
+		if l := run.latencies; l != nil {
+			for name, ms := range l.byName() {
+				latencies[name] = append(latencies[name], time.Duration(ms)*time.Millisecond)
+			}
+		}
+	}
+
+	fmt.Printf("\n%d devices in %s: %d succeeded, %d failed\n", len(runs), elapsed.Round(time.Millisecond), len(total), len(runs)-len(total))
+	if pool != nil {
+		stats := pool.Stats()
+		fmt.Printf("Pool: %d of %d TLS handshakes resumed a session, %d DNS lookups\n", stats.Resumed, stats.Handshakes, stats.Lookups)
+	}
+	if len(total) > 0 {
+		fmt.Printf("\n%-20s %10s %10s %10s %10s\n", "Latency", "p50", "p90", "p99", "max")
+		printPercentiles("total", total)
+		for _, stage := range stageOrder {
+			printPercentiles(string(stage), stages[stage])
+		}
+		for _, name := range latencyNames {
+			if len(latencies[name]) > 0 {
+				printPercentiles(name, latencies[name])
+			}
+		}
+	}
+	if len(failures) > 0 {
+		classes := make([]string, 0, len(failures))
+		for class := range failures {
+			classes = append(classes, class)
+		}
+		// Most frequent first
+		sort.Slice(classes, func(i, j int) bool {
+			if failures[classes[i]] != failures[classes[j]] {
+				return failures[classes[i]] > failures[classes[j]]
+			}
+			return classes[i] < classes[j]
+		})
+		fmt.Printf("\nErrors\n")
+		for _, class := range classes {
+			fmt.Printf("%6d  %s\n", failures[class], class)
+		}
+	}
+}
+
+// Names of the latencies in reports, in the order of the flow
+var latencyNames = []string{"tls-connect", "subscribe", "create-certificate-rt", "register-thing-rt", "persist"}
+
+// byName returns the latencies in milliseconds by their names in reports
+func (l Latencies) byName() map[string]int64 {
+	return map[string]int64{
+		"tls-connect":           l.TLSConnectMS,
+		"subscribe":             l.SubscribeMS,
+		"create-certificate-rt": l.CreateCertificateMS,
+		"register-thing-rt":     l.RegisterThingMS,
+		"persist":               l.PersistMS,
+	}
+}
+
+// printPercentiles prints one row of the latency table
+func printPercentiles(name string, durations []time.Duration) {
+	slices.Sort(durations)
+	fmt.Printf("%-20s %10s %10s %10s %10s\n", name,
+		percentile(durations, 0.5).Round(time.Millisecond), percentile(durations, 0.9).Round(time.Millisecond),
+		percentile(durations, 0.99).Round(time.Millisecond), durations[len(durations)-1].Round(time.Millisecond))
+}
+
+// percentile returns the p (0 to 1) percentile of sorted durations
+func percentile(durations []time.Duration, p float64) time.Duration {
+	return durations[int(p*float64(len(durations)-1))]
+}
+
+// errorClass groups errors for the error distribution: rejections by error
+// code, refused connections by reason code, and other errors by the step that
+// failed and their class
+func errorClass(err error) string {
+	var conflict *ThingNameConflictError
+	var rejection *RejectedError
+	var reasonErr *ReasonCodeError
+	var quarantined *QuarantineError
+	var lockedOut *LockoutError
+	var postStepErr *PostStepError
+	switch {
+	case errors.As(err, &conflict):
+		return "thing name conflict"
+	case errors.As(err, &rejection):
+		return fmt.Sprintf("%s rejected: %d %s", rejection.Op, rejection.StatusCode, rejection.ErrorCode)
+	case errors.As(err, &reasonErr):
+		return fmt.Sprintf("%s refused: reason code 0x%02X (%s)", reasonErr.Op, reasonErr.ReasonCode, reasonCodeName(reasonErr.ReasonCode))
+	case errors.As(err, &quarantined):
+		return "quarantined"
+	case errors.As(err, &lockedOut):
+		return "locked out"
+	case errors.As(err, &postStepErr):
+		return "post steps failed"
+	}
+	// Keep the outermost context, which names the failed step
+	step, _, _ := strings.Cut(err.Error(), ": ")
+	return fmt.Sprintf("%s (%s)", step, ClassifyError(err))
+}
@@ -0,0 +1,345 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+)
+
+// Record of one soak iteration, appended to the soak log
+type soakRecord struct {
+	Time         time.Time `json:"time"`
+	Iteration    int       `json:"iteration"`
+	Serial       string    `json:"serial"`
+	ThingName    string    `json:"thingName,omitempty"`
+	Certificates []string  `json:"certificates,omitempty"` // Issued in the iteration, provisioned first
+	Orphans      []string  `json:"orphans,omitempty"`      // Things and certificates left behind by deprovisioning
+	DurationMS   int64     `json:"durationMs"`
+	Error        string    `json:"error,omitempty"`
+	Goroutines   int       `json:"goroutines"`
+	OpenFiles    int       `json:"openFiles"` // -1 where they cannot be counted
+	HeapBytes    uint64    `json:"heapBytes"`
+}
+
+// runSoakCommand qualifies a release for long-running devices: against a test
+// account, it repeatedly provisions a device, rotates and verifies its
+// certificate, and deprovisions it, checking that nothing is left behind in
+// AWS IoT and that goroutines and open files do not grow from one iteration
+// to the next. Failed iterations are deprovisioned too. It returns an error
+// if any iteration failed or leaked.
+func runSoakCommand(args []string) error {
+	cfg := defaultConfig()
+	iterations := 0
+	duration := time.Duration(0)
+	interval := time.Minute
+	rotations := 1
+	prefix := "soak-"
+	dir := "soak"
+	maxGoroutines := 20
+	maxOpenFiles := 10
+
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.IntVar(&iterations, "iterations", iterations, "Iterations to run, 0 to run until -soak-duration has passed or the soak is interrupted")
+	fs.DurationVar(&duration, "soak-duration", duration, "Stop starting iterations after this long, 0 for no limit")
+	fs.DurationVar(&interval, "soak-interval", interval, "Time from the start of one iteration to the start of the next")
+	fs.IntVar(&rotations, "rotations", rotations, "Certificate rotations per iteration, each verified with the new certificate")
+	fs.StringVar(&prefix, "serial-prefix", prefix, "Prefix of the devices' serial numbers, followed by the iteration number")
+	fs.StringVar(&dir, "soak-dir", dir, "Directory for the device credentials, the audit log, and the soak log")
+	fs.IntVar(&maxGoroutines, "max-goroutine-growth", maxGoroutines, "Goroutines the process may gain after the first iteration before the soak fails")
+	fs.IntVar(&maxOpenFiles, "max-open-file-growth", maxOpenFiles, "Open files the process may gain after the first iteration before the soak fails")
+	fs.Parse(args)
+
+	if iterations < 0 || duration < 0 || interval < 0 || rotations < 0 || maxGoroutines < 0 || maxOpenFiles < 0 {
+		return fmt.Errorf("soak iterations, durations, rotations, and growth limits must not be negative")
+	}
+	cfg.SerialNumber = prefix + "1"
+	cfg.SerialSource = SerialFlag
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	// Rotation registers the new certificate through the template
+	if cfg.Mode != ModeFleet {
+		return fmt.Errorf("soak needs -mode %s", ModeFleet)
+	}
+	if cfg.WipeClaim {
+		return fmt.Errorf("-wipe-claim would leave the soak without a claim after the first iteration")
+	}
+	// The soak provisions on behalf of test devices: hooks, health, and
+	// start-up behaviour belong to a real one
+	cfg.Hooks = Hooks{}
+	cfg.HealthFile = ""
+	cfg.RetryForever = false
+	cfg.WaitNetwork = false
+	cfg.StartupJitter = 0
+	cfg.OutputDir = dir
+	if err := cfg.Files.fs().MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create soak directory: %v", err)
+	}
+
+	// Fail before the first device is provisioned if it could not be removed
+	ctx := context.Background()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	soakLog, err := cfg.Files.fs().OpenFile(filepath.Join(dir, "soak.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, cfg.Files.Mode)
+	if err != nil {
+		return fmt.Errorf("failed to open soak log: %v", err)
+	}
+	defer soakLog.Close()
+
+	// An interrupted soak finishes its iteration, so it leaves nothing behind
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	fmt.Printf("Soaking into %s, one iteration every %s (interrupt to stop)\n", dir, interval)
+	var baseline, last soakRecord
+	failed, orphaned := 0, 0
+	started := time.Now()
+	stopped := false
+	for i := 1; !stopped && (iterations == 0 || i <= iterations); i++ {
+		began := time.Now()
+		record := soakIteration(ctx, cfg, client, i, prefix+fmt.Sprint(i), rotations)
+		if i == 1 {
+			baseline = record
+		}
+		last = record
+		orphaned += len(record.Orphans)
+		usage := fmt.Sprintf("goroutines %d, open files %s, heap %.1f MiB", record.Goroutines, countString(record.OpenFiles), float64(record.HeapBytes)/(1<<20))
+		switch {
+		case record.Error != "":
+			failed++
+			fmt.Printf("✗ Iteration %d failed: %s [%s]\n", i, record.Error, usage)
+		case len(record.Orphans) > 0:
+			fmt.Printf("✗ Iteration %d left %s behind [%s]\n", i, strings.Join(record.Orphans, ", "), usage)
+		default:
+			fmt.Printf("✓ Iteration %d: %s provisioned, rotated %d times, and deprovisioned in %s [%s]\n", i, record.ThingName, rotations, time.Duration(record.DurationMS)*time.Millisecond, usage)
+		}
+		if err := appendSoakRecord(soakLog, record); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+
+		if duration > 0 && time.Since(started) >= duration {
+			break
+		}
+		if iterations != 0 && i == iterations {
+			break
+		}
+		select {
+		case <-stop:
+			stopped = true
+		case <-time.After(time.Until(began.Add(interval))):
+		}
+	}
+
+	goroutines := last.Goroutines - baseline.Goroutines
+	fmt.Printf("\nSoak stopped after %d iterations in %s: %d failed, %d resources left behind\n", last.Iteration, time.Since(started).Round(time.Second), failed, orphaned)
+	fmt.Printf("Growth since the first iteration: %+d goroutines, %s open files, %+.1f MiB heap\n", goroutines, growthString(baseline.OpenFiles, last.OpenFiles), (float64(last.HeapBytes)-float64(baseline.HeapBytes))/(1<<20))
+	var problems []string
+	if failed > 0 {
+		problems = append(problems, fmt.Sprintf("%d iterations failed", failed))
+	}
+	if orphaned > 0 {
+		problems = append(problems, fmt.Sprintf("%d resources left behind", orphaned))
+	}
+	if goroutines > maxGoroutines {
+		problems = append(problems, fmt.Sprintf("goroutines grew by %d", goroutines))
+	}
+	if baseline.OpenFiles >= 0 && last.OpenFiles-baseline.OpenFiles > maxOpenFiles {
+		problems = append(problems, fmt.Sprintf("open files grew by %d", last.OpenFiles-baseline.OpenFiles))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("✗ soak failed: %s", strings.Join(problems, ", "))
+	}
+	fmt.Println("✓ Soak passed")
+	return nil
+}
+
+// soakIteration provisions the device with serial, rotates its certificate
+// rotations times, verifying each new one, and deprovisions it, then samples
+// the resources the process holds
+func soakIteration(ctx context.Context, cfg Config, client *iot.Client, iteration int, serial string, rotations int) soakRecord {
+	began := time.Now()
+	record := soakRecord{Time: began.UTC(), Iteration: iteration, Serial: serial}
+	cfg.SerialNumber = serial
+
+	err := func() error {
+		result, err := runOnce(cfg, nil)
+		if err != nil {
+			return err
+		}
+		record.ThingName = result.ThingName
+		record.Certificates = append(record.Certificates, result.CertificateID)
+		for range rotations {
+			if err := rotateCertificate(cfg, nil); err != nil {
+				return fmt.Errorf("rotation failed: %w", err)
+			}
+			identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+			if err != nil {
+				return err
+			}
+			record.Certificates = append(record.Certificates, identity.CertificateID)
+			if err := soakVerify(cfg, record.ThingName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	// A run that failed after registering only left the thing in its state
+	if record.ThingName == "" {
+		if state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); err == nil {
+			record.ThingName = state.ThingName
+			if state.CertificateID != "" {
+				record.Certificates = append(record.Certificates, state.CertificateID)
+			}
+		}
+	}
+	if err := soakDeprovision(ctx, cfg, client, &record); err != nil && record.Error == "" {
+		record.Error = err.Error()
+	}
+	record.DurationMS = time.Since(began).Milliseconds()
+
+	// Garbage is not a leak, and exited goroutines are gone once collected
+	runtime.GC()
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	record.Goroutines = runtime.NumGoroutine()
+	record.OpenFiles = openFiles()
+	record.HeapBytes = memory.HeapInuse
+	return record
+}
+
+// soakVerify connects with the rotated certificate and gets the thing's
+// shadow with it
+func soakVerify(cfg Config, thingName string) error {
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load rotated certificate: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	var shadowErr error
+	if err := verifyPermanentIdentity(cfg, cert, thingName, func(transport Transport) {
+		// The transport is disconnected by the caller
+		_, shadowErr = newProvisioningSession(transport, cfg).getShadow(thingName)
+	}); err != nil {
+		return fmt.Errorf("rotated certificate cannot connect: %w", err)
+	}
+	if shadowErr != nil {
+		return fmt.Errorf("rotated certificate cannot get the shadow: %w", shadowErr)
+	}
+	return nil
+}
+
+// soakDeprovision deletes the iteration's certificates, including any
+// attached to its thing that a failed rotation registered, and the thing,
+// records what is still there afterwards as orphans, and removes the device
+// files
+func soakDeprovision(ctx context.Context, cfg Config, client *iot.Client, record *soakRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	if record.ThingName != "" {
+		principals := iot.NewListThingPrincipalsPaginator(client, &iot.ListThingPrincipalsInput{ThingName: aws.String(record.ThingName)})
+		for principals.HasMorePages() {
+			page, err := principals.NextPage(ctx)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list principals of thing %s: %v", record.ThingName, err)
+			}
+			for _, principal := range page.Principals {
+				if id := path.Base(principal); strings.Contains(principal, ":cert/") && !slices.Contains(record.Certificates, id) {
+					record.Certificates = append(record.Certificates, id)
+				}
+			}
+		}
+		for _, id := range record.Certificates {
+			if err := deleteCertificate(ctx, client, record.ThingName, id); err != nil {
+				return err
+			}
+		}
+		_, err := client.DeleteThing(ctx, &iot.DeleteThingInput{ThingName: aws.String(record.ThingName)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete thing %s: %v", record.ThingName, err)
+		}
+
+		for _, id := range record.Certificates {
+			_, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(id)})
+			if err == nil {
+				record.Orphans = append(record.Orphans, "certificate "+id)
+			} else if !isNotFound(err) {
+				return fmt.Errorf("failed to check certificate %s was deleted: %v", id, err)
+			}
+		}
+		_, err = client.DescribeThing(ctx, &iot.DescribeThingInput{ThingName: aws.String(record.ThingName)})
+		if err == nil {
+			record.Orphans = append(record.Orphans, "thing "+record.ThingName)
+		} else if !isNotFound(err) {
+			return fmt.Errorf("failed to check thing %s was deleted: %v", record.ThingName, err)
+		}
+	}
+	return removeDeviceFiles(cfg)
+}
+
+// openFiles counts the file descriptors the process has open, or returns -1
+// where /proc is not available
+func openFiles() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// Less the descriptor reading the directory
+	return len(entries) - 1
+}
+
+// countString formats a count that is -1 when unknown
+func countString(n int) string {
+	if n < 0 {
+		return "n/a"
+	}
+	return fmt.Sprint(n)
+}
+
+// growthString formats the growth between two counts that are -1 when
+// unknown
+func growthString(from, to int) string {
+	if from < 0 || to < 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+d", to-from)
+}
+
+// appendSoakRecord appends a record to the soak log, one JSON document per
+// line
+func appendSoakRecord(w io.Writer, record soakRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal soak record: %v", err)
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write soak log: %v", err)
+	}
+	return nil
+}
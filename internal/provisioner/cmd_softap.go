@@ -0,0 +1,194 @@
+//go:build !nosoftap
+
+package provisioner
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Commands that start and stop the hotspot. The start command gets the network
+// name and password in $AP_SSID and $AP_PASSPHRASE (empty for an open network).
+const (
+	defaultAPStartCommand = `nmcli device wifi hotspot con-name provision-hotspot ssid "$AP_SSID" ${AP_PASSPHRASE:+password "$AP_PASSPHRASE"}`
+	defaultAPStopCommand  = `nmcli connection down provision-hotspot`
+)
+
+// Hotspot the device serves the onboarding portal on
+type accessPoint struct {
+	ssid, passphrase          string
+	startCommand, stopCommand string
+}
+
+// runSoftAPCommand onboards a headless device from a browser. The device
+// starts a Wi-Fi hotspot with a captive portal collecting the network
+// credentials, the serial number and template, and optionally the claim
+// credentials. It then joins the network and provisions, streaming the
+// progress to the browser, until the device is provisioned.
+func runSoftAPCommand(args []string) error {
+	cfg := defaultConfig()
+	ap := accessPoint{startCommand: defaultAPStartCommand, stopCommand: defaultAPStopCommand}
+	wifiCommand := defaultWiFiCommand
+	listenAddress := ":80"
+	portalAddress := "10.42.0.1"
+	dnsAddress := ":53"
+	keepAP := false
+
+	fs := flag.NewFlagSet("softap", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&ap.ssid, "ap-ssid", ap.ssid, "Name of the hotspot (default Provision-<serial>)")
+	fs.StringVar(&ap.passphrase, "ap-passphrase", ap.passphrase, "Password of the hotspot, open if empty")
+	fs.StringVar(&ap.startCommand, "ap-start-command", ap.startCommand, "Command that starts the hotspot named $AP_SSID with $AP_PASSPHRASE")
+	fs.StringVar(&ap.stopCommand, "ap-stop-command", ap.stopCommand, "Command that stops the hotspot")
+	fs.BoolVar(&keepAP, "ap-keep", keepAP, "Keep the hotspot up while joining the network, for radios that can be an access point and a client at once")
+	fs.StringVar(&wifiCommand, "wifi-command", wifiCommand, "Command that joins the Wi-Fi network in $WIFI_SSID with $WIFI_PASSPHRASE")
+	fs.StringVar(&listenAddress, "portal-listen", listenAddress, "Address to serve the portal on")
+	fs.StringVar(&portalAddress, "portal-address", portalAddress, "IPv4 address of the device on the hotspot")
+	fs.StringVar(&dnsAddress, "dns-listen", dnsAddress, "Address to answer DNS queries with the portal address on, disabled if empty")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if ap.ssid == "" {
+		ap.ssid = "Provision-" + cfg.SerialNumber
+	}
+	if ap.passphrase != "" && len(ap.passphrase) < 8 {
+		return fmt.Errorf("-ap-passphrase must be at least 8 characters")
+	}
+	address := net.ParseIP(portalAddress).To4()
+	if address == nil {
+		return fmt.Errorf("-portal-address %q is not an IPv4 address", portalAddress)
+	}
+	if state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); err == nil && state.State == FlowVerified {
+		log.Printf("Device is already provisioned as %s", state.ThingName)
+		return nil
+	}
+
+	l, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to serve portal: %v", err)
+	}
+	defer l.Close()
+	url := "http://" + address.String() + "/"
+	if port := l.Addr().(*net.TCPAddr).Port; port != 80 {
+		url = "http://" + net.JoinHostPort(address.String(), strconv.Itoa(port)) + "/"
+	}
+	if dnsAddress != "" {
+		// The system may already run a DNS server for the hotspot; the portal
+		// then has to be opened by hand
+		if conn, err := net.ListenPacket("udp", dnsAddress); err != nil {
+			log.Printf("Warning: failed to serve captive portal DNS: %v, browsers must open %s themselves", err, url)
+		} else {
+			defer conn.Close()
+			go serveCaptiveDNS(conn, address)
+		}
+	}
+
+	if err := ap.start(); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	running := false
+	done := make(chan *ProvisioningResult, 1)
+	feed := newStatusFeed()
+	feed.publish(onboardingStatus{Stage: onboardingWaiting})
+	progress := func(stage Stage, message string) {
+		feed.publish(onboardingStatus{Stage: string(stage), Message: message})
+	}
+	p := &portal{cfg: cfg, url: url, feed: feed}
+	p.start = func(request onboardingRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if running {
+			return errBusy
+		}
+		running = true
+		feed.restart()
+		go func() {
+			defer request.zero()
+			if request.SSID != "" && !keepAP {
+				// Give the browser time to load the progress page
+				time.Sleep(2 * time.Second)
+				if err := ap.stop(); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+			result, err := onboard(cfg, wifiCommand, request, progress)
+			if err != nil {
+				log.Printf("SoftAP onboarding failed: %v", err)
+				feed.publish(onboardingStatus{Stage: onboardingFailed, Message: err.Error()})
+				// Bring the hotspot back so the settings can be corrected
+				if request.SSID != "" && !keepAP {
+					if err := ap.start(); err != nil {
+						log.Printf("Warning: %v", err)
+					}
+				}
+				mu.Lock()
+				running = false
+				mu.Unlock()
+				return
+			}
+			feed.publish(onboardingStatus{Stage: string(StageComplete), ThingName: result.ThingName})
+			done <- result
+		}()
+		return nil
+	}
+
+	server := &http.Server{Handler: p.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(l)
+	log.Printf("Serving onboarding portal on %s over hotspot %s", url, ap.ssid)
+	sdNotify("STATUS=Waiting for SoftAP onboarding")
+	go keepWatchdog()
+
+	result := <-done
+	if keepAP {
+		// Let the browser show the result before the hotspot goes away
+		time.Sleep(5 * time.Second)
+		if err := ap.stop(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	server.Close()
+	fmt.Printf("Provisioned as %s\n", result.ThingName)
+	return nil
+}
+
+// start brings the hotspot up
+func (ap accessPoint) start() error {
+	log.Printf("Starting hotspot %s", ap.ssid)
+	if err := ap.run(ap.startCommand); err != nil {
+		return fmt.Errorf("failed to start hotspot %s: %v", ap.ssid, err)
+	}
+	return nil
+}
+
+// stop takes the hotspot down
+func (ap accessPoint) stop() error {
+	log.Printf("Stopping hotspot %s", ap.ssid)
+	if err := ap.run(ap.stopCommand); err != nil {
+		return fmt.Errorf("failed to stop hotspot %s: %v", ap.ssid, err)
+	}
+	return nil
+}
+
+// run runs a hotspot command through /bin/sh
+func (ap accessPoint) run(command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wifiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), "AP_SSID="+ap.ssid, "AP_PASSPHRASE="+ap.passphrase)
+	return cmd.Run()
+}
@@ -0,0 +1,322 @@
+package provisioner
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Record of one scanned device, appended to the station log
+type stationRecord struct {
+	Time          time.Time         `json:"time"`
+	Serial        string            `json:"serial"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+	Target        string            `json:"target,omitempty"` // From -targets, else the endpoint, see stationTarget
+	ThingName     string            `json:"thingName,omitempty"`
+	CertificateID string            `json:"certificateId,omitempty"`
+	Repeat        bool              `json:"repeat,omitempty"` // Already provisioned when scanned
+	DurationMS    int64             `json:"durationMs"`
+	Latencies     *Latencies        `json:"latencies,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	ErrorClass    string            `json:"errorClass,omitempty"` // See errorClass
+	ErrorCode     ErrorCode         `json:"errorCode,omitempty"`
+}
+
+// Devices passed and failed since the station started
+type stationTally struct {
+	passed, failed, repeated int
+}
+
+func (t stationTally) String() string {
+	return fmt.Sprintf("passed %d, failed %d, repeated %d", t.passed, t.failed, t.repeated)
+}
+
+// Fields of a scanned line that choose where the device is onboarded rather
+// than pass a template parameter; parameter names have no @
+const (
+	stationFieldTarget   = "@target"   // A target of -targets
+	stationFieldEndpoint = "@endpoint" // Comma-separated, replacing -endpoint
+	stationFieldRegion   = "@region"
+	stationFieldTemplate = "@template"
+)
+
+// runStationCommand runs a manufacturing station: it reads a serial number,
+// optionally followed by name=value template parameters and @ fields choosing
+// the device's target, from every line of stdin, as a barcode scanner in
+// keyboard mode types them, and provisions the devices one after another.
+// Each device's credentials, identity, result, and label go to its own
+// directory under the station directory. The tally is kept per target too,
+// so a run onboarding devices to several deployments shows how each went.
+func runStationCommand(args []string) error {
+	cfg := defaultConfig()
+	dir := "station"
+	var naming, nameFormat string
+	nameParam, nameStart, nameCheck := "ThingName", 1, awsSDK
+	fs := flag.NewFlagSet("station", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&dir, "station-dir", dir, "Directory holding a directory per provisioned device and the station log")
+	fs.StringVar(&naming, "thing-names", naming, "Name the things of the batch: template, sequence, or uuid; empty leaves naming to the provisioning template")
+	fs.StringVar(&nameFormat, "thing-name-format", nameFormat, "Thing name with {serial} and {<parameter>} placeholders for template naming, the prefix of the number or UUID otherwise")
+	fs.StringVar(&nameParam, "thing-name-param", nameParam, "Template parameter the thing name is passed in, which the template's ThingName refers to")
+	fs.IntVar(&nameStart, "thing-name-start", nameStart, "First sequence number, unless the station directory holds the next one")
+	fs.BoolVar(&nameCheck, "thing-name-check", nameCheck, "Skip, or refuse for template naming, names fleet indexing knows a thing of")
+	fs.Parse(args)
+
+	// The template is checked with the scanned serial numbers
+	cfg.SerialNumber = "station"
+	cfg.SerialSource = SerialFlag
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if naming != "" {
+		if err := validateNaming(naming, nameFormat, nameParam, nameStart); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Files.fs().MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create station directory: %v", err)
+	}
+	var namer *thingNamer
+	if naming != "" {
+		var err error
+		if namer, err = newThingNamer(cfg, dir, naming, nameFormat, nameParam, nameStart, nameCheck); err != nil {
+			return err
+		}
+	}
+	// The station provisions on behalf of the devices: its own facts, health,
+	// and start-up behaviour don't apply to them
+	cfg.DeviceFacts = nil
+	cfg.HealthFile = ""
+	cfg.RetryForever = false
+	cfg.WaitNetwork = false
+	cfg.StartupJitter = 0
+
+	stationLog, err := cfg.Files.fs().OpenFile(filepath.Join(dir, "station.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, cfg.Files.Mode)
+	if err != nil {
+		return fmt.Errorf("failed to open station log: %v", err)
+	}
+	defer stationLog.Close()
+
+	var tally stationTally
+	targetTallies := map[string]*stationTally{}
+	var targets []string
+	fmt.Println("Ready, scan a serial number (end of input stops the station)")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		record := provisionScanned(cfg, dir, namer, fields)
+		targetTally := targetTallies[record.Target]
+		if targetTally == nil {
+			targetTally = &stationTally{}
+			targetTallies[record.Target] = targetTally
+			targets = append(targets, record.Target)
+		}
+		switch {
+		case record.Error != "":
+			tally.failed++
+			targetTally.failed++
+			fmt.Printf("✗ %s failed: %s [%s]\n", record.Serial, record.Error, tally)
+		case record.Repeat:
+			tally.repeated++
+			targetTally.repeated++
+			fmt.Printf("✓ %s was already provisioned as %s on %s [%s]\n", record.Serial, record.ThingName, record.Target, tally)
+		default:
+			tally.passed++
+			targetTally.passed++
+			fmt.Printf("✓ %s provisioned as %s on %s in %s [%s]\n", record.Serial, record.ThingName, record.Target, time.Duration(record.DurationMS)*time.Millisecond, tally)
+		}
+		if err := appendStationRecord(stationLog, record); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read scans: %v", err)
+	}
+	fmt.Printf("Station stopped: %s\n", tally)
+	if len(targets) > 1 {
+		for _, target := range targets {
+			fmt.Printf("  %s: %s\n", target, *targetTallies[target])
+		}
+	}
+	return nil
+}
+
+// provisionScanned provisions the device of one scanned line: a serial
+// number, name=value template parameters, and @ fields choosing its target. A
+// device not provisioned yet is named by namer, if any, unless the line sets
+// the name's parameter.
+func provisionScanned(cfg Config, dir string, namer *thingNamer, fields []string) stationRecord {
+	started := time.Now()
+	record := stationRecord{Time: started.UTC(), Serial: fields[0]}
+	deviceCfg := cfg
+	deviceCfg.SerialNumber = fields[0]
+	record.Target = stationTarget(deviceCfg, nil, nil)
+	if len(fields) > 1 {
+		deviceCfg.TemplateParameters = maps.Clone(cfg.TemplateParameters)
+		if deviceCfg.TemplateParameters == nil {
+			deviceCfg.TemplateParameters = map[string]string{}
+		}
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok || name == "" || value == "" {
+				record.Error = fmt.Sprintf("expected name=value after the serial number, got %q", field)
+				return record
+			}
+			if strings.HasPrefix(name, "@") {
+				if err := applyStationField(&deviceCfg, name, value); err != nil {
+					record.Error = err.Error()
+					return record
+				}
+				continue
+			}
+			deviceCfg.TemplateParameters[name] = value
+			if record.Parameters == nil {
+				record.Parameters = map[string]string{}
+			}
+			record.Parameters[name] = value
+		}
+		record.Target = stationTarget(deviceCfg, nil, nil)
+	}
+	if err := deviceCfg.validate(); err != nil {
+		record.Error = err.Error()
+		return record
+	}
+	// A serial number is a single path element, never a way out of dir
+	if deviceCfg.SerialNumber != filepath.Base(deviceCfg.SerialNumber) || deviceCfg.SerialNumber == "." || deviceCfg.SerialNumber == ".." {
+		record.Error = fmt.Sprintf("serial number %q cannot name a directory", deviceCfg.SerialNumber)
+		return record
+	}
+	deviceCfg.OutputDir = filepath.Join(dir, deviceCfg.SerialNumber)
+	if deviceCfg.Label.QRFile != "" {
+		deviceCfg.Label.QRFile = filepath.Join(deviceCfg.OutputDir, filepath.Base(cfg.Label.QRFile))
+	}
+	if deviceCfg.Label.ZPLFile != "" && deviceCfg.Label.ZPLFile != "-" {
+		deviceCfg.Label.ZPLFile = filepath.Join(deviceCfg.OutputDir, filepath.Base(cfg.Label.ZPLFile))
+	}
+	if len(cfg.Renders) > 0 {
+		deviceCfg.Renders = make([]Render, len(cfg.Renders))
+		for i, render := range cfg.Renders {
+			deviceCfg.Renders[i] = Render{Template: render.Template, Output: filepath.Join(deviceCfg.OutputDir, filepath.Base(render.Output))}
+		}
+	}
+
+	if state, err := loadState(deviceCfg.outputPath(stateFile), deviceCfg.Files, deviceCfg.clock()); err == nil && state.State == FlowVerified {
+		record.Repeat = true
+	}
+	if namer != nil && !record.Repeat && deviceCfg.TemplateParameters[namer.param] == "" {
+		name, err := namer.name(deviceCfg.SerialNumber, deviceCfg.TemplateParameters)
+		if err != nil {
+			record.Error = err.Error()
+			return record
+		}
+		deviceCfg.TemplateParameters = maps.Clone(deviceCfg.TemplateParameters)
+		if deviceCfg.TemplateParameters == nil {
+			deviceCfg.TemplateParameters = map[string]string{}
+		}
+		deviceCfg.TemplateParameters[namer.param] = name
+		if record.Parameters == nil {
+			record.Parameters = map[string]string{}
+		}
+		record.Parameters[namer.param] = name
+	}
+	result, err := runOnce(deviceCfg, nil)
+	record.DurationMS = time.Since(started).Milliseconds()
+	// A device provisioned before stays where it was onboarded
+	if state, stateErr := loadState(deviceCfg.outputPath(stateFile), deviceCfg.Files, deviceCfg.clock()); stateErr == nil {
+		record.Target = stationTarget(deviceCfg, state, result)
+	}
+	if err != nil {
+		record.Error = err.Error()
+		record.ErrorClass = errorClass(err)
+		record.ErrorCode = ErrorCodeOf(err)
+		return record
+	}
+	record.ThingName = result.ThingName
+	record.CertificateID = result.CertificateID
+	record.Latencies = result.Latencies
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		err = deviceCfg.Files.write(deviceCfg.outputPath("result.json"), data, false)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write result of %s: %v", deviceCfg.SerialNumber, err)
+	}
+	return record
+}
+
+// applyStationField sets up cfg for an @ field of a scanned line
+func applyStationField(cfg *Config, name, value string) error {
+	if cfg.TargetsFile != "" && name != stationFieldTarget {
+		return fmt.Errorf("%s cannot be combined with -targets, set it in the target instead", name)
+	}
+	switch name {
+	case stationFieldTarget:
+		if cfg.TargetsFile == "" {
+			return fmt.Errorf("%s needs -targets", name)
+		}
+		cfg.Target = value
+	case stationFieldEndpoint:
+		cfg.Endpoints = strings.Split(value, ",")
+	case stationFieldRegion:
+		cfg.Region = value
+	case stationFieldTemplate:
+		cfg.TemplateName = value
+	default:
+		return fmt.Errorf("unknown field %s: use %s, %s, %s, or %s", name, stationFieldTarget, stationFieldEndpoint, stationFieldRegion, stationFieldTemplate)
+	}
+	return nil
+}
+
+// stationTarget names the target a device is onboarded to for the station
+// tally: the target of -targets, or else the endpoint and, in fleet mode, the
+// template. The state and result of its run, if any, tell where a device
+// provisioned before went.
+func stationTarget(cfg Config, state *provisioningState, result *ProvisioningResult) string {
+	switch {
+	case state != nil && state.Target != "":
+		return state.Target
+	case cfg.TargetsFile != "" && cfg.Target != "":
+		return cfg.Target
+	case cfg.TargetsFile != "":
+		// Not selected yet
+		return "(" + cfg.TargetSelection + ")"
+	}
+	endpoint := ""
+	if len(cfg.Endpoints) > 0 {
+		endpoint = cfg.Endpoints[0]
+	}
+	if state != nil && state.Endpoint != "" {
+		endpoint = state.Endpoint
+	}
+	if result != nil && result.Endpoint != "" {
+		endpoint = result.Endpoint
+	}
+	if cfg.Mode == ModeFleet {
+		return endpoint + "/" + cfg.TemplateName
+	}
+	return endpoint
+}
+
+// appendStationRecord appends a record to the station log, one JSON document
+// per line
+func appendStationRecord(w io.Writer, record stationRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal station record: %v", err)
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write station log: %v", err)
+	}
+	return nil
+}
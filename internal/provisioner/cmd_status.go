@@ -0,0 +1,96 @@
+package provisioner
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// runStatusCommand prints the persisted provisioning state, showing where a
+// device that didn't finish provisioning is stuck
+func runStatusCommand(args []string) error {
+	cfg := defaultConfig()
+	clearQuarantine, clearLockout, clearRefused := false, false, false
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory holding the provisioning state")
+	fs.BoolVar(&clearQuarantine, "clear-quarantine", clearQuarantine, "Lift the quarantine once the cause of the terminal failures is fixed")
+	fs.BoolVar(&clearLockout, "clear-lockout", clearLockout, "Restore the attempt budget and lift the lockout")
+	fs.BoolVar(&clearRefused, "clear-refused-claims", clearRefused, "Try the claim bundles of -claim-dir that AWS IoT refused again")
+	fs.Parse(args)
+
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return err
+	}
+	if clearQuarantine && state.TerminalFailures > 0 {
+		state.clearQuarantine()
+		if err := state.save(); err != nil {
+			return err
+		}
+		fmt.Println("Quarantine cleared")
+	}
+	if clearLockout && state.FailedAttempts > 0 {
+		state.clearLockout()
+		if err := state.save(); err != nil {
+			return err
+		}
+		fmt.Println("Lockout cleared")
+	}
+	if clearRefused && len(state.RefusedClaims) > 0 {
+		state.RefusedClaims = nil
+		if err := state.save(); err != nil {
+			return err
+		}
+		fmt.Println("Refused claims cleared")
+	}
+
+	fmt.Printf("State:          %s\n", state.State)
+	if state.ThingName != "" {
+		fmt.Printf("Thing name:     %s\n", state.ThingName)
+	}
+	if state.CertificateID != "" {
+		fmt.Printf("Certificate ID: %s\n", state.CertificateID)
+	}
+	if state.PreviousCertificateID != "" && state.RetirePreviousAfter != nil {
+		fmt.Printf("Previous cert:  %s, revoked after %s\n", state.PreviousCertificateID, state.RetirePreviousAfter.Format(time.RFC3339))
+	}
+	if state.Endpoint != "" {
+		fmt.Printf("Endpoint:       %s\n", state.Endpoint)
+	}
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil {
+		return err
+	}
+	if identity != nil && identity.CertificateNotAfter != nil {
+		notAfter := *identity.CertificateNotAfter
+		if remaining := notAfter.Sub(cfg.clock().Now()); remaining > 0 {
+			fmt.Printf("Cert expires:   %s (in %d days)\n", notAfter.Format(time.RFC3339), int(remaining.Hours()/24))
+		} else {
+			fmt.Printf("Cert expired:   %s\n", notAfter.Format(time.RFC3339))
+		}
+	}
+	if !state.UpdatedAt.IsZero() {
+		fmt.Printf("Updated:        %s\n", state.UpdatedAt.Format(time.RFC3339))
+	}
+	if state.LastError != "" {
+		fmt.Printf("Last error:     %s\n", state.LastError)
+		if state.LastErrorCode != "" {
+			fmt.Printf("Error code:     %s\n", state.LastErrorCode)
+		}
+	}
+	if quarantine := state.quarantine(cfg.clock().Now()); quarantine != nil {
+		fmt.Printf("Quarantined:    until %s after %d terminal failures\n", quarantine.Until.Format(time.RFC3339), quarantine.Failures)
+	}
+	if lockout := state.lockout(cfg.clock().Now()); lockout != nil {
+		fmt.Printf("Locked out:     until %s after %d failed attempts\n", lockout.Until.Format(time.RFC3339), lockout.Attempts)
+	} else if state.FailedAttempts > 0 {
+		fmt.Printf("Failed:         %d attempts\n", state.FailedAttempts)
+	}
+	for _, id := range state.RefusedClaims {
+		fmt.Printf("Refused claim:  %s\n", id)
+	}
+	for _, id := range state.OrphanedCertificates {
+		fmt.Printf("Orphaned cert:  %s\n", id)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// runTemplateCommand manages the fleet provisioning template the devices
+// register with: template create|update|describe|delete
+func runTemplateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: template create|update|describe|delete [flags]")
+	}
+	action := args[0]
+
+	cfg := defaultConfig()
+	var bodyFile, roleArn, hookArn, description, providerArn string
+	enabled := true
+	removeHook, removeProvider := false, false
+
+	fs := flag.NewFlagSet("template "+action, flag.ExitOnError)
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the template")
+	fs.StringVar(&cfg.TemplateName, "template", cfg.TemplateName, "Provisioning template name")
+	cfg.registerAWSFlags(fs)
+	switch action {
+	case "create", "update":
+		fs.StringVar(&bodyFile, "body", "", "JSON file with the template body")
+		fs.StringVar(&roleArn, "role-arn", "", "IAM role AWS IoT assumes to provision devices")
+		fs.StringVar(&hookArn, "pre-provisioning-hook", "", "ARN of the Lambda function validating devices before they are provisioned")
+		fs.StringVar(&description, "description", "", "Template description")
+		fs.BoolVar(&enabled, "enabled", enabled, "Whether devices may provision with the template")
+		fs.StringVar(&providerArn, "certificate-provider", "", "ARN of the Lambda function issuing the certificates of devices provisioning from a CSR, such as shorter-lived ones")
+		if action == "update" {
+			fs.BoolVar(&removeHook, "remove-pre-provisioning-hook", removeHook, "Remove the pre-provisioning hook")
+			fs.BoolVar(&removeProvider, "remove-certificate-provider", removeProvider, "Remove the certificate provider, AWS IoT issues the certificates again")
+		}
+	case "describe", "delete":
+	default:
+		return fmt.Errorf("unknown template action %q, expected create, update, describe or delete", action)
+	}
+	fs.Parse(args[1:])
+
+	if err := validateTemplateName(cfg.TemplateName); err != nil {
+		return err
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	if hookArn != "" && removeHook {
+		return fmt.Errorf("-pre-provisioning-hook and -remove-pre-provisioning-hook are mutually exclusive")
+	}
+	if providerArn != "" && removeProvider {
+		return fmt.Errorf("-certificate-provider and -remove-certificate-provider are mutually exclusive")
+	}
+	// Flags left unset keep their current value on update
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var body string
+	if bodyFile != "" {
+		data, err := cfg.Files.fs().ReadFile(bodyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read template body: %v", err)
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("template body %s is not valid JSON", bodyFile)
+		}
+		body = string(data)
+	}
+	var hook *types.ProvisioningHook
+	if hookArn != "" {
+		hook = &types.ProvisioningHook{TargetArn: aws.String(hookArn)}
+	}
+
+	ctx := context.Background()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		if body == "" || roleArn == "" {
+			return fmt.Errorf("-body and -role-arn are required")
+		}
+		created, err := client.CreateProvisioningTemplate(ctx, &iot.CreateProvisioningTemplateInput{
+			TemplateName:        aws.String(cfg.TemplateName),
+			TemplateBody:        aws.String(body),
+			ProvisioningRoleArn: aws.String(roleArn),
+			Description:         optionalString(description),
+			Enabled:             aws.Bool(enabled),
+			PreProvisioningHook: hook,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create template %s: %v", cfg.TemplateName, err)
+		}
+		fmt.Printf("Created template %s (%s)\n", cfg.TemplateName, aws.ToString(created.TemplateArn))
+		if providerArn != "" {
+			if err := putCertificateProvider(ctx, client, cfg, providerArn); err != nil {
+				return err
+			}
+		}
+
+	case "update":
+		// A new body is a new template version, which becomes the default
+		if body != "" {
+			version, err := client.CreateProvisioningTemplateVersion(ctx, &iot.CreateProvisioningTemplateVersionInput{
+				TemplateName: aws.String(cfg.TemplateName),
+				TemplateBody: aws.String(body),
+				SetAsDefault: true,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create version of template %s: %v", cfg.TemplateName, err)
+			}
+			log.Printf("Created version %d of template %s", aws.ToInt32(version.VersionId), cfg.TemplateName)
+		}
+		input := &iot.UpdateProvisioningTemplateInput{
+			TemplateName:        aws.String(cfg.TemplateName),
+			ProvisioningRoleArn: optionalString(roleArn),
+			Description:         optionalString(description),
+			PreProvisioningHook: hook,
+		}
+		if set["enabled"] {
+			input.Enabled = aws.Bool(enabled)
+		}
+		if removeHook {
+			input.RemovePreProvisioningHook = aws.Bool(true)
+		}
+		if _, err := client.UpdateProvisioningTemplate(ctx, input); err != nil {
+			return fmt.Errorf("failed to update template %s: %v", cfg.TemplateName, err)
+		}
+		fmt.Printf("Updated template %s\n", cfg.TemplateName)
+		switch {
+		case providerArn != "":
+			if err := putCertificateProvider(ctx, client, cfg, providerArn); err != nil {
+				return err
+			}
+		case removeProvider:
+			name := certificateProviderName(cfg)
+			if _, err := client.DeleteCertificateProvider(ctx, &iot.DeleteCertificateProviderInput{CertificateProviderName: aws.String(name)}); err != nil && !isNotFound(err) {
+				return fmt.Errorf("failed to delete certificate provider %s: %v", name, err)
+			}
+			fmt.Printf("Removed certificate provider %s\n", name)
+		}
+
+	case "describe":
+		described, err := client.DescribeProvisioningTemplate(ctx, &iot.DescribeProvisioningTemplateInput{TemplateName: aws.String(cfg.TemplateName)})
+		if err != nil {
+			return fmt.Errorf("failed to describe template %s: %v", cfg.TemplateName, err)
+		}
+		out := struct {
+			TemplateName        string          `json:"templateName"`
+			TemplateArn         string          `json:"templateArn"`
+			Description         string          `json:"description,omitempty"`
+			Enabled             bool            `json:"enabled"`
+			DefaultVersionID    int32           `json:"defaultVersionId"`
+			ProvisioningRoleArn string          `json:"provisioningRoleArn"`
+			PreProvisioningHook string          `json:"preProvisioningHook,omitempty"`
+			CertificateProvider string          `json:"certificateProvider,omitempty"`
+			TemplateBody        json.RawMessage `json:"templateBody"`
+		}{
+			TemplateName:        aws.ToString(described.TemplateName),
+			TemplateArn:         aws.ToString(described.TemplateArn),
+			Description:         aws.ToString(described.Description),
+			Enabled:             aws.ToBool(described.Enabled),
+			DefaultVersionID:    aws.ToInt32(described.DefaultVersionId),
+			ProvisioningRoleArn: aws.ToString(described.ProvisioningRoleArn),
+			TemplateBody:        json.RawMessage(aws.ToString(described.TemplateBody)),
+		}
+		if described.PreProvisioningHook != nil {
+			out.PreProvisioningHook = aws.ToString(described.PreProvisioningHook.TargetArn)
+		}
+		provider, err := client.DescribeCertificateProvider(ctx, &iot.DescribeCertificateProviderInput{CertificateProviderName: aws.String(certificateProviderName(cfg))})
+		switch {
+		case err == nil:
+			out.CertificateProvider = aws.ToString(provider.LambdaFunctionArn)
+		case !isNotFound(err):
+			log.Printf("Warning: failed to describe certificate provider %s: %v", certificateProviderName(cfg), err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+
+	case "delete":
+		if _, err := client.DeleteProvisioningTemplate(ctx, &iot.DeleteProvisioningTemplateInput{TemplateName: aws.String(cfg.TemplateName)}); err != nil {
+			return fmt.Errorf("failed to delete template %s: %v", cfg.TemplateName, err)
+		}
+		fmt.Printf("Deleted template %s\n", cfg.TemplateName)
+	}
+	return nil
+}
+
+// optionalString returns nil for an empty string so the API leaves the field unchanged
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// certificateProviderName is the name of the certificate provider set up
+// with the configured template
+func certificateProviderName(cfg Config) string {
+	return cfg.TemplateName + "-certificate-provider"
+}
+
+// putCertificateProvider makes the Lambda function at lambdaArn issue the
+// certificates AWS IoT creates from a CSR, creating the provider or pointing
+// the existing one at it. The function chooses their validity, so devices
+// can be given shorter-lived certificates than the ones AWS IoT issues.
+// Providers apply to the whole account and region, not only the template.
+func putCertificateProvider(ctx context.Context, client *iot.Client, cfg Config, lambdaArn string) error {
+	name := certificateProviderName(cfg)
+	operations := []types.CertificateProviderOperation{types.CertificateProviderOperationCreateCertificateFromCsr}
+	_, err := client.CreateCertificateProvider(ctx, &iot.CreateCertificateProviderInput{
+		CertificateProviderName:     aws.String(name),
+		LambdaFunctionArn:           aws.String(lambdaArn),
+		AccountDefaultForOperations: operations,
+	})
+	var exists *types.ResourceAlreadyExistsException
+	if errors.As(err, &exists) {
+		_, err = client.UpdateCertificateProvider(ctx, &iot.UpdateCertificateProviderInput{
+			CertificateProviderName:     aws.String(name),
+			LambdaFunctionArn:           aws.String(lambdaArn),
+			AccountDefaultForOperations: operations,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up certificate provider %s: %v", name, err)
+	}
+	fmt.Printf("Certificates created from a CSR are issued by %s through certificate provider %s\n", lambdaArn, name)
+	return nil
+}
@@ -0,0 +1,33 @@
+package provisioner
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// runValidateCommand checks the configuration and the files it names without
+// provisioning, listing every problem found
+func runValidateCommand(args []string) error {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Parse(args)
+
+	err := ValidateConfig(cfg)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		if err != nil {
+			return err
+		}
+		fmt.Println("✓ Configuration is valid")
+		return nil
+	}
+	for _, problem := range configErr.Problems {
+		fmt.Printf("✗ %s\n", problem)
+	}
+	if len(configErr.Problems) == 1 {
+		return fmt.Errorf("found 1 problem")
+	}
+	return fmt.Errorf("found %d problems", len(configErr.Problems))
+}
@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// runVerifyCommand checks that the permanent credentials still work: the
+// certificate is valid, its policy lets the device connect, and the device can
+// use its shadow. It reports the remaining certificate lifetime.
+func runVerifyCommand(args []string) error {
+	cfg := defaultConfig()
+	var thingName string
+	minLifetime := 30 * 24 * time.Hour
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.StringVar(&thingName, "thing-name", "", "Thing name, defaults to the one in device-identity.json")
+	fs.DurationVar(&minLifetime, "min-lifetime", minLifetime, "Fail if the certificate expires sooner than this")
+	fs.Parse(args)
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil {
+		return err
+	}
+	if identity != nil {
+		if thingName == "" {
+			thingName = identity.ThingName
+		}
+		// Prefer the endpoint that provisioned the device
+		if identity.Endpoint != "" {
+			cfg.Endpoints = append([]string{identity.Endpoint}, cfg.Endpoints...)
+		}
+	}
+	if thingName == "" {
+		return fmt.Errorf("device is not provisioned, pass -thing-name to verify other credentials")
+	}
+
+	if err := checkPermanentFingerprint(cfg); err != nil {
+		return fmt.Errorf("✗ %w", err)
+	}
+
+	// Certificate lifetime
+	certFile := cfg.outputPath(permanentCertFile)
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+	remaining := leaf.NotAfter.Sub(cfg.clock().Now())
+	if remaining <= 0 {
+		return fmt.Errorf("✗ certificate %s expired at %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	days := int(remaining.Hours() / 24)
+	if remaining < minLifetime {
+		return fmt.Errorf("✗ certificate %s expires at %s, in %d days", certFile, leaf.NotAfter.Format(time.RFC3339), days)
+	}
+	fmt.Printf("✓ Certificate valid until %s (%d days remaining)\n", leaf.NotAfter.Format(time.RFC3339), days)
+
+	// AWS IoT refuses the connection if no policy allowing it is attached
+	transport, err := connectTransport(cfg, cert, thingName)
+	if err != nil {
+		return fmt.Errorf("✗ connection refused, check that an active policy allowing iot:Connect is attached: %w", err)
+	}
+	session := newProvisioningSession(transport, cfg)
+	defer session.close()
+	fmt.Printf("✓ Connected to %s as %s (policy attached)\n", transport.Endpoint(), thingName)
+
+	exists, err := session.getShadow(thingName)
+	if err != nil {
+		return fmt.Errorf("✗ shadow get failed: %w", err)
+	}
+	if exists {
+		fmt.Println("✓ Shadow get authorized")
+	} else {
+		fmt.Println("✓ Shadow get authorized (no shadow exists)")
+	}
+	return nil
+}
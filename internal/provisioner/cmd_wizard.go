@@ -0,0 +1,201 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Line based prompts for the wizard
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prompts until validate accepts the answer. An empty answer takes def.
+func (w *wizard) ask(label, def string, validate func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(w.out, "%s [%s]: ", label, def)
+		} else {
+			fmt.Fprintf(w.out, "%s: ", label)
+		}
+		line, err := w.in.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			return "", fmt.Errorf("failed to read answer: %v", err)
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintf(w.out, "  ✗ %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// runWizardCommand collects the configuration interactively, checking each
+// answer as it is entered, then runs provisioning with a progress display.
+// Flags set the defaults offered by the prompts.
+func runWizardCommand(args []string) error {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("wizard", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Parse(args)
+
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	fmt.Fprintln(w.out, "AWS IoT fleet provisioning")
+	fmt.Fprintln(w.out)
+
+	var err error
+	var claimCert secret
+	steps := []func() error{
+		func() error {
+			cfg.Region, err = w.ask("AWS region", cfg.Region, func(s string) error {
+				if s == "" {
+					return fmt.Errorf("region is required")
+				}
+				return nil
+			})
+			return err
+		},
+		func() error {
+			endpoint, err := w.ask("AWS IoT endpoint", cfg.Endpoints[0], func(s string) error {
+				return partitionForRegion(cfg.Region).validateEndpoint(s, cfg.Region)
+			})
+			cfg.Endpoints = []string{endpoint}
+			return err
+		},
+		func() error {
+			cfg.TemplateName, err = w.ask("Provisioning template", cfg.TemplateName, validateTemplateName)
+			return err
+		},
+		func() error {
+			cfg.SerialNumber, err = w.ask("Device serial number", cfg.SerialNumber, func(s string) error {
+				if s == "" {
+					return fmt.Errorf("serial number is required")
+				}
+				return nil
+			})
+			return err
+		},
+		func() error {
+			cfg.ClaimCertFile, err = w.ask("Claim certificate", cfg.ClaimCertFile, func(s string) error {
+				claimCert = secret{source: s, file: true, fs: cfg.Files.fs()}
+				if err := claimCert.read(); err != nil {
+					return err
+				}
+				return validateClaimCertificate(claimCert, cfg.clock().Now())
+			})
+			return err
+		},
+		func() error {
+			cfg.ClaimKeyFile, err = w.ask("Claim private key", cfg.ClaimKeyFile, func(s string) error {
+				key := secret{source: s, file: true, fs: cfg.Files.fs()}
+				if err := key.read(); err != nil {
+					return err
+				}
+				if err := key.resolve(cfg, claimCert); err != nil {
+					return err
+				}
+				if _, err := keyPair(claimCert, key); err != nil {
+					return fmt.Errorf("key does not match the claim certificate: %v", err)
+				}
+				return nil
+			})
+			return err
+		},
+		func() error {
+			cfg.RootCAFile, err = w.ask("Root CA (\"-\" for the built-in Amazon root CAs)", cfg.RootCAFile, func(s string) error {
+				if s == "-" {
+					return nil
+				}
+				rootCA := secret{source: s, file: true, fs: cfg.Files.fs()}
+				read := rootCA.read
+				if info, err := cfg.Files.fs().Stat(s); err == nil && info.IsDir() {
+					read = func() error { return readRootCADir(&rootCA) }
+				}
+				if err := read(); err != nil {
+					return err
+				}
+				if countCertificates(rootCA.data) == 0 {
+					return fmt.Errorf("%s contains no valid PEM certificates", s)
+				}
+				return nil
+			})
+			if cfg.RootCAFile == "-" {
+				cfg.RootCAFile = ""
+			}
+			return err
+		},
+		func() error {
+			cfg.OutputDir, err = w.ask("Output directory", cfg.OutputDir, func(string) error { return nil })
+			return err
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	fmt.Fprintln(w.out)
+	fmt.Fprintf(w.out, "Provision %s with template %s via %s?\n", cfg.SerialNumber, cfg.TemplateName, cfg.Endpoints[0])
+	confirm, err := w.ask("Continue (y/n)", "y", func(s string) error {
+		if s != "y" && s != "n" {
+			return fmt.Errorf("answer y or n")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if confirm != "y" {
+		return fmt.Errorf("provisioning cancelled")
+	}
+	fmt.Fprintln(w.out)
+
+	// Keep the log for when the run fails, the progress display replaces it
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(redactingWriter{w: &logs})
+
+	start := time.Now()
+	stageStart := start
+	inStage := false
+	_, runErr := run(cfg, func(stage Stage, message string) {
+		now := time.Now()
+		if inStage {
+			fmt.Fprintf(w.out, " ✓ (%s)\n", now.Sub(stageStart).Round(time.Millisecond))
+		}
+		stageStart = now
+		inStage = stage != StageComplete
+		if stage == StageComplete {
+			fmt.Fprintf(w.out, "%s in %s\n", message, now.Sub(start).Round(time.Millisecond))
+			return
+		}
+		fmt.Fprintf(w.out, "  %s...", message)
+	})
+	if runErr != nil {
+		if inStage {
+			fmt.Fprintln(w.out, " ✗")
+		}
+		fmt.Fprintln(w.out)
+		fmt.Fprint(w.out, logs.String())
+		return runErr
+	}
+	return nil
+}
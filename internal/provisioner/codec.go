@@ -0,0 +1,55 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// Codec encodes the payloads of an MQTT API. AWS IoT takes the fleet
+// provisioning requests as JSON or CBOR, on topics ending in the format's name.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// TopicSuffix is the last level of the API's topics in this format
+	TopicSuffix() string
+	// Text renders a payload readably, for logs and errors
+	Text(data []byte) string
+}
+
+// Payload formats of -payload-format
+var codecs = map[string]Codec{
+	"json": jsonCodec{},
+	"cbor": cborCodec{},
+}
+
+// payloadFormats returns the names of the payload formats, sorted
+func payloadFormats() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// apiTopics returns the request topic of a fleet provisioning API in the
+// codec's format, and the topics of its accepted and rejected responses
+func apiTopics(codec Codec, api string) (request, accepted, rejected string) {
+	request = api + "/" + codec.TopicSuffix()
+	return request, request + "/accepted", request + "/rejected"
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) TopicSuffix() string                        { return "json" }
+func (jsonCodec) Text(data []byte) string                    { return string(data) }
+
+// codec returns the codec of the fleet provisioning payloads
+func (c *Config) codec() Codec {
+	if codec, ok := codecs[c.PayloadFormat]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
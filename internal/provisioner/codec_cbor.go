@@ -0,0 +1,36 @@
+//go:build !nocbor
+
+package provisioner
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Built with the CBOR codec, see cbor_disabled.go
+const cborPayloads = true
+
+// cborCodec encodes CBOR (RFC 8949), which is smaller on the wire than JSON
+// for constrained links. Struct fields keep their JSON names, and maps decode
+// with string keys, as from JSON.
+type cborCodec struct{}
+
+var (
+	cborEncoding, _ = cbor.EncOptions{Sort: cbor.SortCanonical}.EncMode()
+	cborDecoding, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+)
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cborEncoding.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cborDecoding.Unmarshal(data, v) }
+func (cborCodec) TopicSuffix() string                        { return "cbor" }
+
+// Text renders the payload in CBOR diagnostic notation, which reads like JSON
+func (cborCodec) Text(data []byte) string {
+	text, err := cbor.Diagnose(data)
+	if err != nil {
+		return fmt.Sprintf("%x", data)
+	}
+	return text
+}
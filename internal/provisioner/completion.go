@@ -0,0 +1,94 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Event published once the permanent identity is verified, for AWS IoT rules
+// to start downstream onboarding workflows
+type CompletionEvent struct {
+	Topic           string // Topic template, see renderCompletion
+	PayloadTemplate string // File with the payload template, the default document if empty
+}
+
+// Payload published without a payload template
+const defaultCompletionPayload = `{"event":"provisioning-complete","thingName":"{thingName}","serial":"{serial}","certificateId":"{certificateId}","endpoint":"{endpoint}","mode":"{mode}","template":"{template}","time":"{time}"}`
+
+// renderCompletion fills in a completion event template. Supported
+// placeholders, in the topic and the payload:
+//
+//	{thingName}      the thing name
+//	{serial}         the serial number
+//	{certificateId}  the certificate ID
+//	{endpoint}       the AWS IoT endpoint
+//	{mode}           fleet or jit
+//	{template}       the provisioning template, empty in jit mode
+//	{time}           when the identity was verified, RFC 3339 in UTC
+//
+// Values are escaped as the inside of a JSON string when escape is set, so
+// payload templates can put them in quotes.
+func renderCompletion(template string, cfg Config, state *provisioningState, escape bool) string {
+	value := func(s string) string {
+		if !escape {
+			return s
+		}
+		quoted, _ := json.Marshal(s)
+		return string(quoted[1 : len(quoted)-1])
+	}
+	templateName := ""
+	if cfg.Mode == ModeFleet {
+		templateName = cfg.TemplateName
+	}
+	return strings.NewReplacer(
+		"{thingName}", value(state.ThingName),
+		"{serial}", value(cfg.SerialNumber),
+		"{certificateId}", value(state.CertificateID),
+		"{endpoint}", value(state.Endpoint),
+		"{mode}", value(cfg.Mode),
+		"{template}", value(templateName),
+		"{time}", value(time.Now().UTC().Format(time.RFC3339)),
+	).Replace(template)
+}
+
+// validatePublishTopic checks a topic the device may publish to: not empty,
+// without wildcards, and outside the reserved $ topics
+func validatePublishTopic(kind, topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("%s topic is empty", kind)
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("%s topic %q must not contain wildcards", kind, topic)
+	case strings.HasPrefix(topic, "$"):
+		return fmt.Errorf("%s topic %q must not be a reserved $ topic", kind, topic)
+	case len(topic) > 256:
+		return fmt.Errorf("%s topic %q is longer than 256 characters", kind, topic)
+	}
+	return nil
+}
+
+// publishCompletion publishes the completion event over the connection with
+// the permanent identity, waiting for AWS IoT to acknowledge it at QoS 1
+func publishCompletion(cfg Config, transport Transport, state *provisioningState) error {
+	topic := renderCompletion(cfg.Completion.Topic, cfg, state, false)
+	if err := validatePublishTopic("completion", topic); err != nil {
+		return err
+	}
+	template := defaultCompletionPayload
+	if cfg.Completion.PayloadTemplate != "" {
+		data, err := cfg.Files.fs().ReadFile(cfg.Completion.PayloadTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to read completion payload template: %v", err)
+		}
+		template = string(data)
+	}
+	payload := renderCompletion(template, cfg, state, true)
+	if err := transport.Publish(topic, cfg.qos("completion").Publish, []byte(payload)); err != nil {
+		return fmt.Errorf("failed to publish completion event to %s: %w", topic, err)
+	}
+	log.Printf("Completion event published to %s", topic)
+	return nil
+}
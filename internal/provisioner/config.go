@@ -0,0 +1,1098 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// Runtime configuration, populated from command line flags
+type Config struct {
+	// AWS IoT endpoints in priority order, and the region they serve
+	Endpoints []string
+	Region    string
+	Port      int // 0 selects the partition default
+
+	// Connect over MQTT on port 443 when the configured port is blocked, such
+	// as by a firewall that only lets HTTPS out
+	PortFallback bool
+
+	// Endpoints are custom domains of AWS IoT rather than its own endpoints,
+	// and the name to verify the server certificate against if not the
+	// endpoint's
+	CustomDomain bool
+	ServerName   string
+
+	// Products built from the firmware image (template, parameters, endpoints,
+	// and identity) to choose from, and the product to provision as, or else
+	// the one the products file's selector reads from the hardware
+	ProductsFile string
+	Product      string
+
+	// Named targets (region, endpoints, template, and claim) to choose from,
+	// the target to use, or else how to select one
+	TargetsFile     string
+	Target          string
+	TargetSelection string
+
+	// Provisioning template to register with, the serial number passed to it
+	// as the SerialNumber parameter, and any other parameters it takes
+	TemplateName       string
+	SerialNumber       string
+	TemplateParameters map[string]string
+
+	// Where the serial number comes from, SerialFlag or SerialTPM, and the
+	// TPM device read for SerialTPM. validate resolves it into SerialNumber.
+	SerialSource string
+	TPMDevice    string
+
+	// Facts about the device gathered from the system and passed to the
+	// template, see facts.go, so a pre-provisioning hook can decide on them
+	DeviceFacts []string
+
+	// Check the parameters against those the template declares before
+	// registering, reading them from TemplateSchemaFile, or else fetching the
+	// template with the AWS SDK when AWS credentials are available
+	CheckParameters    bool
+	TemplateSchemaFile string
+
+	// JSON Schema the device configuration the template returns is checked
+	// against once registered, see configschema.go. A mismatch fails the run
+	// before the registration is recorded, or with ConfigSchemaWarn is logged.
+	ConfigSchemaFile string
+	ConfigSchemaWarn bool
+
+	// How the numbers of the device configuration results hold are decoded,
+	// and the struct type it is also decoded into, in
+	// ProvisioningResult.DeviceConfigurationValue, if set. See confignumbers.go.
+	ConfigNumbers string
+	ConfigType    reflect.Type `json:"-"`
+
+	// Skew from the server time of the device configuration that is logged,
+	// and with SetClock steps the clock, see servertime.go
+	MaxClockSkew time.Duration
+	SetClock     bool
+
+	// Claim certificate and key, unless the CLAIM_CERT and CLAIM_KEY
+	// environment variables hold them. The key may instead be a reference to
+	// a key on a token, pkcs11:... or tpm2:0x81000001, see keyref.go.
+	ClaimCertFile string
+	ClaimKeyFile  string
+
+	// OpenSSL engine pkcs11: key references are signed with, or OpenSSL 3's
+	// providers if empty, and resolvers of key reference schemes replacing
+	// the built-in ones, such as a native PKCS#11 binding
+	OpenSSLEngine string
+	KeyResolvers  map[string]KeyResolver `json:"-"`
+
+	// Directory of claim bundles to choose the claim from instead, see
+	// loadClaimCandidates
+	ClaimDir string
+
+	// SHA-256 fingerprints of the only claim certificates accepted, hex, none
+	// to accept any
+	ClaimFingerprints []string
+
+	// PEM file with the CAs used to verify the endpoint, or a directory of
+	// them, empty for the built-in Amazon root CAs of the region's partition.
+	// The ROOT_CA environment variable takes precedence.
+	RootCAFile string
+	// Also trust the system's trust store
+	SystemRoots bool
+
+	// Directory the permanent credentials and provisioning state are kept in
+	OutputDir string
+
+	// File the provisioning health is written to as it changes, none if empty
+	HealthFile string
+
+	// Directory a diagnostic bundle is written to when provisioning fails
+	// terminally, none if empty
+	DiagnosticsDir string
+
+	// Modes and ownership of every file written
+	Files FilePermissions
+
+	// Bounds of the audit log, pruned as it outgrows them, see retention.go
+	AuditRetention AuditRetention
+
+	// Commands run before and after provisioning, and how long each may take
+	Hooks       Hooks
+	HookTimeout time.Duration
+
+	// Requests of library callers made on the claim connection before and
+	// after RegisterThing, see flowsteps.go
+	Steps FlowSteps `json:"-"`
+
+	// QR code and printer label written once provisioned, see label.go
+	Label Label
+
+	// Configuration files of downstream services rendered once provisioned,
+	// see render.go
+	Renders []Render
+
+	// Device configuration handed to system services once provisioned, see
+	// deviceconfig.go
+	Appliers Appliers
+
+	// DynamoDB table provisioned devices are recorded in, see inventory.go
+	Inventory Inventory
+
+	// Provisioning events and metrics shipped to CloudWatch, see cloudwatch.go
+	CloudWatch CloudWatch
+
+	// MQTT session behaviour
+	MQTTVersion       string
+	ClientIDTemplate  string
+	QoS               byte
+	OperationQoS      map[string]OperationQoS // Overriding QoS, by operation in qosOperations
+	PayloadFormat     string                  // Of the fleet provisioning payloads, in codecs
+	CleanSession      bool
+	DisconnectQuiesce time.Duration
+
+	// Directory in-flight QoS 1 messages are kept in until acknowledged, so
+	// they are resent after a dropped connection; in memory if empty
+	MessageStoreDir string
+
+	// Network dialing
+	IPFamily      string
+	FallbackDelay time.Duration
+
+	// Looks the endpoints up, if set, instead of the system's resolver, see
+	// Resolver. Otherwise DNSResolver, a DNS over HTTPS or TLS server reached
+	// at the DNSBootstrap addresses, does if set.
+	Resolver     Resolver `json:"-"`
+	DNSResolver  string
+	DNSBootstrap []string
+
+	// Connection health and retry behaviour
+	KeepAlive      time.Duration
+	PingTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ConnectRetries int
+	Reconnect      Backoff
+
+	// Time to wait for the broker to acknowledge a subscription (SUBACK or
+	// UNSUBACK) and a QoS 1 publish (PUBACK), and for AWS IoT to answer a
+	// request on its response topics, kept apart so a timeout shows which
+	// step stalled
+	SubscribeTimeout time.Duration
+	PublishTimeout   time.Duration
+	ResponseTimeout  time.Duration
+
+	// Wait for network connectivity before provisioning, and retry failed runs
+	// indefinitely with the reconnect backoff
+	WaitNetwork  bool
+	RetryForever bool
+
+	// Circuit breaker: after this many consecutive terminal failures (0
+	// disables it), provisioning is refused for the quarantine interval
+	QuarantineAfter int
+	Quarantine      time.Duration
+
+	// Attempt budget: after this many failed attempts of any kind without
+	// provisioning (0 disables it), provisioning is refused for the lockout
+	// interval. The count survives reboots.
+	AttemptBudget  int
+	AttemptLockout time.Duration
+
+	// Upper bound of the random delay before the first provisioning attempt
+	StartupJitter time.Duration
+
+	// When the thing name is taken, retry registration up to ConflictRetries
+	// times with ConflictSuffix appended to the ConflictParam parameter. An
+	// empty suffix fails instead.
+	ConflictSuffix  string
+	ConflictParam   string
+	ConflictRetries int
+
+	// Retries of the certificate creation and thing registration requests
+	// within a run, see RetryPolicy. Registration is retried with the same
+	// ownership token.
+	CreateRetry   RetryPolicy
+	RegisterRetry RetryPolicy
+
+	// Time from the start of a run by which the thing must be registered, 0
+	// for no limit. Past it, no further requests are published; with
+	// AbandonOnDeadline a certificate created in the run is abandoned rather
+	// than registered by the next run.
+	Deadline          time.Duration
+	AbandonOnDeadline bool
+
+	// How long the first connection with the permanent certificate is retried
+	// while the policies attached to it propagate
+	PolicyPropagation time.Duration
+
+	// Also write the device certificate's chain, and a bundle of the chain and
+	// key, with intermediates from IntermediatesFile or the issuer URLs
+	Chain             bool
+	Bundle            bool
+	IntermediatesFile string
+
+	// Put the certificate ownership token in the result instead of redacting it
+	IncludeOwnershipToken bool
+
+	// Show private keys and ownership tokens in the log, progress, and errors
+	// instead of redacting them, when debugging at a terminal
+	ShowSecrets bool
+
+	// Certificate signing request to provision with. AWS IoT then signs it
+	// instead of generating a key, which never leaves the device that made it.
+	CSRFile string
+
+	// Shred the claim credentials once the permanent identity is verified
+	WipeClaim bool
+
+	// Fail the run when a post step, such as the label or the post-success
+	// hook, fails, instead of reporting it in the result, see PostStepFailure
+	StrictPostSteps bool
+
+	// Download the claim credentials at first boot instead: an encrypted bundle
+	// and its detached signature, the public key to check the signature with,
+	// and the file holding the AES key the bundle is encrypted with
+	ClaimBundleURL          string
+	ClaimBundleSignatureURL string
+	ClaimBundlePublicKey    string
+	ClaimBundleKey          string
+
+	// Claim files may be envelopes (see claim-encrypt) whose data key is
+	// decrypted with KMS, optionally pinned to ClaimKMSKey, or unwrapped with
+	// the AES key in ClaimWrappingKey
+	ClaimKMSKey      string
+	ClaimWrappingKey string
+
+	// Fleet provisioning by claim, or just-in-time provisioning with a device
+	// certificate signed by the registered CA in CACertFile and CAKeyFile, and
+	// how long to wait for AWS IoT to activate it
+	Mode       string
+	CACertFile string
+	CAKeyFile  string
+	JITTimeout time.Duration
+
+	// Check the registration against AWS IoT with the AWS SDK when AWS
+	// credentials are available
+	CloudVerify bool
+
+	// Apply template parameters changed since the device registered to the
+	// thing with the AWS SDK, see reconcile.go
+	Reconcile bool
+
+	// How long the certificate replaced by a rotation stays active next to the
+	// new one before it is revoked with the AWS SDK, see rotate.go. Without an
+	// overlap it is left active and the new one is not verified first.
+	RotationOverlap time.Duration
+
+	// AWS IoT policies, by name or ARN, attached to the device certificate
+	// with the AWS SDK once it is registered, besides the template's, see
+	// policies.go. Names take the placeholders of renderCompletion.
+	AttachPolicies []string
+
+	// Named shadow the provisioning status is reported in once the permanent
+	// identity is verified, none if empty, and the firmware version reported,
+	// the FirmwareVersion device fact if empty
+	StatusShadow    string
+	FirmwareVersion string
+
+	// Event published once the permanent identity is verified, see
+	// completion.go
+	Completion CompletionEvent
+
+	// Serial port each stage and the outcome are written to for factory test
+	// fixtures, none if empty, see statusport.go
+	StatusPort  string
+	StatusBaud  int
+	StatusRS485 bool
+
+	// Local broker to publish lifecycle events to, nats://host[:port] or
+	// mqtt://host[:port], with optional credentials, see eventBus
+	EventBus       string
+	EventBusPrefix string
+
+	// Credentials of every AWS SDK call: the shared config profile to load,
+	// and a role to assume with them, with the external ID the role's trust
+	// policy may require
+	AWSProfile    string
+	AssumeRoleARN string
+	ExternalID    string
+
+	// Sent the alerts of serve, besides the sinks of its -notify, see
+	// alerter
+	Notifiers []Notifier `json:"-"`
+
+	// Called, if set, whenever a connection to AWS IoT comes up, fails, or
+	// drops, from the goroutine of the MQTT client
+	OnConnectionEvent func(ConnectionEvent) `json:"-"`
+
+	// Counts, if set, the bytes of every connection to AWS IoT
+	Traffic *Traffic `json:"-"`
+
+	// Shares, if set, TLS sessions and DNS lookups with the other devices
+	// provisioned from this host
+	Pool *ConnectionPool `json:"-"`
+
+	// Holds back every publish to AWS IoT, if set, see PublishLimiter.
+	// Otherwise PublishRate messages a second are allowed, in bursts of up to
+	// PublishBurst, or any number with a PublishRate of 0.
+	PublishLimiter PublishLimiter `json:"-"`
+	PublishRate    float64
+	PublishBurst   int
+
+	// Source of the client ID and thing name suffixes, client tokens, and
+	// jitter. With RandomSeed set instead, runs draw a reproducible sequence.
+	Random     Random `json:"-"`
+	RandomSeed uint64
+
+	// Time the run goes by, the system's if nil, see Clock
+	Clock Clock `json:"-"`
+
+	// Instruments of a run, set by run and provision rather than shared by
+	// the process, so concurrent runs for different devices stay apart
+	flight      *recorder     // Of the provisioning attempt
+	connections *atomic.Int32 // Open connections to AWS IoT, for health
+	wedges      *wedgeCounter // MQTT clients found wedged, counted by serve
+	secrets     *secretScope  // Learned by the run, see redactor
+}
+
+// DefaultConfig returns the configuration used when no flags are given, for
+// programs to change what they need of
+func DefaultConfig() Config {
+	return defaultConfig()
+}
+
+// defaultConfig returns the configuration used when no flags are given
+func defaultConfig() Config {
+	return Config{
+		Endpoints:         []string{AWSIoTEndpoint},
+		Region:            region,
+		TemplateName:      templateName,
+		SerialNumber:      serialNumber,
+		SerialSource:      SerialFlag,
+		TPMDevice:         defaultTPMDevice,
+		ClaimCertFile:     certificateFile,
+		ClaimKeyFile:      privateKeyFile,
+		OpenSSLEngine:     keySchemePKCS11,
+		RootCAFile:        rootCAFile,
+		MQTTVersion:       MQTTVersion311,
+		PayloadFormat:     "json",
+		ClientIDTemplate:  "device-{serial}",
+		QoS:               1,
+		CleanSession:      true,
+		DisconnectQuiesce: 250 * time.Millisecond,
+		IPFamily:          IPFamilyAuto,
+		FallbackDelay:     300 * time.Millisecond,
+		KeepAlive:         30 * time.Second,
+		PingTimeout:       10 * time.Second,
+		ConnectTimeout:    30 * time.Second,
+		SubscribeTimeout:  10 * time.Second,
+		PublishTimeout:    10 * time.Second,
+		PublishBurst:      10,
+		ResponseTimeout:   10 * time.Second,
+		HookTimeout:       30 * time.Second,
+		Mode:              ModeFleet,
+		CloudWatch:        CloudWatch{Namespace: "ClaimProvisioning"},
+		TargetSelection:   TargetDefault,
+		JITTimeout:        2 * time.Minute,
+		PolicyPropagation: 30 * time.Second,
+		MaxClockSkew:      30 * time.Second,
+		ConfigNumbers:     ConfigNumbersFloat,
+		ConflictParam:     "SerialNumber",
+		ConflictRetries:   3,
+		CreateRetry:       RetryPolicy{Delay: time.Second},
+		RegisterRetry:     RetryPolicy{Retries: 2, Delay: time.Second},
+		QuarantineAfter:   3,
+		Quarantine:        6 * time.Hour,
+		AttemptLockout:    24 * time.Hour,
+		StatusBaud:        115200,
+		EventBusPrefix:    "provisioning",
+		Appliers: Appliers{
+			WiFiInterface:     "wlan0",
+			WPASupplicantConf: "/etc/wpa_supplicant/wpa_supplicant.conf",
+			ChronySources:     "/etc/chrony/sources.d/aws-iot.sources",
+		},
+		Files: FilePermissions{
+			Mode:    0644,
+			KeyMode: 0600,
+		},
+		Reconnect: Backoff{
+			Min:    1 * time.Second,
+			Max:    2 * time.Minute,
+			Jitter: 0.5,
+		},
+	}
+}
+
+// registerFlags binds the configuration fields to command line flags
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	endpointsSet := false
+	fs.Func("endpoint", "AWS IoT endpoint; repeat to list failover endpoints in priority order", func(s string) error {
+		if !endpointsSet {
+			c.Endpoints = nil
+			endpointsSet = true
+		}
+		c.Endpoints = append(c.Endpoints, s)
+		return nil
+	})
+	fs.StringVar(&c.Region, "region", c.Region, "AWS region of the endpoints; selects the partition (aws, aws-cn, aws-us-gov)")
+	fs.IntVar(&c.Port, "port", c.Port, "Endpoint port, 0 for the partition default")
+	fs.BoolVar(&c.PortFallback, "port-fallback", c.PortFallback, "Connect over MQTT on port 443 when the network blocks the configured port")
+	fs.BoolVar(&c.CustomDomain, "custom-domain", c.CustomDomain, "Endpoints are custom domains configured in AWS IoT, any host name is accepted")
+	fs.StringVar(&c.ServerName, "server-name", c.ServerName, "Name the server certificate is verified against and sent in SNI, default the endpoint")
+	fs.StringVar(&c.TemplateName, "template", c.TemplateName, "Fleet provisioning template name")
+	fs.StringVar(&c.ProductsFile, "products", c.ProductsFile, "JSON file of the products built from this image, each with its template, parameters, endpoints, and identity, and how to tell them apart")
+	fs.StringVar(&c.Product, "product", c.Product, "Product from -products to provision as, overriding its selector")
+	fs.StringVar(&c.TargetsFile, "targets", c.TargetsFile, "JSON file of named targets, each a region with its endpoints, template, and claim, to provision against instead")
+	fs.StringVar(&c.Target, "target", c.Target, "Target from -targets to provision against, overriding -target-selection")
+	fs.StringVar(&c.TargetSelection, "target-selection", c.TargetSelection, "How to select the target: default, assigned (by serial number), or latency")
+	fs.StringVar(&c.SerialNumber, "serial", c.SerialNumber, "Device serial number, passed to the template as SerialNumber")
+	fs.StringVar(&c.SerialSource, "serial-source", c.SerialSource, "Where the serial number comes from: flag (-serial) or tpm (SHA-256 of the TPM endorsement key certificate)")
+	fs.StringVar(&c.TPMDevice, "tpm-device", c.TPMDevice, "TPM device -serial-source tpm reads")
+	fs.Func("param", "Additional template parameter as name=value; repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected name=value, got %q", s)
+		}
+		if c.TemplateParameters == nil {
+			c.TemplateParameters = map[string]string{}
+		}
+		c.TemplateParameters[name] = value
+		return nil
+	})
+	c.registerFactsFlag(fs)
+	fs.BoolVar(&c.CheckParameters, "check-params", c.CheckParameters, "Check the template parameters against the template before registering; the template is fetched when AWS credentials are available")
+	fs.StringVar(&c.TemplateSchemaFile, "template-schema", c.TemplateSchemaFile, "Template body file whose Parameters -check-params checks against instead of fetching the template")
+	fs.StringVar(&c.ConfigSchemaFile, "config-schema", c.ConfigSchemaFile, "JSON Schema file the device configuration the template returns must match, failing the run if it does not")
+	fs.BoolVar(&c.ConfigSchemaWarn, "config-schema-warn", c.ConfigSchemaWarn, "Only log a warning when the device configuration does not match -config-schema")
+	fs.StringVar(&c.ConfigNumbers, "config-numbers", c.ConfigNumbers, "How numbers of the device configuration are decoded: float, or exact to keep large integers as the template returned them")
+	fs.DurationVar(&c.MaxClockSkew, "max-clock-skew", c.MaxClockSkew, "Difference from the server_time of the device configuration beyond which the device clock is reported wrong")
+	fs.BoolVar(&c.SetClock, "set-clock", c.SetClock, "Step the clock to the server_time of the device configuration when it is off by more than -max-clock-skew and not synchronized by NTP (Linux, needs CAP_SYS_TIME)")
+	fs.StringVar(&c.ClaimCertFile, "claim-cert", c.ClaimCertFile, "Claim certificate, PEM or base64 encoded PEM; overridden by $CLAIM_CERT")
+	fs.StringVar(&c.ClaimKeyFile, "claim-key", c.ClaimKeyFile, "Claim private key, PEM or base64 encoded PEM, or a pkcs11: or tpm2: key reference; overridden by $CLAIM_KEY")
+	fs.StringVar(&c.OpenSSLEngine, "openssl-engine", c.OpenSSLEngine, "OpenSSL engine pkcs11: key references are signed with, empty for OpenSSL 3 providers")
+	fs.StringVar(&c.ClaimDir, "claim-dir", c.ClaimDir, "Directory of claim bundles, PEM files each holding a claim certificate and key, to use the newest valid one of instead of -claim-cert and -claim-key; refused claims fall back to the next")
+	fs.Func("claim-fingerprint", "SHA-256 fingerprint of a claim certificate to accept, hex with or without colons; repeatable. Other claims are refused", func(s string) error {
+		fingerprint, err := parseFingerprint(s)
+		if err != nil {
+			return err
+		}
+		c.ClaimFingerprints = append(c.ClaimFingerprints, fingerprint)
+		return nil
+	})
+	fs.StringVar(&c.RootCAFile, "root-ca", c.RootCAFile, "PEM file with the root CAs for the endpoint, or a directory of .pem and .crt files; empty uses the built-in Amazon root CAs. Overridden by $ROOT_CA")
+	fs.BoolVar(&c.SystemRoots, "system-roots", c.SystemRoots, "Also trust the root CAs of the system's trust store")
+	fs.StringVar(&c.OutputDir, "output-dir", c.OutputDir, "Directory for the permanent credentials, device identity, and pending state")
+	fs.StringVar(&c.HealthFile, "health-file", c.HealthFile, "File to write provisioning health (ready, state, connection) to as it changes")
+	fs.StringVar(&c.DiagnosticsDir, "diagnostics-dir", c.DiagnosticsDir, "Directory to write a redacted diagnostic bundle to when provisioning fails terminally, for support")
+	fs.Func("file-mode", "Octal mode of written certificates and other public files (default 0644)", func(s string) error {
+		return parseFileMode(s, &c.Files.Mode)
+	})
+	fs.Func("key-mode", "Octal mode of written private keys and files holding secrets (default 0600)", func(s string) error {
+		return parseFileMode(s, &c.Files.KeyMode)
+	})
+	fs.StringVar(&c.Files.Owner, "file-owner", c.Files.Owner, "User name or ID to own written files, empty for the current user")
+	fs.StringVar(&c.Files.Group, "file-group", c.Files.Group, "Group name or ID to own written files, empty for the current group")
+	c.AuditRetention.registerFlags(fs)
+	fs.StringVar(&c.Hooks.PreProvision, "pre-provision-hook", c.Hooks.PreProvision, "Shell command run before provisioning; failing aborts provisioning")
+	fs.StringVar(&c.Hooks.PostSuccess, "post-success-hook", c.Hooks.PostSuccess, "Shell command run after provisioning succeeds")
+	fs.StringVar(&c.Hooks.PostFailure, "post-failure-hook", c.Hooks.PostFailure, "Shell command run after provisioning fails")
+	fs.DurationVar(&c.HookTimeout, "hook-timeout", c.HookTimeout, "Time a hook may run before it is killed")
+	fs.StringVar(&c.Label.QRFile, "label-qr", c.Label.QRFile, "PNG file to write a QR code of the thing name and serial number to once provisioned")
+	fs.BoolVar(&c.Label.QRTerminal, "label-qr-terminal", c.Label.QRTerminal, "Show the QR code on stderr once provisioned")
+	fs.StringVar(&c.Label.ZPLFile, "label-zpl", c.Label.ZPLFile, "File to write a ZPL printer label to once provisioned, - for stderr")
+	fs.StringVar(&c.Label.ZPLTemplate, "label-zpl-template", c.Label.ZPLTemplate, "ZPL file with {thingName}, {serial}, {certificateId}, and {qr} placeholders replacing the default label")
+	fs.Func("render", "Go template to render into a configuration file once provisioned, as template=output; repeatable", func(s string) error {
+		render, err := parseRender(s)
+		if err != nil {
+			return err
+		}
+		c.Renders = append(c.Renders, render)
+		return nil
+	})
+	fs.Func("apply-config", "Hand the template's device configuration (wifi_ssid, wifi_psk, ntp_servers) to nmcli, wpa-supplicant, or chrony once provisioned; repeatable", func(s string) error {
+		c.Appliers.Names = append(c.Appliers.Names, s)
+		return nil
+	})
+	fs.StringVar(&c.Appliers.WiFiInterface, "wifi-interface", c.Appliers.WiFiInterface, "Wi-Fi interface the nmcli and wpa-supplicant appliers configure")
+	fs.StringVar(&c.Appliers.WPASupplicantConf, "wpa-supplicant-conf", c.Appliers.WPASupplicantConf, "wpa_supplicant configuration the wpa-supplicant applier replaces")
+	fs.StringVar(&c.Appliers.ChronySources, "chrony-sources", c.Appliers.ChronySources, "File in chrony's sourcedir the chrony applier writes the NTP servers to")
+	fs.StringVar(&c.Inventory.Table, "inventory-table", c.Inventory.Table, "DynamoDB table to record each provisioned device in, with AWS credentials")
+	fs.StringVar(&c.CloudWatch.LogGroup, "cloudwatch-log-group", c.CloudWatch.LogGroup, "CloudWatch log group to ship provisioning events and metrics to once the device has credentials")
+	fs.StringVar(&c.CloudWatch.Namespace, "cloudwatch-namespace", c.CloudWatch.Namespace, "CloudWatch namespace of the provisioning metrics")
+	fs.StringVar(&c.CloudWatch.CredentialsEndpoint, "cloudwatch-credentials-endpoint", c.CloudWatch.CredentialsEndpoint, "AWS IoT credentials provider endpoint the device certificate is exchanged at for CloudWatch")
+	fs.StringVar(&c.CloudWatch.RoleAlias, "cloudwatch-role-alias", c.CloudWatch.RoleAlias, "Role alias granting the device logs:CreateLogStream and logs:PutLogEvents")
+	fs.StringVar(&c.Inventory.Station, "inventory-station", c.Inventory.Station, "Factory station recorded with each device in the inventory table, the host name by default")
+	fs.StringVar(&c.MQTTVersion, "mqtt-version", c.MQTTVersion, "MQTT protocol version, 3.1.1 or 5")
+	fs.StringVar(&c.ClientIDTemplate, "client-id", c.ClientIDTemplate, "MQTT client ID template for the claim connection; {serial} and {random} are replaced")
+	fs.Func("qos", "MQTT QoS for provisioning publishes and subscriptions (0 or 1)", func(s string) error {
+		qos, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return err
+		}
+		c.QoS = byte(qos)
+		return nil
+	})
+	fs.Func("operation-qos", fmt.Sprintf("QoS of one operation instead of -qos, as operation=qos or operation=publish/subscribe with one of %s; repeatable", strings.Join(qosOperations, ", ")), func(s string) error {
+		name, qos, err := parseOperationQoS(s)
+		if err != nil {
+			return err
+		}
+		if c.OperationQoS == nil {
+			c.OperationQoS = map[string]OperationQoS{}
+		}
+		c.OperationQoS[name] = qos
+		return nil
+	})
+	fs.StringVar(&c.PayloadFormat, "payload-format", c.PayloadFormat, fmt.Sprintf("Format of the fleet provisioning requests and responses, one of %s", strings.Join(payloadFormats(), ", ")))
+	fs.BoolVar(&c.CleanSession, "clean-session", c.CleanSession, "Start a clean MQTT session")
+	fs.StringVar(&c.MessageStoreDir, "message-store", c.MessageStoreDir, "Directory to keep in-flight QoS 1 messages in until acknowledged, so they survive dropped connections; needs -clean-session=false")
+	fs.DurationVar(&c.DisconnectQuiesce, "disconnect-quiesce", c.DisconnectQuiesce, "Time to wait for in-flight work when disconnecting")
+	fs.StringVar(&c.IPFamily, "ip-family", c.IPFamily, "IP family used to reach the endpoint: auto (dual-stack), 4 or 6")
+	fs.DurationVar(&c.FallbackDelay, "fallback-delay", c.FallbackDelay, "How long dual-stack dialing waits on the preferred address family before racing the other")
+	fs.StringVar(&c.DNSResolver, "dns-resolver", c.DNSResolver, "Look the endpoints up with DNS over HTTPS (https://host/path) or DNS over TLS (tls://host[:port]) instead of the system's resolver")
+	fs.Func("dns-bootstrap", "Comma separated IP addresses of the -dns-resolver server, so its name is not looked up with the network's DNS", func(s string) error {
+		c.DNSBootstrap = nil
+		for _, addr := range strings.Split(s, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				c.DNSBootstrap = append(c.DNSBootstrap, addr)
+			}
+		}
+		return nil
+	})
+	fs.DurationVar(&c.KeepAlive, "keep-alive", c.KeepAlive, "MQTT keep-alive interval")
+	fs.DurationVar(&c.PingTimeout, "ping-timeout", c.PingTimeout, "Time to wait for a ping response before the connection is considered lost (MQTT 3.1.1)")
+	fs.DurationVar(&c.ConnectTimeout, "connect-timeout", c.ConnectTimeout, "Time to wait for a connection attempt to complete")
+	fs.DurationVar(&c.SubscribeTimeout, "subscribe-timeout", c.SubscribeTimeout, "Time to wait for the broker to acknowledge a subscription (SUBACK) or unsubscription")
+	fs.DurationVar(&c.PublishTimeout, "publish-timeout", c.PublishTimeout, "Time to wait for the broker to acknowledge a QoS 1 publish (PUBACK)")
+	fs.Float64Var(&c.PublishRate, "publish-rate", c.PublishRate, "Most messages a second published to AWS IoT on average, across the connections of the process; 0 does not limit them")
+	fs.IntVar(&c.PublishBurst, "publish-burst", c.PublishBurst, "Most messages published at once within -publish-rate")
+	fs.DurationVar(&c.ResponseTimeout, "response-timeout", c.ResponseTimeout, "Time to wait for AWS IoT to answer a request once it is published")
+	fs.IntVar(&c.ConnectRetries, "connect-retries", c.ConnectRetries, "Additional attempts made if the initial connection fails")
+	fs.DurationVar(&c.Reconnect.Min, "reconnect-min", c.Reconnect.Min, "Initial delay between connection attempts")
+	fs.DurationVar(&c.Reconnect.Max, "reconnect-max", c.Reconnect.Max, "Maximum delay between connection attempts")
+	fs.Float64Var(&c.Reconnect.Jitter, "reconnect-jitter", c.Reconnect.Jitter, "Fraction of each reconnect delay that is randomised (0 to 1)")
+	fs.BoolVar(&c.WaitNetwork, "wait-network", c.WaitNetwork, "Wait until a network interface is up and the endpoint resolves before provisioning")
+	fs.IntVar(&c.QuarantineAfter, "quarantine-after", c.QuarantineAfter, "Consecutive terminal failures (such as a missing template) after which provisioning is quarantined; 0 disables")
+	fs.DurationVar(&c.Quarantine, "quarantine", c.Quarantine, "How long provisioning is refused once quarantined")
+	fs.IntVar(&c.AttemptBudget, "attempt-budget", c.AttemptBudget, "Failed attempts of any kind, counted across reboots, after which provisioning is locked out; 0 disables")
+	fs.DurationVar(&c.AttemptLockout, "attempt-lockout", c.AttemptLockout, "How long provisioning is refused once the attempt budget is used up")
+	fs.DurationVar(&c.StartupJitter, "startup-jitter", c.StartupJitter, "Wait a random time up to this before provisioning, so a fleet powering on together does not connect at once")
+	fs.Uint64Var(&c.RandomSeed, "random-seed", c.RandomSeed, "Seed the random client ID and thing name suffixes, client tokens, and jitter, so runs can be reproduced in tests; 0 uses the system's randomness")
+	fs.BoolVar(&c.RetryForever, "retry-forever", c.RetryForever, "Retry failed provisioning indefinitely, backing off up to -reconnect-max between runs")
+	fs.StringVar(&c.ConflictSuffix, "conflict-suffix", c.ConflictSuffix, "On a thing name conflict, retry with this appended to -conflict-param; {n} is the retry number, {random} 8 random hex characters. Empty fails")
+	fs.StringVar(&c.ConflictParam, "conflict-param", c.ConflictParam, "Template parameter the conflict suffix is appended to; a parameter other than SerialNumber is added")
+	fs.IntVar(&c.ConflictRetries, "conflict-retries", c.ConflictRetries, "Registration retries after thing name conflicts")
+	fs.IntVar(&c.CreateRetry.Retries, "create-retries", c.CreateRetry.Retries, "Certificate creation retries when the response times out or the rejection is not terminal; a certificate whose response was lost is left unregistered")
+	fs.DurationVar(&c.CreateRetry.Delay, "create-retry-delay", c.CreateRetry.Delay, "Delay before the first certificate creation retry, doubling up to -reconnect-max")
+	fs.IntVar(&c.RegisterRetry.Retries, "register-retries", c.RegisterRetry.Retries, "Registration retries with the same ownership token when the response times out or the rejection is not terminal")
+	fs.DurationVar(&c.RegisterRetry.Delay, "register-retry-delay", c.RegisterRetry.Delay, "Delay before the first registration retry, doubling up to -reconnect-max")
+	fs.DurationVar(&c.Deadline, "deadline", c.Deadline, "Time a run may take to create the certificate and register the thing, 0 for no limit")
+	fs.BoolVar(&c.AbandonOnDeadline, "deadline-abandon", c.AbandonOnDeadline, "When -deadline passes after the certificate was created, record it in the state as orphaned and create another on the next run")
+	fs.DurationVar(&c.PolicyPropagation, "policy-propagation", c.PolicyPropagation, "How long the first connection with the permanent certificate is retried while its policies propagate; 0 tries once")
+	fs.BoolVar(&c.Chain, "chain", c.Chain, "Also write permanent_chain.pem with the device certificate, its intermediates, and the root CA")
+	fs.BoolVar(&c.Bundle, "bundle", c.Bundle, "Also write permanent_bundle.pem with the certificate chain followed by the private key")
+	fs.StringVar(&c.IntermediatesFile, "intermediates", c.IntermediatesFile, "PEM file with intermediate CAs for the chain; others are fetched from the issuer URLs in the certificates")
+	fs.BoolVar(&c.IncludeOwnershipToken, "include-ownership-token", c.IncludeOwnershipToken, "Include the certificate ownership token in the result instead of redacting it")
+	fs.BoolVar(&c.ShowSecrets, "show-secrets", c.ShowSecrets, "Show private keys and ownership tokens in the log, progress, and errors, for local debugging; only honoured when stderr is a terminal")
+	fs.StringVar(&c.CSRFile, "csr-file", c.CSRFile, "Provision with this certificate signing request from csr export; the device certificate is written for the device holding the key")
+	fs.StringVar(&c.StatusShadow, "status-shadow", c.StatusShadow, "Named shadow to report the firmware version, provisioning time, template, and result in once provisioned, such as provisioning")
+	fs.StringVar(&c.StatusPort, "status-port", c.StatusPort, "Serial port to report each stage and the outcome on, one line each, for factory test fixtures")
+	fs.IntVar(&c.StatusBaud, "status-baud", c.StatusBaud, "Baud rate of -status-port")
+	fs.BoolVar(&c.StatusRS485, "status-rs485", c.StatusRS485, "Put -status-port in RS-485 mode, with RTS driving the transmitter")
+	fs.StringVar(&c.EventBus, "event-bus", c.EventBus, "Local broker to publish each stage and the outcome to for other services, nats://host[:port] or mqtt://host[:port]")
+	fs.StringVar(&c.EventBusPrefix, "event-bus-prefix", c.EventBusPrefix, "First levels of the event subjects, followed by the serial number and the event")
+	fs.StringVar(&c.FirmwareVersion, "firmware-version", c.FirmwareVersion, "Firmware version reported in -status-shadow (default the FirmwareVersion device fact)")
+	fs.StringVar(&c.Completion.Topic, "complete-topic", c.Completion.Topic, "Topic to publish an event to once provisioned, with {thingName} and {serial} placeholders, such as fleet/provisioned/{thingName}")
+	fs.StringVar(&c.Completion.PayloadTemplate, "complete-payload", c.Completion.PayloadTemplate, "File with the payload template of -complete-topic, replacing the default JSON document")
+	fs.BoolVar(&c.CloudVerify, "cloud-verify", c.CloudVerify, "Check the thing, certificate, and attached policies in AWS IoT after registration when AWS credentials are available")
+	fs.BoolVar(&c.Reconcile, "reconcile", c.Reconcile, "On a provisioned device, apply template parameters changed since it registered to its thing (attributes, groups, thing type, billing group) when AWS credentials are available")
+	fs.DurationVar(&c.RotationOverlap, "rotation-overlap", c.RotationOverlap, "Verify a rotated certificate connects before switching to it, and keep the replaced one active and on disk this long before revoking it when AWS credentials are available; 0 leaves it active")
+	fs.Func("attach-policy", "AWS IoT policy, by name or ARN, to attach to the device certificate once registered, besides the template's, with AWS credentials; repeatable. Names take the -complete-topic placeholders", func(s string) error {
+		c.AttachPolicies = append(c.AttachPolicies, s)
+		return nil
+	})
+	fs.BoolVar(&c.WipeClaim, "wipe-claim", c.WipeClaim, "Shred the claim certificate and key after the permanent identity is verified")
+	fs.BoolVar(&c.StrictPostSteps, "strict-post-steps", c.StrictPostSteps, "Fail the run when a step after provisioning (status shadow, completion event, policies, label, render, inventory, post-success hook) fails; the device stays provisioned")
+	fs.StringVar(&c.ClaimBundleURL, "claim-bundle-url", c.ClaimBundleURL, "HTTPS or presigned S3 URL of an encrypted claim bundle to use instead of the claim certificate and key files")
+	fs.StringVar(&c.ClaimBundleSignatureURL, "claim-bundle-signature-url", c.ClaimBundleSignatureURL, "URL of the bundle's detached signature (default the bundle URL with .sig appended)")
+	fs.StringVar(&c.ClaimBundlePublicKey, "claim-bundle-public-key", c.ClaimBundlePublicKey, "PEM public key or certificate the claim bundle signature is checked with")
+	fs.StringVar(&c.ClaimBundleKey, "claim-bundle-key", c.ClaimBundleKey, "File with the 32 byte AES key the claim bundle is encrypted with")
+	fs.StringVar(&c.ClaimKMSKey, "claim-kms-key", c.ClaimKMSKey, "KMS key the data key of encrypted claim files must be decrypted with (default the key in the envelope)")
+	fs.StringVar(&c.ClaimWrappingKey, "claim-wrapping-key", c.ClaimWrappingKey, "File with the 32 byte AES key that wraps the data key of encrypted claim files, instead of KMS")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "Onboarding strategy: fleet (provisioning by claim) or jit (just-in-time provisioning or registration with a registered CA)")
+	fs.StringVar(&c.CACertFile, "ca-cert", c.CACertFile, "Registered CA certificate that signs the device certificate in jit mode")
+	fs.StringVar(&c.CAKeyFile, "ca-key", c.CAKeyFile, "Private key of the registered CA in jit mode")
+	fs.DurationVar(&c.JITTimeout, "jit-timeout", c.JITTimeout, "How long to keep connecting in jit mode until AWS IoT activates the certificate")
+	c.registerAWSFlags(fs)
+}
+
+// registerFactsFlag adds the flag choosing the device facts passed to the
+// template
+func (c *Config) registerFactsFlag(fs *flag.FlagSet) {
+	fs.Func("device-facts", fmt.Sprintf("Comma separated device facts to pass as template parameters: %s", strings.Join(factNames(), ", ")), func(s string) error {
+		c.DeviceFacts = nil
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !slices.Contains(factNames(), name) {
+				return fmt.Errorf("unknown device fact %q, expected one of %s", name, strings.Join(factNames(), ", "))
+			}
+			c.DeviceFacts = append(c.DeviceFacts, name)
+		}
+		return nil
+	})
+}
+
+// registerAWSFlags adds the flags choosing the credentials of AWS SDK calls,
+// for commands that make them
+func (c *Config) registerAWSFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.AWSProfile, "profile", c.AWSProfile, "Shared config profile AWS SDK calls load their credentials from (default $AWS_PROFILE or the default chain)")
+	fs.StringVar(&c.AssumeRoleARN, "assume-role-arn", c.AssumeRoleARN, "Role AWS SDK calls assume with the loaded credentials, such as one in the production account")
+	fs.StringVar(&c.ExternalID, "external-id", c.ExternalID, "External ID passed when assuming -assume-role-arn")
+}
+
+// validateAWS checks the flags of registerAWSFlags
+func (c *Config) validateAWS() error {
+	if c.ExternalID != "" && c.AssumeRoleARN == "" {
+		return fmt.Errorf("-external-id needs -assume-role-arn")
+	}
+	if c.AssumeRoleARN != "" {
+		if parsed, err := arn.Parse(c.AssumeRoleARN); err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+			return fmt.Errorf("-assume-role-arn %q is not an IAM role ARN", c.AssumeRoleARN)
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration for values AWS IoT does not accept,
+// returning a *ConfigError with every problem found
+func (c *Config) validate() error {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if c.Product != "" && c.ProductsFile == "" {
+		fail("-product needs -products")
+	}
+	if c.ProductsFile != "" {
+		check(validateProducts(*c))
+	}
+	if c.TargetsFile != "" {
+		check(validateTargets(*c))
+	}
+	if len(c.Endpoints) == 0 {
+		fail("at least one endpoint is required")
+	}
+	partition := c.partition()
+	for _, endpoint := range c.Endpoints {
+		if c.CustomDomain {
+			check(validateHost(endpoint))
+			continue
+		}
+		err := partition.validateEndpoint(endpoint, c.Region)
+		// A legacy endpoint only works with a root CA other than Amazon's
+		var legacy *LegacyEndpointError
+		if errors.As(err, &legacy) {
+			rootCA, readErr := readRootCAs(*c)
+			if readErr == nil && rootCA.data != nil && !isAmazonRootCA(rootCA.data) {
+				log.Printf("Warning: %v; legacy endpoints are deprecated, prefer the ATS endpoint", err)
+				continue
+			}
+			fail("region %s: %v; the Amazon root CAs cannot validate legacy endpoints", c.Region, err)
+		} else if err != nil {
+			fail("region %s: %v", c.Region, err)
+		}
+	}
+	if c.Port < 0 || c.Port > math.MaxUint16 {
+		fail("invalid port %d", c.Port)
+	}
+	if c.ServerName != "" {
+		if err := validateHost(c.ServerName); err != nil {
+			fail("server name: %v", err)
+		}
+	}
+	check(validateTemplateName(c.TemplateName))
+	switch c.SerialSource {
+	case SerialFlag:
+	case SerialTPM:
+		// Resolved once, so copies of the configuration keep the serial
+		if serial, err := tpmSerial(c.TPMDevice); err != nil {
+			fail("serial number from TPM: %v", err)
+		} else {
+			c.SerialNumber, c.SerialSource = serial, SerialFlag
+		}
+	default:
+		fail("unsupported serial source %q: use %s or %s", c.SerialSource, SerialFlag, SerialTPM)
+	}
+	if c.SerialNumber == "" {
+		fail("serial number is required")
+	} else if strings.IndexFunc(c.SerialNumber, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		fail("serial number %q must not contain spaces or control characters", c.SerialNumber)
+	}
+	if _, err := renderClientID(c.ClientIDTemplate, c.SerialNumber, c.random()); err != nil {
+		fail("%v (set -client-id)", err)
+	}
+	if c.HookTimeout <= 0 {
+		fail("hook timeout must be positive")
+	}
+	if !qrCodes && (c.Label.QRFile != "" || c.Label.QRTerminal) {
+		fail("-label-qr and -label-qr-terminal need the QR code encoder, which this build leaves out; -label-zpl has the printer draw the QR code")
+	}
+	outputs := map[string]bool{}
+	for _, render := range c.Renders {
+		if outputs[filepath.Clean(render.Output)] {
+			fail("-render writes %s more than once", render.Output)
+		}
+		outputs[filepath.Clean(render.Output)] = true
+	}
+	check(validateAppliers(c.Appliers.Names))
+	if c.Label.ZPLTemplate != "" && c.Label.ZPLFile == "" {
+		fail("-label-zpl-template needs -label-zpl")
+	}
+	if c.StatusShadow != "" && !shadowNamePattern.MatchString(c.StatusShadow) {
+		fail("invalid shadow name %q: use up to 64 letters, digits, and :_-", c.StatusShadow)
+	}
+	if c.Completion.Topic != "" {
+		// Placeholders hold no wildcards or $, so the template shows the problems
+		check(validatePublishTopic("completion", c.Completion.Topic))
+	} else if c.Completion.PayloadTemplate != "" {
+		fail("-complete-payload needs -complete-topic")
+	}
+	if c.CloudWatch.LogGroup != "" {
+		if c.CloudWatch.CredentialsEndpoint == "" || c.CloudWatch.RoleAlias == "" {
+			fail("-cloudwatch-log-group needs -cloudwatch-credentials-endpoint and -cloudwatch-role-alias")
+		} else if err := validateHost(c.CloudWatch.CredentialsEndpoint); err != nil {
+			fail("credentials endpoint: %v", err)
+		}
+		if c.CloudWatch.Namespace == "" {
+			fail("-cloudwatch-namespace must not be empty")
+		}
+	}
+	if _, _, err := c.Files.ids(); err != nil {
+		check(err)
+	}
+	// Refuse modes that would hand the private key to other users
+	if c.Files.KeyMode&0007 != 0 {
+		fail("key mode %#o makes private keys accessible to all users", c.Files.KeyMode)
+	}
+	if c.MQTTVersion != MQTTVersion311 && c.MQTTVersion != MQTTVersion5 {
+		fail("unsupported MQTT version %q: use %s or %s", c.MQTTVersion, MQTTVersion311, MQTTVersion5)
+	}
+	if codecs[c.PayloadFormat] == nil {
+		fail("unsupported payload format %q: use one of %s", c.PayloadFormat, strings.Join(payloadFormats(), ", "))
+	}
+	if !cborPayloads && c.PayloadFormat == "cbor" {
+		fail("-payload-format cbor needs the CBOR codec, which this build leaves out")
+	}
+	if c.DNSResolver != "" {
+		_, err := newSecureResolver(c.DNSResolver, c.DNSBootstrap, c.ConnectTimeout)
+		check(err)
+	} else if len(c.DNSBootstrap) > 0 {
+		fail("-dns-bootstrap needs -dns-resolver")
+	}
+	if _, err := dialNetwork(c.IPFamily); err != nil {
+		check(err)
+	}
+	// AWS IoT Core does not support QoS 2
+	if c.QoS > 1 {
+		fail("unsupported QoS %d: AWS IoT supports QoS 0 and 1", c.QoS)
+	}
+	if c.DisconnectQuiesce < 0 {
+		fail("disconnect quiesce must not be negative")
+	}
+	// MQTT keep-alive is sent in whole seconds as a 16 bit value
+	if c.KeepAlive < time.Second || c.KeepAlive > math.MaxUint16*time.Second {
+		fail("keep-alive must be between 1s and %ds", math.MaxUint16)
+	}
+	if c.PingTimeout <= 0 || c.ConnectTimeout <= 0 {
+		fail("ping and connect timeouts must be positive")
+	}
+	if c.AuditRetention.MaxEntries < 0 || c.AuditRetention.MaxAge < 0 || c.AuditRetention.MaxBytes < 0 {
+		fail("audit log retention limits must not be negative")
+	}
+	if c.PublishRate < 0 || c.PublishRate > 0 && c.PublishBurst < 1 {
+		fail("-publish-rate must not be negative and -publish-burst must be positive")
+	}
+	if c.SubscribeTimeout <= 0 || c.PublishTimeout <= 0 || c.ResponseTimeout <= 0 {
+		fail("subscribe, publish, and response timeouts must be positive")
+	}
+	if c.ConnectRetries < 0 {
+		fail("connect retries must not be negative")
+	}
+	if c.Reconnect.Min <= 0 || c.Reconnect.Max < c.Reconnect.Min {
+		fail("reconnect backoff needs 0 < min <= max")
+	}
+	if c.Reconnect.Jitter < 0 || c.Reconnect.Jitter > 1 {
+		fail("reconnect jitter must be between 0 and 1")
+	}
+	if c.ConflictSuffix != "" && !strings.Contains(c.ConflictSuffix, "{n}") && !strings.Contains(c.ConflictSuffix, "{random}") {
+		fail("conflict suffix %q must contain {n} or {random} so retries use new names", c.ConflictSuffix)
+	}
+	if c.CreateRetry.Retries < 0 || c.RegisterRetry.Retries < 0 {
+		fail("create and register retries must not be negative")
+	}
+	if c.CreateRetry.Delay < 0 || c.RegisterRetry.Delay < 0 {
+		fail("create and register retry delays must not be negative")
+	}
+	if c.Deadline < 0 {
+		fail("deadline must not be negative")
+	}
+	if c.AbandonOnDeadline && c.Deadline == 0 {
+		fail("-deadline-abandon needs -deadline")
+	}
+	if c.RotationOverlap < 0 {
+		fail("-rotation-overlap must not be negative")
+	}
+	for _, policy := range c.AttachPolicies {
+		if err := validatePolicyRef(policy); err != nil {
+			fail("invalid -attach-policy: %v", err)
+		}
+	}
+	if c.PolicyPropagation < 0 {
+		fail("policy propagation must not be negative")
+	}
+	if c.TemplateSchemaFile != "" {
+		if !c.CheckParameters {
+			fail("-template-schema requires -check-params")
+		}
+		if data, err := c.Files.fs().ReadFile(c.TemplateSchemaFile); err != nil {
+			fail("failed to read template schema: %v", err)
+		} else if _, err := parseTemplateParameters(c.TemplateSchemaFile, data); err != nil {
+			check(err)
+		}
+	}
+	if c.ConfigSchemaFile != "" {
+		_, err := loadConfigSchema(c.Files.fs(), c.ConfigSchemaFile)
+		check(err)
+	} else if c.ConfigSchemaWarn {
+		fail("-config-schema-warn needs -config-schema")
+	}
+	check(validateConfigNumbers(c.ConfigNumbers))
+	if c.ConfigType != nil && c.ConfigType.Kind() != reflect.Struct {
+		fail("ConfigType must be a struct type, not %s", c.ConfigType)
+	}
+	if c.MaxClockSkew < 0 {
+		fail("-max-clock-skew must not be negative")
+	}
+	if !awsSDK {
+		for _, option := range []struct {
+			name string
+			used bool
+		}{
+			{"-cloud-verify", c.CloudVerify},
+			{"-reconcile", c.Reconcile},
+			{"-rotation-overlap", c.RotationOverlap > 0},
+			{"-attach-policy", len(c.AttachPolicies) > 0},
+			{"-inventory-table", c.Inventory.Table != ""},
+			{"-cloudwatch-log-group", c.CloudWatch.LogGroup != ""},
+			{"-check-params without -template-schema", c.CheckParameters && c.TemplateSchemaFile == ""},
+		} {
+			if option.used {
+				fail("%s needs the AWS SDK, which this build leaves out", option.name)
+			}
+		}
+	}
+	if c.ConflictParam == "" || c.ConflictRetries < 0 {
+		fail("conflict parameter is required and conflict retries must not be negative")
+	}
+	if c.QuarantineAfter < 0 || c.Quarantine <= 0 {
+		fail("quarantine threshold must not be negative and the interval must be positive")
+	}
+	if c.AttemptBudget < 0 || c.AttemptLockout <= 0 {
+		fail("attempt budget must not be negative and the lockout must be positive")
+	}
+	if c.StartupJitter < 0 {
+		fail("startup jitter must not be negative")
+	}
+	// A clean session discards the messages in flight when reconnecting
+	if c.MessageStoreDir != "" && c.CleanSession {
+		fail("-message-store needs -clean-session=false")
+	}
+	if c.ClaimDir != "" {
+		if c.ClaimBundleURL != "" {
+			fail("-claim-dir and -claim-bundle-url are mutually exclusive")
+		}
+		if _, err := c.Files.fs().ReadDir(c.ClaimDir); err != nil {
+			fail("failed to list claim bundles: %v", err)
+		}
+	}
+	if c.ClaimBundleURL != "" {
+		if c.ClaimBundlePublicKey == "" || c.ClaimBundleKey == "" {
+			fail("-claim-bundle-url needs -claim-bundle-public-key and -claim-bundle-key")
+		}
+		// A presigned URL's signature covers its path, so .sig can't be appended
+		if c.ClaimBundleSignatureURL == "" && strings.Contains(c.ClaimBundleURL, "?") {
+			fail("-claim-bundle-signature-url is required for presigned claim bundle URLs")
+		}
+		if c.WipeClaim {
+			fail("-wipe-claim has nothing to wipe, claim credentials from a bundle are only kept in memory")
+		}
+	}
+	check(c.validateAWS())
+	switch c.Mode {
+	case ModeFleet:
+	case ModeJIT:
+		// Without a CA the device certificate must already be in place
+		if _, err := c.Files.fs().Stat(c.outputPath(permanentCertFile)); err != nil && (c.CACertFile == "" || c.CAKeyFile == "") {
+			fail("jit mode needs -ca-cert and -ca-key, or a device certificate in %s", c.outputPath(permanentCertFile))
+		}
+		if c.CSRFile != "" || c.WipeClaim {
+			fail("-csr-file and -wipe-claim only apply to fleet provisioning")
+		}
+		if len(c.Steps.BeforeRegister) > 0 || len(c.Steps.AfterRegister) > 0 {
+			fail("Steps only apply to fleet provisioning")
+		}
+		if c.JITTimeout <= 0 {
+			fail("jit timeout must be positive")
+		}
+	default:
+		fail("unsupported mode %q: use %s or %s", c.Mode, ModeFleet, ModeJIT)
+	}
+	if c.EventBus != "" {
+		if u, err := url.Parse(c.EventBus); err != nil || (u.Scheme != "nats" && u.Scheme != "mqtt") || u.Host == "" {
+			fail("event bus must be a nats://host[:port] or mqtt://host[:port] URL")
+		}
+		if c.EventBusPrefix == "" {
+			fail("-event-bus needs -event-bus-prefix")
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// A configuration a device may end up provisioning with
+type configVariant struct {
+	name string // "product x: " or "target y: " prefixes, empty for cfg itself
+	cfg  Config
+}
+
+// configVariants returns the configuration of every product and target cfg
+// may select, or cfg itself if it selects none
+func configVariants(cfg Config, name string) []configVariant {
+	if cfg.ProductsFile != "" {
+		if products, err := loadProducts(cfg.Files.fs(), cfg.ProductsFile); err == nil {
+			var variants []configVariant
+			for _, product := range products.Products {
+				variants = append(variants, configVariants(product.apply(cfg), name+"product "+product.Name+": ")...)
+			}
+			return variants
+		}
+	}
+	if cfg.TargetsFile != "" {
+		if targets, err := loadTargets(cfg.Files.fs(), cfg.TargetsFile); err == nil {
+			var variants []configVariant
+			for _, target := range targets.Targets {
+				variants = append(variants, configVariant{name + "target " + target.Name + ": ", target.apply(cfg)})
+			}
+			return variants
+		}
+	}
+	return []configVariant{{name, cfg}}
+}
+
+// ConfigError lists the problems found in a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// ValidateConfig checks cfg as thoroughly as possible without provisioning:
+// the values Config.validate checks, the files it names (see
+// checkConfigFiles), and with CheckParameters, the template parameters. It
+// returns a *ConfigError listing every problem, or nil.
+func ValidateConfig(cfg Config) error {
+	var problems []string
+	var configErr *ConfigError
+	if err := cfg.validate(); errors.As(err, &configErr) {
+		problems = append(problems, configErr.Problems...)
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, variant := range configVariants(cfg, "") {
+		for _, problem := range checkConfigFiles(variant.cfg) {
+			problems = append(problems, variant.name+problem)
+		}
+	}
+	if cfg.CheckParameters {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+		defer cancel()
+		var paramErr *TemplateParameterError
+		if err := checkTemplateParameters(ctx, cfg, templateParameters(cfg)); errors.As(err, &paramErr) {
+			for _, problem := range paramErr.Problems {
+				problems = append(problems, fmt.Sprintf("template parameter %s", problem))
+			}
+		} else if err != nil && !slices.Contains(problems, err.Error()) {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// partition returns the AWS partition of the configured region
+func (c *Config) partition() Partition {
+	return partitionForRegion(c.Region)
+}
+
+// port returns the endpoint port, falling back to the partition default
+func (c *Config) port() int {
+	if c.Port != 0 {
+		return c.Port
+	}
+	return c.partition().Port
+}
+
+// outputPath returns the location of a file kept in the output directory
+func (c *Config) outputPath(name string) string {
+	return filepath.Join(c.OutputDir, name)
+}
+
+// Template names AWS IoT accepts
+var templateNamePattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,36}$`)
+
+// validateTemplateName checks a provisioning template name, which is also part
+// of the provisioning topics
+func validateTemplateName(name string) error {
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name %q: use 1 to 36 letters, digits, underscores, or hyphens", name)
+	}
+	return nil
+}
+
+// parseFileMode parses an octal file mode
+func parseFileMode(s string, mode *os.FileMode) error {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return fmt.Errorf("invalid file mode %q", s)
+	}
+	*mode = os.FileMode(m)
+	return nil
+}
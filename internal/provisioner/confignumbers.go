@@ -0,0 +1,151 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How numbers of the device configuration are decoded, -config-numbers
+const (
+	ConfigNumbersFloat = "float" // float64, as encoding/json decodes them
+	ConfigNumbersExact = "exact" // json.Number, as the template returned them
+)
+
+// validateConfigNumbers checks a -config-numbers value, empty meaning float
+func validateConfigNumbers(numbers string) error {
+	switch numbers {
+	case "", ConfigNumbersFloat, ConfigNumbersExact:
+		return nil
+	default:
+		return fmt.Errorf("unsupported -config-numbers %q: use %s or %s", numbers, ConfigNumbersFloat, ConfigNumbersExact)
+	}
+}
+
+// decodeDeviceConfiguration decodes the deviceConfiguration of a payload
+// holding one, a registration response or the provisioning state, with its
+// numbers as json.Number, so large integer IDs keep every digit. The device
+// configuration is kept this way until it is handed out in a result, see
+// deviceConfiguration.
+func decodeDeviceConfiguration(codec Codec, payload []byte) (map[string]interface{}, error) {
+	var response struct {
+		DeviceConfiguration map[string]interface{} `json:"deviceConfiguration"`
+	}
+	if _, ok := codec.(jsonCodec); ok {
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil {
+			return nil, err
+		}
+		return response.DeviceConfiguration, nil
+	}
+	// CBOR keeps integers exact, but as Go integers
+	if err := codec.Unmarshal(payload, &response); err != nil {
+		return nil, err
+	}
+	config, _ := convertNumbers(response.DeviceConfiguration, func(value interface{}) (interface{}, bool) {
+		switch value := value.(type) {
+		case int64:
+			return json.Number(strconv.FormatInt(value, 10)), true
+		case uint64:
+			return json.Number(strconv.FormatUint(value, 10)), true
+		case float64:
+			return json.Number(strconv.FormatFloat(value, 'g', -1, 64)), true
+		case float32:
+			return json.Number(strconv.FormatFloat(float64(value), 'g', -1, 32)), true
+		}
+		return nil, false
+	}).(map[string]interface{})
+	return config, nil
+}
+
+// deviceConfiguration returns the device configuration as a result hands it
+// out, with the numbers of cfg.ConfigNumbers
+func deviceConfiguration(cfg Config, config map[string]interface{}) map[string]interface{} {
+	if cfg.ConfigNumbers == ConfigNumbersExact {
+		return config
+	}
+	floats, _ := convertNumbers(config, func(value interface{}) (interface{}, bool) {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		// Out of range, which encoding/json would have refused
+		f, err := number.Float64()
+		if err != nil {
+			return value, true
+		}
+		return f, true
+	}).(map[string]interface{})
+	return floats
+}
+
+// typedDeviceConfiguration decodes the device configuration into a new value
+// of cfg.ConfigType, returning a pointer to it, or nil if ConfigType is not
+// set or the template returned no configuration
+func typedDeviceConfiguration(cfg Config, config map[string]interface{}) (interface{}, error) {
+	if cfg.ConfigType == nil || config == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.New(cfg.ConfigType).Interface()
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, &DeviceConfigurationError{Template: cfg.TemplateName, Type: cfg.ConfigType.String(), Problems: []string{strings.TrimPrefix(err.Error(), "json: ")}}
+	}
+	return value, nil
+}
+
+// yamlNumbers returns a device configuration whose json.Number values are
+// written to YAML as numbers rather than strings
+func yamlNumbers(config map[string]interface{}) map[string]interface{} {
+	converted, _ := convertNumbers(config, func(value interface{}) (interface{}, bool) {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		tag := "!!float"
+		if _, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+			tag = "!!int"
+		} else if _, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+			tag = "!!int"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: string(number)}, true
+	}).(map[string]interface{})
+	return converted
+}
+
+// convertNumbers returns a copy of a decoded value with the values convert
+// reports true for replaced, leaving the original as it is
+func convertNumbers(value interface{}, convert func(interface{}) (interface{}, bool)) interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		if value == nil {
+			return value
+		}
+		copied := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			copied[key] = convertNumbers(item, convert)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, item := range value {
+			copied[i] = convertNumbers(item, convert)
+		}
+		return copied
+	}
+	if converted, ok := convert(value); ok {
+		return converted
+	}
+	return value
+}
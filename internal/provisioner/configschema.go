@@ -0,0 +1,340 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configSchema is a JSON Schema the device configuration a template returns
+// is checked against. It supports the keywords that describe configuration
+// documents: type, properties, required, additionalProperties, items, enum,
+// const, minLength, maxLength, pattern, minimum, maximum, minItems, and
+// maxItems. Annotations such as title and description are ignored; other
+// keywords, such as $ref and anyOf, are refused rather than ignored, so a
+// schema is never weaker than it reads.
+type configSchema struct {
+	never bool // The schema false
+
+	Types                []string
+	Properties           map[string]*configSchema
+	Required             []string
+	AdditionalProperties *configSchema
+	Items                *configSchema
+	Enum                 []interface{}
+	Const                *interface{}
+	MinLength, MaxLength *int
+	Pattern              *regexp.Regexp
+	Minimum, Maximum     *float64
+	MinItems, MaxItems   *int
+}
+
+// Annotations of JSON Schema, which do not constrain values
+var schemaAnnotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples", "format", "readOnly", "writeOnly", "deprecated"}
+
+// JSON types of the type keyword
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// DeviceConfigurationError is returned when the device configuration the
+// template returned does not match ConfigSchemaFile, or does not decode into
+// ConfigType
+type DeviceConfigurationError struct {
+	Template string
+	Type     string // Of ConfigType, if it did not decode into it
+	Problems []string
+}
+
+func (e *DeviceConfigurationError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("device configuration of template %s does not decode into %s: %s", e.Template, e.Type, strings.Join(e.Problems, "; "))
+	}
+	return fmt.Sprintf("device configuration of template %s does not match the schema: %s", e.Template, strings.Join(e.Problems, "; "))
+}
+
+// loadConfigSchema reads and parses a device configuration schema
+func loadConfigSchema(fsys FileSystem, path string) (*configSchema, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device configuration schema: %v", err)
+	}
+	var schema configSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse device configuration schema %s: %v", path, err)
+	}
+	return &schema, nil
+}
+
+func (s *configSchema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		*s = configSchema{}
+		return nil
+	case "false":
+		*s = configSchema{never: true}
+		return nil
+	}
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return fmt.Errorf("a schema must be an object or a boolean")
+	}
+	var raw struct {
+		Type                 json.RawMessage          `json:"type"`
+		Properties           map[string]*configSchema `json:"properties"`
+		Required             []string                 `json:"required"`
+		AdditionalProperties *configSchema            `json:"additionalProperties"`
+		Items                *configSchema            `json:"items"`
+		Enum                 []interface{}            `json:"enum"`
+		MinLength            *int                     `json:"minLength"`
+		MaxLength            *int                     `json:"maxLength"`
+		Pattern              *string                  `json:"pattern"`
+		Minimum              *float64                 `json:"minimum"`
+		Maximum              *float64                 `json:"maximum"`
+		MinItems             *int                     `json:"minItems"`
+		MaxItems             *int                     `json:"maxItems"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = configSchema{
+		Properties:           raw.Properties,
+		Required:             raw.Required,
+		AdditionalProperties: raw.AdditionalProperties,
+		Items:                raw.Items,
+		Enum:                 raw.Enum,
+		MinLength:            raw.MinLength,
+		MaxLength:            raw.MaxLength,
+		Minimum:              raw.Minimum,
+		Maximum:              raw.Maximum,
+		MinItems:             raw.MinItems,
+		MaxItems:             raw.MaxItems,
+	}
+	for keyword, value := range keywords {
+		switch keyword {
+		case "type", "properties", "required", "additionalProperties", "items", "enum", "minLength", "maxLength", "pattern", "minimum", "maximum", "minItems", "maxItems":
+		case "const":
+			var c interface{}
+			if err := json.Unmarshal(value, &c); err != nil {
+				return err
+			}
+			s.Const = &c
+		default:
+			if !slices.Contains(schemaAnnotations, keyword) {
+				return fmt.Errorf("keyword %s is not supported", keyword)
+			}
+		}
+	}
+	if len(raw.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(raw.Type, &single); err == nil {
+			s.Types = []string{single}
+		} else if err := json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return fmt.Errorf("type must be a type or a list of types")
+		}
+		for _, t := range s.Types {
+			if !slices.Contains(schemaTypes, t) {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	}
+	if raw.Pattern != nil {
+		pattern, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", *raw.Pattern, err)
+		}
+		s.Pattern = pattern
+	}
+	return nil
+}
+
+// checkDeviceConfiguration checks the device configuration the template
+// returned against cfg.ConfigSchemaFile, if set. With cfg.ConfigSchemaWarn a
+// mismatch is only logged.
+func checkDeviceConfiguration(cfg Config, config map[string]interface{}) error {
+	if cfg.ConfigSchemaFile == "" {
+		return nil
+	}
+	schema, err := loadConfigSchema(cfg.Files.fs(), cfg.ConfigSchemaFile)
+	if err != nil {
+		return err
+	}
+	var document interface{} = config
+	if config == nil {
+		// The template returned no configuration, an empty one to the schema
+		document = map[string]interface{}{}
+	}
+	var problems []string
+	schema.check("", document, &problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	err = &DeviceConfigurationError{Template: cfg.TemplateName, Problems: problems}
+	if cfg.ConfigSchemaWarn {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+// check appends why value, found at path, does not match the schema to
+// problems. Values are left out of the problems, as the configuration may
+// hold secrets such as a Wi-Fi passphrase.
+func (s *configSchema) check(path string, value interface{}, problems *[]string) {
+	name := path
+	if name == "" {
+		name = "the configuration"
+	}
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, name+" "+fmt.Sprintf(format, args...))
+	}
+	if s.never {
+		fail("is not expected")
+		return
+	}
+	kind := schemaTypeOf(value)
+	if len(s.Types) > 0 && !slices.Contains(s.Types, kind) && !(kind == "integer" && slices.Contains(s.Types, "number")) {
+		fail("must be of type %s, not %s", strings.Join(s.Types, " or "), kind)
+		return
+	}
+	if s.Const != nil && !schemaEqual(value, *s.Const) {
+		fail("must be %s", schemaLiteral(*s.Const))
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(allowed interface{}) bool { return schemaEqual(value, allowed) }) {
+		literals := make([]string, len(s.Enum))
+		for i, allowed := range s.Enum {
+			literals[i] = schemaLiteral(allowed)
+		}
+		fail("must be one of %s", strings.Join(literals, ", "))
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := len([]rune(value))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(value) {
+			fail("must match %s", s.Pattern)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.check(path+"["+strconv.Itoa(i)+"]", item, problems)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := value[key]; !ok {
+				*problems = append(*problems, schemaPath(path, key)+" is missing")
+			}
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if property, ok := s.Properties[key]; ok {
+				property.check(schemaPath(path, key), value[key], problems)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.check(schemaPath(path, key), value[key], problems)
+			}
+		}
+	default:
+		if number, ok := schemaNumber(value); ok {
+			if s.Minimum != nil && number < *s.Minimum {
+				fail("must be at least %v", *s.Minimum)
+			}
+			if s.Maximum != nil && number > *s.Maximum {
+				fail("must be at most %v", *s.Maximum)
+			}
+		}
+	}
+}
+
+// schemaPath is the path of key in the object at path
+func schemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// schemaTypeOf returns the JSON type of a decoded value. The CBOR payload
+// format decodes integers to integer types rather than float64, and the
+// device configuration is checked with json.Number values.
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	number, ok := schemaNumber(value)
+	if !ok {
+		return fmt.Sprintf("%T", value)
+	}
+	if number == math.Trunc(number) {
+		return "integer"
+	}
+	return "number"
+}
+
+// schemaNumber returns a decoded number as a float64
+func schemaNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+// schemaEqual reports whether two decoded values are the same JSON value
+func schemaEqual(a, b interface{}) bool {
+	x, xok := schemaNumber(a)
+	y, yok := schemaNumber(b)
+	if xok || yok {
+		return xok && yok && x == y
+	}
+	return schemaLiteral(a) == schemaLiteral(b)
+}
+
+// schemaLiteral returns a value of the schema as JSON
+func schemaLiteral(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
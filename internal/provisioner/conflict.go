@@ -0,0 +1,60 @@
+package provisioner
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// ThingNameConflictError is returned when the thing name the template produced
+// from the parameters is already taken
+type ThingNameConflictError struct {
+	Parameters map[string]string
+	Rejection  *RejectedError
+}
+
+func (e *ThingNameConflictError) Error() string {
+	reason := e.Rejection.ErrorMessage
+	if reason == "" {
+		reason = e.Rejection.Error()
+	}
+	return fmt.Sprintf("thing name conflict with parameters %v: %s", e.Parameters, reason)
+}
+
+func (e *ThingNameConflictError) Unwrap() error {
+	return e.Rejection
+}
+
+// thingNameConflict reports whether the registration was rejected because a
+// thing with the same name exists
+func (e *RejectedError) thingNameConflict() bool {
+	return e.StatusCode == 409 ||
+		strings.Contains(e.ErrorCode, "Conflict") ||
+		strings.Contains(e.ErrorCode, "AlreadyExists") ||
+		strings.Contains(strings.ToLower(e.ErrorMessage), "already exists")
+}
+
+// templateParameters returns the parameters the thing is registered with. The
+// device facts give way to parameters set explicitly.
+func templateParameters(cfg Config) map[string]string {
+	params := deviceFacts(cfg)
+	maps.Copy(params, cfg.TemplateParameters)
+	params["SerialNumber"] = cfg.SerialNumber
+	return params
+}
+
+// conflictParameters returns the template parameters for retry number attempt
+// (starting at 1) after a thing name conflict: a copy of params whose conflict
+// parameter gets the rendered suffix appended. Supported placeholders:
+//
+//	{n}       the retry number
+//	{random}  8 random hex characters
+func conflictParameters(cfg Config, params map[string]string, attempt int) map[string]string {
+	params = maps.Clone(params)
+	params[cfg.ConflictParam] += strings.NewReplacer(
+		"{n}", strconv.Itoa(attempt),
+		"{random}", randomHex(cfg.random(), 4),
+	).Replace(cfg.ConflictSuffix)
+	return params
+}
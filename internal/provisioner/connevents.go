@@ -0,0 +1,92 @@
+package provisioner
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// What happened to a connection to AWS IoT
+type ConnectionEventType string
+
+const (
+	ConnectionUp           ConnectionEventType = "connected"      // A connection attempt succeeded
+	ConnectionFailed       ConnectionEventType = "connect-failed" // A connection attempt failed
+	ConnectionLost         ConnectionEventType = "lost"           // An open connection dropped or was closed by the server
+	ConnectionReconnecting ConnectionEventType = "reconnecting"   // The client is about to reconnect after losing the connection
+	ConnectionReconnected  ConnectionEventType = "reconnected"    // The connection is back after being lost
+)
+
+// Why a connection failed or was lost, telling network flaps apart from
+// failures retrying won't fix
+type ConnectionReason string
+
+const (
+	ReasonNetwork          ConnectionReason = "network"            // Timeouts, resets, and DNS failures
+	ReasonTLS              ConnectionReason = "tls"                // The handshake failed, such as for an untrusted server or a rejected certificate
+	ReasonNotAuthorized    ConnectionReason = "not-authorized"     // The certificate is not allowed to connect
+	ReasonThrottled        ConnectionReason = "throttled"          // AWS IoT is shedding load
+	ReasonServer           ConnectionReason = "server"             // The server is unavailable or shutting down
+	ReasonClientIDConflict ConnectionReason = "client-id-conflict" // Another client connected with the same client ID
+	ReasonRefused          ConnectionReason = "refused"            // Any other refusal by the server
+)
+
+// ConnectionEvent is passed to Config.OnConnectionEvent whenever a connection
+// to AWS IoT comes up, fails, or drops
+type ConnectionEvent struct {
+	Time     time.Time           `json:"time"`
+	Type     ConnectionEventType `json:"type"`
+	Endpoint string              `json:"endpoint"`
+	Reason   ConnectionReason    `json:"reason,omitempty"` // Set for failures and losses
+	Error    string              `json:"error,omitempty"`
+}
+
+// reportConnection builds the event for a connection change, err being what
+// caused it if anything, records it for the diagnostic bundle, and passes it
+// to cfg.OnConnectionEvent
+func reportConnection(cfg Config, typ ConnectionEventType, endpoint string, err error) ConnectionEvent {
+	event := ConnectionEvent{Time: time.Now().UTC(), Type: typ, Endpoint: endpoint}
+	if err != nil {
+		event.Reason = connectionReason(err)
+		event.Error = err.Error()
+	}
+	cfg.flight.connection(event)
+	if cfg.OnConnectionEvent != nil {
+		cfg.OnConnectionEvent(event)
+	}
+	return event
+}
+
+// connectionReason classifies why a connection failed or was lost
+func connectionReason(err error) ConnectionReason {
+	var conflict *ClientIDConflictError
+	var reasonErr *ReasonCodeError
+	switch {
+	case errors.As(err, &conflict):
+		return ReasonClientIDConflict
+	case errors.Is(err, packets.ErrorRefusedNotAuthorised), errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword):
+		return ReasonNotAuthorized
+	case errors.As(err, &reasonErr):
+		switch reasonErr.ReasonCode {
+		case reasonNotAuthorized, reasonBadUserNameOrPassword:
+			return ReasonNotAuthorized
+		case reasonSessionTakenOver:
+			return ReasonClientIDConflict
+		}
+		switch ClassifyError(err) {
+		case ErrorThrottled:
+			return ReasonThrottled
+		case ErrorRetryable:
+			return ReasonServer
+		default:
+			return ReasonRefused
+		}
+	// paho flattens the errors of MQTT 3.1.1 connection attempts into text
+	case strings.Contains(err.Error(), "tls: ") || strings.Contains(err.Error(), "x509: "):
+		return ReasonTLS
+	default:
+		return ReasonNetwork
+	}
+}
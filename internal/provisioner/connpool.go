@@ -0,0 +1,151 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionPool is shared by the devices provisioned from one host, such as
+// those of simulate or of concurrent Provision calls, to cut the cost of
+// their connections: TLS sessions are resumed instead of doing a full
+// handshake, and endpoint addresses are looked up once per TTL instead of by
+// every device, which resolvers throttle. It is safe for concurrent use.
+type ConnectionPool struct {
+	sessions tls.ClientSessionCache
+	dnsTTL   time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*poolHost
+
+	handshakes atomic.Int64
+	resumed    atomic.Int64
+	lookups    atomic.Int64
+}
+
+// A host name looked up by the pool
+type poolHost struct {
+	ready   chan struct{} // Closed once the lookup is done
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// PoolStats counts what a ConnectionPool saved
+type PoolStats struct {
+	Handshakes int64 // TLS handshakes of connections dialed through the pool
+	Resumed    int64 // Handshakes that resumed a session
+	Lookups    int64 // DNS lookups, the rest were answered from the pool
+}
+
+// NewConnectionPool returns a pool keeping up to sessions TLS sessions, and
+// the addresses of a host for dnsTTL
+func NewConnectionPool(sessions int, dnsTTL time.Duration) *ConnectionPool {
+	return &ConnectionPool{
+		sessions: tls.NewLRUClientSessionCache(sessions),
+		dnsTTL:   dnsTTL,
+		hosts:    map[string]*poolHost{},
+	}
+}
+
+// Stats returns what the pool saved so far
+func (p *ConnectionPool) Stats() PoolStats {
+	return PoolStats{Handshakes: p.handshakes.Load(), Resumed: p.resumed.Load(), Lookups: p.lookups.Load()}
+}
+
+// share makes config resume the sessions of its client certificate. A
+// resumed session authenticates as the certificate of the handshake that
+// created it, so sessions are never shared between certificates.
+func (p *ConnectionPool) share(config *tls.Config) {
+	identity := ""
+	if len(config.Certificates) > 0 && len(config.Certificates[0].Certificate) > 0 {
+		sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+		identity = hex.EncodeToString(sum[:])
+	}
+	config.ClientSessionCache = identitySessionCache{cache: p.sessions, identity: identity}
+}
+
+// handshake counts a completed handshake
+func (p *ConnectionPool) handshake(state tls.ConnectionState) {
+	p.handshakes.Add(1)
+	if state.DidResume {
+		p.resumed.Add(1)
+	}
+}
+
+// lookup returns the addresses of host, looking it up only when the pool has
+// none younger than the TTL. Devices asking while a lookup is under way wait
+// for it rather than looking up as well.
+func (p *ConnectionPool) lookup(ctx context.Context, resolver Resolver, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	p.mu.Lock()
+	entry := p.hosts[host]
+	if entry == nil || entry.expired() {
+		entry = &poolHost{ready: make(chan struct{})}
+		p.hosts[host] = entry
+		p.mu.Unlock()
+		p.lookups.Add(1)
+		entry.addrs, entry.err = resolver.LookupHost(context.WithoutCancel(ctx), host)
+		// Failures are not kept, the next device looks up again
+		if entry.err == nil {
+			entry.expires = time.Now().Add(p.dnsTTL)
+		}
+		close(entry.ready)
+	} else {
+		p.mu.Unlock()
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// expired reports whether the lookup is done and its addresses are too old
+func (h *poolHost) expired() bool {
+	select {
+	case <-h.ready:
+		return !time.Now().Before(h.expires)
+	default:
+		return false
+	}
+}
+
+// dial connects to the first address of the host of address (host:port) in
+// the IP family of network that accepts the connection, looking the host up
+// with resolver
+func (p *ConnectionPool) dial(ctx context.Context, dialer *net.Dialer, resolver Resolver, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := p.lookup(ctx, resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddresses(ctx, dialer, network, addrs, host, port)
+}
+
+// identitySessionCache keeps the sessions of one client certificate in a
+// cache shared by all of them
+type identitySessionCache struct {
+	cache    tls.ClientSessionCache
+	identity string
+}
+
+func (c identitySessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.identity + "/" + sessionKey)
+}
+
+func (c identitySessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.identity+"/"+sessionKey, cs)
+}
@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// IoTCredentialsProvider exchanges the device certificate for temporary AWS
+// credentials through the AWS IoT credentials provider and a role alias. It
+// implements aws.CredentialsProvider; wrap it in aws.NewCredentialsCache so the
+// credentials are only refreshed when they are about to expire.
+type IoTCredentialsProvider struct {
+	Endpoint  string // Credentials endpoint, see `aws iot describe-endpoint --endpoint-type iot:CredentialProvider`
+	RoleAlias string
+	ThingName string
+	Client    *http.Client
+}
+
+// credentialsResponse is the body returned by the credentials endpoint
+type credentialsResponse struct {
+	Credentials struct {
+		AccessKeyID     string `json:"accessKeyId"`
+		SecretAccessKey string `json:"secretAccessKey"`
+		SessionToken    string `json:"sessionToken"`
+		Expiration      string `json:"expiration"`
+	} `json:"credentials"`
+}
+
+// NewIoTCredentialsProvider creates a provider that authenticates with the
+// device certificate
+func NewIoTCredentialsProvider(cfg Config, cert tls.Certificate, endpoint, roleAlias, thingName string) (*IoTCredentialsProvider, error) {
+	tlsConfig, err := newTLSConfig(cfg, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IoTCredentialsProvider{
+		Endpoint:  endpoint,
+		RoleAlias: roleAlias,
+		ThingName: thingName,
+		Client: &http.Client{
+			Timeout:   cfg.ConnectTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Retrieve fetches a new set of temporary credentials
+func (p *IoTCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	u := fmt.Sprintf("https://%s/role-aliases/%s/credentials", p.Endpoint, url.PathEscape(p.RoleAlias))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to create credentials request: %v", err)
+	}
+	// Required when the role alias policy uses thing name policy variables
+	if p.ThingName != "" {
+		req.Header.Set("x-amzn-iot-thingname", p.ThingName)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to request credentials: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		return aws.Credentials{}, fmt.Errorf("credentials request for role alias %s failed with %s: %s", p.RoleAlias, resp.Status, string(body))
+	}
+
+	// Decoded as it arrives rather than buffered first
+	var response credentialsResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&response); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to unmarshal credentials response: %v", err)
+	}
+	expires, err := time.Parse(time.RFC3339, response.Credentials.Expiration)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("invalid credentials expiration %q: %v", response.Credentials.Expiration, err)
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     response.Credentials.AccessKeyID,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		Source:          "IoTCredentialsProvider",
+		CanExpire:       true,
+		Expires:         expires,
+	}, nil
+}
@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"time"
+)
+
+// watchCredentials checks the permanent credentials of a provisioned device
+// every interval. When they are deleted or damaged, for example by corrupted
+// flash, it records an alert in the audit log and provisions again with the
+// claim. The old certificate stays registered in AWS IoT.
+func (s *apiServer) watchCredentials(interval time.Duration) {
+	clock := s.cfg.clock()
+	for {
+		clock.Sleep(interval)
+		certificateID, err := checkCredentialsLocked(s.cfg)
+		if err == nil {
+			continue
+		}
+		if err := s.begin(); err != nil {
+			continue // Provisioning or rotating already
+		}
+		log.Printf("Warning: device credentials lost: %v, provisioning again with the claim", err)
+		sdNotify("STATUS=Device credentials lost, provisioning again")
+		recordAudit(s.cfg, auditEntry{Event: AuditCredentialsLost, CertificateID: certificateID, Error: err.Error()})
+		if err := removeDeviceFiles(s.cfg); err != nil {
+			s.end(err)
+			continue
+		}
+		_, err = run(s.cfg, nil)
+		s.end(err)
+	}
+}
+
+// checkCredentialsLocked checks the credentials with the output directory
+// locked, after completing a rotation a crash interrupted, so neither a
+// rotation in progress nor an interrupted one is taken for lost credentials.
+// Credentials that cannot be checked, such as while the lock cannot be taken,
+// are logged and not reported lost.
+func checkCredentialsLocked(cfg Config) (string, error) {
+	unlock, err := lockOutputDir(cfg)
+	if err != nil {
+		log.Printf("Warning: cannot check device credentials: %v", err)
+		return "", nil
+	}
+	defer unlock()
+	if err := recoverDeviceCredentials(cfg); err != nil {
+		log.Printf("Warning: cannot check device credentials: %v", err)
+		return "", nil
+	}
+	return checkCredentials(cfg)
+}
+
+// checkCredentials returns why the credentials of a provisioned device are
+// unusable, or nil if they are intact or the device is not provisioned yet,
+// along with the certificate ID the device was provisioned with
+func checkCredentials(cfg Config) (string, error) {
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return "", err
+	}
+	if state.State != FlowVerified {
+		return "", nil
+	}
+	// Rotation updates the identity before the state
+	provisioned := state.CertificateID
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil {
+		return provisioned, err
+	}
+	if identity != nil {
+		provisioned = identity.CertificateID
+	}
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return provisioned, fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return provisioned, fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+	if id := certificateID(leaf); id != provisioned {
+		return provisioned, fmt.Errorf("device certificate %s is not the provisioned certificate %s", id, provisioned)
+	}
+	return provisioned, nil
+}
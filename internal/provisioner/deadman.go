@@ -0,0 +1,169 @@
+package provisioner
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time waited for a call into the MQTT client beyond the timeout it enforces
+// itself before the client is taken for wedged. Paho has been seen to hang
+// without ever timing out on NAT paths that drop packets silently: a PINGRESP
+// that never comes goes unnoticed and its goroutines block on a dead socket.
+const wedgeGrace = 5 * time.Second
+
+// WedgedError is returned by a transport whose MQTT client did not return
+// from a call within its dead-man timer. The client is abandoned: every later
+// call fails with the same error, and a new connection has to be made.
+type WedgedError struct {
+	Op    string // Publish, Subscribe, Unsubscribe, or Disconnect
+	Topic string
+	After time.Duration
+}
+
+func (e *WedgedError) Error() string {
+	return fmt.Sprintf("MQTT client wedged: %s %s did not return within %s", e.Op, e.Topic, e.After)
+}
+
+// wedgeCounter counts the MQTT clients of a process found wedged, in total
+// and since a call last returned in time
+type wedgeCounter struct {
+	total       atomic.Int64
+	consecutive atomic.Int64
+	// Called with the consecutive count when a client is found wedged
+	onWedge func(consecutive int64)
+}
+
+func (w *wedgeCounter) wedged() {
+	if w == nil {
+		return
+	}
+	w.total.Add(1)
+	consecutive := w.consecutive.Add(1)
+	if w.onWedge != nil {
+		w.onWedge(consecutive)
+	}
+}
+
+func (w *wedgeCounter) alive() {
+	if w != nil {
+		w.consecutive.Store(0)
+	}
+}
+
+// Total returns the number of clients found wedged
+func (w *wedgeCounter) Total() int64 {
+	if w == nil {
+		return 0
+	}
+	return w.total.Load()
+}
+
+// deadManTransport runs every call into the MQTT client under a dead-man
+// timer, giving up on the client when one does not return in time. The call
+// is left to return or not on its own goroutine.
+type deadManTransport struct {
+	Transport
+	cfg    Config
+	wedges *wedgeCounter
+
+	mu    sync.Mutex
+	wedge *WedgedError
+}
+
+// guardTransport returns transport with its calls under dead-man timers
+func guardTransport(cfg Config, transport Transport) Transport {
+	return &deadManTransport{Transport: transport, cfg: cfg, wedges: cfg.wedges}
+}
+
+// call runs fn, waiting up to bound for it to return
+func (t *deadManTransport) call(op, topic string, bound time.Duration, fn func() error) error {
+	t.mu.Lock()
+	wedge := t.wedge
+	t.mu.Unlock()
+	if wedge != nil {
+		return wedge
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(bound)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		t.wedges.alive()
+		return err
+	case <-timer.C:
+	}
+
+	wedge = &WedgedError{Op: op, Topic: topic, After: bound}
+	t.mu.Lock()
+	if t.wedge != nil {
+		wedge = t.wedge
+		t.mu.Unlock()
+		return wedge
+	}
+	t.wedge = wedge
+	t.mu.Unlock()
+	log.Printf("Warning: %v, abandoning the connection to %s", wedge, t.Endpoint())
+	reportConnection(t.cfg, ConnectionLost, t.Endpoint(), wedge)
+	t.wedges.wedged()
+	return wedge
+}
+
+func (t *deadManTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	return t.call("Subscribe", topic, t.cfg.SubscribeTimeout+wedgeGrace, func() error {
+		return t.Transport.Subscribe(topic, qos, handler)
+	})
+}
+
+func (t *deadManTransport) Unsubscribe(topics ...string) error {
+	topic := ""
+	if len(topics) > 0 {
+		topic = topics[0]
+	}
+	return t.call("Unsubscribe", topic, t.cfg.SubscribeTimeout+wedgeGrace, func() error {
+		return t.Transport.Unsubscribe(topics...)
+	})
+}
+
+func (t *deadManTransport) Publish(topic string, qos byte, payload []byte) error {
+	return t.call("Publish", topic, t.cfg.PublishTimeout+wedgeGrace, func() error {
+		return t.Transport.Publish(topic, qos, payload)
+	})
+}
+
+func (t *deadManTransport) IsConnected() bool {
+	t.mu.Lock()
+	wedged := t.wedge != nil
+	t.mu.Unlock()
+	return !wedged && t.Transport.IsConnected()
+}
+
+// Disconnect waits for a wedged client no longer than quiesce, and for a
+// client that is not wedged yet no longer than its dead-man timer
+func (t *deadManTransport) Disconnect(quiesce time.Duration) {
+	t.mu.Lock()
+	wedged := t.wedge != nil
+	t.mu.Unlock()
+	if wedged {
+		done := make(chan struct{})
+		go func() {
+			t.Transport.Disconnect(0)
+			close(done)
+		}()
+		timer := time.NewTimer(quiesce)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		return
+	}
+	t.call("Disconnect", t.Endpoint(), quiesce+wedgeGrace, func() error {
+		t.Transport.Disconnect(quiesce)
+		return nil
+	})
+}
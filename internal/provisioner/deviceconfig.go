@@ -0,0 +1,306 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Keys of the template's device configuration the appliers act on
+const (
+	configWiFiSSID   = "wifi_ssid"
+	configWiFiPSK    = "wifi_psk"
+	configNTPServers = "ntp_servers" // A list, or a string separated by commas or spaces
+	configServerTime = "server_time" // When the thing registered, see servertime.go
+)
+
+// Built-in appliers, chosen with -apply-config
+const (
+	ApplierNmcli         = "nmcli"          // A NetworkManager Wi-Fi connection
+	ApplierWPASupplicant = "wpa-supplicant" // The wpa_supplicant configuration
+	ApplierChrony        = "chrony"         // A chrony sources file
+)
+
+// Name of the NetworkManager connection the nmcli applier manages
+const nmcliConnection = "aws-iot-wifi"
+
+// NTP servers chrony accepts: host names and IPv4 or IPv6 addresses
+var ntpServerPattern = regexp.MustCompile(`^[A-Za-z0-9.:-]{1,253}$`)
+
+// DeviceSettings are the well-known settings of the device configuration a
+// provisioning template returns, which appliers hand over to the system
+type DeviceSettings struct {
+	WiFiSSID   string
+	WiFiPSK    string // Empty for an open network
+	NTPServers []string
+}
+
+// ConfigApplier hands device settings over to a system service. Apply runs
+// after every provisioning run, so it must converge: when the service already
+// has the settings it changes nothing and reports no change. Settings it does
+// not handle are ignored.
+type ConfigApplier interface {
+	Name() string
+	Apply(settings DeviceSettings) (changed bool, err error)
+}
+
+// Appliers of the device configuration, run once the device is provisioned
+type Appliers struct {
+	Names             []string        // Built-in appliers, -apply-config
+	Custom            []ConfigApplier // Appliers of library callers, run after the built-in ones
+	WiFiInterface     string
+	WPASupplicantConf string
+	ChronySources     string // File of chrony's sourcedir the NTP servers are written to
+}
+
+// parseDeviceSettings picks the well-known settings out of a device
+// configuration. Keys that are absent leave their settings empty.
+func parseDeviceSettings(config map[string]interface{}) (DeviceSettings, error) {
+	var settings DeviceSettings
+	str := func(key string) (string, error) {
+		value, ok := config[key]
+		if !ok || value == nil {
+			return "", nil
+		}
+		s, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("device configuration %s must be a string", key)
+		}
+		return s, nil
+	}
+	var err error
+	if settings.WiFiSSID, err = str(configWiFiSSID); err != nil {
+		return settings, err
+	}
+	if settings.WiFiPSK, err = str(configWiFiPSK); err != nil {
+		return settings, err
+	}
+	if len(settings.WiFiSSID) > 32 {
+		return settings, fmt.Errorf("device configuration %s is longer than 32 bytes", configWiFiSSID)
+	}
+	if settings.WiFiPSK != "" {
+		if settings.WiFiSSID == "" {
+			return settings, fmt.Errorf("device configuration has %s without %s", configWiFiPSK, configWiFiSSID)
+		}
+		if len(settings.WiFiPSK) < 8 || len(settings.WiFiPSK) > 63 || strings.IndexFunc(settings.WiFiPSK, func(r rune) bool { return r < 0x20 || r > 0x7e }) >= 0 {
+			return settings, fmt.Errorf("device configuration %s must be 8 to 63 printable ASCII characters", configWiFiPSK)
+		}
+	}
+
+	switch servers := config[configNTPServers].(type) {
+	case nil:
+	case string:
+		settings.NTPServers = strings.FieldsFunc(servers, func(r rune) bool { return r == ',' || r == ' ' })
+	case []interface{}:
+		for _, server := range servers {
+			s, ok := server.(string)
+			if !ok {
+				return settings, fmt.Errorf("device configuration %s must list strings", configNTPServers)
+			}
+			settings.NTPServers = append(settings.NTPServers, s)
+		}
+	default:
+		return settings, fmt.Errorf("device configuration %s must be a list or a string", configNTPServers)
+	}
+	for _, server := range settings.NTPServers {
+		if !ntpServerPattern.MatchString(server) {
+			return settings, fmt.Errorf("device configuration %s has invalid server %q", configNTPServers, server)
+		}
+	}
+	return settings, nil
+}
+
+// holdsSecrets reports whether a device configuration holds the Wi-Fi
+// passphrase, so files it is written to need the key mode
+func holdsSecrets(config map[string]interface{}) bool {
+	_, ok := config[configWiFiPSK]
+	return ok
+}
+
+// validateAppliers checks the names of the built-in appliers
+func validateAppliers(names []string) error {
+	for _, name := range names {
+		switch name {
+		case ApplierNmcli, ApplierWPASupplicant, ApplierChrony:
+		default:
+			return fmt.Errorf("unsupported -apply-config %q: use %s, %s, or %s", name, ApplierNmcli, ApplierWPASupplicant, ApplierChrony)
+		}
+	}
+	if slices.Contains(names, ApplierNmcli) && slices.Contains(names, ApplierWPASupplicant) {
+		return fmt.Errorf("-apply-config %s and %s both manage Wi-Fi, choose one", ApplierNmcli, ApplierWPASupplicant)
+	}
+	return nil
+}
+
+// applyDeviceConfiguration hands the well-known settings of the device
+// configuration to the configured appliers. Every applier is run; the errors
+// of those that failed are returned together.
+func applyDeviceConfiguration(cfg Config, result *ProvisioningResult) error {
+	if len(cfg.Appliers.Names) == 0 && len(cfg.Appliers.Custom) == 0 {
+		return nil
+	}
+	settings, err := parseDeviceSettings(result.DeviceConfiguration)
+	if err != nil {
+		return err
+	}
+	var appliers []ConfigApplier
+	for _, name := range cfg.Appliers.Names {
+		switch name {
+		case ApplierNmcli:
+			appliers = append(appliers, nmcliApplier{cfg})
+		case ApplierWPASupplicant:
+			appliers = append(appliers, wpaSupplicantApplier{cfg})
+		case ApplierChrony:
+			appliers = append(appliers, chronyApplier{cfg})
+		}
+	}
+	appliers = append(appliers, cfg.Appliers.Custom...)
+
+	var problems []string
+	for _, applier := range appliers {
+		changed, err := applier.Apply(settings)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", applier.Name(), err))
+			continue
+		}
+		if changed {
+			log.Printf("Applied the device configuration with %s", applier.Name())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to apply device configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// runApplierCommand runs a command of an applier, killed after the hook
+// timeout, and returns its output
+func runApplierCommand(cfg Config, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HookTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s timed out after %s", name, cfg.HookTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%s failed: %v: %s", name, err, message)
+		}
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+	return out, nil
+}
+
+// writeIfChanged writes data to path unless it already holds it, and reports
+// whether it wrote
+func writeIfChanged(cfg Config, path string, data []byte, secret bool) (bool, error) {
+	current, err := cfg.Files.fs().ReadFile(path)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := cfg.Files.write(path, data, secret); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// nmcliApplier keeps a NetworkManager connection on the configured Wi-Fi
+// network, replacing it when the network or passphrase changes
+type nmcliApplier struct{ cfg Config }
+
+func (a nmcliApplier) Name() string { return ApplierNmcli }
+
+func (a nmcliApplier) Apply(settings DeviceSettings) (bool, error) {
+	if settings.WiFiSSID == "" {
+		return false, nil
+	}
+	// -s shows the passphrase, which needs the rights to change it anyway
+	current, err := runApplierCommand(a.cfg, "nmcli", "-s", "-g", "802-11-wireless.ssid,802-11-wireless-security.psk", "connection", "show", nmcliConnection)
+	if err == nil && string(current) == settings.WiFiSSID+"\n"+settings.WiFiPSK+"\n" {
+		return false, nil
+	}
+	if err == nil {
+		if _, err := runApplierCommand(a.cfg, "nmcli", "connection", "delete", nmcliConnection); err != nil {
+			return false, err
+		}
+	}
+	args := []string{"connection", "add", "type", "wifi", "con-name", nmcliConnection, "ifname", a.cfg.Appliers.WiFiInterface, "ssid", settings.WiFiSSID}
+	if settings.WiFiPSK != "" {
+		args = append(args, "wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.psk", settings.WiFiPSK)
+	}
+	if _, err := runApplierCommand(a.cfg, "nmcli", args...); err != nil {
+		return false, err
+	}
+	if _, err := runApplierCommand(a.cfg, "nmcli", "connection", "up", nmcliConnection); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// wpaSupplicantApplier writes the Wi-Fi network to the wpa_supplicant
+// configuration, which it replaces, and has wpa_supplicant reload it
+type wpaSupplicantApplier struct{ cfg Config }
+
+func (a wpaSupplicantApplier) Name() string { return ApplierWPASupplicant }
+
+func (a wpaSupplicantApplier) Apply(settings DeviceSettings) (bool, error) {
+	if settings.WiFiSSID == "" {
+		return false, nil
+	}
+	var b strings.Builder
+	b.WriteString("ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\nupdate_config=1\n\nnetwork={\n")
+	// Hex needs no quoting whatever the SSID holds
+	fmt.Fprintf(&b, "\tssid=%x\n", settings.WiFiSSID)
+	if settings.WiFiPSK != "" {
+		// wpa_supplicant reads up to the last quote, so quotes in it are kept
+		fmt.Fprintf(&b, "\tpsk=\"%s\"\n", settings.WiFiPSK)
+	} else {
+		b.WriteString("\tkey_mgmt=NONE\n")
+	}
+	b.WriteString("}\n")
+	changed, err := writeIfChanged(a.cfg, a.cfg.Appliers.WPASupplicantConf, []byte(b.String()), true)
+	if err != nil || !changed {
+		return false, err
+	}
+	if _, err := runApplierCommand(a.cfg, "wpa_cli", "-i", a.cfg.Appliers.WiFiInterface, "reconfigure"); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// chronyApplier writes the NTP servers to a file of chrony's sourcedir and has
+// chrony reload its sources
+type chronyApplier struct{ cfg Config }
+
+func (a chronyApplier) Name() string { return ApplierChrony }
+
+func (a chronyApplier) Apply(settings DeviceSettings) (bool, error) {
+	if len(settings.NTPServers) == 0 {
+		return false, nil
+	}
+	var b strings.Builder
+	for _, server := range settings.NTPServers {
+		fmt.Fprintf(&b, "server %s iburst\n", server)
+	}
+	changed, err := writeIfChanged(a.cfg, a.cfg.Appliers.ChronySources, []byte(b.String()), false)
+	if err != nil || !changed {
+		return false, err
+	}
+	if _, err := runApplierCommand(a.cfg, "chronyc", "reload", "sources"); err != nil {
+		return true, err
+	}
+	return true, nil
+}
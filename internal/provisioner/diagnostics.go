@@ -0,0 +1,269 @@
+package provisioner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostic bundles kept in the diagnostics directory, the oldest being
+// removed first
+const diagnosticBundles = 5
+
+// Events kept of each kind by the flight recorder
+const flightRecorderEvents = 100
+
+// Request AWS IoT rejected, with the payload of the rejected topic as sent
+type rejectedPayload struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Payload string    `json:"payload"`
+}
+
+// recorder is the flight recorder of a provisioning attempt: it keeps the
+// connection events and rejections for the diagnostic bundle. Each attempt
+// has its own, so concurrent runs in one process don't mix their events. A
+// nil recorder records nothing.
+type recorder struct {
+	mu          sync.Mutex
+	connections []ConnectionEvent
+	rejections  []rejectedPayload
+}
+
+// connection records a connection event
+func (r *recorder) connection(event ConnectionEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connections = appendBounded(r.connections, event)
+}
+
+// rejection records the payload of a rejected request
+func (r *recorder) rejection(op string, payload string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejections = appendBounded(r.rejections, rejectedPayload{Time: time.Now().UTC(), Op: op, Payload: payload})
+}
+
+// appendBounded appends e, dropping the oldest events beyond the recorder's limit
+func appendBounded[E any](events []E, e E) []E {
+	events = append(events, e)
+	if len(events) > flightRecorderEvents {
+		events = slices.Delete(events, 0, len(events)-flightRecorderEvents)
+	}
+	return events
+}
+
+// Summary of the failure, first in the bundle
+type diagnosticFailure struct {
+	Time             time.Time  `json:"time"`
+	Error            string     `json:"error"`
+	Class            ErrorClass `json:"class"`
+	Code             ErrorCode  `json:"code"`
+	FlowState        FlowState  `json:"flowState"`
+	CertificateID    string     `json:"certificateId,omitempty"`
+	ThingName        string     `json:"thingName,omitempty"`
+	Target           string     `json:"target,omitempty"`
+	TerminalFailures int        `json:"terminalFailures"`
+}
+
+// Clock and network of the device at the time of the failure: a wrong clock
+// fails certificate validation, and DNS or routing problems look like a
+// refusing endpoint
+type diagnosticSystem struct {
+	Time            time.Time              `json:"time"`
+	TimeZone        string                 `json:"timeZone"`
+	ClockSynced     *bool                  `json:"clockSynced,omitempty"` // From systemd-timesyncd, if running
+	Hostname        string                 `json:"hostname,omitempty"`
+	Platform        string                 `json:"platform"`
+	Interfaces      []diagnosticInterface  `json:"interfaces"`
+	Nameservers     []string               `json:"nameservers,omitempty"`
+	EndpointLookups []diagnosticResolution `json:"endpointLookups"`
+}
+
+type diagnosticInterface struct {
+	Name         string   `json:"name"`
+	Flags        string   `json:"flags"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+}
+
+type diagnosticResolution struct {
+	Endpoint  string   `json:"endpoint"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// writeDiagnosticBundle writes a tarball describing a failed attempt to
+// cfg.DiagnosticsDir, for support to ask for: the failure, the configuration
+// with secrets redacted, the stage timings, the rejected payloads, the
+// connection events, and the device's clock and network. The claim and device
+// credentials and the ownership token are never included.
+func writeDiagnosticBundle(cfg Config, state *provisioningState, timer *stageTimer, failure error) (string, error) {
+	now := time.Now().UTC()
+	var connections []ConnectionEvent
+	var rejections []rejectedPayload
+	if flight := cfg.flight; flight != nil {
+		flight.mu.Lock()
+		connections = slices.Clone(flight.connections)
+		rejections = slices.Clone(flight.rejections)
+		flight.mu.Unlock()
+	}
+	// Bundles leave the device, so secrets are redacted even with -show-secrets
+	for i := range rejections {
+		rejections[i].Payload = secrets.redact(rejections[i].Payload)
+	}
+
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"failure.json", diagnosticFailure{
+			Time:             now,
+			Error:            secrets.redact(failure.Error()),
+			Class:            ClassifyError(failure),
+			Code:             ErrorCodeOf(failure),
+			FlowState:        state.State,
+			CertificateID:    state.CertificateID,
+			ThingName:        state.ThingName,
+			Target:           state.Target,
+			TerminalFailures: state.TerminalFailures,
+		}},
+		{"config.json", redactedConfig(cfg)},
+		{"stages.json", struct {
+			Stages    []StageTiming `json:"stages"`
+			Latencies Latencies     `json:"latencies"`
+		}{timer.stages, timer.latencies}},
+		{"rejections.json", rejections},
+		{"connections.json", connections},
+		{"system.json", systemDiagnostics(cfg, now)},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.v, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal %s: %v", file.name, err)
+		}
+		header := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	if err := cfg.Files.fs().MkdirAll(cfg.DiagnosticsDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create diagnostics directory: %v", err)
+	}
+	path := filepath.Join(cfg.DiagnosticsDir, "diagnostics-"+now.Format("20060102T150405Z")+".tar.gz")
+	if err := cfg.Files.write(path, buf.Bytes(), true); err != nil {
+		return "", fmt.Errorf("failed to write diagnostic bundle: %v", err)
+	}
+	pruneDiagnosticBundles(cfg)
+	return path, nil
+}
+
+// pruneDiagnosticBundles removes all but the newest bundles. Their names sort
+// by time.
+func pruneDiagnosticBundles(cfg Config) {
+	entries, err := cfg.Files.fs().ReadDir(cfg.DiagnosticsDir)
+	if err != nil {
+		return
+	}
+	var bundles []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "diagnostics-") && strings.HasSuffix(entry.Name(), ".tar.gz") {
+			bundles = append(bundles, entry.Name())
+		}
+	}
+	slices.Sort(bundles)
+	for len(bundles) > diagnosticBundles {
+		if err := cfg.Files.fs().Remove(filepath.Join(cfg.DiagnosticsDir, bundles[0])); err != nil {
+			log.Printf("Warning: failed to remove old diagnostic bundle: %v", err)
+		}
+		bundles = bundles[1:]
+	}
+}
+
+// redactedConfig returns the configuration without anything that grants
+// access: the external ID of the assumed role, and the query of the claim
+// bundle URLs, which carries the signature of presigned URLs. The files it
+// names are not included.
+func redactedConfig(cfg Config) Config {
+	cfg.Files.FS = nil
+	if cfg.ExternalID != "" {
+		cfg.ExternalID = redacted
+	}
+	if cfg.ClaimBundleURL != "" {
+		cfg.ClaimBundleURL = redactURL(cfg.ClaimBundleURL)
+	}
+	if cfg.ClaimBundleSignatureURL != "" {
+		cfg.ClaimBundleSignatureURL = redactURL(cfg.ClaimBundleSignatureURL)
+	}
+	return cfg
+}
+
+// systemDiagnostics describes the device's clock and network
+func systemDiagnostics(cfg Config, now time.Time) diagnosticSystem {
+	zone, _ := time.Now().Zone()
+	system := diagnosticSystem{Time: now, TimeZone: zone, Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if _, err := os.Stat("/run/systemd/timesync"); err == nil {
+		_, err := os.Stat("/run/systemd/timesync/synchronized")
+		synced := err == nil
+		system.ClockSynced = &synced
+	}
+	system.Hostname, _ = os.Hostname()
+
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		described := diagnosticInterface{Name: iface.Name, Flags: iface.Flags.String(), HardwareAddr: iface.HardwareAddr.String()}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			described.Addresses = append(described.Addresses, addr.String())
+		}
+		system.Interfaces = append(system.Interfaces, described)
+	}
+	if data, err := os.ReadFile("/etc/resolv.conf"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "nameserver" {
+				system.Nameservers = append(system.Nameservers, fields[1])
+			}
+		}
+	}
+	for _, endpoint := range cfg.Endpoints {
+		lookup := diagnosticResolution{Endpoint: endpoint}
+		addrs, err := net.LookupHost(endpoint)
+		if err != nil {
+			lookup.Error = err.Error()
+		}
+		lookup.Addresses = addrs
+		system.EndpointLookups = append(system.EndpointLookups, lookup)
+	}
+	return system
+}
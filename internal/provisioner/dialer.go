@@ -0,0 +1,124 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// IP families accepted by the -ip-family flag
+const (
+	IPFamilyAuto = "auto"
+	IPFamilyV4   = "4"
+	IPFamilyV6   = "6"
+)
+
+// dialNetwork returns the network name for the configured IP family. With
+// "tcp" the dialer races IPv6 and IPv4 (happy eyeballs), preferring the
+// address family listed first by DNS.
+func dialNetwork(family string) (string, error) {
+	switch family {
+	case IPFamilyAuto:
+		return "tcp", nil
+	case IPFamilyV4:
+		return "tcp4", nil
+	case IPFamilyV6:
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("unsupported IP family %q: use %s, %s or %s", family, IPFamilyAuto, IPFamilyV4, IPFamilyV6)
+	}
+}
+
+// dialTLS opens the TLS connection to an endpoint address (host:port) using the
+// configured IP family and dual-stack fallback delay
+func dialTLS(ctx context.Context, cfg Config, tlsConfig *tls.Config, address string) (net.Conn, error) {
+	network, err := dialNetwork(cfg.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{
+			Timeout:       cfg.ConnectTimeout,
+			FallbackDelay: cfg.FallbackDelay,
+		},
+		Config: tlsConfig,
+	}
+	resolver, err := cfg.resolver()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Traffic == nil && cfg.Pool == nil && resolver == nil {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial %s over %s: %v", address, network, err)
+		}
+		return conn, nil
+	}
+
+	// Count below TLS, so the handshake and record overhead a metered link
+	// pays for are included. The timeout covers both, as tls.Dialer's does.
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	var raw net.Conn
+	switch {
+	case cfg.Pool != nil:
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		raw, err = cfg.Pool.dial(ctx, dialer.NetDialer, resolver, network, address)
+	case resolver != nil:
+		raw, err = dialResolved(ctx, dialer.NetDialer, resolver, network, address)
+	default:
+		raw, err = dialer.NetDialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s over %s: %v", address, network, err)
+	}
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	if cfg.Pool != nil {
+		cfg.Pool.share(config)
+	}
+	conn := raw
+	if cfg.Traffic != nil {
+		conn = &countingConn{Conn: raw, traffic: cfg.Traffic}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to dial %s over %s: %v", address, network, err)
+	}
+	if cfg.Pool != nil {
+		cfg.Pool.handshake(tlsConn.ConnectionState())
+	}
+	return tlsConn, nil
+}
+
+// Traffic counts the bytes sent and received on connections, TLS included
+type Traffic struct {
+	Sent     atomic.Int64
+	Received atomic.Int64
+}
+
+// countingConn adds what passes through a connection to its traffic
+type countingConn struct {
+	net.Conn
+	traffic *Traffic
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.traffic.Received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.traffic.Sent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,167 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+// Envelope encrypted claim credential file. The PEM is encrypted with a random
+// AES-256-GCM data key, and the data key with either KMS or a local wrapping
+// key, so a stolen device only yields the shared claim secret together with
+// access to the KMS key or the wrapping key.
+type claimEnvelope struct {
+	EncryptedDataKey []byte `json:"encryptedDataKey"` // KMS ciphertext blob, or nonce and ciphertext under the wrapping key
+	Nonce            []byte `json:"nonce"`
+	Ciphertext       []byte `json:"ciphertext"`
+}
+
+// isEnvelope reports whether data is an encrypted claim envelope
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// open decrypts the secret in memory if it is an envelope, leaving PEM data as
+// it is. The data key is decrypted with the -claim-wrapping-key if one is
+// configured, and with KMS otherwise.
+func (s *secret) open(cfg Config) error {
+	if !isEnvelope(s.data) {
+		return nil
+	}
+	var envelope claimEnvelope
+	if err := json.Unmarshal(s.data, &envelope); err != nil {
+		return fmt.Errorf("%s: invalid claim envelope: %v", s.source, err)
+	}
+
+	var dataKey []byte
+	if cfg.ClaimWrappingKey != "" {
+		wrappingKey, err := readWrappingKey(cfg.Files.fs(), cfg.ClaimWrappingKey)
+		if err != nil {
+			return err
+		}
+		defer clear(wrappingKey)
+		if dataKey, err = gcmOpen(wrappingKey, envelope.EncryptedDataKey); err != nil {
+			return fmt.Errorf("%s: failed to unwrap data key: %v", s.source, err)
+		}
+	} else {
+		var err error
+		if dataKey, err = kmsDecryptDataKey(cfg, envelope.EncryptedDataKey); err != nil {
+			return fmt.Errorf("%s: %v", s.source, err)
+		}
+	}
+	defer clear(dataKey)
+
+	plaintext, err := gcmOpen(dataKey, append(envelope.Nonce, envelope.Ciphertext...))
+	if err != nil {
+		return fmt.Errorf("%s: failed to decrypt: %v", s.source, err)
+	}
+	clear(s.data)
+	s.data = plaintext
+	return nil
+}
+
+// gcmOpen decrypts AES-256-GCM data made of a nonce followed by the ciphertext
+func gcmOpen(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// gcmSeal encrypts data with AES-256-GCM, returning a random nonce followed by
+// the ciphertext
+func gcmSeal(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// runClaimEncryptCommand encrypts a claim certificate or key file into an
+// envelope, with a data key from KMS or wrapped with a local key
+func runClaimEncryptCommand(args []string) error {
+	cfg := defaultConfig()
+	in, out := "", ""
+
+	fs := flag.NewFlagSet("claim-encrypt", flag.ExitOnError)
+	fs.StringVar(&in, "in", in, "PEM file to encrypt")
+	fs.StringVar(&out, "out", out, "Where to write the envelope (default the input file with .enc appended)")
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "AWS region of the KMS key")
+	fs.StringVar(&cfg.ClaimKMSKey, "claim-kms-key", cfg.ClaimKMSKey, "KMS key ID, ARN, or alias to generate the data key with")
+	fs.StringVar(&cfg.ClaimWrappingKey, "claim-wrapping-key", cfg.ClaimWrappingKey, "File with a 32 byte AES key to wrap the data key with instead of KMS")
+	cfg.registerAWSFlags(fs)
+	fs.Parse(args)
+
+	if in == "" || (cfg.ClaimKMSKey == "") == (cfg.ClaimWrappingKey == "") {
+		return fmt.Errorf("usage: claim-encrypt -in file (-claim-kms-key key | -claim-wrapping-key file)")
+	}
+	if err := cfg.validateAWS(); err != nil {
+		return err
+	}
+	if out == "" {
+		out = in + ".enc"
+	}
+	plaintext, err := cfg.Files.fs().ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", in, err)
+	}
+	defer clear(plaintext)
+
+	var envelope claimEnvelope
+	var dataKey []byte
+	if cfg.ClaimWrappingKey != "" {
+		wrappingKey, err := readWrappingKey(cfg.Files.fs(), cfg.ClaimWrappingKey)
+		if err != nil {
+			return err
+		}
+		defer clear(wrappingKey)
+		dataKey = make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return fmt.Errorf("failed to generate data key: %v", err)
+		}
+		if envelope.EncryptedDataKey, err = gcmSeal(wrappingKey, dataKey); err != nil {
+			return fmt.Errorf("failed to wrap data key: %v", err)
+		}
+	} else {
+		if dataKey, envelope.EncryptedDataKey, err = kmsGenerateDataKey(cfg); err != nil {
+			return err
+		}
+	}
+	defer clear(dataKey)
+
+	sealed, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %v", in, err)
+	}
+	envelope.Nonce, envelope.Ciphertext = sealed[:12], sealed[12:]
+	data, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %v", err)
+	}
+	if err := cfg.Files.write(out, data, false); err != nil {
+		return fmt.Errorf("failed to write %s: %v", out, err)
+	}
+	fmt.Printf("Encrypted %s to %s\n", in, out)
+	return nil
+}
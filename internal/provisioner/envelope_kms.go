@@ -0,0 +1,52 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// kmsDecryptDataKey decrypts the data key of a claim envelope with KMS, with
+// the -claim-kms-key if one is configured
+func kmsDecryptDataKey(cfg Config, blob []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("data key is KMS encrypted: %v", err)
+	}
+	input := &kms.DecryptInput{CiphertextBlob: blob}
+	if cfg.ClaimKMSKey != "" {
+		input.KeyId = aws.String(cfg.ClaimKMSKey)
+	}
+	decrypted, err := kms.NewFromConfig(awsCfg).Decrypt(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with KMS: %v", err)
+	}
+	return decrypted.Plaintext, nil
+}
+
+// kmsGenerateDataKey generates an AES-256 data key with the -claim-kms-key,
+// returning it in plaintext and encrypted
+func kmsGenerateDataKey(cfg Config) (plaintext, blob []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	generated, err := kms.NewFromConfig(awsCfg).GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(cfg.ClaimKMSKey),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key with KMS: %v", err)
+	}
+	return generated.Plaintext, generated.CiphertextBlob, nil
+}
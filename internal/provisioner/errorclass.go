@@ -0,0 +1,118 @@
+package provisioner
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrorClass says how a provisioning failure should be retried. The CLI's
+// retry, failover, and quarantine logic all use ClassifyError, and library
+// callers can use it to handle failures the same way.
+type ErrorClass string
+
+const (
+	// ErrorRetryable failures are transient: retry with the normal backoff
+	ErrorRetryable ErrorClass = "retryable"
+	// ErrorThrottled failures mean AWS IoT is shedding load: retry after a
+	// randomised delay (see Backoff.ThrottledDelay)
+	ErrorThrottled ErrorClass = "throttled"
+	// ErrorTerminal failures need the configuration or the AWS IoT setup
+	// fixed, retrying cannot help
+	ErrorTerminal ErrorClass = "terminal"
+)
+
+// Error codes AWS IoT Fleet Provisioning publishes on the rejected topics, and
+// how to retry them. Codes not listed are classified by their status code.
+var errorCodeClasses = map[string]ErrorClass{
+	"ThrottlingException":         ErrorThrottled,
+	"Throttling":                  ErrorThrottled,
+	"LimitExceededException":      ErrorThrottled,
+	"InternalFailure":             ErrorRetryable,
+	"InternalFailureException":    ErrorRetryable,
+	"InternalException":           ErrorRetryable,
+	"ServiceUnavailable":          ErrorRetryable,
+	"ServiceUnavailableException": ErrorRetryable,
+	"InvalidPayload":              ErrorTerminal,
+	"InvalidRequest":              ErrorTerminal,
+	"InvalidRequestException":     ErrorTerminal,
+	"ResourceRegistrationFailure": ErrorTerminal, // Template or pre-provisioning hook refused the device
+	"ResourceNotFoundException":   ErrorTerminal, // Template does not exist
+	"Unauthorized":                ErrorTerminal,
+	"UnauthorizedException":       ErrorTerminal,
+	"Forbidden":                   ErrorTerminal,
+	"ForbiddenException":          ErrorTerminal,
+}
+
+// MQTT 5 reason codes AWS IoT sends when it sheds load
+const (
+	reasonServerBusy    = 0x89
+	reasonQuotaExceeded = 0x97
+)
+
+// MQTT 5 reason codes for a server that is temporarily unavailable; any other
+// refusal, such as "Not authorized", is terminal
+const (
+	reasonServerUnavailable  = 0x88
+	reasonServerShuttingDown = 0x8B
+)
+
+// MQTT 5 reason code of a connection no attached policy allows, which AWS IoT
+// also sends while a newly attached policy propagates
+const reasonNotAuthorized = 0x87
+
+// ClassifyError returns how err should be retried. Errors AWS IoT did not
+// send, such as timeouts and lost connections, are retryable.
+func ClassifyError(err error) ErrorClass {
+	var paramErr *TemplateParameterError
+	if errors.As(err, &paramErr) {
+		return ErrorTerminal
+	}
+	var fingerprintErr *FingerprintError
+	if errors.As(err, &fingerprintErr) {
+		return ErrorTerminal
+	}
+	var postStepErr *PostStepError
+	if errors.As(err, &postStepErr) {
+		return ErrorTerminal
+	}
+	var configErr *DeviceConfigurationError
+	if errors.As(err, &configErr) {
+		return ErrorTerminal
+	}
+	var stepErr *FlowStepError
+	if errors.As(err, &stepErr) && stepErr.terminal() {
+		return ErrorTerminal
+	}
+	var rejection *RejectedError
+	if errors.As(err, &rejection) {
+		return rejection.Class()
+	}
+	var reasonErr *ReasonCodeError
+	if errors.As(err, &reasonErr) {
+		switch reasonErr.ReasonCode {
+		case reasonServerBusy, reasonQuotaExceeded:
+			return ErrorThrottled
+		case reasonServerUnavailable, reasonServerShuttingDown:
+			return ErrorRetryable
+		default:
+			return ErrorTerminal
+		}
+	}
+	return ErrorRetryable
+}
+
+// Class returns how the rejected request should be retried, from its error
+// code or else its status code
+func (e *RejectedError) Class() ErrorClass {
+	if class, ok := errorCodeClasses[e.ErrorCode]; ok {
+		return class
+	}
+	switch {
+	case e.StatusCode == 429 || strings.HasPrefix(e.ErrorCode, "Throttling"):
+		return ErrorThrottled
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return ErrorTerminal
+	default:
+		return ErrorRetryable
+	}
+}
@@ -0,0 +1,164 @@
+package provisioner
+
+import (
+	"errors"
+)
+
+// ErrorCode identifies a kind of provisioning failure. Codes are stable across
+// releases and independent of the error messages, which change and may be
+// redacted, so support articles and automated triage can key off them. A code
+// is never reused for another kind of failure; new kinds get new numbers.
+type ErrorCode string
+
+const (
+	// Configuration and local setup
+	ErrorInvalidConfiguration ErrorCode = "PRV-1001-INVALID-CONFIGURATION"
+	ErrorTemplateParameters   ErrorCode = "PRV-1002-TEMPLATE-PARAMETERS-INVALID"
+	ErrorLegacyEndpoint       ErrorCode = "PRV-1003-LEGACY-ENDPOINT"
+	ErrorCredentialsUnusable  ErrorCode = "PRV-1004-CREDENTIALS-UNUSABLE" // The claim or permanent certificate and key don't load or don't match
+	ErrorDeviceConfiguration  ErrorCode = "PRV-1005-DEVICE-CONFIGURATION-INVALID"
+	ErrorNotWritable          ErrorCode = "PRV-1006-DESTINATION-NOT-WRITABLE"
+
+	// Refused by AWS IoT
+	ErrorCertificateRejected  ErrorCode = "PRV-2001-CERTIFICATE-REJECTED"
+	ErrorRegistrationRejected ErrorCode = "PRV-2002-REGISTRATION-REJECTED"
+	ErrorThingNameConflict    ErrorCode = "PRV-2003-THING-NAME-CONFLICT"
+	ErrorNotAuthorized        ErrorCode = "PRV-2004-NOT-AUTHORIZED"
+	ErrorServerBusy           ErrorCode = "PRV-2005-SERVER-BUSY"
+	ErrorServerUnavailable    ErrorCode = "PRV-2006-SERVER-UNAVAILABLE"
+	ErrorOperationRefused     ErrorCode = "PRV-2007-OPERATION-REFUSED"
+	ErrorClientIDConflict     ErrorCode = "PRV-2008-CLIENT-ID-CONFLICT"
+	ErrorInvalidResponse      ErrorCode = "PRV-2009-INVALID-RESPONSE" // Accepted, but with a response AWS IoT would not send
+
+	// No answer in time
+	ErrorCertificateTimeout  ErrorCode = "PRV-3001-CERTIFICATE-TIMEOUT"
+	ErrorRegistrationTimeout ErrorCode = "PRV-3002-REGISTRATION-TIMEOUT"
+	ErrorAckTimeout          ErrorCode = "PRV-3003-ACK-TIMEOUT"
+	ErrorDeadlineExceeded    ErrorCode = "PRV-3004-DEADLINE-EXCEEDED"
+	ErrorClientWedged        ErrorCode = "PRV-3005-CLIENT-WEDGED"
+
+	// Held back by the device itself
+	ErrorQuarantined ErrorCode = "PRV-4001-QUARANTINED"
+	ErrorLockedOut   ErrorCode = "PRV-4002-LOCKED-OUT"
+	ErrorBusy        ErrorCode = "PRV-4003-PROVISIONING-IN-PROGRESS"
+
+	// After the device was provisioned
+	ErrorFingerprintMismatch ErrorCode = "PRV-5001-FINGERPRINT-MISMATCH"
+	ErrorPostStepsFailed     ErrorCode = "PRV-5002-POST-STEPS-FAILED"
+
+	// Steps of library callers, see FlowStep
+	ErrorStepFailed ErrorCode = "PRV-6001-STEP-FAILED"
+
+	// Anything else, such as a dropped connection or a local I/O error
+	ErrorUnexpected ErrorCode = "PRV-9001-UNEXPECTED"
+)
+
+// codedError gives an error without a type of its own a code. It unwraps to
+// the original, so its class is still recognised.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+// withCode returns err with code, or nil
+func withCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// ErrorCodeOf returns the stable code of err, ErrorUnexpected for errors of
+// no known kind, or empty for nil. The CLI logs it with the error and puts it
+// in the summary, events, and diagnostic bundle.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	var stepErr *FlowStepError
+	var configErr *ConfigError
+	var paramErr *TemplateParameterError
+	var deviceConfigErr *DeviceConfigurationError
+	var notWritable *NotWritableError
+	var legacyErr *LegacyEndpointError
+	var conflict *ThingNameConflictError
+	var rejection *RejectedError
+	var reasonErr *ReasonCodeError
+	var clientIDErr *ClientIDConflictError
+	var invalidResponse *InvalidResponseError
+	var ackErr *AckTimeoutError
+	var wedge *WedgedError
+	var quarantined *QuarantineError
+	var lockedOut *LockoutError
+	var fingerprintErr *FingerprintError
+	var postStepErr *PostStepError
+	switch {
+	// Whatever failed the step, such as a timeout, is the step's
+	case errors.As(err, &stepErr):
+		return ErrorStepFailed
+	case errors.As(err, &configErr):
+		return ErrorInvalidConfiguration
+	case errors.As(err, &paramErr):
+		return ErrorTemplateParameters
+	case errors.As(err, &deviceConfigErr):
+		return ErrorDeviceConfiguration
+	case errors.As(err, &notWritable):
+		return ErrorNotWritable
+	case errors.As(err, &legacyErr):
+		return ErrorLegacyEndpoint
+	case errors.As(err, &conflict):
+		return ErrorThingNameConflict
+	case errors.As(err, &rejection):
+		if rejection.Op == "certificate creation" {
+			return ErrorCertificateRejected
+		}
+		return ErrorRegistrationRejected
+	case errors.As(err, &reasonErr):
+		switch reasonErr.ReasonCode {
+		case reasonNotAuthorized:
+			return ErrorNotAuthorized
+		case reasonServerBusy, reasonQuotaExceeded:
+			return ErrorServerBusy
+		case reasonServerUnavailable, reasonServerShuttingDown:
+			return ErrorServerUnavailable
+		}
+		return ErrorOperationRefused
+	case errors.As(err, &clientIDErr):
+		return ErrorClientIDConflict
+	case errors.As(err, &invalidResponse):
+		return ErrorInvalidResponse
+	case errors.Is(err, errCreateTimeout):
+		return ErrorCertificateTimeout
+	case errors.Is(err, errRegisterTimeout):
+		return ErrorRegistrationTimeout
+	case errors.As(err, &ackErr):
+		return ErrorAckTimeout
+	case errors.As(err, &wedge):
+		return ErrorClientWedged
+	case errors.Is(err, errDeadline):
+		return ErrorDeadlineExceeded
+	case errors.As(err, &quarantined):
+		return ErrorQuarantined
+	case errors.As(err, &lockedOut):
+		return ErrorLockedOut
+	case errors.Is(err, errBusy):
+		return ErrorBusy
+	case errors.As(err, &fingerprintErr):
+		return ErrorFingerprintMismatch
+	case errors.As(err, &postStepErr):
+		return ErrorPostStepsFailed
+	}
+	return ErrorUnexpected
+}
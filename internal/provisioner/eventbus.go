@@ -0,0 +1,293 @@
+package provisioner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Lifecycle event published on the local event bus
+type busEvent struct {
+	Time       time.Time  `json:"time"`
+	Serial     string     `json:"serial"`
+	Event      string     `json:"event"` // stage, provisioned, or failed
+	Stage      Stage      `json:"stage,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	ThingName  string     `json:"thingName,omitempty"`
+	ErrorClass ErrorClass `json:"errorClass,omitempty"`
+	ErrorCode  ErrorCode  `json:"errorCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// A connection to the local broker
+type busPublisher interface {
+	publish(subject string, payload []byte) error
+	close()
+}
+
+// eventBus publishes the lifecycle events of a run to a broker on the device
+// or its local network, so other local services can follow onboarding as it
+// happens. With NATS an event is published on <prefix>.<serial>.<event>, with
+// MQTT on <prefix>/<serial>/<event>, the event being stage, provisioned, or
+// failed.
+type eventBus struct {
+	mu        sync.Mutex
+	publisher busPublisher
+	serial    string
+	prefix    string // Of the subjects, with the serial number
+	separator string
+}
+
+// openEventBus connects to -event-bus, or returns nil if it is not set. A
+// broker that cannot be reached is only a warning: local services are told
+// nothing, but the device is still provisioned.
+func openEventBus(cfg Config) *eventBus {
+	if cfg.EventBus == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.EventBus)
+	if err != nil {
+		log.Printf("Warning: not publishing events: invalid event bus URL: %v", err)
+		return nil
+	}
+	bus := &eventBus{serial: cfg.SerialNumber}
+	switch u.Scheme {
+	case "nats":
+		bus.publisher, err = connectNATS(u, cfg.ConnectTimeout)
+		bus.separator = "."
+	case "mqtt":
+		bus.publisher, err = connectLocalMQTT(u, cfg.SerialNumber, cfg.ConnectTimeout)
+		bus.separator = "/"
+	default:
+		err = fmt.Errorf("unsupported scheme %q: use nats or mqtt", u.Scheme)
+	}
+	if err != nil {
+		log.Printf("Warning: not publishing events on %s: %v", u.Redacted(), err)
+		return nil
+	}
+	// Subject levels of the serial number would split it
+	serial := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("./+#*> ", r) {
+			return '_'
+		}
+		return r
+	}, cfg.SerialNumber)
+	bus.prefix = strings.ReplaceAll(cfg.EventBusPrefix, "/", bus.separator) + bus.separator + serial
+	return bus
+}
+
+// send publishes an event, dropping the connection if it fails
+func (b *eventBus) send(event busEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.publisher == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Serial = b.serial
+	event.Message = secrets.output(event.Message)
+	event.Error = secrets.output(event.Error)
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = b.publisher.publish(b.prefix+b.separator+event.Event, payload)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to publish event: %v", err)
+		b.publisher.close()
+		b.publisher = nil
+	}
+}
+
+// report is a ProgressFunc publishing each stage
+func (b *eventBus) report(stage Stage, message string) {
+	b.send(busEvent{Event: "stage", Stage: stage, Message: message})
+}
+
+// finish publishes the outcome of the run and disconnects
+func (b *eventBus) finish(result *ProvisioningResult, err error) {
+	if b == nil {
+		return
+	}
+	if err != nil {
+		b.send(busEvent{Event: "failed", ErrorClass: ClassifyError(err), ErrorCode: ErrorCodeOf(err), Error: err.Error()})
+	} else {
+		b.send(busEvent{Event: "provisioned", ThingName: result.ThingName})
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.publisher != nil {
+		b.publisher.close()
+		b.publisher = nil
+	}
+}
+
+// natsPublisher publishes with the NATS client protocol, of which only
+// CONNECT, PUB, PING, and PONG are needed
+type natsPublisher struct {
+	mu      sync.Mutex // Of writes
+	conn    net.Conn
+	timeout time.Duration
+	pongs   chan error // A PONG, nil, or what the server refused, closed with the connection
+}
+
+func connectNATS(u *url.URL, timeout time.Duration) (*natsPublisher, error) {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// The server introduces itself first
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("%s did not answer as a NATS server", address)
+	}
+	conn.SetReadDeadline(time.Time{})
+	p := &natsPublisher{conn: conn, timeout: timeout, pongs: make(chan error, 1)}
+	go p.read(reader)
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "claim-provisioning", "lang": "go"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if err := p.write(fmt.Sprintf("CONNECT %s\r\n", connect)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The PING is answered once CONNECT is accepted
+	if err := p.flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// read answers the server's PINGs, which it sends to idle clients and drops
+// them for not answering, and hands on PONGs and refusals
+func (p *natsPublisher) read(reader *bufio.Reader) {
+	defer close(p.pongs)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			p.write("PONG\r\n")
+		case line == "PONG":
+			p.answer(nil)
+		case strings.HasPrefix(line, "-ERR"):
+			p.answer(fmt.Errorf("NATS server refused: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+}
+
+// answer hands on a PONG or refusal, keeping the first if the last is not
+// collected yet, so reading never stops
+func (p *natsPublisher) answer(err error) {
+	select {
+	case p.pongs <- err:
+	default:
+	}
+}
+
+func (p *natsPublisher) write(data string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err := p.conn.Write([]byte(data))
+	return err
+}
+
+func (p *natsPublisher) publish(subject string, payload []byte) error {
+	return p.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload))
+}
+
+// flush waits until the server has processed everything sent before
+func (p *natsPublisher) flush() error {
+	if err := p.write("PING\r\n"); err != nil {
+		return err
+	}
+	select {
+	case err, ok := <-p.pongs:
+		if !ok {
+			return fmt.Errorf("NATS server closed the connection")
+		}
+		return err
+	case <-time.After(p.timeout):
+		return fmt.Errorf("NATS server did not answer within %s", p.timeout)
+	}
+}
+
+func (p *natsPublisher) close() {
+	if err := p.flush(); err != nil {
+		log.Printf("Warning: events may not have been published: %v", err)
+	}
+	p.conn.Close()
+}
+
+// mqttPublisher publishes to a local MQTT broker, such as mosquitto
+type mqttPublisher struct {
+	client  mqtt.Client
+	timeout time.Duration
+}
+
+func connectLocalMQTT(u *url.URL, serial string, timeout time.Duration) (*mqttPublisher, error) {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + address)
+	opts.SetClientID("claim-provisioning-" + serial)
+	opts.SetConnectTimeout(timeout)
+	opts.SetAutoReconnect(false)
+	if u.User != nil {
+		opts.SetUsername(u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			opts.SetPassword(password)
+		}
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return nil, fmt.Errorf("timed out connecting to %s", address)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return &mqttPublisher{client: client, timeout: timeout}, nil
+}
+
+func (p *mqttPublisher) publish(topic string, payload []byte) error {
+	token := p.client.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(p.timeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+func (p *mqttPublisher) close() {
+	p.client.Disconnect(250)
+}
@@ -0,0 +1,122 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Device facts that can be passed to the template, named after the template
+// parameter each is passed as
+const (
+	FactModel            = "Model"
+	FactFirmwareVersion  = "FirmwareVersion"
+	FactOSVersion        = "OSVersion"
+	FactMACAddress       = "MACAddress"
+	FactHardwareRevision = "HardwareRevision"
+)
+
+// Files each fact is read from, the first that holds a value winning. Device
+// tree entries cover embedded boards, DMI entries PCs and virtual machines.
+var factFiles = map[string][]string{
+	FactModel:            {"/proc/device-tree/model", "/sys/class/dmi/id/product_name"},
+	FactFirmwareVersion:  {"/proc/device-tree/chosen/u-boot,version", "/sys/class/dmi/id/bios_version"},
+	FactHardwareRevision: {"/proc/device-tree/hardware-revision", "/sys/class/dmi/id/board_version"},
+}
+
+// factNames returns the supported facts, sorted
+func factNames() []string {
+	return []string{FactFirmwareVersion, FactHardwareRevision, FactMACAddress, FactModel, FactOSVersion}
+}
+
+// deviceFacts gathers the facts named in cfg.DeviceFacts. Facts the system
+// does not provide are left out with a warning.
+func deviceFacts(cfg Config) map[string]string {
+	facts := map[string]string{}
+	for _, name := range cfg.DeviceFacts {
+		value, err := deviceFact(cfg.Files.fs(), name)
+		if err != nil {
+			log.Printf("Warning: device fact %s unavailable: %v", name, err)
+			continue
+		}
+		facts[name] = value
+	}
+	return facts
+}
+
+// deviceFact reads one fact from the system
+func deviceFact(fsys FileSystem, name string) (string, error) {
+	switch name {
+	case FactOSVersion:
+		return osVersion(fsys), nil
+	case FactMACAddress:
+		return macAddress(fsys)
+	case FactHardwareRevision:
+		// Raspberry Pi boards report their revision in cpuinfo
+		if data, err := fsys.ReadFile("/proc/cpuinfo"); err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				key, value, ok := strings.Cut(scanner.Text(), ":")
+				if ok && strings.TrimSpace(key) == "Revision" && strings.TrimSpace(value) != "" {
+					return strings.TrimSpace(value), nil
+				}
+			}
+		}
+	}
+	for _, file := range factFiles[name] {
+		data, err := fsys.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// Device tree strings are NUL terminated
+		if value := strings.TrimSpace(strings.TrimRight(string(data), "\x00")); value != "" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("not found in %s", strings.Join(factFiles[name], ", "))
+}
+
+// osVersion returns the PRETTY_NAME of os-release, or the operating system
+// Go reports
+func osVersion(fsys FileSystem) string {
+	for _, file := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := fsys.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+	return runtime.GOOS
+}
+
+// macAddress returns the hardware address of the first physical network
+// interface, or of the first other one that has an address, such as a bridge
+func macAddress(fsys FileSystem) (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	interfaces = slices.DeleteFunc(interfaces, func(iface net.Interface) bool {
+		return iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0
+	})
+	if len(interfaces) == 0 {
+		return "", fmt.Errorf("no network interface has a hardware address")
+	}
+	for _, iface := range interfaces {
+		// Only interfaces backed by a device have one in sysfs
+		if _, err := fsys.Stat("/sys/class/net/" + iface.Name + "/device"); err == nil {
+			return iface.HardwareAddr.String(), nil
+		}
+	}
+	return interfaces[0].HardwareAddr.String(), nil
+}
@@ -0,0 +1,261 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Modes and ownership of the files the program writes, and the file system
+// they are written to
+type FilePermissions struct {
+	Mode    os.FileMode // Certificates and other public files
+	KeyMode os.FileMode // Private keys and files holding secrets or audit records
+	Owner   string      // User name or ID, empty keeps the process's user
+	Group   string      // Group name or ID, empty keeps the process's group
+	FS      FileSystem  // Nil for the operating system's, see FileSystem
+}
+
+// mode returns the mode for a public or secret file
+func (p FilePermissions) mode(secret bool) os.FileMode {
+	if secret {
+		return p.KeyMode
+	}
+	return p.Mode
+}
+
+// ids resolves the owner and group, -1 leaving either unchanged
+func (p FilePermissions) ids() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if p.Owner != "" {
+		if uid, err = strconv.Atoi(p.Owner); err != nil {
+			u, err := user.Lookup(p.Owner)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unknown file owner %q: %v", p.Owner, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if p.Group != "" {
+		if gid, err = strconv.Atoi(p.Group); err != nil {
+			g, err := user.LookupGroup(p.Group)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unknown file group %q: %v", p.Group, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// apply sets the mode and ownership of an existing file. The mode is set
+// explicitly since the umask may have narrowed it on creation.
+func (p FilePermissions) apply(path string, secret bool) error {
+	if err := p.fs().Chmod(path, p.mode(secret)); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", path, err)
+	}
+	uid, gid, err := p.ids()
+	if err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := p.fs().Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %v", path, err)
+	}
+	return nil
+}
+
+// write writes a file atomically with the configured mode and ownership, which
+// are set before the file is moved into place
+func (p FilePermissions) write(path string, data []byte, secret bool) error {
+	return writeFileAtomic(p.fs(), path, data, p.mode(secret), func(tmp string) error {
+		return p.apply(tmp, secret)
+	})
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place, so a
+// crash never leaves a truncated file behind. prepare, if set, is called on
+// the temporary file before the rename.
+func writeFileAtomic(fsys FileSystem, path string, data []byte, perm os.FileMode, prepare func(tmp string) error) error {
+	tmp := path + ".tmp"
+	if err := fsys.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if prepare != nil {
+		if err := prepare(tmp); err != nil {
+			fsys.Remove(tmp)
+			return err
+		}
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("failed to rename %s: %v", tmp, err)
+	}
+	return nil
+}
+
+// Suffixes of a certificate and key staged by stageKeyPair, and of the marker
+// committing their swap
+const (
+	stagedSuffix = ".new"
+	swapSuffix   = ".swap"
+)
+
+// replaceKeyPair replaces a certificate and its private key so they are only
+// ever seen together, see stageKeyPair. A nil key leaves the key file as it is.
+func (p FilePermissions) replaceKeyPair(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	if err := p.stageKeyPair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return err
+	}
+	return p.finishKeyPair(certFile, keyFile)
+}
+
+// stageKeyPair writes a certificate and its private key next to the files
+// they replace, then commits the swap with a marker file. Renaming two files
+// is not atomic, so a swap interrupted after the commit is completed by
+// recoverKeyPair, and one interrupted before it is discarded; either way the
+// certificate is not left with the wrong key. A nil key is not staged. Other
+// files naming the certificate, such as the identity file, are replaced with
+// it when the caller has staged them at path+stagedSuffix and passes them as
+// with; they are discarded too if the swap fails.
+func (p FilePermissions) stageKeyPair(certFile, keyFile string, certPEM, keyPEM []byte, with ...string) error {
+	fsys := p.fs()
+	discard := func() {
+		for _, path := range append([]string{certFile, keyFile}, with...) {
+			fsys.Remove(path + stagedSuffix)
+		}
+	}
+	if err := p.write(certFile+stagedSuffix, certPEM, false); err != nil {
+		discard()
+		return fmt.Errorf("failed to stage certificate: %v", err)
+	}
+	if keyPEM != nil {
+		if err := p.write(keyFile+stagedSuffix, keyPEM, true); err != nil {
+			discard()
+			return fmt.Errorf("failed to stage private key: %v", err)
+		}
+	}
+	if err := writeFileAtomic(fsys, certFile+swapSuffix, nil, 0600, nil); err != nil {
+		discard()
+		return fmt.Errorf("failed to commit replacement of %s: %v", certFile, err)
+	}
+	return nil
+}
+
+// finishKeyPair moves a committed certificate and key, and the files staged
+// with them, into place and removes the marker. It can be repeated until it
+// succeeds.
+func (p FilePermissions) finishKeyPair(certFile, keyFile string, with ...string) error {
+	fsys := p.fs()
+	for _, path := range append([]string{keyFile, certFile}, with...) {
+		if _, err := fsys.Stat(path + stagedSuffix); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := fsys.Rename(path+stagedSuffix, path); err != nil {
+			return fmt.Errorf("failed to replace %s, the next run completes it: %v", path, err)
+		}
+	}
+	if err := fsys.Remove(certFile + swapSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %v", certFile+swapSuffix, err)
+	}
+	return nil
+}
+
+// recoverKeyPair completes a swap of certificate and key stageKeyPair
+// committed, or discards the files it staged without committing them,
+// including those staged with them
+func (p FilePermissions) recoverKeyPair(certFile, keyFile string, with ...string) error {
+	fsys := p.fs()
+	if _, err := fsys.Stat(certFile + swapSuffix); err == nil {
+		log.Printf("Completing the interrupted replacement of %s", certFile)
+		return p.finishKeyPair(certFile, keyFile, with...)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot access %s: %v", certFile+swapSuffix, err)
+	}
+	for _, path := range append([]string{certFile, keyFile}, with...) {
+		if err := fsys.Remove(path + stagedSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %v", path+stagedSuffix, err)
+		}
+	}
+	return nil
+}
+
+// checkDestination refuses to write into a world-writable directory, where
+// other users could replace or pre-create the credential files
+func checkDestination(fsys FileSystem, dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("cannot access output directory %s: %v", dir, err)
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		abs, _ := filepath.Abs(dir)
+		return fmt.Errorf("refusing to write credentials to world-writable directory %s", abs)
+	}
+	return nil
+}
+
+// Runs in progress in this process, by output directory. Two runs in one
+// directory would overwrite each other's state and credentials, so a second
+// run waits for the first and takes its outcome.
+var (
+	flightsMu sync.Mutex
+	flights   = map[string]*flight{}
+)
+
+// A provisioning run others in the process wait for
+type flight struct {
+	dir    string
+	done   chan struct{}
+	result *ProvisioningResult
+	err    error
+}
+
+// joinFlight returns the run in progress in the output directory, and whether
+// the caller leads it. The leader runs the flow and lands it; the others wait
+// for its outcome.
+func joinFlight(dir string) (f *flight, leader bool, err error) {
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot resolve output directory %s: %v", dir, err)
+	}
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+	if f, ok := flights[abs]; ok {
+		return f, false, nil
+	}
+	f = &flight{dir: abs, done: make(chan struct{})}
+	flights[abs] = f
+	return f, true, nil
+}
+
+// land records the outcome of the run and releases those waiting for it
+func (f *flight) land(result *ProvisioningResult, err error) {
+	if result == nil && err == nil {
+		// The run panicked
+		err = fmt.Errorf("provisioning run in %s did not finish", f.dir)
+	}
+	flightsMu.Lock()
+	delete(flights, f.dir)
+	flightsMu.Unlock()
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// wait returns the outcome of the run
+func (f *flight) wait() (*ProvisioningResult, error) {
+	<-f.done
+	return f.result, f.err
+}
@@ -0,0 +1,225 @@
+package provisioner
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+// memoryFiles returns file permissions writing to a new MemoryFS
+func memoryFiles() (FilePermissions, *MemoryFS) {
+	mem := NewMemoryFS()
+	return FilePermissions{Mode: 0644, KeyMode: 0600, FS: mem}, mem
+}
+
+// mustRead returns the contents of a file, failing the test if it is missing
+func mustRead(t *testing.T, fsys FileSystem, path string) string {
+	t.Helper()
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return string(data)
+}
+
+// assertMissing fails the test if path exists
+func assertMissing(t *testing.T, fsys FileSystem, path string) {
+	t.Helper()
+	if _, err := fsys.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s exists, want it missing (stat: %v)", path, err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	mem := NewMemoryFS()
+	if err := mem.WriteFile("cert.pem", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(mem, "cert.pem", []byte("new"), 0600, nil); err != nil {
+		t.Fatalf("writeFileAtomic: %v", err)
+	}
+	if got := mustRead(t, mem, "cert.pem"); got != "new" {
+		t.Errorf("cert.pem = %q, want %q", got, "new")
+	}
+	assertMissing(t, mem, "cert.pem.tmp")
+
+	// A failing prepare leaves the file as it was
+	prepareErr := errors.New("chown refused")
+	err := writeFileAtomic(mem, "cert.pem", []byte("newer"), 0600, func(tmp string) error {
+		if got := mustRead(t, mem, tmp); got != "newer" {
+			t.Errorf("prepare saw %q, want %q", got, "newer")
+		}
+		return prepareErr
+	})
+	if !errors.Is(err, prepareErr) {
+		t.Fatalf("writeFileAtomic error = %v, want %v", err, prepareErr)
+	}
+	if got := mustRead(t, mem, "cert.pem"); got != "new" {
+		t.Errorf("cert.pem = %q after failed prepare, want %q", got, "new")
+	}
+	assertMissing(t, mem, "cert.pem.tmp")
+
+	// The directory must exist, as on disk
+	if err := writeFileAtomic(mem, "missing/cert.pem", []byte("x"), 0600, nil); err == nil {
+		t.Error("writeFileAtomic into a missing directory succeeded")
+	}
+}
+
+func TestFilePermissionsApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		perms    FilePermissions
+		secret   bool
+		wantMode os.FileMode
+		wantUID  int
+		wantGID  int
+		wantErr  bool
+	}{
+		{name: "public", perms: FilePermissions{Mode: 0644, KeyMode: 0600}, wantMode: 0644, wantUID: -1, wantGID: -1},
+		{name: "secret", perms: FilePermissions{Mode: 0644, KeyMode: 0600}, secret: true, wantMode: 0600, wantUID: -1, wantGID: -1},
+		{name: "group readable key", perms: FilePermissions{Mode: 0644, KeyMode: 0640, Group: "1001"}, secret: true, wantMode: 0640, wantUID: -1, wantGID: 1001},
+		{name: "numeric owner", perms: FilePermissions{Mode: 0644, KeyMode: 0600, Owner: "1000", Group: "1000"}, wantMode: 0644, wantUID: 1000, wantGID: 1000},
+		{name: "unknown owner", perms: FilePermissions{Mode: 0644, KeyMode: 0600, Owner: "no-such-user-for-tests"}, wantMode: 0644, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryFS()
+			if err := mem.WriteFile("file", []byte("data"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			tt.perms.FS = mem
+			err := tt.perms.apply("file", tt.secret)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("apply succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			info, err := mem.Stat("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+			uid, gid, _ := mem.Owner("file")
+			if uid != tt.wantUID || gid != tt.wantGID {
+				t.Errorf("owner = %d:%d, want %d:%d", uid, gid, tt.wantUID, tt.wantGID)
+			}
+		})
+	}
+
+	if err := (FilePermissions{Mode: 0644, FS: NewMemoryFS()}).apply("missing", false); err == nil {
+		t.Error("apply to a missing file succeeded")
+	}
+}
+
+func TestFilePermissionsWrite(t *testing.T) {
+	files, mem := memoryFiles()
+	if err := files.write("key.pem", []byte("key"), true); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, err := mem.Stat("key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key mode = %v, want 0600", info.Mode().Perm())
+	}
+	assertMissing(t, mem, "key.pem.tmp")
+}
+
+func TestReplaceKeyPair(t *testing.T) {
+	files, mem := memoryFiles()
+	mem.WriteFile("cert.pem", []byte("old cert"), 0644)
+	mem.WriteFile("key.pem", []byte("old key"), 0600)
+
+	if err := files.replaceKeyPair("cert.pem", "key.pem", []byte("new cert"), []byte("new key")); err != nil {
+		t.Fatalf("replaceKeyPair: %v", err)
+	}
+	if cert, key := mustRead(t, mem, "cert.pem"), mustRead(t, mem, "key.pem"); cert != "new cert" || key != "new key" {
+		t.Errorf("files hold %q and %q, want the new pair", cert, key)
+	}
+	for _, path := range []string{"cert.pem.new", "key.pem.new", "cert.pem.swap"} {
+		assertMissing(t, mem, path)
+	}
+	if info, _ := mem.Stat("key.pem"); info.Mode().Perm() != 0600 {
+		t.Errorf("key mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+// TestRecoverKeyPair interrupts a swap at each point and checks the next start
+// leaves a matching pair
+func TestRecoverKeyPair(t *testing.T) {
+	tests := []struct {
+		name      string
+		interrupt func(mem *MemoryFS)
+		wantCert  string
+		wantKey   string
+	}{
+		{
+			name: "certificate staged",
+			interrupt: func(mem *MemoryFS) {
+				mem.Remove("key.pem.new")
+				mem.Remove("cert.pem.swap")
+			},
+			wantCert: "old cert", wantKey: "old key",
+		},
+		{
+			name:      "both staged, not committed",
+			interrupt: func(mem *MemoryFS) { mem.Remove("cert.pem.swap") },
+			wantCert:  "old cert", wantKey: "old key",
+		},
+		{
+			name:      "committed",
+			interrupt: func(mem *MemoryFS) {},
+			wantCert:  "new cert", wantKey: "new key",
+		},
+		{
+			name:      "key renamed",
+			interrupt: func(mem *MemoryFS) { mem.Rename("key.pem.new", "key.pem") },
+			wantCert:  "new cert", wantKey: "new key",
+		},
+		{
+			name: "both renamed",
+			interrupt: func(mem *MemoryFS) {
+				mem.Rename("key.pem.new", "key.pem")
+				mem.Rename("cert.pem.new", "cert.pem")
+			},
+			wantCert: "new cert", wantKey: "new key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, mem := memoryFiles()
+			mem.WriteFile("cert.pem", []byte("old cert"), 0644)
+			mem.WriteFile("key.pem", []byte("old key"), 0600)
+			mem.WriteFile("identity.json", []byte("old identity"), 0644)
+			mem.WriteFile("identity.json.new", []byte("new identity"), 0644)
+			if err := files.stageKeyPair("cert.pem", "key.pem", []byte("new cert"), []byte("new key"), "identity.json"); err != nil {
+				t.Fatalf("stageKeyPair: %v", err)
+			}
+			tt.interrupt(mem)
+
+			if err := files.recoverKeyPair("cert.pem", "key.pem", "identity.json"); err != nil {
+				t.Fatalf("recoverKeyPair: %v", err)
+			}
+			if cert, key := mustRead(t, mem, "cert.pem"), mustRead(t, mem, "key.pem"); cert != tt.wantCert || key != tt.wantKey {
+				t.Errorf("files hold %q and %q, want %q and %q", cert, key, tt.wantCert, tt.wantKey)
+			}
+			// The identity names the certificate the files hold
+			if identity, want := mustRead(t, mem, "identity.json"), strings.Replace(tt.wantCert, "cert", "identity", 1); identity != want {
+				t.Errorf("identity file holds %q, want %q", identity, want)
+			}
+			for _, path := range []string{"cert.pem.new", "key.pem.new", "identity.json.new", "cert.pem.swap"} {
+				assertMissing(t, mem, path)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+)
+
+// FlowStep is a request/response exchange of a library caller's own that the
+// provisioning flow makes on the claim connection, such as activating the
+// device with a company service on its own topics, see FlowSteps. A step is
+// run again when the flow resumes or retries, so it must be idempotent.
+type FlowStep interface {
+	Name() string
+	Run(step *StepContext) error
+}
+
+// FlowSteps are the steps of library callers in the provisioning flow, run in
+// order. Just-in-time mode makes no requests to add them to.
+type FlowSteps struct {
+	// Run once the certificate is created, or the flow resumes with one,
+	// before RegisterThing. They can set the template parameters the thing is
+	// registered with.
+	BeforeRegister []FlowStep
+	// Run once RegisterThing is accepted, before the registration is recorded:
+	// when a step fails, the next attempt registers the certificate again,
+	// which AWS IoT answers the same way, and runs the steps again
+	AfterRegister []FlowStep
+}
+
+// StepContext is what a FlowStep runs with
+type StepContext struct {
+	// Makes requests on the claim connection, with the codec, QoS, response
+	// timeout, and deadline of the flow. Its subscriptions end with the steps.
+	Requester *Requester
+	// The claim connection, which stays the flow's to disconnect
+	Transport Transport
+
+	Serial        string
+	CertificateID string
+	// Template parameters of the registration. Steps before it can change
+	// them, say to pass on an activation code; those they set or remove are
+	// recorded in the state as their own, so later runs do not take them for
+	// drift.
+	Parameters map[string]string
+
+	// Set for the steps after registration
+	ThingName           string
+	DeviceConfiguration map[string]interface{} // With the numbers of Config.ConfigNumbers
+}
+
+// ErrStepRefused is wrapped by the error of a step whose service refuses the
+// device, so the flow does not retry it
+var ErrStepRefused = errors.New("refused")
+
+// FlowStepError is returned when a FlowStep fails. It is terminal when the
+// step's error wraps ErrStepRefused or a *RequestRejectedError, and otherwise
+// classified as the error it wraps.
+type FlowStepError struct {
+	Step string
+	Err  error
+}
+
+func (e *FlowStepError) Error() string {
+	return fmt.Sprintf("step %s failed: %v", e.Step, e.Err)
+}
+
+func (e *FlowStepError) Unwrap() error {
+	return e.Err
+}
+
+// terminal reports whether the step's service refused the device
+func (e *FlowStepError) terminal() bool {
+	var rejected *RequestRejectedError
+	return errors.Is(e.Err, ErrStepRefused) || errors.As(e.Err, &rejected)
+}
+
+// runFlowSteps runs steps on the connection of session, with their own
+// subscriptions
+func runFlowSteps(session *provisioningSession, steps []FlowStep, step *StepContext) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	requester := NewRequester(session.cfg, session.transport)
+	requester.session.deadline = session.deadline
+	defer func() {
+		if err := requester.Close(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+	step.Requester = requester
+	step.Transport = session.transport
+	for _, s := range steps {
+		log.Printf("Running step %s", s.Name())
+		if err := s.Run(step); err != nil {
+			return &FlowStepError{Step: s.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// runStepsBeforeRegister runs cfg.Steps.BeforeRegister and returns the
+// template parameters as they left them, and the names of those they set or
+// removed
+func runStepsBeforeRegister(cfg Config, session *provisioningSession, certificateID string, params map[string]string) (map[string]string, []string, error) {
+	step := &StepContext{Serial: cfg.SerialNumber, CertificateID: certificateID, Parameters: maps.Clone(params)}
+	if err := runFlowSteps(session, cfg.Steps.BeforeRegister, step); err != nil {
+		return nil, nil, err
+	}
+	var set []string
+	for name, value := range step.Parameters {
+		if previous, ok := params[name]; !ok || previous != value {
+			set = append(set, name)
+		}
+	}
+	for name := range params {
+		if _, ok := step.Parameters[name]; !ok {
+			set = append(set, name)
+		}
+	}
+	slices.Sort(set)
+	return step.Parameters, set, nil
+}
@@ -0,0 +1,63 @@
+package provisioner
+
+import (
+	"io"
+	"os"
+)
+
+// FileSystem is the storage the program reads its claim credentials and
+// settings from, and keeps the device's credentials, identity, and state in.
+// The operating system's file system is used unless FilePermissions.FS is set,
+// so tests can run against a MemoryFS and embedded targets can keep
+// credentials on a dedicated partition or in a secure store. Device nodes and sockets, such
+// as the serial port of the bridge, are always opened directly.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+}
+
+// File is an open file of a FileSystem
+type File interface {
+	io.ReadWriteCloser
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// The operating system's file system
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (osFS) Chown(name string, uid, gid int) error        { return os.Chown(name, uid, gid) }
+
+// fs returns the file system files are read from and written to
+func (p FilePermissions) fs() FileSystem {
+	if p.FS == nil {
+		return osFS{}
+	}
+	return p.FS
+}
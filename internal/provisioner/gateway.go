@@ -0,0 +1,235 @@
+package provisioner
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Local policy deciding which child devices a gateway provisions. A child is
+// provisioned if an allow rule matches it and no deny rule does, and, when it
+// is new, fewer than MaxChildren children are known.
+type gatewayPolicy struct {
+	Allow       []gatewayRule `json:"allow"`
+	Deny        []gatewayRule `json:"deny,omitempty"`
+	MaxChildren int           `json:"maxChildren,omitempty"` // 0 for no limit
+}
+
+// A rule matches children by serial number pattern (path.Match syntax) and,
+// if set, by the networks they connect from and the templates they ask for
+type gatewayRule struct {
+	Serial    string   `json:"serial"`
+	Networks  []string `json:"networks,omitempty"` // CIDRs
+	Templates []string `json:"templates,omitempty"`
+}
+
+// Refusal of a child by the gateway policy
+var errChildNotAllowed = errors.New("child is not allowed by the gateway policy")
+
+// loadGatewayPolicy reads and checks a policy file
+func loadGatewayPolicy(fsys FileSystem, file string) (*gatewayPolicy, error) {
+	data, err := fsys.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway policy: %v", err)
+	}
+	var policy gatewayPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse gateway policy %s: %v", file, err)
+	}
+	if len(policy.Allow) == 0 {
+		return nil, fmt.Errorf("gateway policy %s allows no children", file)
+	}
+	for _, rule := range append(slices.Clone(policy.Allow), policy.Deny...) {
+		if _, err := path.Match(rule.Serial, ""); rule.Serial == "" || err != nil {
+			return nil, fmt.Errorf("gateway policy %s: invalid serial pattern %q", file, rule.Serial)
+		}
+		for _, network := range rule.Networks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				return nil, fmt.Errorf("gateway policy %s: %v", file, err)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// matches reports whether the rule matches a child
+func (r gatewayRule) matches(serial, template string, addr net.IP) bool {
+	if ok, _ := path.Match(r.Serial, serial); !ok {
+		return false
+	}
+	if len(r.Templates) > 0 && !slices.Contains(r.Templates, template) {
+		return false
+	}
+	if len(r.Networks) == 0 {
+		return true
+	}
+	for _, network := range r.Networks {
+		if _, ipNet, _ := net.ParseCIDR(network); ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why a child may not be provisioned, or nil if it may. known
+// children don't count against MaxChildren again.
+func (p *gatewayPolicy) check(serial, template string, addr net.IP, children int, known bool) error {
+	for _, rule := range p.Deny {
+		if rule.matches(serial, template, addr) {
+			return fmt.Errorf("%w: %s is denied", errChildNotAllowed, serial)
+		}
+	}
+	allowed := false
+	for _, rule := range p.Allow {
+		if rule.matches(serial, template, addr) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: no rule allows %s with template %s from %s", errChildNotAllowed, serial, template, addr)
+	}
+	if !known && p.MaxChildren > 0 && children >= p.MaxChildren {
+		return fmt.Errorf("%w: the gateway already has %d children", errChildNotAllowed, children)
+	}
+	return nil
+}
+
+// Provisioning request of a child device
+type childProvisionRequest struct {
+	Serial     string            `json:"serial"`
+	Template   string            `json:"template,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	CSR        string            `json:"csr,omitempty"`
+}
+
+// Credentials handed back to a provisioned child
+type childCredentials struct {
+	ThingName      string      `json:"thingName"`
+	CertificateID  string      `json:"certificateId"`
+	CertificatePEM string      `json:"certificatePem"`
+	PrivateKeyPEM  keyMaterial `json:"privateKeyPem,omitempty"` // Only when the child sent no CSR
+	Endpoint       string      `json:"endpoint"`
+}
+
+// Error document of the gateway API
+type childError struct {
+	Error string     `json:"error"`
+	Class ErrorClass `json:"class"`
+}
+
+// Local API through which child devices are provisioned by the gateway, one at
+// a time, with the gateway's claim
+type gatewayServer struct {
+	cfg    Config
+	dir    string // Child directories, see provisionChild
+	policy *gatewayPolicy
+	token  []byte // Bearer token children must present, none if empty
+	tls    bool   // Whether the API is served over HTTPS
+
+	mu sync.Mutex
+}
+
+func (g *gatewayServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/children", g.handleProvisionChild)
+	return mux
+}
+
+func (g *gatewayServer) handleProvisionChild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(g.token) > 0 {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), g.token) != 1 {
+			writeJSON(w, http.StatusUnauthorized, childError{Error: "invalid token", Class: ErrorTerminal})
+			return
+		}
+	}
+	var request childProvisionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOnboardingValue)).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, childError{Error: fmt.Sprintf("invalid request: %v", err), Class: ErrorTerminal})
+		return
+	}
+	// A generated key must not cross the network in the clear
+	if request.CSR == "" && !g.tls {
+		writeJSON(w, http.StatusBadRequest, childError{Error: "csr is required unless the gateway serves HTTPS", Class: ErrorTerminal})
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	addr := net.ParseIP(host)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.allow(request, addr); err != nil {
+		log.Printf("Refused child %s from %s: %v", request.Serial, host, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errChildNotAllowed) {
+			status = http.StatusForbidden
+		}
+		writeJSON(w, status, childError{Error: err.Error(), Class: ErrorTerminal})
+		return
+	}
+
+	log.Printf("Provisioning child %s for %s", request.Serial, host)
+	child := childRequest{Serial: request.Serial, Template: request.Template, Parameters: request.Parameters, CSR: request.CSR}
+	result, certPEM, keyPEM, err := provisionChild(g.cfg, g.dir, child, nil)
+	defer clear(keyPEM)
+	if err != nil {
+		log.Printf("Failed to provision child %s: %v", request.Serial, err)
+		class := childErrorClass(err)
+		status := http.StatusBadGateway
+		var requestErr *childRequestError
+		switch {
+		case errors.As(err, &requestErr):
+			status = http.StatusBadRequest
+		case class == ErrorThrottled:
+			status = http.StatusTooManyRequests
+		}
+		writeJSON(w, status, childError{Error: err.Error(), Class: class})
+		return
+	}
+	recordAudit(g.cfg, auditEntry{Event: AuditChildProvisioned, CertificateID: result.CertificateID, ThingName: result.ThingName})
+	writeJSON(w, http.StatusOK, childCredentials{
+		ThingName:      result.ThingName,
+		CertificateID:  result.CertificateID,
+		CertificatePEM: string(certPEM),
+		PrivateKeyPEM:  keyPEM,
+		Endpoint:       result.Endpoint,
+	})
+}
+
+// allow checks a request against the policy, with g.mu held
+func (g *gatewayServer) allow(request childProvisionRequest, addr net.IP) error {
+	if !childSerialPattern.MatchString(request.Serial) {
+		return fmt.Errorf("%w: invalid serial number %q", errChildNotAllowed, request.Serial)
+	}
+	template := request.Template
+	if template == "" {
+		template = g.cfg.TemplateName
+	}
+	entries, err := g.cfg.Files.fs().ReadDir(g.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to list children: %v", err)
+	}
+	children := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			children++
+		}
+	}
+	_, err = g.cfg.Files.fs().Stat(filepath.Join(g.dir, request.Serial))
+	return g.policy.check(request.Serial, template, addr, children, err == nil)
+}
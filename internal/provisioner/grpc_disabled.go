@@ -0,0 +1,10 @@
+//go:build nogrpc
+
+package provisioner
+
+import "errors"
+
+// Built without gRPC: serve only has the HTTP API
+func serveGRPC(api *apiServer, address string, errs chan<- error) error {
+	return errors.New("the gRPC API is not available in this build (built with -tags nogrpc)")
+}
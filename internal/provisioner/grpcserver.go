@@ -0,0 +1,103 @@
+//go:build !nogrpc
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/humblenginr/aws-claim-provisioning/api/provisionerpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC implementation of the local provisioning API. It shares the operation
+// lock and status with the HTTP API.
+type grpcServer struct {
+	provisionerpb.UnimplementedProvisionerServer
+	api *apiServer
+}
+
+func newGRPCServer(api *apiServer) *grpc.Server {
+	server := grpc.NewServer()
+	provisionerpb.RegisterProvisionerServer(server, &grpcServer{api: api})
+	return server
+}
+
+func (g *grpcServer) Provision(_ *provisionerpb.ProvisionRequest, stream provisionerpb.Provisioner_ProvisionServer) error {
+	return g.runStreaming(func(cfg Config, progress ProgressFunc) error {
+		_, err := run(cfg, progress)
+		return err
+	}, stream)
+}
+
+func (g *grpcServer) RotateCertificate(_ *provisionerpb.RotateCertificateRequest, stream provisionerpb.Provisioner_RotateCertificateServer) error {
+	return g.runStreaming(rotateCertificate, stream)
+}
+
+func (g *grpcServer) GetStatus(context.Context, *provisionerpb.GetStatusRequest) (*provisionerpb.Status, error) {
+	s, err := g.api.status()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &provisionerpb.Status{
+		State:            s.State,
+		ThingName:        s.ThingName,
+		CertificateId:    s.CertificateID,
+		LastError:        s.LastError,
+		FlowState:        s.FlowState,
+		QuarantinedUntil: s.QuarantinedUntil,
+	}, nil
+}
+
+// runStreaming runs an operation, sending a progress event for every stage and
+// a final event carrying the outcome
+func (g *grpcServer) runStreaming(op func(Config, ProgressFunc) error, stream grpc.ServerStreamingServer[provisionerpb.ProgressEvent]) error {
+	if err := g.api.begin(); err != nil {
+		if errors.Is(err, errBusy) {
+			return status.Error(codes.Aborted, err.Error())
+		}
+		return err
+	}
+
+	var last Stage
+	err := op(g.api.cfg, func(stage Stage, message string) {
+		last = stage
+		// A client that went away doesn't stop the operation
+		stream.Send(&provisionerpb.ProgressEvent{Stage: string(stage), Message: message})
+	})
+	g.api.end(err)
+
+	final := &provisionerpb.ProgressEvent{Stage: string(last), Done: true}
+	if err != nil {
+		final.Error = err.Error()
+	}
+	return stream.Send(final)
+}
+
+// serveGRPC serves the gRPC API on address in the background, sending the
+// error it stops with to errs
+func serveGRPC(api *apiServer, address string, errs chan<- error) error {
+	l, err := listenGRPC(address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving gRPC provisioning API on %s", l.Addr())
+	go func() { errs <- newGRPCServer(api).Serve(l) }()
+	return nil
+}
+
+// listenGRPC opens the unix socket for the gRPC API. TCP is refused since
+// access control relies on the socket's file permissions.
+func listenGRPC(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return nil, fmt.Errorf("gRPC API address %q must be a unix socket (unix:/path/to/socket)", address)
+	}
+	return listen(address)
+}
@@ -0,0 +1,115 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health reported through the health file and /healthz, for orchestrators and
+// test rigs that gate on the device being fully provisioned
+type Health struct {
+	Ready         bool      `json:"ready"` // Provisioned and the permanent identity verified
+	FlowState     FlowState `json:"flowState"`
+	Connected     bool      `json:"connected"` // A connection to AWS IoT is open
+	ThingName     string    `json:"thingName,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorCode ErrorCode `json:"lastErrorCode,omitempty"`
+	// Set while provisioning is refused after repeated terminal failures
+	QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+	// Set while provisioning is refused after using up the attempt budget
+	LockedOutUntil *time.Time `json:"lockedOutUntil,omitempty"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+}
+
+func currentHealth(cfg Config, state *provisioningState) Health {
+	health := Health{
+		Ready:         state.State == FlowVerified,
+		FlowState:     state.State,
+		Connected:     cfg.connections != nil && cfg.connections.Load() > 0,
+		ThingName:     state.ThingName,
+		LastError:     state.LastError,
+		LastErrorCode: state.LastErrorCode,
+		UpdatedAt:     time.Now().UTC(),
+	}
+	if quarantine := state.quarantine(cfg.clock().Now()); quarantine != nil {
+		health.QuarantinedUntil = &quarantine.Until
+	}
+	if lockout := state.lockout(cfg.clock().Now()); lockout != nil {
+		health.LockedOutUntil = &lockout.Until
+	}
+	return health
+}
+
+// writeHealthFile writes the current health to the health file, if one is
+// configured
+func writeHealthFile(cfg Config, state *provisioningState) {
+	if cfg.HealthFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(currentHealth(cfg, state), "", "  ")
+	if err == nil {
+		err = cfg.Files.write(cfg.HealthFile, data, false)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write health file: %v", err)
+	}
+}
+
+// trackedTransport counts the connection in the run's open connections until
+// it is disconnected
+type trackedTransport struct {
+	Transport
+	once        sync.Once
+	connections *atomic.Int32
+	connectTime time.Duration
+}
+
+func trackConnection(cfg Config, transport Transport, connectTime time.Duration) Transport {
+	if cfg.connections != nil {
+		cfg.connections.Add(1)
+	}
+	return &trackedTransport{Transport: transport, connections: cfg.connections, connectTime: connectTime}
+}
+
+// connectTime returns how long the successful connection attempt of a
+// transport from connectTransport took
+func connectTime(transport Transport) time.Duration {
+	if tracked, ok := transport.(*trackedTransport); ok {
+		return tracked.connectTime
+	}
+	return 0
+}
+
+func (t *trackedTransport) Disconnect(quiesce time.Duration) {
+	t.Transport.Disconnect(quiesce)
+	t.once.Do(func() {
+		if t.connections != nil {
+			t.connections.Add(-1)
+		}
+	})
+}
+
+// handleHealth serves /healthz: 200 once the device is provisioned and
+// verified, 503 otherwise
+func (s *apiServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state, err := loadState(s.cfg.outputPath(stateFile), s.cfg.Files, s.cfg.clock())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load provisioning state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	health := currentHealth(s.cfg, state)
+	code := http.StatusOK
+	if !health.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
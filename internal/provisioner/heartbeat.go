@@ -0,0 +1,179 @@
+package provisioner
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Heartbeat published by serve while the device is provisioned, so the fleet
+// sees onboarded devices are alive without another agent running on them
+type Heartbeat struct {
+	Topic           string // Topic template, see renderHeartbeat
+	Interval        time.Duration
+	PayloadTemplate string // File with the payload template, the default document if empty
+}
+
+// Payload published without a payload template
+const defaultHeartbeatPayload = `{"event":"heartbeat","thingName":"{thingName}","serial":"{serial}","certificateId":"{certificateId}","sequence":{sequence},"uptime":{uptime},"time":"{time}"}`
+
+// Shortest heartbeat interval: AWS IoT bills every message, and liveness
+// needs no finer resolution
+const minHeartbeatInterval = 10 * time.Second
+
+// renderHeartbeat fills in a heartbeat template. It supports the placeholders
+// of renderCompletion, with {time} the time of the heartbeat, and:
+//
+//	{sequence}  the number of the heartbeat, from 1 when serve started
+//	{uptime}    seconds since serve started
+func renderHeartbeat(template string, cfg Config, state *provisioningState, sequence int, uptime time.Duration, escape bool) string {
+	// Numbers hold no placeholders, unlike the serial number
+	template = strings.NewReplacer(
+		"{sequence}", strconv.Itoa(sequence),
+		"{uptime}", strconv.FormatInt(int64(uptime.Seconds()), 10),
+	).Replace(template)
+	return renderCompletion(template, cfg, state, escape)
+}
+
+// heartbeatPublisher publishes heartbeats over a connection with the
+// permanent identity, kept open between them. Operations of the server
+// connect with the same client ID, the thing name, so the connection is given
+// up while one runs and made again with the identity it left.
+type heartbeatPublisher struct {
+	cfg       Config
+	heartbeat Heartbeat
+	payload   string
+	started   time.Time
+
+	mu        sync.Mutex
+	transport Transport
+	cert      tls.Certificate
+	sequence  int
+}
+
+// newHeartbeatPublisher checks the heartbeat and reads its payload template
+func newHeartbeatPublisher(cfg Config, heartbeat Heartbeat) (*heartbeatPublisher, error) {
+	if heartbeat.Interval < minHeartbeatInterval {
+		return nil, fmt.Errorf("-heartbeat-interval must be at least %s", minHeartbeatInterval)
+	}
+	if err := validatePublishTopic("heartbeat", heartbeat.Topic); err != nil {
+		return nil, err
+	}
+	p := &heartbeatPublisher{cfg: cfg, heartbeat: heartbeat, payload: defaultHeartbeatPayload, started: cfg.clock().Now()}
+	if heartbeat.PayloadTemplate != "" {
+		data, err := cfg.Files.fs().ReadFile(heartbeat.PayloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read heartbeat payload template: %v", err)
+		}
+		p.payload = string(data)
+	}
+	return p, nil
+}
+
+// publishHeartbeats publishes a heartbeat every interval while the device is
+// provisioned and no operation runs. A failed heartbeat is logged and the
+// next one connects again if the connection is gone.
+func (s *apiServer) publishHeartbeats() {
+	clock := s.cfg.clock()
+	for {
+		if err := s.heartbeats.beat(s.busy); err != nil {
+			log.Printf("Warning: heartbeat failed: %v", err)
+		}
+		clock.Sleep(s.heartbeats.heartbeat.Interval)
+	}
+}
+
+// beat publishes a heartbeat unless busy reports that an operation runs
+func (p *heartbeatPublisher) beat(busy func() bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if busy() {
+		return nil
+	}
+	state, err := loadState(p.cfg.outputPath(stateFile), p.cfg.Files, p.cfg.clock())
+	if err != nil {
+		return err
+	}
+	if state.State != FlowVerified {
+		p.disconnectLocked()
+		return nil
+	}
+
+	if p.transport != nil {
+		select {
+		case err := <-p.transport.Failed():
+			p.disconnectLocked()
+			return err
+		default:
+		}
+	}
+	if p.transport == nil {
+		if err := p.connectLocked(state); err != nil {
+			return err
+		}
+	}
+
+	p.sequence++
+	uptime := p.cfg.clock().Now().Sub(p.started)
+	topic := renderHeartbeat(p.heartbeat.Topic, p.cfg, state, p.sequence, uptime, false)
+	if err := validatePublishTopic("heartbeat", topic); err != nil {
+		return err
+	}
+	payload := renderHeartbeat(p.payload, p.cfg, state, p.sequence, uptime, true)
+	if err := p.transport.Publish(topic, p.cfg.qos("heartbeat").Publish, []byte(payload)); err != nil {
+		// The next heartbeat connects again rather than use the wedged client
+		var wedge *WedgedError
+		if errors.As(err, &wedge) {
+			p.disconnectLocked()
+		}
+		return fmt.Errorf("failed to publish heartbeat to %s: %w", topic, err)
+	}
+	if p.sequence == 1 {
+		log.Printf("Publishing heartbeats to %s every %s", topic, p.heartbeat.Interval)
+	}
+	return nil
+}
+
+// connectLocked connects with the permanent identity, preferring the endpoint
+// that provisioned the device. The connection keeps the key to reconnect with.
+func (p *heartbeatPublisher) connectLocked(state *provisioningState) error {
+	cert, err := p.cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	cfg := p.cfg
+	if state.Endpoint != "" {
+		cfg.Endpoints = append([]string{state.Endpoint}, cfg.Endpoints...)
+	}
+	transport, err := connectTransport(cfg, cert, state.ThingName)
+	if err != nil {
+		zeroPrivateKey(&cert)
+		return err
+	}
+	p.transport, p.cert = transport, cert
+	return nil
+}
+
+// disconnect gives up the connection, waiting for a heartbeat being published
+func (p *heartbeatPublisher) disconnect() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disconnectLocked()
+}
+
+func (p *heartbeatPublisher) disconnectLocked() {
+	if p.transport == nil {
+		return
+	}
+	p.transport.Disconnect(p.cfg.DisconnectQuiesce)
+	zeroPrivateKey(&p.cert)
+	p.transport = nil
+}
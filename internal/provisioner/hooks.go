@@ -0,0 +1,83 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Hook events
+const (
+	HookPreProvision = "pre_provision"
+	HookPostSuccess  = "post_success"
+	HookPostFailure  = "post_failure"
+	HookFirstBoot    = "first_boot"
+)
+
+// Commands run around provisioning, empty to skip. They run through /bin/sh.
+type Hooks struct {
+	PreProvision string
+	PostSuccess  string
+	PostFailure  string
+	FirstBoot    string // Run by first-boot once the device is ready
+}
+
+// Document passed to a hook on stdin
+type hookInput struct {
+	Event  string              `json:"event"`
+	Serial string              `json:"serial"`
+	Result *ProvisioningResult `json:"result,omitempty"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// runHook runs the command for an event with the result (if any) as JSON on
+// stdin and as PROVISION_* environment variables
+func runHook(cfg Config, command string, input hookInput) error {
+	if command == "" {
+		return nil
+	}
+	input.Serial = cfg.SerialNumber
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s hook input: %v", input.Event, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stderr // Keep stdout for the result document
+	cmd.Stderr = os.Stderr
+	// Don't wait on children of the shell that still hold its output open
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"PROVISION_EVENT="+input.Event,
+		"PROVISION_SERIAL="+input.Serial,
+		"PROVISION_ERROR="+input.Error,
+	)
+	if r := input.Result; r != nil {
+		cmd.Env = append(cmd.Env,
+			"PROVISION_THING_NAME="+r.ThingName,
+			"PROVISION_CERTIFICATE_ID="+r.CertificateID,
+			"PROVISION_CERTIFICATE_ARN="+r.CertificateArn,
+			"PROVISION_ENDPOINT="+r.Endpoint,
+			"PROVISION_CERTIFICATE_FILE="+r.CertificateFile,
+			"PROVISION_PRIVATE_KEY_FILE="+r.PrivateKeyFile,
+			"PROVISION_IDENTITY_FILE="+r.IdentityFile,
+		)
+	}
+
+	log.Printf("Running %s hook", input.Event)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s hook timed out after %s", input.Event, cfg.HookTimeout)
+		}
+		return fmt.Errorf("%s hook failed: %v", input.Event, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package provisioner
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Identity of a provisioned device, written once registration succeeds so other
+// processes on the device can find out what it was provisioned as
+type DeviceIdentity struct {
+	ThingName              string     `json:"thingName"`
+	Serial                 string     `json:"serial,omitempty"`
+	CertificateID          string     `json:"certificateId"`
+	CertificateFingerprint string     `json:"certificateFingerprint,omitempty"` // SHA-256 of the DER certificate, hex
+	CertificateNotAfter    *time.Time `json:"certificateNotAfter,omitempty"`    // End of the certificate's validity, as issued
+	Endpoint               string     `json:"endpoint"`
+	Template               string     `json:"template,omitempty"` // Empty for just-in-time provisioning
+	ProvisionedAt          time.Time  `json:"provisionedAt"`
+}
+
+// LoadDeviceIdentity returns the identity of the device provisioned into the
+// configured output directory, or nil if it is not provisioned. It is the
+// single source of truth for other software on the device.
+func LoadDeviceIdentity(cfg Config) (*DeviceIdentity, error) {
+	return loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+}
+
+// certificateFingerprint returns the SHA-256 of the DER encoding of the first
+// certificate in certPEM, empty if there is none
+func certificateFingerprint(certPEM []byte) string {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return ""
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// certificateNotAfter returns the end of the validity period of the first
+// certificate in certPEM, nil if there is none. AWS IoT and certificate
+// providers choose it, so it is read from the certificate rather than assumed.
+func certificateNotAfter(certPEM []byte) *time.Time {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil
+	}
+	notAfter := cert.NotAfter.UTC()
+	return &notAfter
+}
+
+// saveIdentity writes the identity file
+func saveIdentity(path string, identity DeviceIdentity, files FilePermissions) error {
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal device identity: %v", err)
+	}
+	if err := files.write(path, data, false); err != nil {
+		return fmt.Errorf("failed to save device identity: %v", err)
+	}
+	return nil
+}
+
+// loadIdentity reads the identity file, returning nil if the device has not
+// been provisioned
+func loadIdentity(path string, files FilePermissions) (*DeviceIdentity, error) {
+	data, err := files.fs().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device identity: %v", err)
+	}
+
+	var identity DeviceIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("failed to parse device identity %s: %v", path, err)
+	}
+	return &identity, nil
+}
+
+// certificateID is the ID AWS IoT assigns a certificate, the SHA-256 of its DER encoding
+func certificateID(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
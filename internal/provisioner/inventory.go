@@ -0,0 +1,8 @@
+package provisioner
+
+// Inventory table recording every provisioned device on the manufacturing
+// side, see writeInventory
+type Inventory struct {
+	Table   string // DynamoDB table, keyed by the string attribute "serial"
+	Station string // Factory station recorded with each device, the host name if empty
+}
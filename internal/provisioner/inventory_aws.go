@@ -0,0 +1,53 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// writeInventory records the provisioned device in the inventory table, if
+// one is configured: its serial number, thing name, certificate ID, factory
+// station, and when it was provisioned. A device provisioned again replaces
+// its item.
+func writeInventory(cfg Config, result *ProvisioningResult) error {
+	if cfg.Inventory.Table == "" {
+		return nil
+	}
+	station := cfg.Inventory.Station
+	if station == "" {
+		station, _ = os.Hostname()
+	}
+	item := map[string]types.AttributeValue{
+		"serial":        &types.AttributeValueMemberS{Value: cfg.SerialNumber},
+		"thingName":     &types.AttributeValueMemberS{Value: result.ThingName},
+		"certificateId": &types.AttributeValueMemberS{Value: result.CertificateID},
+		"provisionedAt": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if station != "" {
+		item["station"] = &types.AttributeValueMemberS{Value: station}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to record device in inventory: %v", err)
+	}
+	if _, err := dynamodb.NewFromConfig(awsCfg).PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(cfg.Inventory.Table),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("failed to record device in inventory %s: %v", cfg.Inventory.Table, err)
+	}
+	log.Printf("Recorded %s in inventory %s", cfg.SerialNumber, cfg.Inventory.Table)
+	return nil
+}
@@ -0,0 +1,211 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Provisioning modes accepted by the -mode flag
+const (
+	ModeFleet = "fleet" // Fleet provisioning by claim
+	ModeJIT   = "jit"   // Just-in-time provisioning or registration with a registered CA
+)
+
+// jitRegister onboards the device with a certificate signed by a CA registered
+// in AWS IoT. The certificate is issued here from -ca-cert and -ca-key, unless
+// a pre-made one is already in the output directory. The first connection
+// with it triggers just-in-time provisioning (JITP) or registration (JITR),
+// and AWS IoT drops it; connecting is retried until the certificate is active
+// or -jit-timeout passes. The thing is named after the serial number, which the
+// certificate carries as its common name.
+func jitRegister(cfg Config, state *provisioningState, progress ProgressFunc, latencies *Latencies) error {
+	certFile := cfg.outputPath(permanentCertFile)
+	keyFile := cfg.outputPath(permanentKeyFile)
+
+	progress.report(StageCreateCertificate, "Preparing device certificate")
+	if _, err := cfg.Files.fs().Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		if err := issueDeviceCertificate(cfg, certFile, keyFile); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Using device certificate %s", certFile)
+	}
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	defer zeroPrivateKey(&cert)
+	// AWS IoT needs the registered CA in the handshake to find the certificate
+	if len(cert.Certificate) < 2 {
+		log.Printf("Warning: %s holds no CA certificate after the device certificate, just-in-time registration needs it", certFile)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+	certificateID := certificateID(leaf)
+
+	if state.State != FlowCertCreated {
+		if state.State == FlowUnprovisioned {
+			if err := state.transition(FlowClaimConnected); err != nil {
+				return err
+			}
+		}
+		if err := state.certificateCreated(CreateCertificateResponse{CertificateID: certificateID}); err != nil {
+			return err
+		}
+		recordAudit(cfg, auditEntry{Event: AuditCertificateCreated, CertificateID: certificateID})
+	}
+	log.Printf("Certificate ID: %s", certificateID)
+
+	progress.report(StageRegisterThing, "Waiting for just-in-time registration")
+	thingName := cfg.SerialNumber
+	clock := cfg.clock()
+	deadline := clock.Now().Add(cfg.JITTimeout)
+	var transport Transport
+	for attempt := 0; ; attempt++ {
+		petWatchdog()
+		if transport, err = connectTransport(cfg, cert, thingName); err == nil {
+			break
+		}
+		delay := cfg.Reconnect.Delay(attempt)
+		if clock.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("certificate %s was not activated within %s: %w", certificateID, cfg.JITTimeout, err)
+		}
+		// The triggering connection is refused or dropped while AWS IoT registers
+		// the certificate, so failures are expected here
+		log.Printf("Certificate not active yet (%v), retrying in %s", err, delay.Round(time.Millisecond))
+		sleepWithWatchdog(clock, delay)
+	}
+	endpoint := transport.Endpoint()
+	latencies.TLSConnectMS = connectTime(transport).Milliseconds()
+	transport.Disconnect(cfg.DisconnectQuiesce)
+	log.Printf("Certificate %s is active, registered as %s (via %s)", certificateID, thingName, endpoint)
+
+	persistStarted := time.Now()
+	notAfter := leaf.NotAfter.UTC()
+	identity := DeviceIdentity{
+		ThingName:              thingName,
+		Serial:                 cfg.SerialNumber,
+		CertificateID:          certificateID,
+		CertificateFingerprint: certificateID, // Computed the same way
+		CertificateNotAfter:    &notAfter,
+		Endpoint:               endpoint,
+		ProvisionedAt:          time.Now().UTC(),
+	}
+	if err := saveIdentity(cfg.outputPath(identityFile), identity, cfg.Files); err != nil {
+		return err
+	}
+	if err := state.registered(RegisterThingResponse{ThingName: thingName}, endpoint); err != nil {
+		return err
+	}
+	latencies.PersistMS = time.Since(persistStarted).Milliseconds()
+	recordAudit(cfg, auditEntry{Event: AuditThingRegistered, CertificateID: certificateID, ThingName: thingName})
+	return nil
+}
+
+// issueDeviceCertificate generates the device key and a certificate for it
+// signed by the registered CA. The certificate file holds the CA certificate
+// after the device certificate, as just-in-time registration requires.
+func issueDeviceCertificate(cfg Config, certFile, keyFile string) error {
+	ca, caCert, err := loadCA(cfg)
+	if err != nil {
+		return err
+	}
+	defer zeroPrivateKey(&ca)
+	certPEM, keyPEM, err := signDeviceCertificate(caCert, ca.PrivateKey.(crypto.Signer), cfg.SerialNumber)
+	if err != nil {
+		return err
+	}
+	defer keyPEM.zero()
+
+	// A key left without a certificate by an earlier run is replaced too
+	if err := cfg.Files.replaceKeyPair(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("failed to write permanent credentials: %v", err)
+	}
+	if err := writeChain(cfg, certPEM, keyPEM); err != nil {
+		return err
+	}
+	log.Printf("Issued device certificate for %s signed by %s", cfg.SerialNumber, caCert.Subject)
+	return nil
+}
+
+// loadCA loads the CA of -ca-cert and -ca-key. The caller zeroes its key.
+func loadCA(cfg Config) (tls.Certificate, *x509.Certificate, error) {
+	caCertPEM, err := cfg.Files.fs().ReadFile(cfg.CACertFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+	caKeyPEM, err := cfg.Files.fs().ReadFile(cfg.CAKeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to read CA private key: %v", err)
+	}
+	defer clear(caKeyPEM)
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to load CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		zeroPrivateKey(&ca)
+		return tls.Certificate{}, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	if !caCert.IsCA {
+		zeroPrivateKey(&ca)
+		return tls.Certificate{}, nil, fmt.Errorf("%s is not a CA certificate", cfg.CACertFile)
+	}
+	return ca, caCert, nil
+}
+
+// signDeviceCertificate generates a P-256 key and issues a client certificate
+// for it with commonName, signed by the CA and valid until the CA expires. The
+// certificate PEM holds the CA certificate after the device's, as AWS IoT
+// needs it in the handshake.
+func signDeviceCertificate(caCert *x509.Certificate, caKey crypto.Signer, commonName string) ([]byte, keyMaterial, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate serial: %v", err)
+	}
+	// Backdated to tolerate devices whose clock is slightly behind
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     caCert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign device certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal private key: %v", err)
+	}
+	defer clear(keyDER)
+	zeroBigInt(key.D)
+
+	var certPEM bytes.Buffer
+	pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	return certPEM.Bytes(), keyMaterial(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})), nil
+}
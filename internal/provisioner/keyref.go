@@ -0,0 +1,166 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KeyResolver returns the signer of a key reference, a key that never leaves
+// the token holding it. public is the key of the certificate the reference
+// is used with.
+type KeyResolver func(ref string, public crypto.PublicKey) (crypto.Signer, error)
+
+// Schemes of key references accepted in place of a private key file, as
+// OpenSSL engines name keys
+const (
+	keySchemePKCS11 = "pkcs11" // RFC 7512 URI, pkcs11:token=...;object=...
+	keySchemeTPM2   = "tpm2"   // Persistent TPM 2.0 handle, tpm2:0x81000001
+)
+
+// Time the openssl command may take to sign
+const opensslSignTimeout = 30 * time.Second
+
+// keyScheme returns the scheme of a key reference, or "" if s is not one,
+// such as a file path. Paths that happen to start with a scheme and a colon
+// can be given as ./pkcs11:...
+func keyScheme(s string) string {
+	scheme, _, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || scheme != keySchemePKCS11 && scheme != keySchemeTPM2 {
+		return ""
+	}
+	return scheme
+}
+
+// PIN attributes of PKCS#11 URIs, redacted from messages
+var pinValuePattern = regexp.MustCompile(`(pin-value=)[^;?&]*`)
+
+// redactKeyReference returns a key reference fit for messages
+func redactKeyReference(ref string) string {
+	return pinValuePattern.ReplaceAllString(ref, "${1}REDACTED")
+}
+
+// resolveKey returns the signer of a key reference through the resolver of
+// its scheme: KeyResolvers, or else the built-in one
+func (c Config) resolveKey(ref string, public crypto.PublicKey) (crypto.Signer, error) {
+	scheme := keyScheme(ref)
+	if resolver, ok := c.KeyResolvers[scheme]; ok {
+		return resolver(ref, public)
+	}
+	switch scheme {
+	case keySchemeTPM2:
+		return newTPMSigner(c.TPMDevice, ref, public)
+	case keySchemePKCS11:
+		return &opensslSigner{ref: ref, engine: c.OpenSSLEngine, public: public}, nil
+	}
+	return nil, fmt.Errorf("%s is not a key reference", redactKeyReference(ref))
+}
+
+// resolve resolves a key read as a reference (see secret.read) to its
+// signer, for the certificate in cert
+func (s *secret) resolve(cfg Config, cert secret) error {
+	if s.ref == "" {
+		return nil
+	}
+	leaf, err := parseCertificatePEM(cert.data)
+	if err != nil {
+		return fmt.Errorf("certificate %s is invalid: %v", cert.source, err)
+	}
+	signer, err := cfg.resolveKey(s.ref, leaf.PublicKey)
+	if err != nil {
+		return fmt.Errorf("key %s: %v", s.source, err)
+	}
+	s.signer = signer
+	return nil
+}
+
+// keyPair returns the certificate in cert with the key in key, which holds
+// either PEM or the signer of a key reference
+func keyPair(cert, key secret) (tls.Certificate, error) {
+	if key.signer == nil {
+		return tls.X509KeyPair(cert.data, key.data)
+	}
+	identity, err := NewSignerIdentity(cert.data, key.signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return identity.TLSCertificate()
+}
+
+// opensslSigner signs with a PKCS#11 key through the openssl command, loading
+// the key with an engine, such as libp11's pkcs11, or with OpenSSL 3's
+// providers if engine is empty. The URI's pin-value or pin-source attribute
+// unlocks the token.
+type opensslSigner struct {
+	ref    string
+	engine string
+	public crypto.PublicKey
+}
+
+func (s *opensslSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest as crypto.Signer does, with PKCS #1 v1.5 or PSS for
+// RSA keys, and ASN.1 encoded for ECDSA keys
+func (s *opensslSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := []string{"pkeyutl", "-sign", "-inkey", s.ref}
+	if s.engine != "" {
+		args = append(args, "-engine", s.engine, "-keyform", "engine")
+	}
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		hash, err := opensslDigestName(opts.HashFunc())
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-pkeyopt", "digest:"+hash)
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			saltLength := "digest"
+			if pss.SaltLength == rsa.PSSSaltLengthAuto {
+				saltLength = "max"
+			}
+			args = append(args, "-pkeyopt", "rsa_padding_mode:pss", "-pkeyopt", "rsa_pss_saltlen:"+saltLength)
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.public)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opensslSignTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "openssl", args...)
+	cmd.Stdin = bytes.NewReader(digest)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	signature, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		return nil, fmt.Errorf("openssl failed to sign with %s: %v: %s", redactKeyReference(s.ref), err, redactKeyReference(message))
+	}
+	return signature, nil
+}
+
+// opensslDigestName returns OpenSSL's name of a hash
+func opensslDigestName(hash crypto.Hash) (string, error) {
+	switch hash {
+	case crypto.SHA1:
+		return "sha1", nil
+	case crypto.SHA256:
+		return "sha256", nil
+	case crypto.SHA384:
+		return "sha384", nil
+	case crypto.SHA512:
+		return "sha512", nil
+	}
+	return "", fmt.Errorf("unsupported hash %v", hash)
+}
@@ -0,0 +1,122 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Pixels of the QR code PNG, large enough to print sharply on a 50 mm label
+const labelQRSize = 512
+
+// Label printed by default: the QR code on the left, the thing name and
+// serial number beside it. Placeholders are replaced as in renderZPL.
+const defaultZPLTemplate = `^XA
+^CI28
+^FO30,30^BQN,2,6^FH^FDQA,{qr}^FS
+^FO260,50^A0N,32,32^FH^FD{thingName}^FS
+^FO260,100^A0N,26,26^FH^FDSN {serial}^FS
+^XZ
+`
+
+// Device label written once the device is provisioned, so a factory station
+// can print it in the same step
+type Label struct {
+	QRFile      string // PNG of the QR code
+	QRTerminal  bool   // Show the QR code on stderr
+	ZPLFile     string // Label for Zebra printers, "-" for stderr
+	ZPLTemplate string // ZPL file replacing the default label
+}
+
+// QR code of a label, rendered as an image or as text for a terminal
+type qrCode interface {
+	PNG(size int) ([]byte, error)
+	ToSmallString(inverse bool) string
+}
+
+// enabled reports whether any label output is configured
+func (l Label) enabled() bool {
+	return l.QRFile != "" || l.QRTerminal || l.ZPLFile != ""
+}
+
+// labelPayload returns what the QR code encodes: the thing name and serial
+// number as JSON, which scanners at later stations can parse
+func labelPayload(thingName, serial string) string {
+	data, _ := json.Marshal(struct {
+		ThingName string `json:"thingName"`
+		Serial    string `json:"serial"`
+	}{thingName, serial})
+	return string(data)
+}
+
+// writeLabel writes the configured label outputs for the provisioned device
+func writeLabel(cfg Config, result *ProvisioningResult) error {
+	if !cfg.Label.enabled() {
+		return nil
+	}
+	payload := labelPayload(result.ThingName, cfg.SerialNumber)
+	if cfg.Label.QRFile != "" || cfg.Label.QRTerminal {
+		qr, err := newQRCode(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encode QR code: %v", err)
+		}
+		if cfg.Label.QRFile != "" {
+			png, err := qr.PNG(labelQRSize)
+			if err != nil {
+				return fmt.Errorf("failed to render QR code: %v", err)
+			}
+			if err := cfg.Files.write(cfg.Label.QRFile, png, false); err != nil {
+				return fmt.Errorf("failed to write QR code: %v", err)
+			}
+			log.Printf("QR code written to %s", cfg.Label.QRFile)
+		}
+		// Stdout is kept for the result document
+		if cfg.Label.QRTerminal {
+			fmt.Fprint(os.Stderr, qr.ToSmallString(false))
+		}
+	}
+	if cfg.Label.ZPLFile != "" {
+		template := defaultZPLTemplate
+		if cfg.Label.ZPLTemplate != "" {
+			data, err := cfg.Files.fs().ReadFile(cfg.Label.ZPLTemplate)
+			if err != nil {
+				return fmt.Errorf("failed to read ZPL template: %v", err)
+			}
+			template = string(data)
+		}
+		zpl := renderZPL(template, result, cfg.SerialNumber, payload)
+		if cfg.Label.ZPLFile == "-" {
+			fmt.Fprint(os.Stderr, zpl)
+		} else {
+			if err := cfg.Files.write(cfg.Label.ZPLFile, []byte(zpl), false); err != nil {
+				return fmt.Errorf("failed to write ZPL label: %v", err)
+			}
+			log.Printf("ZPL label written to %s", cfg.Label.ZPLFile)
+		}
+	}
+	return nil
+}
+
+// renderZPL fills in a ZPL template. Supported placeholders, escaped for
+// fields introduced with ^FH:
+//
+//	{thingName}      the thing name
+//	{serial}         the serial number
+//	{certificateId}  the certificate ID
+//	{qr}             the QR code payload, see labelPayload
+func renderZPL(template string, result *ProvisioningResult, serial, payload string) string {
+	return strings.NewReplacer(
+		"{thingName}", escapeZPL(result.ThingName),
+		"{serial}", escapeZPL(serial),
+		"{certificateId}", escapeZPL(result.CertificateID),
+		"{qr}", escapeZPL(payload),
+	).Replace(template)
+}
+
+// escapeZPL hex-escapes the characters ZPL treats as commands in field data,
+// and the ^FH escape character itself
+func escapeZPL(s string) string {
+	return strings.NewReplacer("_", "_5F", "^", "_5E", "~", "_7E").Replace(s)
+}
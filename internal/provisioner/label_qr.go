@@ -0,0 +1,14 @@
+//go:build !noqr
+
+package provisioner
+
+import "github.com/skip2/go-qrcode"
+
+// Built with the QR code encoder, see qr_disabled.go
+const qrCodes = true
+
+// newQRCode encodes payload with medium error correction, which survives a
+// scratched label
+func newQRCode(payload string) (qrCode, error) {
+	return qrcode.New(payload, qrcode.Medium)
+}
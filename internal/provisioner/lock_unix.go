@@ -0,0 +1,46 @@
+//go:build unix
+
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockOutputDir takes the lock file of the output directory, waiting while
+// another process holds it, and returns the function releasing it. The kernel
+// releases the lock of a process that dies, so a crash never leaves the
+// directory locked. Storage other than the operating system's file system is
+// not shared with other processes and is not locked.
+func lockOutputDir(cfg Config) (func(), error) {
+	if cfg.Files.FS != nil {
+		return func() {}, nil
+	}
+	path := cfg.outputPath(lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	for waited := false; ; waited = true {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		if !waited {
+			log.Printf("Another process is provisioning in %s, waiting for it to finish", cfg.OutputDir)
+		}
+		sleepWithWatchdog(cfg.clock(), time.Second)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,923 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	region              = "us-east-1"
+	templateName        = "testing_template" // Default provisioning template
+	serialNumber        = "testing_serial"   // Default device serial number (this should be the unique identifier for the device. We can use MAC address + a time seeded random sequence of characters
+	certificateFile     = "device_cert.pem"
+	privateKeyFile      = "device_key.pem"
+	rootCAFile          = "root_ca.pem"             // AWS Root certificate file
+	stateFile           = "provisioning-state.json" // Provisioning progress, used to resume after a restart
+	permanentCertFile   = "permanent_cert.pem"
+	permanentKeyFile    = "permanent_key.pem"
+	previousCertFile    = "previous_cert.pem" // Permanent certificate replaced by rotation, kept for -rotation-overlap
+	previousKeyFile     = "previous_key.pem"
+	permanentChainFile  = "permanent_chain.pem"       // Device certificate, intermediates, and root
+	permanentBundleFile = "permanent_bundle.pem"      // Chain followed by the private key
+	identityFile        = "device-identity.json"      // Thing name and certificate of the provisioned device
+	auditLogFile        = "provisioning-audit.jsonl"  // Hash-chained record of provisioning events
+	receiptFile         = "provisioning-receipt.json" // Signed proof that provisioning completed
+	resultFile          = "provisioning-result.json"  // Result of the run that provisioned the device
+	csrFile             = "device.csr"                // Certificate signing request written by csr export
+	deviceConfigFile    = "device-configuration.json" // Device configuration of the template, written by first-boot
+	lockFile            = "provisioning.lock"         // Held by the process provisioning in the output directory
+	AWSIoTEndpoint      = "aj0bkidxn9p53-ats.iot.us-east-1.amazonaws.com"
+
+	// MQTT Topics
+	topicCreateCertificate         = "$aws/certificates/create" // Followed by the payload format, see apiTopics
+	topicCreateFromCSR             = "$aws/certificates/create-from-csr"
+	topicRegisterThing             = "$aws/provisioning-templates/%s/provision" // Formatted with the template name
+	topicShadowGet                 = "$aws/things/%s/shadow/get"                // Formatted with the thing name
+	topicShadowGetAccepted         = "$aws/things/%s/shadow/get/accepted"
+	topicShadowGetRejected         = "$aws/things/%s/shadow/get/rejected"
+	topicNamedShadowGet            = "$aws/things/%s/shadow/name/%s/get" // Formatted with the thing and shadow names
+	topicNamedShadowGetAccepted    = "$aws/things/%s/shadow/name/%s/get/accepted"
+	topicNamedShadowGetRejected    = "$aws/things/%s/shadow/name/%s/get/rejected"
+	topicNamedShadowUpdate         = "$aws/things/%s/shadow/name/%s/update"
+	topicNamedShadowUpdateAccepted = "$aws/things/%s/shadow/name/%s/update/accepted"
+	topicNamedShadowUpdateRejected = "$aws/things/%s/shadow/name/%s/update/rejected"
+)
+
+// Device registration response
+type RegisterThingResponse struct {
+	DeviceConfiguration map[string]interface{} `json:"deviceConfiguration"`
+	ThingName           string                 `json:"thingName"`
+	Additional          map[string]interface{} `json:"-"` // Fields not modelled above, see ResponseFields
+}
+
+// Certificate creation response
+type CreateCertificateResponse struct {
+	CertificateID             string                 `json:"certificateId"`
+	CertificatePem            string                 `json:"certificatePem"`
+	PrivateKey                keyMaterial            `json:"privateKey"`
+	CertificateOwnershipToken string                 `json:"certificateOwnershipToken"`
+	Additional                map[string]interface{} `json:"-"` // Fields not modelled above, see ResponseFields
+}
+
+// verifyPermanentIdentity connects with the permanent certificate to confirm the
+// new identity is usable. Policies the template attached can take a few seconds
+// to propagate, so refused connections are retried for cfg.PolicyPropagation.
+// If set, connected is called with the connection before it is closed.
+func verifyPermanentIdentity(cfg Config, cert tls.Certificate, thingName string, connected func(Transport)) error {
+	// Local TLS setup errors are not worth waiting on
+	if _, err := newTLSConfig(cfg, cert); err != nil {
+		return err
+	}
+	clock := cfg.clock()
+	deadline := clock.Now().Add(cfg.PolicyPropagation)
+	for attempt := 0; ; attempt++ {
+		petWatchdog()
+		transport, err := connectTransport(cfg, cert, thingName)
+		if err == nil {
+			if connected != nil {
+				connected(transport)
+			}
+			transport.Disconnect(cfg.DisconnectQuiesce)
+			return nil
+		}
+		if !policyPending(err) {
+			return err
+		}
+		delay := cfg.Reconnect.Delay(attempt)
+		if clock.Now().Add(delay).After(deadline) {
+			if cfg.PolicyPropagation > 0 {
+				return fmt.Errorf("still refused %s after the certificate was registered: %w", cfg.PolicyPropagation, err)
+			}
+			return err
+		}
+		log.Printf("Permanent identity refused, policies may still be propagating (%v), retrying in %s", err, delay.Round(time.Millisecond))
+		sleepWithWatchdog(clock, delay)
+	}
+}
+
+// policyPending reports whether a connection failure can be caused by policies
+// that have not propagated yet: AWS IoT then drops the connection, or refuses
+// it as not authorized with MQTT 5
+func policyPending(err error) bool {
+	var reasonErr *ReasonCodeError
+	if errors.As(err, &reasonErr) && reasonErr.ReasonCode == reasonNotAuthorized {
+		return true
+	}
+	return ClassifyError(err) != ErrorTerminal
+}
+
+/*
+Main runs the command line of cmd/provisioner: a subcommand, or otherwise provisioning with the flags given.
+
+Ensure that the device_cert.pem, device_key.pem, and root_ca.pem files are present before running this, or
+that the CLAIM_CERT, CLAIM_KEY, and ROOT_CA environment variables hold them
+*/
+func Main() {
+	log.SetOutput(redactingWriter{w: os.Stderr})
+
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "credentials":
+			if err := runCredentialsCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "status":
+			if err := runStatusCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "audit":
+			if err := runAuditCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "audit-claim-policy":
+			if err := runAuditClaimPolicyCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "verify":
+			if err := runVerifyCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "apply":
+			if err := runApplyCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "first-boot":
+			if err := runFirstBootCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "validate":
+			if err := runValidateCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "claim-rotate":
+			if err := runClaimRotateCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "bootstrap-claim":
+			if err := runBootstrapClaimCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "hook-simulate":
+			if err := runHookSimulateCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "csr":
+			if err := runCSRCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "ca-register":
+			if err := runCARegisterCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "ca-sign":
+			if err := runCASignCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "template":
+			if err := runTemplateCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "wizard":
+			if err := runWizardCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "serve":
+			if err := runServeCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "deprovision":
+			if err := runDeprovisionCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "rma":
+			if err := runRMACommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "cleanup-orphans":
+			if err := runCleanupOrphansCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "find-thing":
+			if err := runFindThingCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "claim-encrypt":
+			if err := runClaimEncryptCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "station":
+			if err := runStationCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "report":
+			if err := runReportCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "simulate":
+			if err := runSimulateCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "soak":
+			if err := runSoakCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "canary":
+			if err := runCanaryCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "preflight-claim":
+			if err := runPreflightClaimCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "ble":
+			if err := runBLECommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "softap":
+			if err := runSoftAPCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "bridge":
+			if err := runBridgeCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "gateway":
+			if err := runGatewayCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	output := flag.String("output", "", "Print the result to stdout as json or yaml on success")
+	summaryFormat := flag.String("summary", SummaryText, "Print a summary of the run to stderr at exit: text, json, or none")
+	flag.Parse()
+
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("[%s] Invalid configuration: %v", ErrorInvalidConfiguration, err)
+	}
+	if err := validateOutputFormat(*output); err != nil {
+		log.Fatalf("[%s] Invalid configuration: %v", ErrorInvalidConfiguration, err)
+	}
+	if err := validateSummaryFormat(*summaryFormat); err != nil {
+		log.Fatalf("[%s] Invalid configuration: %v", ErrorInvalidConfiguration, err)
+	}
+
+	log.Println("Starting AWS IoT Device Provisioning test using trusted user flow")
+	summary := newRunSummary()
+	result, err := run(summary.watch(cfg), summary.record)
+	summary.finish(result, err)
+	if err := summary.write(os.Stderr, *summaryFormat); err != nil {
+		log.Printf("Warning: failed to write summary: %v", err)
+	}
+	if err != nil {
+		sdNotify(fmt.Sprintf("STATUS=Provisioning failed [%s]: %v", ErrorCodeOf(err), err))
+		log.Fatalf("[%s] %v", ErrorCodeOf(err), err)
+	}
+	if *output != "" {
+		if err := writeResult(os.Stdout, *output, result); err != nil {
+			log.Fatalf("Failed to write result: %v", err)
+		}
+	}
+	log.Println("Device provisioning test complete")
+}
+
+// Provision provisions the device cfg describes, as the program does (see
+// run), for services embedding the provisioning flow. Calls for different
+// devices can run concurrently in one process: each has its own MQTT client,
+// flight recorder, and connection count, and keeps its state and credentials
+// in cfg.OutputDir, which a concurrent call for the same directory is refused.
+// Give each device a distinct client ID, as the default -client-id derived
+// from the serial number does, or AWS IoT disconnects one for the other.
+func Provision(cfg Config, progress ProgressFunc) (*ProvisioningResult, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return run(cfg, progress)
+}
+
+// run executes the provisioning flow (see runOnce), first waiting for the
+// network and retrying failed runs if configured to
+func run(cfg Config, progress ProgressFunc) (result *ProvisioningResult, err error) {
+	// The secrets of every attempt are kept until the last one ends
+	cfg.secrets = secrets.open(cfg.ShowSecrets)
+	defer cfg.secrets.close()
+	defer func() { err = redactError(err) }()
+	if port := openStatusPort(cfg); port != nil {
+		progress = progress.and(port.report)
+		defer func() { port.finish(result, err) }()
+	}
+	if bus := openEventBus(cfg); bus != nil {
+		progress = progress.and(bus.report)
+		defer func() { bus.finish(result, err) }()
+	}
+	cfg = cfg.withRandom()
+	// Spread out a fleet powering on at once, unless there is nothing to do
+	if cfg.StartupJitter > 0 {
+		if state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); err == nil && state.State != FlowVerified {
+			delay := randomDuration(cfg.random(), cfg.StartupJitter)
+			log.Printf("Delaying start by %s", delay.Round(time.Millisecond))
+			sleepWithWatchdog(cfg.clock(), delay)
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if cfg.WaitNetwork {
+			waitForNetwork(cfg)
+		}
+		result, err := runOnce(cfg, progress)
+		// The device is provisioned, another run would not repeat the post steps
+		var postStepErr *PostStepError
+		if err == nil || !cfg.RetryForever || errors.As(err, &postStepErr) {
+			return result, err
+		}
+		delay := cfg.Reconnect.Delay(attempt)
+		var quarantined *QuarantineError
+		var lockedOut *LockoutError
+		if errors.As(err, &quarantined) {
+			delay = quarantined.Until.Sub(cfg.clock().Now())
+		} else if errors.As(err, &lockedOut) {
+			delay = lockedOut.Until.Sub(cfg.clock().Now())
+		} else if isThrottled(err) {
+			delay = cfg.Reconnect.ThrottledDelay()
+		}
+		log.Printf("Provisioning failed [%s]: %v, retrying in %s", ErrorCodeOf(err), err, delay.Round(time.Millisecond))
+		sdNotify(fmt.Sprintf("STATUS=Provisioning failed [%s], retrying: %v", ErrorCodeOf(err), err))
+		sleepWithWatchdog(cfg.clock(), delay)
+	}
+}
+
+// runOnce executes the provisioning flow, reporting each stage to progress
+// (which may be nil). It resumes from the persisted state, and records the
+// error in it if the flow fails. The MQTT session is torn down before it
+// returns, whether the flow succeeded or not. Only one run provisions in an
+// output directory at a time: a concurrent run in the process waits for it and
+// returns its outcome, and one in another process waits for the lock file and
+// then finds the device provisioned.
+func runOnce(cfg Config, progress ProgressFunc) (result *ProvisioningResult, err error) {
+	started := time.Now()
+	cfg = cfg.withRandom()
+	// Commands such as simulate and station call it for each device directly
+	if cfg.secrets == nil {
+		cfg.secrets = secrets.open(cfg.ShowSecrets)
+		defer cfg.secrets.close()
+		// Before the scope closes and its secrets are forgotten
+		defer func() { err = redactError(err) }()
+	}
+	if cfg.connections == nil {
+		cfg.connections = new(atomic.Int32)
+	}
+	if cfg.OutputDir != "" {
+		if err := cfg.Files.fs().MkdirAll(cfg.OutputDir, 0700); err != nil {
+			return nil, &NotWritableError{What: "output directory", Dir: cfg.OutputDir, Err: err}
+		}
+	}
+	if err := checkDestination(cfg.Files.fs(), cfg.OutputDir); err != nil {
+		return nil, err
+	}
+	if err := checkWritable(cfg); err != nil {
+		return nil, err
+	}
+	inFlight, leader, err := joinFlight(cfg.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	if !leader {
+		log.Printf("Provisioning is already in progress in %s, waiting for its outcome", cfg.OutputDir)
+		result, err := inFlight.wait()
+		if err == nil {
+			progress.report(StageComplete, fmt.Sprintf("Provisioned as %s", result.ThingName))
+		}
+		return result, err
+	}
+	// The redaction deferred above runs after this, so the runs waiting would
+	// otherwise get the error with its secrets
+	defer func() { inFlight.land(result, redactError(err)) }()
+	unlock, err := lockOutputDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// A replacement of credentials interrupted by a crash
+	if err := recoverDeviceCredentials(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Files.recoverKeyPair(cfg.ClaimCertFile, cfg.ClaimKeyFile); err != nil {
+		return nil, err
+	}
+	if cfg.HealthFile != "" {
+		if err := checkDestination(cfg.Files.fs(), filepath.Dir(cfg.HealthFile)); err != nil {
+			return nil, err
+		}
+	}
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return nil, err
+	}
+	if state.State == FlowVerified {
+		if err := checkPermanentFingerprint(cfg); err != nil {
+			return nil, err
+		}
+		writeHealthFile(cfg, state)
+		log.Printf("Device is already provisioned as %s", state.ThingName)
+		progress.report(StageComplete, fmt.Sprintf("Provisioned as %s", state.ThingName))
+		result := storedResult(cfg, state)
+		postStepFailed(&result.PostStepFailures, PostStepReconcile, reconcileParameters(cfg, state))
+		// Policies added to -attach-policy, or missed without credentials
+		postStepFailed(&result.PostStepFailures, PostStepPolicies, attachPolicies(cfg, state))
+		postStepFailed(&result.PostStepFailures, PostStepRetire, retirePreviousCertificate(cfg, false))
+		// Stations rerun provisioning to reprint a label
+		postStepFailed(&result.PostStepFailures, PostStepLabel, writeLabel(cfg, result))
+		// Templates changed with a firmware update apply on the next boot
+		postStepFailed(&result.PostStepFailures, PostStepRender, writeRenders(cfg, result))
+		postStepFailed(&result.PostStepFailures, PostStepDeviceConfig, applyDeviceConfiguration(cfg, result))
+		reportToCloudWatch(cfg, state.ThingName, nil)
+		return checkPostSteps(cfg, result)
+	}
+	if err := state.quarantine(cfg.clock().Now()); err != nil {
+		writeHealthFile(cfg, state)
+		return nil, err
+	}
+	if err := state.lockout(cfg.clock().Now()); err != nil {
+		writeHealthFile(cfg, state)
+		return nil, err
+	}
+	if cfg.ProductsFile != "" {
+		if cfg, err = selectProduct(cfg, state); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TargetsFile != "" {
+		if cfg, err = selectTarget(cfg, state); err != nil {
+			return nil, err
+		}
+	}
+	if err := runHook(cfg, cfg.Hooks.PreProvision, hookInput{Event: HookPreProvision}); err != nil {
+		return nil, err
+	}
+	result, err = provision(cfg, state, progress)
+	if err != nil {
+		event := newProvisioningEvent(cfg, started, nil, err)
+		reportToCloudWatch(cfg, "", &event)
+		if hookErr := runHook(cfg, cfg.Hooks.PostFailure, hookInput{Event: HookPostFailure, Error: err.Error()}); hookErr != nil {
+			log.Printf("Warning: %v", hookErr)
+		}
+		return nil, err
+	}
+	// The device is provisioned, what follows is reported rather than failing
+	// the run, see PostStepFailure
+	postStepFailed(&result.PostStepFailures, PostStepPolicies, attachPolicies(cfg, state))
+	// Looked up to attach them
+	result.CertificateArn = state.CertificateArn
+	postStepFailed(&result.PostStepFailures, PostStepLabel, writeLabel(cfg, result))
+	postStepFailed(&result.PostStepFailures, PostStepRender, writeRenders(cfg, result))
+	postStepFailed(&result.PostStepFailures, PostStepDeviceConfig, applyDeviceConfiguration(cfg, result))
+	postStepFailed(&result.PostStepFailures, PostStepInventory, writeInventory(cfg, result))
+	event := newProvisioningEvent(cfg, started, result, nil)
+	reportToCloudWatch(cfg, result.ThingName, &event)
+	postStepFailed(&result.PostStepFailures, PostStepHook, runHook(cfg, cfg.Hooks.PostSuccess, hookInput{Event: HookPostSuccess, Result: result}))
+	return checkPostSteps(cfg, result)
+}
+
+// newProvisioningResult describes the provisioned device from its state
+func newProvisioningResult(cfg Config, state *provisioningState) *ProvisioningResult {
+	result := &ProvisioningResult{
+		ThingName:           state.ThingName,
+		CertificateID:       state.CertificateID,
+		CertificateArn:      state.CertificateArn,
+		Endpoint:            state.Endpoint,
+		CertificateFile:     cfg.outputPath(permanentCertFile),
+		PrivateKeyFile:      cfg.outputPath(permanentKeyFile),
+		IdentityFile:        cfg.outputPath(identityFile),
+		ReceiptFile:         cfg.outputPath(receiptFile),
+		DeviceConfiguration: deviceConfiguration(cfg, state.DeviceConfiguration),
+		AdditionalFields:    state.AdditionalFields.clone(),
+		ClockSkewMS:         state.ClockSkewMS,
+	}
+	// The registration is recorded by now, so the run is not failed for it
+	var err error
+	result.DeviceConfigurationValue, err = typedDeviceConfiguration(cfg, state.DeviceConfiguration)
+	postStepFailed(&result.PostStepFailures, PostStepDeviceConfig, err)
+	if certPEM, err := cfg.Files.fs().ReadFile(result.CertificateFile); err == nil {
+		result.CertificateNotAfter = certificateNotAfter(certPEM)
+	}
+	if cfg.Chain {
+		result.ChainFile = cfg.outputPath(permanentChainFile)
+	}
+	if cfg.Bundle {
+		result.BundleFile = cfg.outputPath(permanentBundleFile)
+	}
+	// Provisioning from a CSR leaves no key, bundle, or receipt on this host
+	if cfg.CSRFile != "" {
+		result.PrivateKeyFile = ""
+		result.BundleFile = ""
+		result.ReceiptFile = ""
+	}
+	return result
+}
+
+// provision advances the flow from its current state to verified and returns
+// the result of the run
+func provision(cfg Config, state *provisioningState, progress ProgressFunc) (result *ProvisioningResult, err error) {
+	if state.State != FlowUnprovisioned {
+		log.Printf("Resuming provisioning from state %s", state.State)
+	}
+	recordAudit(cfg, auditEntry{Event: AuditAttemptStarted})
+	cfg.flight = &recorder{}
+	timer := &stageTimer{}
+	progress = progress.and(func(Stage, string) { writeHealthFile(cfg, state) }).and(timer.record)
+	defer func() {
+		defer writeHealthFile(cfg, state)
+		if err != nil {
+			err = redactError(err)
+			recordAudit(cfg, auditEntry{Event: AuditAttemptFailed, CertificateID: state.CertificateID, Error: err.Error()})
+			now := cfg.clock().Now()
+			state.failed(err, cfg.QuarantineAfter, cfg.Quarantine, now)
+			state.attemptFailed(cfg.AttemptBudget, cfg.AttemptLockout, now)
+			if cfg.DiagnosticsDir != "" && isTerminal(err) {
+				if path, bundleErr := writeDiagnosticBundle(cfg, state, timer, err); bundleErr != nil {
+					log.Printf("Warning: %v", bundleErr)
+				} else {
+					log.Printf("Diagnostic bundle written to %s", path)
+				}
+			}
+			if state.QuarantinedUntil != nil {
+				log.Printf("Quarantined until %s after %d terminal failures", state.QuarantinedUntil.Format(time.RFC3339), state.TerminalFailures)
+			}
+			if lockout := state.lockout(now); lockout != nil {
+				log.Printf("Attempt budget used up, locked out until %s after %d failed attempts", lockout.Until.Format(time.RFC3339), lockout.Attempts)
+			}
+			if saveErr := state.save(); saveErr != nil {
+				log.Printf("Warning: %v", saveErr)
+			}
+		}
+	}()
+
+	certFile := cfg.outputPath(permanentCertFile)
+	claimCertPEM := newSecret(cfg.Files.fs(), envClaimCert, cfg.ClaimCertFile)
+	claimKeyPEM := newSecret(cfg.Files.fs(), envClaimKey, cfg.ClaimKeyFile)
+
+	// 1-6. Obtain and register the permanent identity with the claim credentials
+	var ownershipToken string
+	if state.State != FlowRegistered && cfg.Mode == ModeJIT {
+		if err = jitRegister(cfg, state, progress, &timer.latencies); err != nil {
+			return nil, err
+		}
+	} else if state.State != FlowRegistered {
+		if ownershipToken, err = claimAndRegister(cfg, state, &claimCertPEM, &claimKeyPEM, progress, &timer.latencies); err != nil {
+			return nil, err
+		}
+	}
+
+	// The key is on the device that made the CSR, which verifies the identity
+	// once the certificate is installed there
+	if cfg.CSRFile != "" {
+		log.Printf("Certificate for %s written to %s, install it on the device holding the key", state.ThingName, certFile)
+		progress.report(StageComplete, fmt.Sprintf("Registered as %s, certificate ready for the device", state.ThingName))
+		return newRunResult(cfg, state, ownershipToken, timer), nil
+	}
+
+	// 7. Confirm the permanent identity works, against the endpoint that served
+	// the provisioning
+	log.Println("Verifying permanent identity...")
+	progress.report(StageVerify, "Verifying permanent identity")
+	permanentCert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return nil, withCode(ErrorCredentialsUnusable, fmt.Errorf("failed to load permanent certificates: %v", err))
+	}
+	defer zeroPrivateKey(&permanentCert)
+	verifyCfg := cfg
+	verifyCfg.Endpoints = []string{state.Endpoint}
+	var postStepFailures []PostStepFailure
+	connected := func(transport Transport) {
+		if cfg.StatusShadow != "" {
+			postStepFailed(&postStepFailures, PostStepStatusShadow, reportStatusShadow(cfg, transport, state))
+		}
+		if cfg.Completion.Topic != "" {
+			postStepFailed(&postStepFailures, PostStepCompletion, publishCompletion(cfg, transport, state))
+		}
+	}
+	if err := verifyPermanentIdentity(verifyCfg, permanentCert, state.ThingName, connected); err != nil {
+		return nil, fmt.Errorf("permanent identity verification failed, keeping claim credentials: %w", err)
+	}
+	if cfg.CloudVerify {
+		certPEM, err := cfg.Files.fs().ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read permanent certificate: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := verifyCloudState(ctx, cfg, state, certPEM); err != nil {
+			return nil, fmt.Errorf("cloud verification failed, keeping claim credentials: %w", err)
+		}
+	}
+
+	// Leave proof, signed with the new key, that this device completed provisioning
+	receipt := ProvisioningReceipt{
+		Serial:        cfg.SerialNumber,
+		ThingName:     state.ThingName,
+		CertificateID: state.CertificateID,
+		Endpoint:      state.Endpoint,
+		VerifiedAt:    cfg.clock().Now().UTC(),
+	}
+	if identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files); err == nil && identity != nil {
+		receipt.ProvisionedAt = identity.ProvisionedAt
+	}
+	if err := writeReceipt(cfg.outputPath(receiptFile), permanentCert, receipt, cfg.Files); err != nil {
+		return nil, err
+	}
+
+	// 8. Optionally remove the claim credentials now that the permanent identity works
+	if cfg.WipeClaim {
+		if err := wipeClaimCredentials(claimCertPEM, claimKeyPEM); err != nil {
+			return nil, fmt.Errorf("failed to wipe claim credentials: %v", err)
+		}
+		log.Println("Claim credentials wiped")
+	}
+	if err := state.transition(FlowVerified); err != nil {
+		return nil, err
+	}
+	recordAudit(cfg, auditEntry{Event: AuditIdentityVerified, CertificateID: state.CertificateID, ThingName: state.ThingName})
+
+	progress.report(StageComplete, fmt.Sprintf("Provisioned as %s", state.ThingName))
+	result = newRunResult(cfg, state, ownershipToken, timer)
+	result.PostStepFailures = append(postStepFailures, result.PostStepFailures...)
+	return result, nil
+}
+
+// claimAndRegister connects with the claim credentials, creates the permanent
+// certificate, and registers the thing, advancing state through
+// claim-connected, cert-created, and registered. It returns the ownership token
+// the thing was registered with, and records the latencies of the steps.
+func claimAndRegister(cfg Config, state *provisioningState, claimCertPEM, claimKeyPEM *secret, progress ProgressFunc, latencies *Latencies) (string, error) {
+	started := cfg.clock().Now()
+	// Validate claim credentials before connecting
+	progress.report(StageValidate, "Validating claim credentials")
+	rootCA, err := readRootCAs(cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to read root CA: %v", err)
+	}
+	var candidates []claimCandidate
+	switch {
+	case cfg.ClaimBundleURL != "":
+		cert, key, err := fetchClaimBundle(cfg)
+		if err != nil {
+			return "", err
+		}
+		*claimCertPEM, *claimKeyPEM = cert, key
+	case cfg.ClaimDir != "":
+		if candidates, err = loadClaimCandidates(cfg, rootCA, state.RefusedClaims); err != nil {
+			return "", err
+		}
+		for _, candidate := range candidates {
+			defer clear(candidate.key.data)
+		}
+	default:
+		if err := claimCertPEM.read(); err != nil {
+			return "", withCode(ErrorCredentialsUnusable, fmt.Errorf("failed to read claim certificate: %v", err))
+		}
+		if err := claimKeyPEM.read(); err != nil {
+			return "", withCode(ErrorCredentialsUnusable, fmt.Errorf("failed to read claim private key: %v", err))
+		}
+		if err := claimCertPEM.open(cfg); err != nil {
+			return "", err
+		}
+		if err := claimKeyPEM.open(cfg); err != nil {
+			return "", err
+		}
+		if err := claimKeyPEM.resolve(cfg, *claimCertPEM); err != nil {
+			return "", withCode(ErrorCredentialsUnusable, fmt.Errorf("failed to resolve claim private key: %v", err))
+		}
+	}
+	if candidates == nil {
+		if err := validateClaimCredentials(*claimCertPEM, *claimKeyPEM, rootCA, cfg.clock().Now()); err != nil {
+			return "", withCode(ErrorCredentialsUnusable, fmt.Errorf("claim credential check failed: %v", err))
+		}
+		candidates = []claimCandidate{{cert: *claimCertPEM, key: *claimKeyPEM}}
+	}
+	if candidates, err = pinnedClaims(cfg, candidates); err != nil {
+		return "", err
+	}
+	var csr []byte
+	if cfg.CSRFile != "" {
+		if csr, err = readCSR(cfg.Files.fs(), cfg.CSRFile); err != nil {
+			return "", err
+		}
+	}
+	// Parameters the template would reject are better caught before a
+	// certificate is created for nothing
+	params := templateParameters(cfg)
+	if cfg.CheckParameters {
+		if err := checkTemplateParameters(context.Background(), cfg, params); err != nil {
+			return "", err
+		}
+	}
+
+	// Create MQTT client with temporary credentials
+	log.Println("Creating MQTT client with temporary credentials...")
+	progress.report(StageConnect, "Connecting with claim credentials")
+	defer clear(claimKeyPEM.data)
+	clientID, err := renderClientID(cfg.ClientIDTemplate, cfg.SerialNumber, cfg.random())
+	if err != nil {
+		return "", err
+	}
+	transport, claimCert, err := connectClaim(cfg, state, candidates, clientID, claimCertPEM, claimKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("failed to create MQTT client: %w", err)
+	}
+	defer zeroPrivateKey(&claimCert)
+	session := newProvisioningSession(transport, cfg)
+	defer session.close()
+	if cfg.Deadline > 0 {
+		session.deadline = started.Add(cfg.Deadline)
+	}
+	endpoint := transport.Endpoint()
+	latencies.TLSConnectMS = connectTime(transport).Milliseconds()
+	defer func() {
+		latencies.SubscribeMS = session.latencies.SubscribeMS
+		latencies.CreateCertificateMS = session.latencies.CreateCertificateMS
+		latencies.RegisterThingMS = session.latencies.RegisterThingMS
+	}()
+
+	if state.State == FlowUnprovisioned {
+		if err := state.transition(FlowClaimConnected); err != nil {
+			return "", err
+		}
+	}
+
+	// Resume a previous run that created a certificate but never registered it
+	var certResponse CreateCertificateResponse
+	if state.State == FlowCertCreated {
+		log.Printf("Resuming registration for certificate %s created at %s", state.CertificateID, state.UpdatedAt.Format(time.RFC3339))
+		certResponse = state.certificateResponse()
+	} else {
+		// Create permanent certificate via MQTT
+		progress.report(StageCreateCertificate, "Creating permanent certificate")
+		certResponse, err = session.createCertificateWithRetry(csr, cfg.CreateRetry)
+		if err != nil {
+			return "", fmt.Errorf("certificate creation failed: %w", err)
+		}
+		log.Println("Successfully created permanent certificate")
+
+		// Persist the ownership token before registering so a crash doesn't orphan the certificate
+		if err := state.certificateCreated(certResponse); err != nil {
+			return "", err
+		}
+		recordAudit(cfg, auditEntry{Event: AuditCertificateCreated, CertificateID: certResponse.CertificateID})
+	}
+	// Keys are redacted by their PEM form, without a copy that could not be
+	// zeroed
+	cfg.secrets.add(SecretOwnershipToken, certResponse.CertificateOwnershipToken)
+	log.Printf("Certificate ID: %s", certResponse.CertificateID)
+	// The state keeps its own copy of the key until registration
+	defer certResponse.PrivateKey.zero()
+
+	// Save permanent certificate and key
+	persistStarted := time.Now()
+	certPEM := []byte(certResponse.CertificatePem)
+	err = cfg.Files.write(cfg.outputPath(permanentCertFile), certPEM, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to write permanent certificate to file: %v", err)
+	}
+
+	// Certificates signed from a CSR come without a key
+	if len(certResponse.PrivateKey) > 0 {
+		err = cfg.Files.write(cfg.outputPath(permanentKeyFile), certResponse.PrivateKey, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to write permanent private key to file: %v", err)
+		}
+	}
+	if err := writeChain(cfg, certPEM, certResponse.PrivateKey); err != nil {
+		return "", err
+	}
+	latencies.PersistMS = time.Since(persistStarted).Milliseconds()
+
+	// Requests of library callers, which can set template parameters, see
+	// flowsteps.go
+	stepped, stepParams, err := runStepsBeforeRegister(cfg, session, certResponse.CertificateID, params)
+	if err != nil {
+		return "", err
+	}
+	params = stepped
+
+	// Register thing via MQTT, retrying with a suffixed parameter while the
+	// thing name is taken if configured to
+	progress.report(StageRegisterThing, "Registering thing")
+	registerResponse, err := session.registerThingWithRetry(certResponse, params, cfg.RegisterRetry)
+	var conflict *ThingNameConflictError
+	for attempt := 1; errors.As(err, &conflict) && cfg.ConflictSuffix != "" && attempt <= cfg.ConflictRetries; attempt++ {
+		// Suffixed after the steps, which may have set the conflict parameter
+		params = conflictParameters(cfg, stepped, attempt)
+		log.Printf("Warning: %v, retrying with %s=%s", err, cfg.ConflictParam, params[cfg.ConflictParam])
+		registerResponse, err = session.registerThingWithRetry(certResponse, params, cfg.RegisterRetry)
+	}
+	if errors.Is(err, errDeadline) && cfg.AbandonOnDeadline {
+		id := state.CertificateID
+		if abandonErr := state.abandonCertificate(); abandonErr != nil {
+			log.Printf("Warning: %v", abandonErr)
+		} else {
+			log.Printf("Warning: abandoned certificate %s, recorded in the state as orphaned", id)
+			recordAudit(cfg, auditEntry{Event: AuditCertificateOrphaned, CertificateID: id, Error: err.Error()})
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("thing registration failed: %w", err)
+	}
+	// The response of the request that registered the certificate was lost;
+	// templates usually name the thing after the conflict parameter
+	if registerResponse.ThingName == "" {
+		registerResponse.ThingName = params[cfg.ConflictParam]
+		log.Printf("Warning: assuming thing name %s from the %s parameter", registerResponse.ThingName, cfg.ConflictParam)
+	}
+	log.Printf("Successfully registered thing: %s (via %s)", registerResponse.ThingName, endpoint)
+	logged := registerResponse.DeviceConfiguration
+	if psk, ok := logged[configWiFiPSK].(string); ok {
+		// Passphrases may be too short to be redacted by value
+		cfg.secrets.add(SecretWiFiPSK, psk)
+		logged = maps.Clone(logged)
+		logged[configWiFiPSK] = redactedRole(SecretWiFiPSK)
+	}
+	log.Printf("Device configuration: %+v", logged)
+	if err := checkDeviceConfiguration(cfg, registerResponse.DeviceConfiguration); err != nil {
+		return "", err
+	}
+	// Before the identity and state record the time
+	clockSkew := checkServerTime(cfg, registerResponse.DeviceConfiguration, session.registered)
+	// A step that fails leaves the registration to be made again
+	if err := runFlowSteps(session, cfg.Steps.AfterRegister, &StepContext{
+		Serial:              cfg.SerialNumber,
+		CertificateID:       certResponse.CertificateID,
+		Parameters:          maps.Clone(params),
+		ThingName:           registerResponse.ThingName,
+		DeviceConfiguration: deviceConfiguration(cfg, registerResponse.DeviceConfiguration),
+	}); err != nil {
+		return "", err
+	}
+
+	// Record the identity for other processes on the device
+	persistStarted = time.Now()
+	identity := DeviceIdentity{
+		ThingName:              registerResponse.ThingName,
+		Serial:                 cfg.SerialNumber,
+		CertificateID:          certResponse.CertificateID,
+		CertificateFingerprint: certificateFingerprint([]byte(certResponse.CertificatePem)),
+		CertificateNotAfter:    certificateNotAfter([]byte(certResponse.CertificatePem)),
+		Endpoint:               endpoint,
+		Template:               cfg.TemplateName,
+		ProvisionedAt:          cfg.clock().Now().UTC(),
+	}
+	if err := saveIdentity(cfg.outputPath(identityFile), identity, cfg.Files); err != nil {
+		return "", err
+	}
+	state.TemplateParameters = params
+	state.StepParameters = stepParams
+	state.ClockSkewMS = clockSkew
+	if err := state.registered(registerResponse, endpoint); err != nil {
+		return "", err
+	}
+	latencies.PersistMS += time.Since(persistStarted).Milliseconds()
+	recordAudit(cfg, auditEntry{Event: AuditThingRegistered, CertificateID: certResponse.CertificateID, ThingName: registerResponse.ThingName})
+	return certResponse.CertificateOwnershipToken, nil
+}
@@ -0,0 +1,386 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Bootstrap manifest given to apply: the state a device should end up in once
+// brought up. Applying it converges the device to it, changing only what
+// differs, so it can be applied on every boot.
+type bootstrapManifest struct {
+	Identity manifestIdentity `json:"identity"`
+	// Named shadows to seed with reported state
+	Shadows []manifestShadow `json:"shadows,omitempty"`
+	// Topics the device must be allowed to publish and subscribe to, with
+	// {thingName} replaced
+	Topics  []string `json:"topics,omitempty"`
+	Renders []Render `json:"renders,omitempty"`
+	// Services restarted when the identity or a rendered file changed
+	Services []string `json:"services,omitempty"`
+	// Command a service's name is appended to to restart it, split on spaces
+	RestartCommand string `json:"restartCommand,omitempty"`
+}
+
+// How the device is provisioned. Fields left empty keep the value of the
+// corresponding flag.
+type manifestIdentity struct {
+	Template   string            `json:"template,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"` // Added to -param, replacing those of the same name
+	// Thing name the device must be provisioned as, if known in advance
+	ThingName string `json:"thingName,omitempty"`
+}
+
+type manifestShadow struct {
+	Name     string                 `json:"name"`
+	Reported map[string]interface{} `json:"reported"`
+}
+
+// Restarts services unless the manifest says otherwise
+const defaultRestartCommand = "systemctl restart"
+
+// loadManifest reads and checks a bootstrap manifest
+func loadManifest(fsys FileSystem, file string) (*bootstrapManifest, error) {
+	data, err := fsys.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest bootstrapManifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", file, err)
+	}
+	for _, shadow := range manifest.Shadows {
+		if !shadowNamePattern.MatchString(shadow.Name) {
+			return nil, fmt.Errorf("manifest %s: invalid shadow name %q: use up to 64 letters, digits, and :_-", file, shadow.Name)
+		}
+		if len(shadow.Reported) == 0 {
+			return nil, fmt.Errorf("manifest %s: shadow %s has no reported state", file, shadow.Name)
+		}
+	}
+	for _, topic := range manifest.Topics {
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("manifest %s: topic %q must not be empty or contain wildcards", file, topic)
+		}
+	}
+	for _, render := range manifest.Renders {
+		if render.Template == "" || render.Output == "" {
+			return nil, fmt.Errorf("manifest %s: renders need a template and an output", file)
+		}
+	}
+	if manifest.RestartCommand == "" {
+		manifest.RestartCommand = defaultRestartCommand
+	}
+	return &manifest, nil
+}
+
+// apply returns cfg set up to provision the identity
+func (i manifestIdentity) apply(cfg Config) Config {
+	if i.Template != "" {
+		cfg.TemplateName = i.Template
+	}
+	if len(i.Parameters) > 0 {
+		params := maps.Clone(cfg.TemplateParameters)
+		if params == nil {
+			params = map[string]string{}
+		}
+		maps.Copy(params, i.Parameters)
+		cfg.TemplateParameters = params
+	}
+	return cfg
+}
+
+// How a resource of the manifest differs from the device
+type changeKind string
+
+const (
+	changeNone   changeKind = "="
+	changeCreate changeKind = "+"
+	changeUpdate changeKind = "~"
+	changeFailed changeKind = "✗"
+)
+
+// manifestChange is a line of the diff apply reports
+type manifestChange struct {
+	Kind     changeKind
+	Resource string // Such as "shadow config"
+	Detail   string
+}
+
+func (c manifestChange) String() string {
+	return fmt.Sprintf("%s %s: %s", c.Kind, c.Resource, c.Detail)
+}
+
+// manifestDiff is what applying a manifest changed, or with a dry run would
+// change
+type manifestDiff []manifestChange
+
+func (d *manifestDiff) add(kind changeKind, resource, detail string, args ...interface{}) {
+	*d = append(*d, manifestChange{Kind: kind, Resource: resource, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// failed returns an error naming the resources that could not be converged,
+// or nil if all were
+func (d manifestDiff) failed() error {
+	var problems []string
+	for _, change := range d {
+		if change.Kind == changeFailed {
+			problems = append(problems, change.Resource)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to converge %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// convergeManifest brings the device to the state the manifest describes:
+// it provisions the device, seeds its shadows, checks it may use its topics,
+// renders its files, and restarts its services if anything they depend on
+// changed. With dryRun, nothing is changed and the diff says what would be;
+// topics are still checked, by publishing a probe to each.
+func convergeManifest(cfg Config, manifest *bootstrapManifest, dryRun bool) (manifestDiff, error) {
+	var diff manifestDiff
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	var result *ProvisioningResult
+	switch {
+	case state.State == FlowVerified && manifest.Identity.ThingName != "" && state.ThingName != manifest.Identity.ThingName:
+		// Replacing an identity is for deprovision, not for converging
+		diff.add(changeFailed, "identity", "provisioned as %s, the manifest wants %s; deprovision the device first", state.ThingName, manifest.Identity.ThingName)
+		return diff, diff.failed()
+	case state.State == FlowVerified:
+		diff.add(changeNone, "identity", "provisioned as %s", state.ThingName)
+		result = storedResult(cfg, state)
+	case dryRun:
+		diff.add(changeCreate, "identity", "provision with template %s", cfg.TemplateName)
+		// Without an identity, nothing else can be compared
+		for _, shadow := range manifest.Shadows {
+			diff.add(changeCreate, "shadow "+shadow.Name, "seed once provisioned")
+		}
+		for _, topic := range manifest.Topics {
+			diff.add(changeCreate, "topic "+topic, "check once provisioned")
+		}
+		for _, render := range manifest.Renders {
+			diff.add(changeCreate, "file "+render.Output, "render %s once provisioned", render.Template)
+		}
+		for _, service := range manifest.Services {
+			diff.add(changeUpdate, "service "+service, "restart once provisioned")
+		}
+		return diff, nil
+	default:
+		if result, err = run(cfg, nil); err != nil {
+			diff.add(changeFailed, "identity", "%v", err)
+			return diff, err
+		}
+		if manifest.Identity.ThingName != "" && result.ThingName != manifest.Identity.ThingName {
+			diff.add(changeFailed, "identity", "provisioned as %s, the manifest wants %s; check the template", result.ThingName, manifest.Identity.ThingName)
+			return diff, diff.failed()
+		}
+		diff.add(changeCreate, "identity", "provisioned as %s", result.ThingName)
+		changed = true
+	}
+
+	if len(manifest.Shadows) > 0 || len(manifest.Topics) > 0 {
+		convergeCloud(cfg, manifest, result, dryRun, &diff)
+	}
+
+	data := newRenderData(cfg, result)
+	for _, render := range manifest.Renders {
+		resource := "file " + render.Output
+		rendered, err := renderTemplate(cfg, render, data)
+		if err != nil {
+			diff.add(changeFailed, resource, "%v", err)
+			continue
+		}
+		current, err := cfg.Files.fs().ReadFile(render.Output)
+		kind := changeUpdate
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			kind = changeCreate
+		case err != nil:
+			diff.add(changeFailed, resource, "failed to read: %v", err)
+			continue
+		case bytes.Equal(current, rendered):
+			diff.add(changeNone, resource, "up to date")
+			continue
+		}
+		if !dryRun {
+			if err := cfg.Files.write(render.Output, rendered, false); err != nil {
+				diff.add(changeFailed, resource, "failed to write: %v", err)
+				continue
+			}
+		}
+		diff.add(kind, resource, "rendered from %s", render.Template)
+		changed = true
+	}
+
+	for _, service := range manifest.Services {
+		resource := "service " + service
+		switch {
+		case !changed:
+			diff.add(changeNone, resource, "nothing it depends on changed")
+		case dryRun:
+			diff.add(changeUpdate, resource, "restart")
+		default:
+			if err := restartService(cfg, manifest.RestartCommand, service); err != nil {
+				diff.add(changeFailed, resource, "%v", err)
+				continue
+			}
+			diff.add(changeUpdate, resource, "restarted")
+		}
+	}
+	return diff, diff.failed()
+}
+
+// convergeCloud seeds the manifest's shadows and checks its topics over a
+// connection with the permanent identity
+func convergeCloud(cfg Config, manifest *bootstrapManifest, result *ProvisioningResult, dryRun bool, diff *manifestDiff) {
+	fail := func(err error) {
+		for _, shadow := range manifest.Shadows {
+			diff.add(changeFailed, "shadow "+shadow.Name, "%v", err)
+		}
+		for _, topic := range manifest.Topics {
+			diff.add(changeFailed, "topic "+topic, "%v", err)
+		}
+	}
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		fail(fmt.Errorf("failed to load device certificates: %v", err))
+		return
+	}
+	defer zeroPrivateKey(&cert)
+	// Prefer the endpoint that provisioned the device
+	if result.Endpoint != "" {
+		cfg.Endpoints = append([]string{result.Endpoint}, cfg.Endpoints...)
+	}
+	transport, err := connectTransport(cfg, cert, result.ThingName)
+	if err != nil {
+		fail(fmt.Errorf("failed to connect: %w", err))
+		return
+	}
+	session := newProvisioningSession(transport, cfg)
+	defer session.close()
+
+	for _, shadow := range manifest.Shadows {
+		resource := "shadow " + shadow.Name
+		current, err := session.getNamedShadow(result.ThingName, shadow.Name)
+		if err != nil {
+			diff.add(changeFailed, resource, "%v", err)
+			continue
+		}
+		drift := shadowDrift("", shadow.Reported, current)
+		if len(drift) == 0 {
+			diff.add(changeNone, resource, "up to date")
+			continue
+		}
+		if !dryRun {
+			if err := session.updateNamedShadow(result.ThingName, shadow.Name, shadow.Reported); err != nil {
+				diff.add(changeFailed, resource, "%v", err)
+				continue
+			}
+		}
+		if current == nil {
+			diff.add(changeCreate, resource, "seeded")
+		} else {
+			diff.add(changeUpdate, resource, "reported %s", strings.Join(drift, ", "))
+		}
+	}
+
+	for _, topic := range manifest.Topics {
+		topic = strings.ReplaceAll(topic, "{thingName}", result.ThingName)
+		if err := checkTopic(session, topic); err != nil {
+			diff.add(changeFailed, "topic "+topic, "%v", err)
+			continue
+		}
+		diff.add(changeNone, "topic "+topic, "publish and subscribe allowed")
+	}
+}
+
+// shadowDrift returns the keys of want, dotted below prefix, whose values
+// differ from have. Keys have holds and want does not are left alone, as a
+// shadow update only replaces the keys it reports.
+func shadowDrift(prefix string, want, have map[string]interface{}) []string {
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var drift []string
+	for _, key := range keys {
+		wantValue, haveValue := want[key], have[key]
+		wantMap, wantIsMap := wantValue.(map[string]interface{})
+		haveMap, haveIsMap := haveValue.(map[string]interface{})
+		switch {
+		case wantIsMap && haveIsMap:
+			drift = append(drift, shadowDrift(prefix+key+".", wantMap, haveMap)...)
+		case !reflect.DeepEqual(wantValue, haveValue):
+			drift = append(drift, prefix+key)
+		}
+	}
+	return drift
+}
+
+// checkTopic subscribes to a topic and publishes a probe to it, checking that
+// the device's policy allows both and that the probe comes back. AWS IoT
+// disconnects clients that publish where they may not, so this is the only
+// way to tell.
+func checkTopic(session *provisioningSession, topic string) error {
+	probe, err := json.Marshal(map[string]string{"probe": randomHex(session.cfg.random(), 8)})
+	if err != nil {
+		return err
+	}
+	received := make(chan struct{}, 1)
+	if err := session.subscribe(topic, 1, func(_ string, payload []byte) {
+		if bytes.Equal(payload, probe) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if err := session.transport.Publish(topic, 1, probe); err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", topic, err)
+	}
+	select {
+	case <-received:
+		return nil
+	case <-session.cfg.clock().After(session.cfg.ResponseTimeout):
+		return fmt.Errorf("probe published to %s not received back within %s (the policy may not allow receiving on it)", topic, session.cfg.ResponseTimeout)
+	}
+}
+
+// restartService restarts a service with the restart command
+func restartService(cfg Config, command, service string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HookTimeout)
+	defer cancel()
+	args := append(strings.Fields(command), service)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stderr // Keep stdout for the diff
+	cmd.Stderr = os.Stderr
+	log.Printf("Restarting %s", service)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("restart timed out after %s", cfg.HookTimeout)
+		}
+		return fmt.Errorf("failed to restart: %v", err)
+	}
+	return nil
+}
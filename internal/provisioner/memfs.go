@@ -0,0 +1,382 @@
+package provisioner
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryFS is a FileSystem held in memory, for tests and for simulations that
+// should leave nothing on disk. Modes and owners are recorded but not
+// enforced. It is safe for concurrent use.
+type MemoryFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // By cleaned path, directories included
+}
+
+// A file or directory of a MemoryFS. Open files keep their node, so a file
+// renamed or removed while open is still written to, as on Unix.
+type memNode struct {
+	data     []byte
+	mode     os.FileMode
+	uid, gid int
+	modTime  time.Time
+}
+
+// NewMemoryFS returns an empty MemoryFS, holding only the working and root
+// directories
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{nodes: map[string]*memNode{
+		".": {mode: fs.ModeDir | 0755, uid: -1, gid: -1},
+		"/": {mode: fs.ModeDir | 0755, uid: -1, gid: -1},
+	}}
+}
+
+// parent checks that the directory holding name exists, returning an error
+// for op if not
+func (m *MemoryFS) parent(op, name string) error {
+	dir, ok := m.nodes[filepath.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !dir.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+func (m *MemoryFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	return slices.Clone(node.data), nil
+}
+
+func (m *MemoryFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (m *MemoryFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := m.parent("open", name); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), uid: -1, gid: -1, modTime: time.Now()}
+		m.nodes[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+func (m *MemoryFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, ok := m.nodes[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := m.parent("rename", newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if target, ok := m.nodes[newpath]; ok && target.mode.IsDir() != node.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = node
+	// A directory takes what it holds along
+	if node.mode.IsDir() {
+		for name, child := range m.nodes {
+			if rest, ok := strings.CutPrefix(name, oldpath+string(filepath.Separator)); ok {
+				delete(m.nodes, name)
+				m.nodes[filepath.Join(newpath, rest)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.mode.IsDir() && len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemoryFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.info(name), nil
+}
+
+func (m *MemoryFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var entries []os.DirEntry
+	for _, child := range m.children(name) {
+		entries = append(entries, fs.FileInfoToDirEntry(m.nodes[child].info(child)))
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// children returns the paths directly in the directory dir
+func (m *MemoryFS) children(dir string) []string {
+	var names []string
+	for name := range m.nodes {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (m *MemoryFS) MkdirAll(dir string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		node, ok := m.nodes[d]
+		if ok {
+			if !node.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: d, Err: fs.ErrExist}
+			}
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	for _, d := range missing {
+		m.nodes[d] = &memNode{mode: fs.ModeDir | perm.Perm(), uid: -1, gid: -1, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemoryFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	node.mode = node.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *MemoryFS) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &fs.PathError{Op: "chown", Path: name, Err: fs.ErrNotExist}
+	}
+	if uid != -1 {
+		node.uid = uid
+	}
+	if gid != -1 {
+		node.gid = gid
+	}
+	return nil
+}
+
+// Owner returns the user and group IDs a file was given with Chown, -1 for
+// those it was not
+func (m *MemoryFS) Owner(name string) (uid, gid int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return -1, -1, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.uid, node.gid, nil
+}
+
+// info describes the node at name
+func (n *memNode) info(name string) os.FileInfo {
+	return memFileInfo{name: path.Base(filepath.ToSlash(name)), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
+
+// An open file of a MemoryFS
+type memFile struct {
+	fs     *MemoryFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if write && !writable || !write && !readable {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	f.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+// writeAt writes p at off, growing the file as needed
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,66 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// waitForNetwork blocks until the device has network connectivity: a
+// non-loopback interface is up with a usable address and an endpoint resolves.
+// Devices often boot before the cellular or Wi-Fi link is established.
+func waitForNetwork(cfg Config) {
+	for attempt := 0; ; attempt++ {
+		err := networkReady(cfg)
+		if err == nil {
+			if attempt > 0 {
+				log.Println("Network is up")
+			}
+			return
+		}
+		delay := cfg.Reconnect.Delay(attempt)
+		log.Printf("Waiting for network: %v, checking again in %s", err, delay.Round(time.Millisecond))
+		sdNotify("STATUS=Waiting for network")
+		sleepWithWatchdog(cfg.clock(), delay)
+	}
+}
+
+// networkReady reports why the network is not usable yet, or nil if it is
+func networkReady(cfg Config) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+	up := false
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				up = true
+			}
+		}
+	}
+	if !up {
+		return fmt.Errorf("no network interface is up with an address")
+	}
+
+	// Any endpoint resolving is enough, failover handles the rest
+	var lookupErr error
+	for _, endpoint := range networkEndpoints(cfg) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, lookupErr = cfg.lookupHost(ctx, endpoint)
+		cancel()
+		if lookupErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("endpoint does not resolve: %v", lookupErr)
+}
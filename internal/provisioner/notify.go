@@ -0,0 +1,315 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of alerts serve raises
+const (
+	// The device certificate is about to expire and rotation has not
+	// replaced it
+	AlertCertificateExpiring = "certificate-expiring"
+	// Provisioning or rotation failed several times in a row
+	AlertOperationsFailing = "operations-failing"
+)
+
+// Alert tells fleet operators of a failure serve cannot fix on its own,
+// before the device drops offline. The same kind is sent again once resolved.
+type Alert struct {
+	Time          time.Time `json:"time"`
+	Kind          string    `json:"kind"`
+	Resolved      bool      `json:"resolved,omitempty"`
+	Serial        string    `json:"serial"`
+	ThingName     string    `json:"thingName,omitempty"`
+	CertificateID string    `json:"certificateId,omitempty"`
+	Summary       string    `json:"summary"`
+	ErrorCode     ErrorCode `json:"errorCode,omitempty"`
+	Error         string    `json:"error,omitempty"` // Redacted
+}
+
+// Notifier sends alerts to fleet operators, such as to a chat channel or an
+// on-call service
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Sinks -notify accepts, as sink=target
+const (
+	NotifySlack     = "slack"     // Incoming webhook URL
+	NotifyPagerDuty = "pagerduty" // Events API v2 routing key
+	NotifySNS       = "sns"       // Topic ARN
+	NotifyWebhook   = "webhook"   // URL to POST the alert to as JSON
+)
+
+const (
+	// Time a notifier may take to send an alert
+	notifyTimeout = 30 * time.Second
+	// How often an alert is sent again while its condition lasts
+	alertRepeatInterval = 24 * time.Hour
+	// Events API v2 of PagerDuty
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// parseNotifier returns the notifier of a -notify sink=target. The targets of
+// Slack and PagerDuty are secrets, so they are redacted from the log.
+func parseNotifier(cfg Config, s string) (Notifier, error) {
+	sink, target, ok := strings.Cut(s, "=")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("expected sink=target, got %q", s)
+	}
+	switch sink {
+	case NotifySlack:
+		if err := checkNotifyURL(target, false); err != nil {
+			return nil, fmt.Errorf("invalid Slack webhook: %v", err)
+		}
+		secrets.add(SecretNotifyTarget, target)
+		return &webhookNotifier{url: target, slack: true}, nil
+	case NotifyPagerDuty:
+		secrets.add(SecretNotifyTarget, target)
+		return &pagerDutyNotifier{url: pagerDutyEventsURL, routingKey: target}, nil
+	case NotifySNS:
+		return newSNSNotifier(cfg, target)
+	case NotifyWebhook:
+		if err := checkNotifyURL(target, true); err != nil {
+			return nil, fmt.Errorf("invalid webhook: %v", err)
+		}
+		return &webhookNotifier{url: target}, nil
+	}
+	return nil, fmt.Errorf("unknown notification sink %q: use %s, %s, %s, or %s", sink, NotifySlack, NotifyPagerDuty, NotifySNS, NotifyWebhook)
+}
+
+// checkNotifyURL checks a URL alerts are posted to is absolute, and HTTPS
+// unless plain HTTP is allowed, as for a webhook on the local network
+func checkNotifyURL(s string, allowHTTP bool) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && !(allowHTTP && u.Scheme == "http") || u.Host == "" {
+		return fmt.Errorf("%s is not an https URL", u.Redacted())
+	}
+	return nil
+}
+
+// text returns the alert as a line of text, for chat and e-mail
+func (a Alert) text() string {
+	device := a.Serial
+	if a.ThingName != "" {
+		device = a.ThingName
+	}
+	status := "ALERT"
+	if a.Resolved {
+		status = "RESOLVED"
+	}
+	text := fmt.Sprintf("%s %s on %s: %s", status, a.Kind, device, a.Summary)
+	if a.Error != "" {
+		text += fmt.Sprintf(" [%s] %s", a.ErrorCode, a.Error)
+	}
+	return text
+}
+
+// webhookNotifier posts alerts as JSON, or as a Slack message
+type webhookNotifier struct {
+	url   string
+	slack bool
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	if n.slack {
+		return postJSON(ctx, "Slack", n.url, map[string]string{"text": alert.text()})
+	}
+	return postJSON(ctx, "webhook", n.url, alert)
+}
+
+// pagerDutyNotifier triggers a PagerDuty incident per device and alert kind,
+// and resolves it with the alert
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+func (n *pagerDutyNotifier) Notify(ctx context.Context, alert Alert) error {
+	source := alert.Serial
+	if alert.ThingName != "" {
+		source = alert.ThingName
+	}
+	action, severity := "trigger", "error"
+	if alert.Resolved {
+		action = "resolve"
+	}
+	if alert.Kind == AlertCertificateExpiring {
+		severity = "critical"
+	}
+	return postJSON(ctx, "PagerDuty", n.url, map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": action,
+		// Incidents of a device are told apart by serial number, which
+		// does not change when the device is provisioned again
+		"dedup_key": alert.Kind + "/" + alert.Serial,
+		"payload": map[string]interface{}{
+			"summary":        alert.text(),
+			"source":         source,
+			"severity":       severity,
+			"timestamp":      alert.Time.Format(time.RFC3339),
+			"class":          alert.Kind,
+			"custom_details": alert,
+		},
+	})
+}
+
+// postJSON posts a JSON document to the sink named name, failing on a
+// response other than 2xx
+func postJSON(ctx context.Context, name, u string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return sendNotification(name, req)
+}
+
+// sendNotification sends the request of the sink named name, failing on a
+// response other than 2xx
+func sendNotification(name string, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s refused the alert with %s: %s", name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return nil
+}
+
+// alerter raises and resolves the alerts of serve through its notifiers. An
+// alert is sent when raised, again every alertRepeatInterval while it is, and
+// once more when it is resolved. Alerts are sent in the background, and a
+// notifier failing to send one is only a warning.
+type alerter struct {
+	cfg       Config
+	notifiers []Notifier
+
+	mu     sync.Mutex
+	raised map[string]time.Time // Kinds raised, with when they were last sent
+}
+
+// newAlerter returns the alerter of notifiers, or nil if there are none
+func newAlerter(cfg Config, notifiers []Notifier) *alerter {
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return &alerter{cfg: cfg, notifiers: notifiers, raised: map[string]time.Time{}}
+}
+
+// raise raises an alert of kind, unless it was sent within
+// alertRepeatInterval. err, if not nil, is the failure behind it.
+func (a *alerter) raise(kind, summary string, err error) {
+	if a == nil {
+		return
+	}
+	now := a.cfg.clock().Now()
+	a.mu.Lock()
+	sent, ok := a.raised[kind]
+	if ok && now.Sub(sent) < alertRepeatInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.raised[kind] = now
+	a.mu.Unlock()
+
+	alert := a.alert(kind, summary, now)
+	if err != nil {
+		alert.ErrorCode = ErrorCodeOf(err)
+		alert.Error = secrets.redact(err.Error())
+	}
+	log.Printf("Alerting %s: %s", kind, summary)
+	go a.send(alert)
+}
+
+// resolve resolves the alert of kind, if it is raised
+func (a *alerter) resolve(kind, summary string) {
+	if a == nil {
+		return
+	}
+	now := a.cfg.clock().Now()
+	a.mu.Lock()
+	_, ok := a.raised[kind]
+	delete(a.raised, kind)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	alert := a.alert(kind, summary, now)
+	alert.Resolved = true
+	log.Printf("Resolving alert %s: %s", kind, summary)
+	go a.send(alert)
+}
+
+// alert returns an alert about the device as last provisioned
+func (a *alerter) alert(kind, summary string, now time.Time) Alert {
+	alert := Alert{Time: now.UTC(), Kind: kind, Serial: a.cfg.SerialNumber, Summary: summary}
+	if state, err := loadState(a.cfg.outputPath(stateFile), a.cfg.Files, a.cfg.clock()); err == nil {
+		alert.ThingName = state.ThingName
+		alert.CertificateID = state.CertificateID
+	}
+	return alert
+}
+
+// send sends an alert through every notifier
+func (a *alerter) send(alert Alert) {
+	var wg sync.WaitGroup
+	for _, notifier := range a.notifiers {
+		wg.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, alert); err != nil {
+				log.Printf("Warning: failed to send %s alert: %v", alert.Kind, err)
+			}
+		}(notifier)
+	}
+	wg.Wait()
+}
+
+// watchExpiry alerts when the device certificate is within before of the end
+// of its validity, or of a quarter of it if that is shorter, as rotation
+// would have replaced it by then. It checks as often as rotateBeforeExpiry.
+func (s *apiServer) watchExpiry(before time.Duration) {
+	clock := s.cfg.clock()
+	for {
+		cert, err := deviceCertificate(s.cfg)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		if cert != nil {
+			id, notAfter := certificateID(cert), cert.NotAfter.UTC().Format(time.RFC3339)
+			switch left := cert.NotAfter.Sub(clock.Now()); {
+			case left <= 0:
+				s.alerts.raise(AlertCertificateExpiring, fmt.Sprintf("device certificate %s expired at %s", id, notAfter), nil)
+			case left <= min(before, cert.NotAfter.Sub(cert.NotBefore)/4):
+				s.alerts.raise(AlertCertificateExpiring, fmt.Sprintf("device certificate %s expires at %s, in %s", id, notAfter, left.Round(time.Minute)), nil)
+			default:
+				s.alerts.resolve(AlertCertificateExpiring, fmt.Sprintf("device certificate %s is valid until %s", id, notAfter))
+			}
+		}
+		clock.Sleep(rotationCheckInterval)
+	}
+}
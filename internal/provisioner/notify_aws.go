@@ -0,0 +1,82 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Longest subject SNS accepts
+const maxSNSSubject = 100
+
+// snsNotifier publishes alerts to an SNS topic, as the JSON document with
+// the kind and device in the subject, so e-mail, SMS, and Lambda subscribers
+// can all take them. It calls the Query API signed with the AWS credentials
+// of the other AWS SDK calls, which need sns:Publish on the topic.
+type snsNotifier struct {
+	cfg   Config
+	topic arn.ARN
+}
+
+// newSNSNotifier returns the notifier of a topic ARN
+func newSNSNotifier(cfg Config, topicARN string) (Notifier, error) {
+	topic, err := arn.Parse(topicARN)
+	if err != nil || topic.Service != "sns" || topic.Region == "" {
+		return nil, fmt.Errorf("%s is not an SNS topic ARN", topicARN)
+	}
+	// The topic's region, whatever AWS IoT's
+	cfg.Region = topic.Region
+	return &snsNotifier{cfg: cfg, topic: topic}, nil
+}
+
+func (n *snsNotifier) Notify(ctx context.Context, alert Alert) error {
+	awsCfg, err := loadAWSConfig(ctx, n.cfg)
+	if err != nil {
+		return fmt.Errorf("SNS: %v", err)
+	}
+	credentials, err := awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("SNS: %v", err)
+	}
+	message, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	subject := alert.text()
+	if i := strings.Index(subject, ": "); i > 0 {
+		subject = subject[:i]
+	}
+	if len(subject) > maxSNSSubject {
+		subject = subject[:maxSNSSubject]
+	}
+	body := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {n.topic.String()},
+		"Subject":  {subject},
+		"Message":  {string(message)},
+	}.Encode()
+
+	endpoint := fmt.Sprintf("https://sns.%s.%s/", n.topic.Region, partitionForRegion(n.topic.Region).DNSSuffix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	hash := sha256.Sum256([]byte(body))
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(hash[:]), "sns", n.topic.Region, time.Now()); err != nil {
+		return fmt.Errorf("SNS: failed to sign request: %v", err)
+	}
+	return sendNotification("SNS", req)
+}
@@ -0,0 +1,129 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Joins the Wi-Fi network given in $WIFI_SSID and $WIFI_PASSPHRASE (empty for
+// an open network). The passphrase is passed in the environment rather than on
+// the command line, where other processes could see it.
+const defaultWiFiCommand = `nmcli device wifi connect "$WIFI_SSID" ${WIFI_PASSPHRASE:+password "$WIFI_PASSPHRASE"}`
+
+// How long joining the Wi-Fi network may take
+const wifiTimeout = time.Minute
+
+// Largest value accepted for claim credentials and other pushed settings
+const maxOnboardingValue = 16 << 10
+
+// Settings a commissioning app pushes to the device before provisioning
+type onboardingRequest struct {
+	SSID       string
+	Passphrase []byte
+	ClaimCert  []byte // Optional claim certificate, PEM or an encrypted envelope
+	ClaimKey   []byte // Optional claim private key, PEM or an encrypted envelope
+
+	// Optional overrides of -template and -serial
+	TemplateName string
+	SerialNumber string
+}
+
+// zero clears the secrets of the request
+func (r *onboardingRequest) zero() {
+	clear(r.Passphrase)
+	clear(r.ClaimKey)
+	r.Passphrase, r.ClaimKey = nil, nil
+}
+
+// Onboarding stages besides the provisioning stages
+const (
+	onboardingWaiting = "waiting" // Waiting for the settings
+	onboardingFailed  = "failed"
+)
+
+// Progress of an onboarding, as reported to the commissioning app
+type onboardingStatus struct {
+	Stage     string `json:"stage"` // A provisioning Stage, waiting, or failed
+	Message   string `json:"message,omitempty"`
+	ThingName string `json:"thingName,omitempty"`
+}
+
+// final reports whether the onboarding is over
+func (s onboardingStatus) final() bool {
+	return s.Stage == string(StageComplete) || s.Stage == onboardingFailed
+}
+
+// onboard applies an onboarding request and provisions the device: it joins
+// the Wi-Fi network if one is given, stores the claim credentials if given,
+// and runs the provisioning flow once the network is up.
+func onboard(cfg Config, wifiCommand string, request onboardingRequest, progress ProgressFunc) (*ProvisioningResult, error) {
+	if request.TemplateName != "" {
+		cfg.TemplateName = request.TemplateName
+	}
+	if request.SerialNumber != "" {
+		cfg.SerialNumber = request.SerialNumber
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if request.SSID != "" {
+		progress.report(StageConnect, fmt.Sprintf("Joining Wi-Fi network %s", request.SSID))
+		if err := joinWiFi(wifiCommand, request.SSID, request.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if len(request.ClaimCert) > 0 || len(request.ClaimKey) > 0 {
+		if err := storeClaim(cfg, request.ClaimCert, request.ClaimKey); err != nil {
+			return nil, err
+		}
+	}
+	cfg.WaitNetwork = true
+	return run(cfg, progress)
+}
+
+// joinWiFi runs the Wi-Fi command through /bin/sh
+func joinWiFi(command, ssid string, passphrase []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wifiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), "WIFI_SSID="+ssid, "WIFI_PASSPHRASE="+string(passphrase))
+
+	log.Printf("Joining Wi-Fi network %s", ssid)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("joining Wi-Fi network %s timed out after %s", ssid, wifiTimeout)
+		}
+		return fmt.Errorf("failed to join Wi-Fi network %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// storeClaim writes pushed claim credentials to the -claim-cert and -claim-key
+// files, where the provisioning flow reads them
+func storeClaim(cfg Config, certPEM, keyPEM []byte) error {
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return fmt.Errorf("both a claim certificate and a claim private key are needed")
+	}
+	if _, ok := os.LookupEnv(envClaimCert); ok {
+		log.Printf("Warning: $%s is set and takes precedence over the pushed claim certificate", envClaimCert)
+	}
+	if _, err := decodePEM(certPEM); err != nil {
+		return fmt.Errorf("pushed claim certificate is %v", err)
+	}
+	if _, err := decodePEM(keyPEM); err != nil {
+		return fmt.Errorf("pushed claim private key is %v", err)
+	}
+	// Replacing earlier claim credentials, see stageKeyPair
+	if err := cfg.Files.replaceKeyPair(cfg.ClaimCertFile, cfg.ClaimKeyFile, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("failed to store claim credentials: %v", err)
+	}
+	log.Printf("Stored pushed claim credentials in %s", cfg.ClaimCertFile)
+	return nil
+}
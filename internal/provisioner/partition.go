@@ -0,0 +1,129 @@
+package provisioner
+
+import (
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Amazon Root CA 1 (RSA) and Amazon Root CA 3 (ECC), which issue the server
+// certificates of ATS endpoints in every partition
+//
+//go:embed certs/amazon_root_ca.pem
+var amazonRootCAs []byte
+
+// An AWS partition and the conventions its IoT data endpoints follow
+type Partition struct {
+	ID           string
+	RegionPrefix string // Regions in this partition start with this prefix
+	DNSSuffix    string
+	ATSInfix     string // Separates the account prefix from "iot." in ATS endpoints
+	Port         int
+	RootCAs      []byte
+}
+
+// Known partitions. The commercial partition matches any region so it must be last.
+var partitions = []Partition{
+	{
+		ID:           "aws-cn",
+		RegionPrefix: "cn-",
+		DNSSuffix:    "amazonaws.com.cn",
+		ATSInfix:     ".ats.",
+		Port:         8883,
+		RootCAs:      amazonRootCAs,
+	},
+	{
+		ID:           "aws-us-gov",
+		RegionPrefix: "us-gov-",
+		DNSSuffix:    "amazonaws.com",
+		ATSInfix:     "-ats.",
+		Port:         8883,
+		RootCAs:      amazonRootCAs,
+	},
+	{
+		ID:           "aws",
+		RegionPrefix: "",
+		DNSSuffix:    "amazonaws.com",
+		ATSInfix:     "-ats.",
+		Port:         8883,
+		RootCAs:      amazonRootCAs,
+	},
+}
+
+// partitionForRegion returns the partition a region belongs to
+func partitionForRegion(region string) Partition {
+	for _, p := range partitions {
+		if strings.HasPrefix(region, p.RegionPrefix) {
+			return p
+		}
+	}
+	return partitions[len(partitions)-1]
+}
+
+// LegacyEndpointError is returned for a legacy (VeriSign) endpoint. Their
+// server certificates are not signed by the Amazon root CAs, so connecting to
+// one with them fails with an opaque certificate error.
+type LegacyEndpointError struct {
+	Endpoint  string
+	Partition Partition
+}
+
+func (e *LegacyEndpointError) Error() string {
+	return fmt.Sprintf("endpoint %s is not an ATS endpoint (expected <prefix>%siot.<region>.%s, see `aws iot describe-endpoint --endpoint-type iot:Data-ATS`)", e.Endpoint, e.Partition.ATSInfix, e.Partition.DNSSuffix)
+}
+
+// validateEndpoint checks that an AWS IoT endpoint is a host name in the
+// partition's ATS format for region. A well-formed legacy endpoint is reported
+// as a LegacyEndpointError.
+func (p Partition) validateEndpoint(endpoint, region string) error {
+	if err := validateHost(endpoint); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(endpoint, "."+p.DNSSuffix) {
+		return fmt.Errorf("endpoint %s is not in partition %s (expected a *.%s host)", endpoint, p.ID, p.DNSSuffix)
+	}
+
+	suffix := `iot\.([a-z0-9-]+)\.` + regexp.QuoteMeta(p.DNSSuffix) + `$`
+	ats := regexp.MustCompile(`^[a-z0-9]+` + regexp.QuoteMeta(p.ATSInfix) + suffix).FindStringSubmatch(endpoint)
+	legacy := regexp.MustCompile(`^[a-z0-9]+\.` + suffix).FindStringSubmatch(endpoint)
+	var endpointRegion string
+	switch {
+	case ats != nil:
+		endpointRegion = ats[1]
+	case legacy != nil:
+		endpointRegion = legacy[1]
+	default:
+		return fmt.Errorf("endpoint %s is not an AWS IoT data endpoint (expected <prefix>%siot.<region>.%s, see `aws iot describe-endpoint --endpoint-type iot:Data-ATS`)", endpoint, p.ATSInfix, p.DNSSuffix)
+	}
+	if endpointRegion != region {
+		return fmt.Errorf("endpoint %s is in region %s, not %s (set -region)", endpoint, endpointRegion, region)
+	}
+	if ats == nil {
+		return &LegacyEndpointError{Endpoint: endpoint, Partition: p}
+	}
+	return nil
+}
+
+// validateHost checks that an endpoint is a bare host name, as required for
+// custom domains that have no fixed format
+func validateHost(endpoint string) error {
+	if strings.ContainsAny(endpoint, ":/") {
+		return fmt.Errorf("endpoint %s must be a host name without scheme, port, or path (set the port with -port)", endpoint)
+	}
+	if endpoint == "" || strings.HasPrefix(endpoint, ".") || strings.HasSuffix(endpoint, ".") || strings.Contains(endpoint, "..") {
+		return fmt.Errorf("endpoint %q is not a valid host name", endpoint)
+	}
+	return nil
+}
+
+// isAmazonRootCA reports whether the PEM data holds an Amazon root CA, which
+// only validates ATS endpoints
+func isAmazonRootCA(data []byte) bool {
+	for _, cert := range parseCertificates(data) {
+		if strings.HasPrefix(cert.Subject.CommonName, "Amazon Root CA") {
+			return true
+		}
+	}
+	return false
+}
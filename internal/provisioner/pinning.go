@@ -0,0 +1,82 @@
+package provisioner
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// FingerprintError reports a certificate whose SHA-256 fingerprint is not one
+// expected: a claim not pinned with -claim-fingerprint, as in a tampered
+// factory image, or a permanent certificate other than the one provisioned,
+// as when credentials are swapped between devices. Retrying cannot fix
+// either.
+type FingerprintError struct {
+	Certificate string // Where the certificate was read from
+	Fingerprint string
+	Expected    []string
+}
+
+func (e *FingerprintError) Error() string {
+	return fmt.Sprintf("certificate %s has fingerprint %s, expected %s", e.Certificate, e.Fingerprint, strings.Join(e.Expected, " or "))
+}
+
+// parseFingerprint parses a SHA-256 fingerprint as hex, with or without the
+// colons of openssl x509 -fingerprint
+func parseFingerprint(s string) (string, error) {
+	fingerprint := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("expected a SHA-256 fingerprint as 64 hex digits, got %q", s)
+	}
+	return fingerprint, nil
+}
+
+// pinnedClaims returns the claims whose certificates are pinned with
+// -claim-fingerprint, all of them if none are pinned. The others are refused
+// and recorded in the audit log; if none is left, the run fails.
+func pinnedClaims(cfg Config, candidates []claimCandidate) ([]claimCandidate, error) {
+	if len(cfg.ClaimFingerprints) == 0 {
+		return candidates, nil
+	}
+	var pinned []claimCandidate
+	var err error
+	for _, candidate := range candidates {
+		fingerprint := certificateFingerprint(candidate.cert.data)
+		if slices.Contains(cfg.ClaimFingerprints, fingerprint) {
+			pinned = append(pinned, candidate)
+			continue
+		}
+		err = &FingerprintError{Certificate: candidate.cert.source, Fingerprint: fingerprint, Expected: cfg.ClaimFingerprints}
+		log.Printf("Warning: refusing claim that is not pinned: %v", err)
+		recordAudit(cfg, auditEntry{Event: AuditFingerprintMismatch, CertificateID: fingerprint, Error: err.Error()})
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("claim certificate check failed: %w", err)
+	}
+	return pinned, nil
+}
+
+// checkPermanentFingerprint checks that the permanent certificate is the one
+// the device was provisioned with, whose fingerprint the identity file
+// records. Devices provisioned before fingerprints were recorded are not
+// checked.
+func checkPermanentFingerprint(cfg Config) error {
+	identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	if err != nil || identity == nil || identity.CertificateFingerprint == "" {
+		return err
+	}
+	certFile := cfg.outputPath(permanentCertFile)
+	certPEM, err := cfg.Files.fs().ReadFile(certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read device certificate: %v", err)
+	}
+	fingerprint := certificateFingerprint(certPEM)
+	if fingerprint == identity.CertificateFingerprint {
+		return nil
+	}
+	err = &FingerprintError{Certificate: certFile, Fingerprint: fingerprint, Expected: []string{identity.CertificateFingerprint}}
+	recordAudit(cfg, auditEntry{Event: AuditFingerprintMismatch, ThingName: identity.ThingName, CertificateID: identity.CertificateID, Error: err.Error()})
+	return fmt.Errorf("permanent certificate is not the one provisioned, the credentials may have been swapped: %w", err)
+}
@@ -0,0 +1,65 @@
+package provisioner
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Names AWS IoT allows for policies, and the placeholders of
+// renderCompletion in them
+var policyNamePattern = regexp.MustCompile(`^[\w+=,.@{}-]{1,128}$`)
+
+// validatePolicyRef checks an -attach-policy value: a policy name, which may
+// hold placeholders, or the ARN of an AWS IoT policy
+func validatePolicyRef(ref string) error {
+	if strings.HasPrefix(ref, "arn:") {
+		parts := strings.SplitN(ref, ":", 6)
+		if len(parts) != 6 || parts[2] != "iot" || !strings.HasPrefix(parts[5], "policy/") || !policyNamePattern.MatchString(strings.TrimPrefix(parts[5], "policy/")) {
+			return fmt.Errorf("%s is not the ARN of an AWS IoT policy", ref)
+		}
+		return nil
+	}
+	if !policyNamePattern.MatchString(ref) {
+		return fmt.Errorf("%q is not a policy name", ref)
+	}
+	return nil
+}
+
+// policyName returns the name of a policy given by name or ARN
+func policyName(ref string) string {
+	if strings.HasPrefix(ref, "arn:") {
+		return ref[strings.LastIndex(ref, "policy/")+len("policy/"):]
+	}
+	return ref
+}
+
+// attachPolicies attaches the policies of cfg.AttachPolicies the device
+// certificate does not have yet, for templates that attach a minimal policy
+// and leave the permissions of applications to onboarding. The policies
+// attached are recorded in the state, so a run that failed to attach them,
+// say without AWS credentials, is followed up by the next, and a rotated
+// certificate gets them too.
+func attachPolicies(cfg Config, state *provisioningState) error {
+	var missing []string
+	for _, ref := range cfg.AttachPolicies {
+		name := policyName(renderCompletion(ref, cfg, state, false))
+		if !slices.Contains(state.AttachedPolicies, name) && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := attachCertificatePolicies(cfg, state, missing); err != nil {
+		return err
+	}
+	state.AttachedPolicies = append(state.AttachedPolicies, missing...)
+	if err := state.save(); err != nil {
+		return err
+	}
+	log.Printf("Attached policies %s to certificate %s", strings.Join(missing, ", "), state.CertificateID)
+	return nil
+}
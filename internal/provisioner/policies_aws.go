@@ -0,0 +1,42 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+)
+
+// attachCertificatePolicies attaches policies to the device certificate
+// with the AWS SDK. Attaching a policy already attached changes nothing.
+func attachCertificatePolicies(cfg Config, state *provisioningState, policies []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to attach policies: %v", err)
+	}
+	// The provisioning MQTT API does not return the certificate's ARN, and the
+	// device cannot build it without the account ID, so it is looked up once
+	// and recorded with the attached policies
+	certificateArn := state.CertificateArn
+	if !strings.HasSuffix(certificateArn, "cert/"+state.CertificateID) {
+		described, err := client.DescribeCertificate(ctx, &iot.DescribeCertificateInput{CertificateId: aws.String(state.CertificateID)})
+		if err != nil {
+			return fmt.Errorf("failed to describe certificate %s: %v", state.CertificateID, err)
+		}
+		certificateArn = aws.ToString(described.CertificateDescription.CertificateArn)
+		state.CertificateArn = certificateArn
+	}
+	for _, policy := range policies {
+		if _, err := client.AttachPolicy(ctx, &iot.AttachPolicyInput{PolicyName: aws.String(policy), Target: aws.String(certificateArn)}); err != nil {
+			return fmt.Errorf("failed to attach policy %s to certificate %s: %v", policy, state.CertificateID, err)
+		}
+	}
+	return nil
+}
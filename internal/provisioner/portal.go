@@ -0,0 +1,292 @@
+//go:build !nosoftap
+
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Onboarding statuses of the current attempt, which browsers follow as they
+// are published
+type statusFeed struct {
+	mu       sync.Mutex
+	statuses []onboardingStatus
+	changed  chan struct{} // Closed and replaced on every change
+}
+
+func newStatusFeed() *statusFeed {
+	return &statusFeed{changed: make(chan struct{})}
+}
+
+// publish adds a status, waking the followers
+func (f *statusFeed) publish(status onboardingStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = append(f.statuses, status)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// restart drops the statuses of the previous attempt
+func (f *statusFeed) restart() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = nil
+}
+
+// since returns the statuses after the first n, and a channel closed on the
+// next change
+func (f *statusFeed) since(n int) ([]onboardingStatus, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n > len(f.statuses) {
+		n = 0 // Restarted since
+	}
+	return append([]onboardingStatus(nil), f.statuses[n:]...), f.changed
+}
+
+// Captive portal collecting the onboarding settings from a browser. Every
+// request for another host or path is redirected to it, so the operating
+// system's captive portal check opens it once the browser joins the hotspot.
+type portal struct {
+	cfg  Config
+	url  string // Where the portal is reached, such as http://10.42.0.1/
+	feed *statusFeed
+
+	// start begins onboarding in the background, failing if it already runs
+	start func(request onboardingRequest) error
+}
+
+func (p *portal) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.handleForm)
+	mux.HandleFunc("/provision", p.handleProvision)
+	mux.HandleFunc("/progress", p.handleProgress)
+	mux.HandleFunc("/events", p.handleEvents)
+	return mux
+}
+
+func (p *portal) handleForm(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || "http://"+r.Host+"/" != p.url {
+		http.Redirect(w, r, p.url, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := portalForm.Execute(w, p.cfg); err != nil {
+		log.Printf("Warning: failed to render portal: %v", err)
+	}
+}
+
+func (p *portal) handleProvision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxOnboardingValue)
+	if err := r.ParseMultipartForm(4 * maxOnboardingValue); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	request := onboardingRequest{
+		SSID:         r.FormValue("ssid"),
+		Passphrase:   []byte(r.FormValue("passphrase")),
+		TemplateName: r.FormValue("template"),
+		SerialNumber: r.FormValue("serial"),
+	}
+	var err error
+	if request.ClaimCert, err = formFile(r, "claim_cert"); err == nil {
+		request.ClaimKey, err = formFile(r, "claim_key")
+	}
+	if err != nil {
+		request.zero()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.start(request); err != nil {
+		request.zero()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/progress", http.StatusSeeOther)
+}
+
+// formFile reads an optional uploaded file
+func formFile(r *http.Request, name string) ([]byte, error) {
+	file, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxOnboardingValue+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if len(data) > maxOnboardingValue {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxOnboardingValue)
+	}
+	return data, nil
+}
+
+func (p *portal) handleProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, portalProgress)
+}
+
+// handleEvents streams the statuses of the current attempt as server-sent
+// events, from the first, until the attempt is over
+func (p *portal) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for sent := 0; ; {
+		statuses, changed := p.feed.since(sent)
+		for _, status := range statuses {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			if status.final() {
+				flusher.Flush()
+				return
+			}
+		}
+		sent += len(statuses)
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveCaptiveDNS answers every A query with the portal's address, so
+// browsers on the hotspot reach the portal whatever host they ask for
+func serveCaptiveDNS(conn net.PacketConn, address net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply, err := captiveDNSReply(buf[:n], address)
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(reply, from)
+	}
+}
+
+// captiveDNSReply answers a query with address for A questions, and no
+// records for anything else
+func captiveDNSReply(query []byte, address net.IP) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if question.Type == dnsmessage.TypeA && question.Class == dnsmessage.ClassINET {
+		var a [4]byte
+		copy(a[:], address.To4())
+		err := builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET}, dnsmessage.AResource{A: a})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+var portalForm = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Device setup</title>
+<style>body{font-family:sans-serif;max-width:28em;margin:2em auto;padding:0 1em}label{display:block;margin-top:1em}input{width:100%;box-sizing:border-box}</style>
+</head>
+<body>
+<h1>Device setup</h1>
+<form method="post" action="/provision" enctype="multipart/form-data">
+<label>Wi-Fi network <input name="ssid" required></label>
+<label>Wi-Fi password <input name="passphrase" type="password"></label>
+<label>Serial number <input name="serial" value="{{.SerialNumber}}"></label>
+<label>Provisioning template <input name="template" value="{{.TemplateName}}"></label>
+<label>Claim certificate (optional) <input name="claim_cert" type="file"></label>
+<label>Claim private key (optional) <input name="claim_key" type="file"></label>
+<p><button type="submit">Connect and provision</button></p>
+</form>
+</body>
+</html>
+`))
+
+const portalProgress = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Device setup</title>
+<style>body{font-family:sans-serif;max-width:28em;margin:2em auto;padding:0 1em}</style>
+</head>
+<body>
+<h1>Device setup</h1>
+<ul id="log"></ul>
+<p id="result"></p>
+<script>
+const log = document.getElementById("log");
+const result = document.getElementById("result");
+const events = new EventSource("/events");
+events.onopen = () => log.replaceChildren();
+events.onmessage = (e) => {
+  const status = JSON.parse(e.data);
+  const item = document.createElement("li");
+  item.textContent = status.message || status.stage;
+  log.appendChild(item);
+  if (status.stage === "complete") {
+    events.close();
+    result.textContent = "Provisioned as " + status.thingName + ". You can close this page.";
+  } else if (status.stage === "failed") {
+    events.close();
+    result.innerHTML = '<a href="/">Try again</a>';
+  }
+};
+</script>
+</body>
+</html>
+`
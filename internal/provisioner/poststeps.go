@@ -0,0 +1,65 @@
+package provisioner
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Post steps, run once the device is provisioned. Their failures are reported
+// in the result and the log without failing the run, unless StrictPostSteps is
+// set. CloudWatch events are not among them: undelivered events are kept for
+// the next run.
+const (
+	PostStepStatusShadow = "status-shadow"
+	PostStepCompletion   = "completion"
+	PostStepPolicies     = "attach-policies"
+	PostStepLabel        = "label"
+	PostStepRender       = "render"
+	PostStepDeviceConfig = "device-config"
+	PostStepInventory    = "inventory"
+	PostStepReconcile    = "reconcile"
+	PostStepRetire       = "retire-certificate"
+	PostStepHook         = "post-success-hook"
+)
+
+// PostStepFailure is a post step that failed in the run
+type PostStepFailure struct {
+	Step  string `json:"step" yaml:"step"`
+	Error string `json:"error" yaml:"error"`
+}
+
+// PostStepError is returned instead of the result with StrictPostSteps when
+// post steps failed. The device is provisioned all the same: running again
+// does not provision it again, and only the label and rendered files are
+// written again.
+type PostStepError struct {
+	ThingName string
+	Failures  []PostStepFailure
+}
+
+func (e *PostStepError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		failures[i] = failure.Step + ": " + failure.Error
+	}
+	return fmt.Sprintf("provisioned as %s, but post steps failed: %s", e.ThingName, strings.Join(failures, "; "))
+}
+
+// postStepFailed records the failure of a post step, if err is not nil
+func postStepFailed(failures *[]PostStepFailure, step string, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("Warning: %v", err)
+	*failures = append(*failures, PostStepFailure{Step: step, Error: redactError(err).Error()})
+}
+
+// checkPostSteps returns the result, or with StrictPostSteps the error of its
+// failed post steps
+func checkPostSteps(cfg Config, result *ProvisioningResult) (*ProvisioningResult, error) {
+	if !cfg.StrictPostSteps || len(result.PostStepFailures) == 0 {
+		return result, nil
+	}
+	return nil, &PostStepError{ThingName: result.ThingName, Failures: result.PostStepFailures}
+}
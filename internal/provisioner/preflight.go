@@ -0,0 +1,179 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// validateClaimCredentials checks the claim certificate, key, and root CA before
+// connecting, so misconfigured credentials fail with an actionable error instead
+// of paho's opaque connect failure
+func validateClaimCredentials(certPEM, keyPEM, rootCA secret, now time.Time) error {
+	if err := validateClaimCertificate(certPEM, now); err != nil {
+		return err
+	}
+
+	// Verify the key matches the certificate
+	if _, err := keyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("claim private key %s does not match certificate %s: %v", keyPEM.source, certPEM.source, err)
+	}
+
+	// Confirm the CA holds at least one usable certificate. Without one the
+	// built-in Amazon root CAs are used.
+	if rootCA.data == nil {
+		return nil
+	}
+	if n := countCertificates(rootCA.data); n == 0 {
+		return fmt.Errorf("root CA %s contains no valid PEM certificates (download https://www.amazontrust.com/repository/AmazonRootCA1.pem)", rootCA.source)
+	}
+
+	return nil
+}
+
+// validateClaimCertificate checks the claim certificate parses and is within
+// its validity period at now
+func validateClaimCertificate(certPEM secret, now time.Time) error {
+	// Parse the leaf certificate
+	cert, err := parseCertificatePEM(certPEM.data)
+	if err != nil {
+		return fmt.Errorf("claim certificate %s is invalid: %v", certPEM.source, err)
+	}
+
+	// Check validity period
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("claim certificate %s is not valid until %s (check the device clock)", certPEM.source, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("claim certificate %s expired at %s", certPEM.source, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// parseCertificatePEM parses the first CERTIFICATE block in data
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// countCertificates returns the number of parseable certificates in PEM data
+func countCertificates(data []byte) int {
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return count
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err == nil {
+			count++
+		}
+	}
+}
+
+// checkConfigFiles checks the files the configuration names, beyond what
+// Config.validate does: that they exist and parse, and that keys match their
+// certificates. It returns every problem found.
+func checkConfigFiles(cfg Config) []string {
+	var problems []string
+	fsys := cfg.Files.fs()
+	rootCA, err := readRootCAs(cfg)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("root CA: %v (set -root-ca or ROOT_CA, or leave both empty for the Amazon root CAs)", err))
+	} else if rootCA.data != nil && countCertificates(rootCA.data) == 0 {
+		problems = append(problems, fmt.Sprintf("root CA %s contains no valid PEM certificates", rootCA.source))
+	}
+
+	// A provisioned device may have wiped its claim. The root CA was checked
+	// above, so the claims are checked without it.
+	identity, _ := loadIdentity(cfg.outputPath(identityFile), cfg.Files)
+	switch {
+	case cfg.Mode != ModeFleet || identity != nil || cfg.ClaimBundleURL != "":
+	case cfg.ClaimDir != "":
+		if candidates, err := loadClaimCandidates(cfg, secret{}, nil); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			for _, candidate := range candidates {
+				clear(candidate.key.data)
+			}
+		}
+	default:
+		cert := newSecret(fsys, envClaimCert, cfg.ClaimCertFile)
+		key := newSecret(fsys, envClaimKey, cfg.ClaimKeyFile)
+		certErr, keyErr := cert.read(), key.read()
+		defer clear(key.data)
+		if certErr != nil {
+			problems = append(problems, fmt.Sprintf("claim certificate: %v (set -claim-cert or CLAIM_CERT)", certErr))
+		}
+		if keyErr != nil {
+			problems = append(problems, fmt.Sprintf("claim private key: %v (set -claim-key or CLAIM_KEY)", keyErr))
+		}
+		// Envelopes are only opened to provision, which may need KMS
+		if certErr == nil && keyErr == nil && !isEnvelope(cert.data) && !isEnvelope(key.data) {
+			if err := key.resolve(cfg, cert); err != nil {
+				problems = append(problems, fmt.Sprintf("claim private key: %v", err))
+			} else if err := validateClaimCredentials(cert, key, secret{}, cfg.clock().Now()); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if cfg.ClaimBundlePublicKey != "" {
+		if _, err := readPublicKey(fsys, cfg.ClaimBundlePublicKey); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, wrappingKey := range []string{cfg.ClaimBundleKey, cfg.ClaimWrappingKey} {
+		if wrappingKey == "" {
+			continue
+		}
+		if key, err := readWrappingKey(fsys, wrappingKey); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			clear(key)
+		}
+	}
+	if cfg.Mode == ModeJIT && cfg.CACertFile != "" && cfg.CAKeyFile != "" {
+		if ca, err := (fileIdentity{fs: fsys, certFile: cfg.CACertFile, keyFile: cfg.CAKeyFile}).TLSCertificate(); err != nil {
+			problems = append(problems, fmt.Sprintf("CA private key %s does not match certificate %s: %v", cfg.CAKeyFile, cfg.CACertFile, err))
+		} else {
+			zeroPrivateKey(&ca)
+		}
+	}
+	if cfg.CSRFile != "" {
+		if _, err := readCSR(fsys, cfg.CSRFile); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if cfg.Completion.PayloadTemplate != "" {
+		if _, err := fsys.ReadFile(cfg.Completion.PayloadTemplate); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to read completion payload template: %v", err))
+		}
+	}
+	for _, render := range cfg.Renders {
+		if _, err := parseRenderTemplate(fsys, render.Template); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", render.Template, err))
+		}
+	}
+	if cfg.IntermediatesFile != "" {
+		if data, err := fsys.ReadFile(cfg.IntermediatesFile); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to read intermediates: %v", err))
+		} else if countCertificates(data) == 0 {
+			problems = append(problems, fmt.Sprintf("intermediates %s contain no valid PEM certificates", cfg.IntermediatesFile))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,271 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Directory of the sysfs GPIO interface strap pins are read through
+const gpioSysfs = "/sys/class/gpio"
+
+// A product built from the firmware image, with what sets it apart from the
+// others. Fields left empty keep the value of the corresponding flag.
+type Product struct {
+	Name       string            `json:"name"`
+	Match      []string          `json:"match,omitempty"` // Selector values that select the product
+	Template   string            `json:"template,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"` // Added to -param, replacing those of the same name
+	Region     string            `json:"region,omitempty"`
+	Endpoints  []string          `json:"endpoints,omitempty"`
+	Port       int               `json:"port,omitempty"`
+	Targets    string            `json:"targets,omitempty"`
+	Mode       string            `json:"mode,omitempty"`
+	CACert     string            `json:"caCert,omitempty"`
+	CAKey      string            `json:"caKey,omitempty"`
+	ClaimCert  string            `json:"claimCert,omitempty"`
+	ClaimKey   string            `json:"claimKey,omitempty"`
+	ClaimDir   string            `json:"claimDir,omitempty"`
+	RootCA     string            `json:"rootCa,omitempty"`
+}
+
+// Where the value selecting the product is read from: hardware strap pins,
+// or a field of an EEPROM
+type productSelector struct {
+	// Strap pins read through sysfs as the bits of a number, the first pin
+	// the most significant
+	GPIO []int `json:"gpio,omitempty"`
+
+	// File the EEPROM is exposed as, such as an nvmem device, and the
+	// position of the field in it. The field is read as text, trailing NUL
+	// and 0xFF padding removed.
+	EEPROM string `json:"eeprom,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Length int    `json:"length,omitempty"`
+}
+
+// Products file given with -products
+type productsFile struct {
+	Default  string           `json:"default"`
+	Selector *productSelector `json:"selector,omitempty"`
+	Products []Product        `json:"products"`
+}
+
+// loadProducts reads and checks a products file
+func loadProducts(fsys FileSystem, file string) (*productsFile, error) {
+	data, err := fsys.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read products: %v", err)
+	}
+	var products productsFile
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("failed to parse products %s: %v", file, err)
+	}
+	if len(products.Products) == 0 {
+		return nil, fmt.Errorf("products %s lists no products", file)
+	}
+	names := map[string]bool{}
+	matches := map[string]string{}
+	for _, product := range products.Products {
+		if product.Name == "" || names[product.Name] {
+			return nil, fmt.Errorf("products %s: product names must be unique and not empty", file)
+		}
+		names[product.Name] = true
+		for _, value := range product.Match {
+			if other, ok := matches[value]; ok {
+				return nil, fmt.Errorf("products %s: products %s and %s both match %q", file, other, product.Name, value)
+			}
+			matches[value] = product.Name
+		}
+	}
+	if products.Default == "" {
+		products.Default = products.Products[0].Name
+	}
+	if !names[products.Default] {
+		return nil, fmt.Errorf("products %s: unknown default product %q", file, products.Default)
+	}
+	if selector := products.Selector; selector != nil {
+		switch {
+		case len(selector.GPIO) > 0 && selector.EEPROM != "":
+			return nil, fmt.Errorf("products %s: the selector reads either strap pins or an EEPROM", file)
+		case len(selector.GPIO) == 0 && selector.EEPROM == "":
+			return nil, fmt.Errorf("products %s: the selector needs strap pins or an EEPROM", file)
+		case selector.EEPROM != "" && (selector.Offset < 0 || selector.Length <= 0):
+			return nil, fmt.Errorf("products %s: the EEPROM field needs a length and a non-negative offset", file)
+		}
+	}
+	return &products, nil
+}
+
+// product returns the named product
+func (p *productsFile) product(name string) (Product, error) {
+	i := slices.IndexFunc(p.Products, func(product Product) bool { return product.Name == name })
+	if i < 0 {
+		return Product{}, fmt.Errorf("unknown product %q", name)
+	}
+	return p.Products[i], nil
+}
+
+// apply returns cfg set up to provision as the product
+func (p Product) apply(cfg Config) Config {
+	cfg.ProductsFile, cfg.Product = "", ""
+	if p.Template != "" {
+		cfg.TemplateName = p.Template
+	}
+	if len(p.Parameters) > 0 {
+		params := maps.Clone(cfg.TemplateParameters)
+		if params == nil {
+			params = map[string]string{}
+		}
+		maps.Copy(params, p.Parameters)
+		cfg.TemplateParameters = params
+	}
+	if p.Region != "" {
+		cfg.Region = p.Region
+	}
+	if len(p.Endpoints) > 0 {
+		cfg.Endpoints = p.Endpoints
+	}
+	if p.Port != 0 {
+		cfg.Port = p.Port
+	}
+	if p.Targets != "" {
+		cfg.TargetsFile = p.Targets
+	}
+	if p.Mode != "" {
+		cfg.Mode = p.Mode
+	}
+	if p.CACert != "" {
+		cfg.CACertFile = p.CACert
+	}
+	if p.CAKey != "" {
+		cfg.CAKeyFile = p.CAKey
+	}
+	if p.ClaimCert != "" {
+		cfg.ClaimCertFile = p.ClaimCert
+	}
+	if p.ClaimKey != "" {
+		cfg.ClaimKeyFile = p.ClaimKey
+	}
+	if p.ClaimDir != "" {
+		cfg.ClaimDir = p.ClaimDir
+	}
+	if p.RootCA != "" {
+		cfg.RootCAFile = p.RootCA
+	}
+	return cfg
+}
+
+// validateProducts checks the products file and the configuration each
+// product results in
+func validateProducts(cfg Config) error {
+	products, err := loadProducts(cfg.Files.fs(), cfg.ProductsFile)
+	if err != nil {
+		return err
+	}
+	if cfg.Product != "" {
+		if _, err := products.product(cfg.Product); err != nil {
+			return err
+		}
+	}
+	for _, product := range products.Products {
+		productCfg := product.apply(cfg)
+		if err := productCfg.validate(); err != nil {
+			return fmt.Errorf("product %s: %v", product.Name, err)
+		}
+	}
+	return nil
+}
+
+// selectProduct returns cfg set up for the product the device is, and records
+// it in the state. The product is the one -product names, or else the one
+// matching the selector's value, or else the file's default. A flow already
+// under way stays with its product.
+func selectProduct(cfg Config, state *provisioningState) (Config, error) {
+	products, err := loadProducts(cfg.Files.fs(), cfg.ProductsFile)
+	if err != nil {
+		return cfg, err
+	}
+	name := state.Product
+	switch {
+	case name != "":
+	case cfg.Product != "":
+		name = cfg.Product
+	case products.Selector != nil:
+		value, err := products.Selector.read(cfg.Files.fs())
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read product selector: %v", err)
+		}
+		name = products.Default
+		if i := slices.IndexFunc(products.Products, func(product Product) bool { return slices.Contains(product.Match, value) }); i >= 0 {
+			name = products.Products[i].Name
+		} else {
+			log.Printf("Warning: no product matches selector value %q, using %s", value, name)
+		}
+	default:
+		name = products.Default
+	}
+	product, err := products.product(name)
+	if err != nil {
+		return cfg, fmt.Errorf("provisioning state: %v", err)
+	}
+	if state.Product == "" {
+		state.Product = name
+	}
+	log.Printf("Provisioning as product %s", product.Name)
+	return product.apply(cfg), nil
+}
+
+// read returns the selector's value
+func (s productSelector) read(fsys FileSystem) (string, error) {
+	if s.EEPROM != "" {
+		data, err := fsys.ReadFile(s.EEPROM)
+		if err != nil {
+			return "", err
+		}
+		if s.Offset+s.Length > len(data) {
+			return "", fmt.Errorf("field at %d+%d is beyond the end of %s (%d bytes)", s.Offset, s.Length, s.EEPROM, len(data))
+		}
+		field := bytes.TrimRight(data[s.Offset:s.Offset+s.Length], "\x00\xff")
+		return strings.TrimSpace(string(field)), nil
+	}
+	value := 0
+	for _, pin := range s.GPIO {
+		bit, err := readGPIO(fsys, pin)
+		if err != nil {
+			return "", err
+		}
+		value = value<<1 | bit
+	}
+	return strconv.Itoa(value), nil
+}
+
+// readGPIO returns the level of a pin, exporting it through sysfs first if no
+// one has
+func readGPIO(fsys FileSystem, pin int) (int, error) {
+	dir := fmt.Sprintf("%s/gpio%d", gpioSysfs, pin)
+	if _, err := fsys.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := fsys.WriteFile(gpioSysfs+"/export", []byte(strconv.Itoa(pin)), 0200); err != nil {
+			return 0, fmt.Errorf("failed to export GPIO %d: %v", pin, err)
+		}
+	}
+	data, err := fsys.ReadFile(dir + "/value")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read GPIO %d: %v", pin, err)
+	}
+	switch strings.TrimSpace(string(data)) {
+	case "0":
+		return 0, nil
+	case "1":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("GPIO %d reads %q", pin, strings.TrimSpace(string(data)))
+	}
+}
@@ -0,0 +1,43 @@
+package provisioner
+
+// A stage of the provisioning flow, reported through ProgressFunc
+type Stage string
+
+const (
+	StageValidate          Stage = "validate"
+	StageConnect           Stage = "connect"
+	StageCreateCertificate Stage = "create-certificate"
+	StageRegisterThing     Stage = "register-thing"
+	StageVerify            Stage = "verify"
+	StageComplete          Stage = "complete"
+)
+
+// ProgressFunc is called when the flow enters a stage
+type ProgressFunc func(stage Stage, message string)
+
+// report calls progress if it is set. Every stage is also shown as the systemd
+// service status and pets the watchdog; completing the flow marks the service
+// ready. Secrets in the message are redacted.
+func (progress ProgressFunc) report(stage Stage, message string) {
+	message = secrets.output(message)
+	state := "STATUS=" + message
+	if stage == StageComplete {
+		state = "READY=1\n" + state
+	}
+	sdNotify(state)
+	petWatchdog()
+
+	if progress != nil {
+		progress(stage, message)
+	}
+}
+
+// and returns a ProgressFunc that reports to progress and then to next
+func (progress ProgressFunc) and(next ProgressFunc) ProgressFunc {
+	return func(stage Stage, message string) {
+		if progress != nil {
+			progress(stage, message)
+		}
+		next(stage, message)
+	}
+}
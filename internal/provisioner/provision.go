@@ -0,0 +1,307 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A provisioning session over a connected MQTT transport. It tracks the topics
+// it subscribes to so they can be removed when the flow ends.
+type provisioningSession struct {
+	transport  Transport
+	cfg        Config
+	topics     []string
+	latencies  Latencies // Subscribe and request round-trips
+	registered time.Time // Halfway through the registration that succeeded
+	deadline   time.Time // Of -deadline, zero for none
+	codec      Codec     // Of the fleet provisioning payloads
+}
+
+func newProvisioningSession(transport Transport, cfg Config) *provisioningSession {
+	return &provisioningSession{transport: transport, cfg: cfg, codec: cfg.codec()}
+}
+
+// subscribe subscribes to a topic and waits for the broker to acknowledge it
+func (s *provisioningSession) subscribe(topic string, qos byte, handler MessageHandler) error {
+	started := time.Now()
+	if err := s.transport.Subscribe(topic, qos, handler); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	s.latencies.SubscribeMS += time.Since(started).Milliseconds()
+	// A request sent again subscribes again
+	if !slices.Contains(s.topics, topic) {
+		s.topics = append(s.topics, topic)
+	}
+	return nil
+}
+
+// close unsubscribes from all provisioning topics and disconnects the transport
+func (s *provisioningSession) close() {
+	if len(s.topics) > 0 && s.transport.IsConnected() {
+		if err := s.transport.Unsubscribe(s.topics...); err != nil {
+			log.Printf("Warning: failed to unsubscribe from provisioning topics: %v", err)
+		}
+	}
+	s.topics = nil
+
+	s.transport.Disconnect(s.cfg.DisconnectQuiesce)
+}
+
+// Certificate creation request. Without a CSR, AWS IoT generates the key.
+type createCertificateRequest struct {
+	CertificateSigningRequest string `json:"certificateSigningRequest"`
+}
+
+// createCertificate requests a new permanent certificate over MQTT. Without a
+// CSR AWS IoT generates the key as well; with one the response carries no key.
+func (s *provisioningSession) createCertificate(csr []byte) (CreateCertificateResponse, error) {
+	api := topicCreateCertificate
+	if csr != nil {
+		api = topicCreateFromCSR
+	}
+	createTopic, acceptedTopic, rejectedTopic := apiTopics(s.codec, api)
+
+	// Subscribe to certificate creation response topics
+	log.Println("Subscribing to certificate creation response topics...")
+	request, err := s.expect(exchange{
+		op:       "certificate creation",
+		qos:      "create-certificate",
+		topic:    createTopic,
+		accepted: acceptedTopic,
+		rejected: rejectedTopic,
+		rejection: func(payload []byte) error {
+			return s.rejected("certificate creation", payload)
+		},
+		timeout: errCreateTimeout,
+	})
+	if err != nil {
+		return CreateCertificateResponse{}, err
+	}
+
+	// Create permanent certificate via MQTT
+	log.Println("Creating permanent certificate via MQTT...")
+	payloadBytes, err := s.codec.Marshal(createCertificateRequest{CertificateSigningRequest: string(csr)})
+	if err != nil {
+		return CreateCertificateResponse{}, fmt.Errorf("failed to marshal create certificate payload: %v", err)
+	}
+
+	started := time.Now()
+	payload, err := request.send(payloadBytes)
+	if err != nil {
+		return CreateCertificateResponse{}, err
+	}
+	// The payload holds the private key, clear it once decoded
+	defer clear(payload)
+	var certResponse CreateCertificateResponse
+	if err := s.codec.Unmarshal(payload, &certResponse); err != nil {
+		return CreateCertificateResponse{}, fmt.Errorf("failed to unmarshal certificate response: %v", err)
+	}
+	if certResponse.Additional, err = additionalFields(s.codec, payload, &certResponse); err != nil {
+		certResponse.PrivateKey.zero()
+		return CreateCertificateResponse{}, fmt.Errorf("failed to unmarshal certificate response: %v", err)
+	}
+	if err := checkCertificateResponse(certResponse, csr); err != nil {
+		certResponse.PrivateKey.zero()
+		return CreateCertificateResponse{}, err
+	}
+	s.latencies.CreateCertificateMS = time.Since(started).Milliseconds()
+	log.Printf("Certificate creation took %s", time.Since(started).Round(time.Millisecond))
+	return certResponse, nil
+}
+
+// errCreateTimeout is returned when no certificate creation response arrives.
+// The certificate may still have been created.
+var errCreateTimeout = errors.New("timeout waiting for certificate creation response")
+
+// createCertificateWithRetry creates the certificate, retrying as policy
+// allows. A certificate whose response was lost stays unregistered.
+func (s *provisioningSession) createCertificateWithRetry(csr []byte, policy RetryPolicy) (CreateCertificateResponse, error) {
+	for attempt := 0; ; attempt++ {
+		response, err := s.createCertificate(csr)
+		if err == nil || attempt == policy.Retries || !policy.retryable(err, errCreateTimeout) {
+			return response, err
+		}
+		delay := policy.delay(s.cfg, attempt, err)
+		log.Printf("Warning: %v, retrying certificate creation in %s", err, delay.Round(time.Millisecond))
+		sleepWithWatchdog(s.cfg.clock(), delay)
+	}
+}
+
+// Thing registration request
+type registerThingRequest struct {
+	CertificateOwnershipToken string            `json:"certificateOwnershipToken"`
+	Parameters                map[string]string `json:"parameters"`
+}
+
+// registerThing publishes a registration request, the ownership token of the
+// permanent certificate and the template parameters params, to the
+// provisioning template. A rejection because the thing name is taken is
+// returned as a ThingNameConflictError.
+func (s *provisioningSession) registerThing(payload []byte, params map[string]string) (RegisterThingResponse, error) {
+	// Subscribe to thing registration response topics
+	log.Println("Subscribing to thing registration response topics...")
+	registerTopic, acceptedTopic, rejectedTopic := apiTopics(s.codec, fmt.Sprintf(topicRegisterThing, s.cfg.TemplateName))
+	request, err := s.expect(exchange{
+		op:       "thing registration",
+		qos:      "register-thing",
+		topic:    registerTopic,
+		accepted: acceptedTopic,
+		rejected: rejectedTopic,
+		rejection: func(payload []byte) error {
+			rejection := s.rejected("thing registration", payload)
+			if rejection.thingNameConflict() {
+				return &ThingNameConflictError{Parameters: params, Rejection: rejection}
+			}
+			return rejection
+		},
+		timeout: errRegisterTimeout,
+	})
+	if err != nil {
+		return RegisterThingResponse{}, err
+	}
+
+	// Register thing via MQTT
+	log.Println("Registering thing via MQTT...")
+	started := time.Now()
+	response, err := request.send(payload)
+	if err != nil {
+		return RegisterThingResponse{}, err
+	}
+	var registerResponse RegisterThingResponse
+	if err := s.codec.Unmarshal(response, &registerResponse); err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to unmarshal register thing response: %v", err)
+	}
+	if registerResponse.Additional, err = additionalFields(s.codec, response, &registerResponse); err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to unmarshal register thing response: %v", err)
+	}
+	if registerResponse.DeviceConfiguration, err = decodeDeviceConfiguration(s.codec, response); err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to unmarshal register thing response: %v", err)
+	}
+	if err := checkRegisterResponse(registerResponse); err != nil {
+		return RegisterThingResponse{}, err
+	}
+	s.latencies.RegisterThingMS = time.Since(started).Milliseconds()
+	s.registered = started.Add(time.Since(started) / 2)
+	log.Printf("Thing registration took %s", time.Since(started).Round(time.Millisecond))
+	return registerResponse, nil
+}
+
+// errRegisterTimeout is returned when no registration response arrives. The
+// request may still have succeeded.
+var errRegisterTimeout = errors.New("timeout waiting for thing registration response")
+
+// registerThingWithRetry registers the thing, retrying as policy allows with
+// the same ownership token, so a lost response doesn't orphan the
+// certificate. A rejection because the token was already used, when an
+// earlier request (in this run or one that crashed) registered the
+// certificate, counts as success; the response then has no thing name.
+func (s *provisioningSession) registerThingWithRetry(certResponse CreateCertificateResponse, params map[string]string, policy RetryPolicy) (RegisterThingResponse, error) {
+	// Retries resend the same request
+	payload, err := s.codec.Marshal(registerThingRequest{CertificateOwnershipToken: certResponse.CertificateOwnershipToken, Parameters: params})
+	if err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to marshal register thing payload: %v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		response, err := s.registerThing(payload, params)
+		var rejection *RejectedError
+		if errors.As(err, &rejection) && rejection.alreadyRegistered() {
+			log.Printf("Certificate %s is already registered: %v", certResponse.CertificateID, rejection)
+			return RegisterThingResponse{}, nil
+		}
+		if err == nil || attempt == policy.Retries || !policy.retryable(err, errRegisterTimeout) {
+			return response, err
+		}
+		delay := policy.delay(s.cfg, attempt, err)
+		log.Printf("Warning: %v, retrying registration with the same ownership token in %s", err, delay.Round(time.Millisecond))
+		sleepWithWatchdog(s.cfg.clock(), delay)
+	}
+}
+
+// RejectedError is a provisioning request AWS IoT rejected, with the error
+// document published on the rejected topic
+type RejectedError struct {
+	Op           string `json:"-"` // What was rejected, such as "thing registration"
+	StatusCode   int    `json:"statusCode"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+	payload      string
+}
+
+func newRejectedError(op string, codec Codec, payload []byte) *RejectedError {
+	e := &RejectedError{Op: op, payload: codec.Text(payload)}
+	// Keep the raw payload if it isn't the documented error document
+	codec.Unmarshal(payload, e)
+	return e
+}
+
+// rejected returns the error of a rejected request, recording the payload
+// for the diagnostic bundle
+func (s *provisioningSession) rejected(op string, payload []byte) *RejectedError {
+	e := newRejectedError(op, s.codec, payload)
+	s.cfg.flight.rejection(op, e.payload)
+	return e
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s rejected: %s", e.Op, e.payload)
+}
+
+// alreadyRegistered reports whether a registration was rejected because its
+// ownership token was already used to register the certificate
+func (e *RejectedError) alreadyRegistered() bool {
+	message := strings.ToLower(e.ErrorMessage)
+	return strings.Contains(message, "already") &&
+		(strings.Contains(message, "registered") || strings.Contains(message, "ownership token"))
+}
+
+// Error document published on shadow rejected topics
+type shadowError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// getShadow requests the thing's classic shadow, reporting whether one exists.
+// A missing shadow is not an error: the answer still shows the device may
+// publish and receive on its shadow topics.
+func (s *provisioningSession) getShadow(thingName string) (bool, error) {
+	token := newClientToken(s.cfg.random())
+	request, err := s.expect(exchange{
+		op:       "shadow get",
+		qos:      "shadow",
+		topic:    fmt.Sprintf(topicShadowGet, thingName),
+		accepted: fmt.Sprintf(topicShadowGetAccepted, thingName),
+		rejected: fmt.Sprintf(topicShadowGetRejected, thingName),
+		token:    token,
+		rejection: func(payload []byte) error {
+			var rejected shadowError
+			if err := json.Unmarshal(payload, &rejected); err == nil && rejected.Code == 404 {
+				return errNoShadow
+			}
+			return fmt.Errorf("shadow get rejected: %s", string(payload))
+		},
+		timeout: fmt.Errorf("timeout waiting for shadow get response (the policy may not allow the shadow topics)"),
+	})
+	if err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(map[string]string{"clientToken": token})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal shadow get request: %v", err)
+	}
+	_, err = request.send(payload)
+	if errors.Is(err, errNoShadow) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// errNoShadow is a shadow get rejected because the shadow does not exist
+var errNoShadow = errors.New("shadow does not exist")
@@ -0,0 +1,112 @@
+package provisioner
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PublishLimiter holds back messages published to AWS IoT, so a host
+// application that publishes its own telemetry can keep everything the device
+// sends within one budget. Wait is called before every publish of the
+// provisioning flow and blocks until the message may go out; an error refuses
+// it, failing the publish. It must be safe for concurrent use.
+type PublishLimiter interface {
+	Wait(topic string) error
+}
+
+// TokenBucket is a PublishLimiter allowing rate messages a second on average
+// and bursts of up to burst messages. Share one between the configurations of
+// the process and the application's own publishes, calling Wait before each,
+// to enforce a budget across all of them.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full token bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucket(systemClock{}, rate, burst)
+}
+
+func newTokenBucket(clock Clock, rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), clock: clock, tokens: float64(burst), last: clock.Now()}
+}
+
+// Wait takes a token, sleeping until one is available
+func (b *TokenBucket) Wait(topic string) error {
+	for {
+		b.mu.Lock()
+		now := b.clock.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		b.clock.Sleep(wait)
+	}
+}
+
+// Buckets of -publish-rate, one per rate and burst, so the connections of a
+// process share the budget
+var (
+	publishBucketsMu sync.Mutex
+	publishBuckets   = map[publishBudget]*TokenBucket{}
+)
+
+type publishBudget struct {
+	rate  float64
+	burst int
+}
+
+// publishLimiter returns the limiter of the configuration: PublishLimiter,
+// or else the bucket of PublishRate, or nil if publishes are not limited
+func (c Config) publishLimiter() PublishLimiter {
+	if c.PublishLimiter != nil {
+		return c.PublishLimiter
+	}
+	if c.PublishRate <= 0 {
+		return nil
+	}
+	budget := publishBudget{rate: c.PublishRate, burst: max(c.PublishBurst, 1)}
+	publishBucketsMu.Lock()
+	defer publishBucketsMu.Unlock()
+	bucket := publishBuckets[budget]
+	if bucket == nil {
+		bucket = newTokenBucket(c.clock(), budget.rate, budget.burst)
+		publishBuckets[budget] = bucket
+	}
+	return bucket
+}
+
+// limitedTransport waits for its limiter before every publish
+type limitedTransport struct {
+	Transport
+	limiter PublishLimiter
+}
+
+// limitPublishes returns transport with its publishes held back by the
+// configuration's limiter, if any
+func limitPublishes(cfg Config, transport Transport) Transport {
+	limiter := cfg.publishLimiter()
+	if limiter == nil {
+		return transport
+	}
+	return &limitedTransport{Transport: transport, limiter: limiter}
+}
+
+func (t *limitedTransport) Publish(topic string, qos byte, payload []byte) error {
+	if err := t.limiter.Wait(topic); err != nil {
+		return fmt.Errorf("publish to %s refused by the publish limiter: %w", topic, err)
+	}
+	return t.Transport.Publish(topic, qos, payload)
+}
@@ -0,0 +1,53 @@
+package provisioner
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Operations whose QoS can be set apart from -qos: the requests of the
+// provisioning flow, with their response subscriptions, and the completion
+// event and heartbeats, which have no response
+var qosOperations = []string{"create-certificate", "register-thing", "shadow", "completion", "heartbeat"}
+
+// QoS of an operation's request and of the subscriptions to its responses
+type OperationQoS struct {
+	Publish   byte
+	Subscribe byte
+}
+
+// parseOperationQoS parses name=qos, or name=publish/subscribe to subscribe
+// to the responses with a different QoS than the request is published with
+func parseOperationQoS(s string) (string, OperationQoS, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !slices.Contains(qosOperations, name) {
+		return "", OperationQoS{}, fmt.Errorf("expected operation=qos with one of %s, got %q", strings.Join(qosOperations, ", "), s)
+	}
+	publish, subscribe, split := strings.Cut(value, "/")
+	if !split {
+		subscribe = publish
+	}
+	var qos OperationQoS
+	for _, level := range []struct {
+		value string
+		qos   *byte
+	}{{publish, &qos.Publish}, {subscribe, &qos.Subscribe}} {
+		// AWS IoT Core does not support QoS 2
+		n, err := strconv.ParseUint(level.value, 10, 8)
+		if err != nil || n > 1 {
+			return "", OperationQoS{}, fmt.Errorf("unsupported QoS %q for %s: AWS IoT supports QoS 0 and 1", level.value, name)
+		}
+		*level.qos = byte(n)
+	}
+	return name, qos, nil
+}
+
+// qos returns the QoS of an operation, -qos unless -operation-qos sets it
+func (c *Config) qos(operation string) OperationQoS {
+	if qos, ok := c.OperationQoS[operation]; ok {
+		return qos
+	}
+	return OperationQoS{Publish: c.QoS, Subscribe: c.QoS}
+}
@@ -0,0 +1,13 @@
+//go:build noqr
+
+package provisioner
+
+import "errors"
+
+// Built without the QR code encoder: labels are only printed as ZPL, whose
+// QR code the printer draws, see validate
+const qrCodes = false
+
+func newQRCode(payload string) (qrCode, error) {
+	return nil, errors.New("QR codes are not available in this build (built with -tags noqr)")
+}
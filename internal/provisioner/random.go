@@ -0,0 +1,79 @@
+package provisioner
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Random is the source of what varies from run to run: the {random} suffixes
+// of client IDs and thing names, the client tokens of requests, and the
+// jitter of delays. Keys, nonces, and other secrets never come from it. It is
+// a math/rand/v2 Source, and must be safe for concurrent use.
+type Random interface {
+	Uint64() uint64
+}
+
+// systemRandom draws from the operating system, the default
+type systemRandom struct{}
+
+func (systemRandom) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// NewSeededRandom returns a deterministic Random: runs given the same seed get
+// the same client IDs, suffixes, tokens, and delays, so integration tests and
+// simulations can be reproduced
+func NewSeededRandom(seed uint64) Random {
+	return &lockedRandom{src: rand.NewPCG(seed, seed)}
+}
+
+// lockedRandom makes a source safe for concurrent use
+type lockedRandom struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (r *lockedRandom) Uint64() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.Uint64()
+}
+
+// random returns the run's source of randomness
+func (c *Config) random() Random {
+	if c.Random != nil {
+		return c.Random
+	}
+	return systemRandom{}
+}
+
+// withRandom returns the configuration with its source of randomness
+// resolved, seeded from RandomSeed if set, and handed to the backoff. Runs
+// resolve it once, so the draws of a seeded run follow one sequence.
+func (c Config) withRandom() Config {
+	if c.Random == nil && c.RandomSeed != 0 {
+		c.Random = NewSeededRandom(c.RandomSeed)
+	}
+	c.Reconnect.random = c.random()
+	return c
+}
+
+// randomDuration returns a duration between 0 and max, both included
+func randomDuration(r Random, max time.Duration) time.Duration {
+	return time.Duration(rand.New(r).Int64N(int64(max) + 1))
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(r Random, n int) string {
+	b := make([]byte, 0, n+8)
+	for len(b) < n {
+		b = binary.LittleEndian.AppendUint64(b, r.Uint64())
+	}
+	return hex.EncodeToString(b[:n])
+}
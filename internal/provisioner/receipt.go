@@ -0,0 +1,111 @@
+package provisioner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 of ES384 and ES512
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Proof that a device completed provisioning. It is signed with the device's new
+// private key, so a backend holding the registered certificate can check that
+// the physical device that owns the key produced it.
+type ProvisioningReceipt struct {
+	Serial                 string    `json:"serial"`
+	ThingName              string    `json:"thingName"`
+	CertificateID          string    `json:"certificateId"`
+	CertificateFingerprint string    `json:"certificateFingerprint"` // SHA-256 of the DER certificate, hex
+	Endpoint               string    `json:"endpoint"`
+	ProvisionedAt          time.Time `json:"provisionedAt"`
+	VerifiedAt             time.Time `json:"verifiedAt"`
+}
+
+// Receipt file contents. The signature covers the exact bytes of Receipt.
+type signedReceipt struct {
+	Receipt   json.RawMessage `json:"receipt"`
+	Algorithm string          `json:"algorithm"` // RS256, ES256, ES384, ES512, or EdDSA
+	Signature string          `json:"signature"` // base64
+}
+
+// writeReceipt signs the receipt with the device certificate's key and writes
+// it to path. The fingerprint is filled in from the certificate.
+func writeReceipt(path string, cert tls.Certificate, receipt ProvisioningReceipt, files FilePermissions) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("device certificate is empty")
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	receipt.CertificateFingerprint = hex.EncodeToString(fingerprint[:])
+
+	payload, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %v", err)
+	}
+	algorithm, signature, err := signPayload(cert.PrivateKey, payload)
+	if err != nil {
+		return fmt.Errorf("failed to sign receipt: %v", err)
+	}
+
+	// Not indented, indenting would change the signed bytes
+	data, err := json.Marshal(signedReceipt{
+		Receipt:   payload,
+		Algorithm: algorithm,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %v", err)
+	}
+	if err := files.write(path, data, false); err != nil {
+		return fmt.Errorf("failed to save receipt: %v", err)
+	}
+	return nil
+}
+
+// signPayload signs payload with key, returning the JWS name of the algorithm.
+// The key is only used as a crypto.Signer, so it may be held by hardware.
+func signPayload(key crypto.PrivateKey, payload []byte) (string, []byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", nil, fmt.Errorf("private key of type %T cannot sign", key)
+	}
+	switch public := signer.Public().(type) {
+	case *rsa.PublicKey:
+		// PKCS #1 v1.5 unless the signer is given PSS options
+		digest := sha256.Sum256(payload)
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return "RS256", signature, err
+	case *ecdsa.PublicKey:
+		// The hash goes with the curve, as JWS pairs them
+		var algorithm string
+		var hash crypto.Hash
+		switch public.Curve {
+		case elliptic.P256():
+			algorithm, hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			algorithm, hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			algorithm, hash = "ES512", crypto.SHA512
+		default:
+			return "", nil, fmt.Errorf("unsupported elliptic curve %s", public.Curve.Params().Name)
+		}
+		h := hash.New()
+		h.Write(payload)
+		signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+		return algorithm, signature, err
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself
+		signature, err := signer.Sign(rand.Reader, payload, crypto.Hash(0))
+		return "EdDSA", signature, err
+	default:
+		return "", nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+}
@@ -0,0 +1,309 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Thing resource type of provisioning templates
+const thingResourceType = "AWS::IoT::Thing"
+
+// Properties of the thing a provisioning template registers, as rendered with
+// a set of parameters
+type thingProperties struct {
+	ThingName     string
+	Attributes    map[string]string
+	ThingTypeName string
+	ThingGroups   []string
+	BillingGroup  string
+}
+
+// parameterDrift returns the template parameters of this run and the names of
+// those that differ from the parameters the device registered with, sorted.
+// Devices registered before the parameters were recorded, or without a
+// template, have no drift.
+func parameterDrift(cfg Config, state *provisioningState) (map[string]string, []string) {
+	if state.TemplateParameters == nil || cfg.Mode != ModeFleet {
+		return nil, nil
+	}
+	params := templateParameters(cfg)
+	// A suffix added after a thing name conflict is not a change
+	if registered, ok := state.TemplateParameters[cfg.ConflictParam]; ok && cfg.ConflictSuffix != "" && strings.HasPrefix(registered, params[cfg.ConflictParam]) {
+		params[cfg.ConflictParam] = registered
+	}
+	// Steps set or remove theirs during the registration only
+	for _, name := range state.StepParameters {
+		if value, ok := state.TemplateParameters[name]; ok {
+			params[name] = value
+		} else {
+			delete(params, name)
+		}
+	}
+	var changed []string
+	for name := range params {
+		if value, ok := state.TemplateParameters[name]; !ok || value != params[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range state.TemplateParameters {
+		if _, ok := params[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return params, changed
+}
+
+// reconcileParameters brings the thing in line with parameters changed since
+// the device registered, applying only what changed with the AWS SDK, see
+// reconcileThing, and records the parameters. Without cfg.Reconcile the drift
+// is only logged. Missing AWS credentials skip it until the next run.
+func reconcileParameters(cfg Config, state *provisioningState) error {
+	// The product and target the device was provisioned as give the template
+	// and some of the parameters
+	var err error
+	if cfg.ProductsFile != "" {
+		if cfg, err = selectProduct(cfg, state); err != nil {
+			return err
+		}
+	}
+	if cfg.TargetsFile != "" {
+		if cfg, err = selectTarget(cfg, state); err != nil {
+			return err
+		}
+	}
+	params, changed := parameterDrift(cfg, state)
+	if len(changed) == 0 {
+		return nil
+	}
+	if !cfg.Reconcile {
+		log.Printf("Warning: template parameters %s changed since %s was provisioned, pass -reconcile to apply them", strings.Join(changed, ", "), state.ThingName)
+		return nil
+	}
+	log.Printf("Template parameters %s changed since %s was provisioned, reconciling", strings.Join(changed, ", "), state.ThingName)
+	applied, err := reconcileThing(cfg, state, params)
+	if err != nil || !applied {
+		return err
+	}
+	state.TemplateParameters = params
+	if err := state.save(); err != nil {
+		return err
+	}
+	recordAudit(cfg, auditEntry{Event: AuditThingReconciled, CertificateID: state.CertificateID, ThingName: state.ThingName})
+	return nil
+}
+
+// renderThing evaluates the thing resource of a template body with params.
+// Values may be literals or use Ref, Fn::Join, and Fn::Sub; resources with
+// conditions and other functions are not evaluated.
+func renderThing(body []byte, params map[string]string) (*thingProperties, error) {
+	var template struct {
+		Parameters map[string]templateParameter `json:"Parameters"`
+		Resources  map[string]struct {
+			Type       string                 `json:"Type"`
+			Condition  string                 `json:"Condition"`
+			Properties map[string]interface{} `json:"Properties"`
+		} `json:"Resources"`
+	}
+	if err := json.Unmarshal(body, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+	var properties map[string]interface{}
+	for name, resource := range template.Resources {
+		if resource.Type != thingResourceType {
+			continue
+		}
+		if properties != nil {
+			return nil, fmt.Errorf("template has more than one %s resource", thingResourceType)
+		}
+		if resource.Condition != "" {
+			return nil, fmt.Errorf("thing resource %s has a condition, which reconciliation does not evaluate", name)
+		}
+		properties = resource.Properties
+		if properties == nil {
+			properties = map[string]interface{}{}
+		}
+	}
+	if properties == nil {
+		return nil, fmt.Errorf("template has no %s resource", thingResourceType)
+	}
+
+	value := func(name string) (interface{}, error) {
+		v, ok := properties[name]
+		if !ok {
+			return nil, nil
+		}
+		v, err := evaluateTemplateValue(v, params, template.Parameters)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return v, nil
+	}
+	str := func(name string) (string, error) {
+		v, err := value(name)
+		if err != nil || v == nil {
+			return "", err
+		}
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("%s must be a string", name)
+		}
+		return s, nil
+	}
+	thing := &thingProperties{Attributes: map[string]string{}}
+	var err error
+	if thing.ThingName, err = str("ThingName"); err != nil {
+		return nil, err
+	}
+	if thing.ThingTypeName, err = str("ThingTypeName"); err != nil {
+		return nil, err
+	}
+	if thing.BillingGroup, err = str("BillingGroup"); err != nil {
+		return nil, err
+	}
+	attributes, err := value("AttributePayload")
+	if err != nil {
+		return nil, err
+	}
+	if attributes != nil {
+		payload, ok := attributes.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("AttributePayload must be an object")
+		}
+		for name, v := range payload {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("attribute %s must be a string", name)
+			}
+			thing.Attributes[name] = s
+		}
+	}
+	groups, err := value("ThingGroups")
+	if err != nil {
+		return nil, err
+	}
+	switch groups := groups.(type) {
+	case nil:
+	case string:
+		// A Ref to a list parameter
+		for _, group := range strings.Split(groups, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				thing.ThingGroups = append(thing.ThingGroups, group)
+			}
+		}
+	case []interface{}:
+		for _, group := range groups {
+			s, ok := group.(string)
+			if !ok {
+				return nil, fmt.Errorf("ThingGroups must list strings")
+			}
+			thing.ThingGroups = append(thing.ThingGroups, s)
+		}
+	default:
+		return nil, fmt.Errorf("ThingGroups must be a list")
+	}
+	return thing, nil
+}
+
+// evaluateTemplateValue evaluates the functions in a value of a template with
+// params, or the defaults of the parameters not passed
+func evaluateTemplateValue(v interface{}, params map[string]string, declared map[string]templateParameter) (interface{}, error) {
+	ref := func(name string) (string, error) {
+		if value, ok := params[name]; ok {
+			return value, nil
+		}
+		if parameter, ok := declared[name]; ok && parameter.Default != nil {
+			return *parameter.Default, nil
+		}
+		return "", fmt.Errorf("parameter %s is not passed and has no default", name)
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := evaluateTemplateValue(item, params, declared)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for function, argument := range v {
+				switch {
+				case function == "Ref":
+					name, ok := argument.(string)
+					if !ok {
+						return nil, fmt.Errorf("Ref must name a parameter")
+					}
+					return ref(name)
+				case function == "Fn::Join":
+					join, ok := argument.([]interface{})
+					if !ok || len(join) != 2 {
+						return nil, fmt.Errorf("Fn::Join must be a delimiter and a list")
+					}
+					delimiter, ok := join[0].(string)
+					if !ok {
+						return nil, fmt.Errorf("Fn::Join must be a delimiter and a list")
+					}
+					values, err := evaluateTemplateValue(join[1], params, declared)
+					if err != nil {
+						return nil, err
+					}
+					list, ok := values.([]interface{})
+					if !ok {
+						return nil, fmt.Errorf("Fn::Join must be a delimiter and a list")
+					}
+					parts := make([]string, len(list))
+					for i, part := range list {
+						if parts[i], ok = part.(string); !ok {
+							return nil, fmt.Errorf("Fn::Join must join strings")
+						}
+					}
+					return strings.Join(parts, delimiter), nil
+				case function == "Fn::Sub":
+					s, ok := argument.(string)
+					if !ok {
+						return nil, fmt.Errorf("Fn::Sub must be a string")
+					}
+					var b strings.Builder
+					for {
+						start := strings.Index(s, "${")
+						if start < 0 {
+							break
+						}
+						end := strings.Index(s[start:], "}")
+						if end < 0 {
+							break
+						}
+						value, err := ref(s[start+2 : start+end])
+						if err != nil {
+							return nil, err
+						}
+						b.WriteString(s[:start])
+						b.WriteString(value)
+						s = s[start+end+1:]
+					}
+					b.WriteString(s)
+					return b.String(), nil
+				case strings.HasPrefix(function, "Fn::"):
+					return nil, fmt.Errorf("uses %s, which reconciliation does not evaluate", function)
+				}
+			}
+		}
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			value, err := evaluateTemplateValue(item, params, declared)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+		return values, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,134 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// reconcileThing renders the thing resource of the template's default version
+// with the parameters the device registered with and with params, and applies
+// the difference to the thing in AWS IoT: attributes and the thing type and
+// billing group are set to what params give where the thing differs, groups
+// it is not in are joined, and what only the old parameters gave is removed.
+// Groups and attributes the template never gave the thing are left alone. It
+// reports false, applying nothing, when AWS credentials are missing.
+func reconcileThing(cfg Config, state *provisioningState, params map[string]string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		log.Printf("Warning: skipping reconciliation: %v", err)
+		return false, nil
+	}
+	described, err := client.DescribeProvisioningTemplate(ctx, &iot.DescribeProvisioningTemplateInput{TemplateName: aws.String(cfg.TemplateName)})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe template %s: %v", cfg.TemplateName, err)
+	}
+	body := []byte(aws.ToString(described.TemplateBody))
+	previous, err := renderThing(body, state.TemplateParameters)
+	if err != nil {
+		return false, fmt.Errorf("failed to render template %s with the registered parameters: %v", cfg.TemplateName, err)
+	}
+	desired, err := renderThing(body, params)
+	if err != nil {
+		return false, fmt.Errorf("failed to render template %s: %v", cfg.TemplateName, err)
+	}
+	thingName := aws.String(state.ThingName)
+	if desired.ThingName != "" && desired.ThingName != state.ThingName {
+		return false, fmt.Errorf("parameters would rename thing %s to %s, deprovision and provision again to rename it", state.ThingName, desired.ThingName)
+	}
+
+	thing, err := client.DescribeThing(ctx, &iot.DescribeThingInput{ThingName: thingName})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe thing %s: %v", state.ThingName, err)
+	}
+	var groups []string
+	pages := iot.NewListThingGroupsForThingPaginator(client, &iot.ListThingGroupsForThingInput{ThingName: thingName})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to list thing groups of %s: %v", state.ThingName, err)
+		}
+		for _, group := range page.ThingGroups {
+			groups = append(groups, aws.ToString(group.GroupName))
+		}
+	}
+
+	// Empty values remove attributes from a merged payload
+	attributes := map[string]string{}
+	for name, value := range desired.Attributes {
+		if thing.Attributes[name] != value {
+			attributes[name] = value
+		}
+	}
+	for name := range previous.Attributes {
+		if _, kept := desired.Attributes[name]; !kept {
+			if _, ok := thing.Attributes[name]; ok {
+				attributes[name] = ""
+			}
+		}
+	}
+	update := &iot.UpdateThingInput{ThingName: thingName}
+	if len(attributes) > 0 {
+		update.AttributePayload = &types.AttributePayload{Attributes: attributes, Merge: true}
+	}
+	switch current := aws.ToString(thing.ThingTypeName); {
+	case desired.ThingTypeName != "" && desired.ThingTypeName != current:
+		update.ThingTypeName = aws.String(desired.ThingTypeName)
+	case desired.ThingTypeName == "" && previous.ThingTypeName != "" && previous.ThingTypeName == current:
+		update.RemoveThingType = true
+	}
+	if update.AttributePayload != nil || update.ThingTypeName != nil || update.RemoveThingType {
+		if _, err := client.UpdateThing(ctx, update); err != nil {
+			return false, fmt.Errorf("failed to update thing %s: %v", state.ThingName, err)
+		}
+		if len(attributes) > 0 {
+			log.Printf("Updated %d attributes of %s", len(attributes), state.ThingName)
+		}
+		if update.ThingTypeName != nil || update.RemoveThingType {
+			log.Printf("Changed the thing type of %s to %q", state.ThingName, desired.ThingTypeName)
+		}
+	}
+
+	for _, group := range desired.ThingGroups {
+		if slices.Contains(groups, group) {
+			continue
+		}
+		if _, err := client.AddThingToThingGroup(ctx, &iot.AddThingToThingGroupInput{ThingName: thingName, ThingGroupName: aws.String(group)}); err != nil {
+			return false, fmt.Errorf("failed to add %s to thing group %s: %v", state.ThingName, group, err)
+		}
+		log.Printf("Added %s to thing group %s", state.ThingName, group)
+	}
+	for _, group := range previous.ThingGroups {
+		if slices.Contains(desired.ThingGroups, group) || !slices.Contains(groups, group) {
+			continue
+		}
+		if _, err := client.RemoveThingFromThingGroup(ctx, &iot.RemoveThingFromThingGroupInput{ThingName: thingName, ThingGroupName: aws.String(group)}); err != nil {
+			return false, fmt.Errorf("failed to remove %s from thing group %s: %v", state.ThingName, group, err)
+		}
+		log.Printf("Removed %s from thing group %s", state.ThingName, group)
+	}
+
+	switch current := aws.ToString(thing.BillingGroupName); {
+	case desired.BillingGroup != "" && desired.BillingGroup != current:
+		if _, err := client.AddThingToBillingGroup(ctx, &iot.AddThingToBillingGroupInput{ThingName: thingName, BillingGroupName: aws.String(desired.BillingGroup)}); err != nil {
+			return false, fmt.Errorf("failed to add %s to billing group %s: %v", state.ThingName, desired.BillingGroup, err)
+		}
+		log.Printf("Moved %s to billing group %s", state.ThingName, desired.BillingGroup)
+	case desired.BillingGroup == "" && previous.BillingGroup != "" && previous.BillingGroup == current:
+		if _, err := client.RemoveThingFromBillingGroup(ctx, &iot.RemoveThingFromBillingGroupInput{ThingName: thingName, BillingGroupName: aws.String(current)}); err != nil {
+			return false, fmt.Errorf("failed to remove %s from billing group %s: %v", state.ThingName, current, err)
+		}
+		log.Printf("Removed %s from billing group %s", state.ThingName, current)
+	}
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package provisioner
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Role of a secret, named in its place where it is redacted
+type secretRole string
+
+const (
+	SecretPrivateKey     secretRole = "private-key"
+	SecretOwnershipToken secretRole = "ownership-token"
+	SecretWiFiPSK        secretRole = "wifi-psk"
+	SecretNotifyTarget   secretRole = "notify-target" // Slack webhook URL or PagerDuty routing key
+)
+
+// Secrets shorter than this are not redacted by value, as they would match
+// unrelated text
+const minSecretLength = 16
+
+// Secrets recognised by their form, whether or not the run learned them:
+// PEM private keys, also JSON-escaped, and the secret fields of the fleet
+// provisioning responses
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`), redactedRole(SecretPrivateKey)},
+	{regexp.MustCompile(`("privateKey"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redactedRole(SecretPrivateKey) + `"`},
+	{regexp.MustCompile(`("certificateOwnershipToken"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redactedRole(SecretOwnershipToken) + `"`},
+	{regexp.MustCompile(`("wifi_psk"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redactedRole(SecretWiFiPSK) + `"`},
+}
+
+// secrets redacts private keys and ownership tokens from everything the
+// program outputs: the log, progress reports, errors, and diagnostic bundles.
+// It is shared by the process, since the log is, but a run's secrets are only
+// kept while it is in progress, see secretScope.
+var secrets redactor
+
+type redactor struct {
+	mu        sync.RWMutex
+	values    map[string]*secretValue
+	runs      int // In progress, see open
+	revealing int // Of runs, those with -show-secrets
+}
+
+// A secret the redactor replaces by value
+type secretValue struct {
+	role secretRole
+	runs int // That learned it, zero for secrets of the process
+}
+
+// add has the redactor replace a secret of the process, such as a -notify
+// target, wherever it appears. Secrets a run learns are added to its scope.
+func (r *redactor) add(role secretRole, value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = map[string]*secretValue{}
+	}
+	if v, ok := r.values[value]; ok {
+		v.runs = 0
+		return
+	}
+	r.values[value] = &secretValue{role: role}
+}
+
+// redact replaces the secrets in s with REDACTED and their role
+func (r *redactor) redact(s string) string {
+	for _, p := range secretPatterns {
+		if p.pattern.MatchString(s) {
+			s = p.pattern.ReplaceAllString(s, p.replacement)
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for value, v := range r.values {
+		s = strings.ReplaceAll(s, value, redactedRole(v.role))
+	}
+	return s
+}
+
+// output redacts s unless -show-secrets is in effect, which it is while every
+// run in progress has it: the log cannot tell the runs' lines apart
+func (r *redactor) output(s string) string {
+	r.mu.RLock()
+	show := r.revealing > 0 && r.revealing == r.runs
+	r.mu.RUnlock()
+	if show {
+		return s
+	}
+	return r.redact(s)
+}
+
+// open starts the scope of a run. With show, for -show-secrets, the log,
+// progress, and errors are not redacted while it is the only kind of run in
+// progress, for debugging on the device itself. It is refused unless stderr
+// is a terminal, so the secrets cannot end up in the journal or a log
+// shipper.
+func (r *redactor) open(show bool) *secretScope {
+	if show {
+		if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			log.Printf("Warning: ignoring -show-secrets, stderr is not a terminal")
+			show = false
+		}
+	}
+	r.mu.Lock()
+	r.runs++
+	if show {
+		r.revealing++
+	}
+	r.mu.Unlock()
+	if show {
+		log.Printf("Warning: -show-secrets is set, private keys and ownership tokens are shown; do not share this output")
+	}
+	return &secretScope{r: r, values: map[string]bool{}, show: show}
+}
+
+// secretScope holds the secrets a run learned, which are redacted until it
+// ends, so a process provisioning one device after another does not keep
+// every ownership token and passphrase it saw
+type secretScope struct {
+	r      *redactor
+	mu     sync.Mutex
+	values map[string]bool
+	show   bool
+}
+
+// add has the redactor replace a secret the run learned wherever it appears,
+// until the run ends. Without a scope the secret is the process's.
+func (s *secretScope) add(role secretRole, value string) {
+	if s == nil {
+		secrets.add(role, value)
+		return
+	}
+	if len(value) < minSecretLength {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values[value] {
+		return
+	}
+	s.values[value] = true
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if s.r.values == nil {
+		s.r.values = map[string]*secretValue{}
+	}
+	if v, ok := s.r.values[value]; ok {
+		if v.runs > 0 {
+			v.runs++
+		}
+		return
+	}
+	s.r.values[value] = &secretValue{role: role, runs: 1}
+}
+
+// close ends the run, forgetting the secrets no other run learned. Errors of
+// the run are redacted when they are made, see redactError.
+func (s *secretScope) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	for value := range s.values {
+		if v, ok := s.r.values[value]; ok && v.runs > 0 {
+			if v.runs--; v.runs == 0 {
+				delete(s.r.values, value)
+			}
+		}
+	}
+	s.values = nil
+	s.r.runs--
+	if s.show {
+		s.r.revealing--
+	}
+}
+
+func redactedRole(role secretRole) string {
+	return redacted + "(" + string(role) + ")"
+}
+
+// redactingWriter redacts what is written through it, such as log lines
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, secrets.output(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactedError is an error whose message is redacted. It unwraps to the
+// original, so its class and kind are still recognised.
+type redactedError struct {
+	err     error
+	message string
+}
+
+// redactError returns err with its message redacted, or nil. The message is
+// redacted right away, while the secrets of the run are known.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*redactedError); ok {
+		return err
+	}
+	return &redactedError{err: err, message: secrets.output(err.Error())}
+}
+
+func (e *redactedError) Error() string { return e.message }
+func (e *redactedError) Unwrap() error { return e.err }
@@ -0,0 +1,78 @@
+package provisioner
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// DeviceCredentials holds the permanent device identity for long-running
+// consumers. TLS configurations from TLSConfig pick the certificate up on every
+// handshake, so after a rotation ReloadCredentials swaps the identity without
+// restarting the process; established connections keep the old one until they
+// reconnect.
+type DeviceCredentials struct {
+	identity TLSIdentity
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewDeviceCredentials loads the permanent certificate and key from the output
+// directory
+func NewDeviceCredentials(cfg Config) (*DeviceCredentials, error) {
+	return NewDeviceCredentialsFromIdentity(cfg.permanentIdentity())
+}
+
+// NewDeviceCredentialsFromIdentity loads the device identity from another
+// source than the output directory, such as a NewSignerIdentity whose key is
+// kept in a hardware module
+func NewDeviceCredentialsFromIdentity(identity TLSIdentity) (*DeviceCredentials, error) {
+	c := &DeviceCredentials{identity: identity}
+	if err := c.ReloadCredentials(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReloadCredentials loads the certificate and key again. On failure the
+// current identity is kept.
+func (c *DeviceCredentials) ReloadCredentials() error {
+	cert, err := c.identity.TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %v", err)
+	}
+
+	// The old key is left to the garbage collector rather than zeroed, as a
+	// handshake in progress may still be signing with it
+	c.mu.Lock()
+	reloaded := c.cert != nil
+	c.cert = &cert
+	c.mu.Unlock()
+
+	if reloaded {
+		log.Printf("Reloaded device certificate %s", c.identity)
+	}
+	return nil
+}
+
+// GetClientCertificate returns the current identity; it is a
+// tls.Config.GetClientCertificate callback
+func (c *DeviceCredentials) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns the mutual TLS configuration for the AWS IoT endpoint,
+// presenting whichever identity was loaded last
+func (c *DeviceCredentials) TLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig, err := newTLSConfig(cfg, tls.Certificate{})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = c.GetClientCertificate
+	return tlsConfig, nil
+}
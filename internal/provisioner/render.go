@@ -0,0 +1,118 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Render is a Go template rendered into a configuration file of a downstream
+// service, such as a Mosquitto bridge or Telegraf, once the device is
+// provisioned
+type Render struct {
+	Template string // text/template file
+	Output   string // File the result is written to
+}
+
+// parseRender parses template=output
+func parseRender(s string) (Render, error) {
+	tmpl, output, ok := strings.Cut(s, "=")
+	if !ok || tmpl == "" || output == "" {
+		return Render{}, fmt.Errorf("expected template=output, got %q", s)
+	}
+	return Render{Template: tmpl, Output: output}, nil
+}
+
+// What rendered templates are executed with: the fields of the result, and
+// the device's configuration
+type renderData struct {
+	*ProvisioningResult
+	Serial     string
+	Region     string
+	Port       int
+	RootCAFile string // Empty when the built-in Amazon root CAs are used
+	Parameters map[string]string
+}
+
+// Functions available to rendered templates
+var renderFuncs = template.FuncMap{
+	// json quotes a value for JSON or TOML, or renders a map or list as JSON
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseRenderTemplate reads and parses the template of a render. Missing
+// fields and map keys are errors when executed, rather than rendered empty.
+func parseRenderTemplate(fsys FileSystem, path string) (*template.Template, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read render template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(renderFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse render template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// writeRenders renders the configured templates for the provisioned device.
+// Every render is attempted; the errors of those that failed are returned
+// together.
+func writeRenders(cfg Config, result *ProvisioningResult) error {
+	data := newRenderData(cfg, result)
+	var problems []string
+	for _, render := range cfg.Renders {
+		if err := writeRender(cfg, render, data); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		log.Printf("Rendered %s to %s", render.Template, render.Output)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// newRenderData returns what templates are rendered with for the device
+func newRenderData(cfg Config, result *ProvisioningResult) renderData {
+	return renderData{
+		ProvisioningResult: result,
+		Serial:             cfg.SerialNumber,
+		Region:             cfg.Region,
+		Port:               cfg.port(),
+		RootCAFile:         cfg.RootCAFile,
+		Parameters:         templateParameters(cfg),
+	}
+}
+
+// renderTemplate renders one template
+func renderTemplate(cfg Config, render Render, data renderData) ([]byte, error) {
+	tmpl, err := parseRenderTemplate(cfg.Files.fs(), render.Template)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %v", render.Template, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeRender renders one template and writes it in place of its output
+func writeRender(cfg Config, render Render, data renderData) error {
+	rendered, err := renderTemplate(cfg, render, data)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Files.write(render.Output, rendered, false); err != nil {
+		return fmt.Errorf("failed to write rendered %s: %v", render.Output, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// exchange describes a request AWS IoT answers on an accepted or a rejected
+// topic
+type exchange struct {
+	op       string // What is requested, for logs, such as "thing registration"
+	qos      string // Operation in qosOperations
+	topic    string // Topic the request is published to
+	accepted string // Topic of the response when the request succeeds
+	rejected string // Topic of the error document when it fails
+	// Client token the response must echo, for APIs that echo one, which
+	// speak JSON; other responses are answers to other requests
+	token string
+	// rejection turns the error document into the request's error
+	rejection func(payload []byte) error
+	// timeout is returned when no response arrives in -response-timeout
+	timeout error
+	// wait replaces -response-timeout for the request if set
+	wait time.Duration
+}
+
+// pendingRequest is an exchange whose response topics are subscribed to. The
+// first response to arrive after the request is sent answers it; responses
+// arriving before, duplicates, and late responses are discarded without
+// blocking the MQTT client.
+type pendingRequest struct {
+	session *provisioningSession
+	exchange
+	sent     atomic.Bool
+	answered sync.Once
+	done     chan struct{}
+	payload  []byte
+	err      error
+}
+
+// expect subscribes to the exchange's response topics, ready to send the
+// request
+func (s *provisioningSession) expect(ex exchange) (*pendingRequest, error) {
+	p := &pendingRequest{session: s, exchange: ex, done: make(chan struct{})}
+	qos := s.cfg.qos(ex.qos)
+	if err := s.subscribe(ex.accepted, qos.Subscribe, func(topic string, payload []byte) {
+		p.answer(payload, false)
+	}); err != nil {
+		return nil, err
+	}
+	if err := s.subscribe(ex.rejected, qos.Subscribe, func(topic string, payload []byte) {
+		p.answer(payload, true)
+	}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// answer completes the request with a response, unless it is not one to this
+// request. Discarded payloads are cleared, as they may hold a private key.
+func (p *pendingRequest) answer(payload []byte, rejected bool) {
+	reason := ""
+	switch {
+	// With persistent sessions, the broker can deliver answers to a request
+	// of an earlier connection
+	case !p.sent.Load():
+		reason = "arrived before the request was sent"
+	// Before anything of it is decoded
+	case len(payload) > maxResponsePayload:
+		reason = fmt.Sprintf("is larger than %d bytes", maxResponsePayload)
+	case p.token != "" && responseToken(payload) != p.token:
+		reason = "answers another request"
+	}
+	if reason == "" {
+		answered := false
+		p.answered.Do(func() {
+			answered = true
+			if rejected {
+				p.err = p.rejection(payload)
+			} else {
+				p.payload = payload
+			}
+			close(p.done)
+		})
+		if answered {
+			return
+		}
+		reason = "is a duplicate"
+	}
+	log.Printf("Warning: discarding %s response that %s", p.op, reason)
+	clear(payload)
+}
+
+// send publishes the request and waits for its response, returning the
+// payload of the accepted response. Once the session's deadline has passed,
+// nothing is published.
+func (p *pendingRequest) send(payload []byte) ([]byte, error) {
+	s := p.session
+	timeout, pastDeadline, option := s.cfg.ResponseTimeout, false, " (-response-timeout)"
+	if p.wait > 0 {
+		timeout, option = p.wait, ""
+	}
+	if !s.deadline.IsZero() {
+		remaining := s.deadline.Sub(s.cfg.clock().Now())
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w after %s, not sending %s request", errDeadline, s.cfg.Deadline, p.op)
+		}
+		if remaining < timeout {
+			timeout, pastDeadline = remaining, true
+		}
+	}
+	p.sent.Store(true)
+	if err := s.transport.Publish(p.topic, s.cfg.qos(p.qos).Publish, payload); err != nil {
+		return nil, fmt.Errorf("failed to publish %s request: %w", p.op, err)
+	}
+	select {
+	case <-p.done:
+		if p.err != nil {
+			return nil, p.err
+		}
+		return p.payload, nil
+	case err := <-s.transport.Failed():
+		return nil, err
+	case <-s.cfg.clock().After(timeout):
+		if pastDeadline {
+			return nil, fmt.Errorf("%w after %s waiting for %s response", errDeadline, s.cfg.Deadline, p.op)
+		}
+		return nil, fmt.Errorf("waited %s%s: %w", timeout, option, p.timeout)
+	}
+}
+
+// errDeadline is returned instead of a request, or of its response, once
+// -deadline has passed
+var errDeadline = errors.New("provisioning deadline exceeded")
+
+// newClientToken returns a random token to correlate a request with its
+// response
+func newClientToken(random Random) string {
+	return randomHex(random, 16)
+}
+
+// responseToken returns the client token a response echoes
+func responseToken(payload []byte) string {
+	var response struct {
+		ClientToken string `json:"clientToken"`
+	}
+	json.Unmarshal(payload, &response)
+	return response.ClientToken
+}
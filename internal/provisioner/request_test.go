@@ -0,0 +1,158 @@
+package provisioner
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport is a connection to AWS IoT whose responses the test scripts
+type fakeTransport struct {
+	mu        sync.Mutex
+	handlers  map[string]MessageHandler
+	published []string // Topics, in order
+	// respond answers request number n (starting at 0) published to topic,
+	// through deliver, or leaves it unanswered
+	respond func(n int, topic string, deliver func(topic string, payload []byte))
+	failed  chan error
+}
+
+func newFakeTransport(respond func(n int, topic string, deliver func(topic string, payload []byte))) *fakeTransport {
+	return &fakeTransport{handlers: map[string]MessageHandler{}, respond: respond, failed: make(chan error, 1)}
+}
+
+func (f *fakeTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[topic] = handler
+	return nil
+}
+
+func (f *fakeTransport) Unsubscribe(topics ...string) error { return nil }
+
+func (f *fakeTransport) Publish(topic string, qos byte, payload []byte) error {
+	f.mu.Lock()
+	n := len(f.published)
+	f.published = append(f.published, topic)
+	f.mu.Unlock()
+	if f.respond != nil {
+		f.respond(n, topic, f.deliver)
+	}
+	return nil
+}
+
+// deliver hands a message to the handler subscribed to topic
+func (f *fakeTransport) deliver(topic string, payload []byte) {
+	f.mu.Lock()
+	handler := f.handlers[topic]
+	f.mu.Unlock()
+	if handler != nil {
+		handler(topic, payload)
+	}
+}
+
+// requests returns how many requests were published
+func (f *fakeTransport) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.published)
+}
+
+func (f *fakeTransport) IsConnected() bool                { return true }
+func (f *fakeTransport) Disconnect(quiesce time.Duration) {}
+func (f *fakeTransport) Endpoint() string                 { return "fake.iot.test" }
+func (f *fakeTransport) Failed() <-chan error             { return f.failed }
+
+// testSession returns a session over transport going by clock
+func testSession(transport Transport, clock Clock) *provisioningSession {
+	cfg := defaultConfig()
+	cfg.Clock = clock
+	cfg.ResponseTimeout = 10 * time.Second
+	cfg.Reconnect = Backoff{Min: time.Second, Max: time.Minute}
+	return newProvisioningSession(transport, cfg)
+}
+
+var errTestTimeout = errors.New("timeout waiting for test response")
+
+func TestPendingRequestDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		deadline  time.Duration // From the start, 0 for none
+		elapsed   time.Duration // Before the request is sent
+		wait      time.Duration // Of the exchange
+		answer    bool
+		wantWait  time.Duration // Until the request gives up
+		wantErr   error
+		wantNoPub bool
+	}{
+		{name: "answered", answer: true},
+		{name: "response timeout", wantWait: 10 * time.Second, wantErr: errTestTimeout},
+		{name: "exchange wait", wait: 3 * time.Second, wantWait: 3 * time.Second, wantErr: errTestTimeout},
+		{name: "deadline after response timeout", deadline: time.Minute, wantWait: 10 * time.Second, wantErr: errTestTimeout},
+		{name: "deadline before response timeout", deadline: time.Minute, elapsed: 55 * time.Second, wantWait: 5 * time.Second, wantErr: errDeadline},
+		{name: "deadline before exchange wait", deadline: time.Minute, elapsed: 58 * time.Second, wait: 3 * time.Second, wantWait: 2 * time.Second, wantErr: errDeadline},
+		{name: "deadline passed", deadline: time.Minute, elapsed: time.Minute, wantErr: errDeadline, wantNoPub: true},
+		{name: "deadline passed, answered", deadline: time.Minute, elapsed: 2 * time.Minute, answer: true, wantErr: errDeadline, wantNoPub: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(testStart)
+			transport := newFakeTransport(func(n int, topic string, deliver func(string, []byte)) {
+				if tt.answer {
+					deliver("test/accepted", []byte(`{"ok":true}`))
+				}
+			})
+			s := testSession(transport, clock)
+			if tt.deadline > 0 {
+				s.deadline = testStart.Add(tt.deadline)
+			}
+			request, err := s.expect(exchange{
+				op:        "test",
+				topic:     "test",
+				accepted:  "test/accepted",
+				rejected:  "test/rejected",
+				rejection: func(payload []byte) error { return errors.New(string(payload)) },
+				timeout:   errTestTimeout,
+				wait:      tt.wait,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(tt.elapsed)
+
+			type result struct {
+				payload []byte
+				err     error
+			}
+			done := make(chan result, 1)
+			go func() {
+				payload, err := request.send([]byte("{}"))
+				done <- result{payload, err}
+			}()
+			if tt.wantWait > 0 {
+				if wait := nextWait(t, clock); wait != tt.wantWait {
+					t.Errorf("request waits %s, want %s", wait, tt.wantWait)
+				}
+				clock.Advance(tt.wantWait - time.Nanosecond)
+				select {
+				case r := <-done:
+					t.Fatalf("request gave up early: %v", r.err)
+				case <-time.After(10 * time.Millisecond):
+				}
+				clock.Advance(time.Nanosecond)
+			}
+
+			r := <-done
+			if !errors.Is(r.err, tt.wantErr) {
+				t.Errorf("send error = %v, want %v", r.err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(r.payload) != `{"ok":true}` {
+				t.Errorf("send payload = %q", r.payload)
+			}
+			if published := transport.requests(); published != 1 && !tt.wantNoPub || published != 0 && tt.wantNoPub {
+				t.Errorf("%d requests published", published)
+			}
+		})
+	}
+}
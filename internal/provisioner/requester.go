@@ -0,0 +1,164 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Requester makes requests to MQTT APIs that answer on an accepted and a
+// rejected topic, such as device shadows, jobs, and an application's own
+// topics following the same pattern. It is the helper the provisioning flow
+// makes its requests with: the response topics are subscribed to before the
+// request is published, responses that arrive early, twice, or for another
+// client token are discarded, and a dropped connection or a response that
+// does not come fails the request. Requests are made one at a time, and the
+// response topics stay subscribed to until Close.
+type Requester struct {
+	mu      sync.Mutex
+	session *provisioningSession
+}
+
+// NewRequester returns a Requester over transport, which stays the caller's
+// to disconnect. Payloads are encoded with the codec of cfg.PayloadFormat,
+// requests are published and their responses subscribed to with cfg.QoS, and
+// responses are waited for for cfg.ResponseTimeout unless the request sets
+// its own timeout.
+func NewRequester(cfg Config, transport Transport) *Requester {
+	return &Requester{session: newProvisioningSession(transport, cfg)}
+}
+
+// Request is a request made with a Requester
+type Request struct {
+	Topic string // Topic the request is published to
+	// Topics of the responses, Topic + "/accepted" and Topic + "/rejected"
+	// if empty
+	Accepted, Rejected string
+	// Payload of the request, encoded with the codec unless it is a []byte
+	Payload interface{}
+	// Client token the responses must echo in their clientToken field, for
+	// JSON APIs that echo one, such as shadows and jobs. The payload has to
+	// carry it too.
+	ClientToken string
+	Timeout     time.Duration // Replaces cfg.ResponseTimeout if set
+}
+
+// ErrResponseTimeout is returned, wrapped, when no response to a request
+// arrives in time. The request may still have been carried out.
+var ErrResponseTimeout = errors.New("timeout waiting for response")
+
+// RequestRejectedError is returned when a request is answered on its rejected
+// topic
+type RequestRejectedError struct {
+	Topic   string // Of the request
+	Payload []byte // Error document of the rejected topic
+	codec   Codec
+}
+
+func (e *RequestRejectedError) Error() string {
+	return fmt.Sprintf("request to %s rejected: %s", e.Topic, e.codec.Text(e.Payload))
+}
+
+// Decode decodes the error document into v, such as a struct with the code
+// and message fields of a shadow or jobs error
+func (e *RequestRejectedError) Decode(v interface{}) error {
+	return e.codec.Unmarshal(e.Payload, v)
+}
+
+// Do makes a request and decodes the accepted response into response, unless
+// it is nil. A rejection is returned as a *RequestRejectedError.
+func (r *Requester) Do(request Request, response interface{}) error {
+	if request.Topic == "" {
+		return fmt.Errorf("request has no topic")
+	}
+	accepted, rejected := request.Accepted, request.Rejected
+	if accepted == "" {
+		accepted = request.Topic + "/accepted"
+	}
+	if rejected == "" {
+		rejected = request.Topic + "/rejected"
+	}
+	payload, ok := request.Payload.([]byte)
+	if !ok {
+		var err error
+		if payload, err = r.session.codec.Marshal(request.Payload); err != nil {
+			return fmt.Errorf("failed to marshal request to %s: %v", request.Topic, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.session
+	pending, err := s.expect(exchange{
+		op:       request.Topic,
+		topic:    request.Topic,
+		accepted: accepted,
+		rejected: rejected,
+		token:    request.ClientToken,
+		rejection: func(payload []byte) error {
+			return &RequestRejectedError{Topic: request.Topic, Payload: payload, codec: s.codec}
+		},
+		timeout: ErrResponseTimeout,
+		wait:    request.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+	answer, err := pending.send(payload)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	if err := s.codec.Unmarshal(answer, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response to %s: %v", request.Topic, err)
+	}
+	return nil
+}
+
+// Close unsubscribes from the response topics of the requests made, leaving
+// the transport connected
+func (r *Requester) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.session
+	if len(s.topics) == 0 || !s.transport.IsConnected() {
+		s.topics = nil
+		return nil
+	}
+	err := s.transport.Unsubscribe(s.topics...)
+	s.topics = nil
+	if err != nil {
+		return fmt.Errorf("failed to unsubscribe from response topics: %w", err)
+	}
+	return nil
+}
+
+// ConnectDevice connects to AWS IoT with the permanent identity of the device
+// provisioned into the configured output directory, using its thing name as
+// the client ID, as heartbeats and verification do. Other connections of the
+// device with the same client ID are taken over.
+func ConnectDevice(cfg Config) (Transport, error) {
+	identity, err := LoadDeviceIdentity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, fmt.Errorf("device is not provisioned")
+	}
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device certificates: %v", err)
+	}
+	if identity.Endpoint != "" {
+		cfg.Endpoints = append([]string{identity.Endpoint}, cfg.Endpoints...)
+	}
+	transport, err := connectTransport(cfg.withRandom(), cert, identity.ThingName)
+	if err != nil {
+		zeroPrivateKey(&cert)
+		return nil, err
+	}
+	return transport, nil
+}
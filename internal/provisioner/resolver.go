@@ -0,0 +1,302 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the addresses of an endpoint before it is dialed, instead
+// of the system's resolver. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Schemes of -dns-resolver
+const (
+	dnsOverHTTPS = "https" // DNS over HTTPS, RFC 8484
+	dnsOverTLS   = "tls"   // DNS over TLS, RFC 7858
+)
+
+// Port of DNS over TLS servers
+const dotPort = "853"
+
+// Largest DNS message a resolver may answer with
+const maxDNSMessage = 65535
+
+// secureResolver looks up addresses over DNS over HTTPS or TLS, reaching its
+// server at bootstrap addresses rather than resolving the server's name, so a
+// network that intercepts plain DNS can neither answer for the endpoint nor
+// for the server. The server's certificate is verified against its name.
+type secureResolver struct {
+	scheme     string
+	url        string // Of DNS over HTTPS
+	serverName string
+	port       string
+	bootstrap  []string
+	timeout    time.Duration
+}
+
+// newSecureResolver parses a -dns-resolver URL, https://host/path for DNS
+// over HTTPS or tls://host[:port] for DNS over TLS. A server named by host
+// name needs bootstrap addresses.
+func newSecureResolver(resolver string, bootstrap []string, timeout time.Duration) (*secureResolver, error) {
+	u, err := url.Parse(resolver)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS resolver %q: %v", resolver, err)
+	}
+	r := &secureResolver{scheme: u.Scheme, serverName: u.Hostname(), port: u.Port(), timeout: timeout}
+	switch u.Scheme {
+	case dnsOverHTTPS:
+		r.url = u.String()
+		if r.port == "" {
+			r.port = "443"
+		}
+	case dnsOverTLS:
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("invalid DNS resolver %q: DNS over TLS takes no path", resolver)
+		}
+		if r.port == "" {
+			r.port = dotPort
+		}
+	default:
+		return nil, fmt.Errorf("invalid DNS resolver %q: use https://host/path for DNS over HTTPS or tls://host[:port] for DNS over TLS", resolver)
+	}
+	if r.serverName == "" {
+		return nil, fmt.Errorf("invalid DNS resolver %q: no server", resolver)
+	}
+	for _, addr := range bootstrap {
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("DNS bootstrap address %q is not an IP address", addr)
+		}
+	}
+	r.bootstrap = bootstrap
+	if len(r.bootstrap) == 0 {
+		if net.ParseIP(r.serverName) == nil {
+			return nil, fmt.Errorf("DNS resolver %s is named by host name and needs -dns-bootstrap, as resolving it would go through the network's DNS", r.serverName)
+		}
+		r.bootstrap = []string{r.serverName}
+	}
+	return r, nil
+}
+
+// resolver returns the Resolver of the configuration, nil for the system's
+func (c Config) resolver() (Resolver, error) {
+	if c.Resolver != nil {
+		return c.Resolver, nil
+	}
+	if c.DNSResolver == "" {
+		return nil, nil
+	}
+	return newSecureResolver(c.DNSResolver, c.DNSBootstrap, c.ConnectTimeout)
+}
+
+// lookupHost looks host up with the configuration's resolver
+func (c Config) lookupHost(ctx context.Context, host string) ([]string, error) {
+	resolver, err := c.resolver()
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupHost(ctx, host)
+}
+
+// LookupHost returns the IPv4 and then the IPv6 addresses of host
+func (r *secureResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid host name %q: %v", host, err)
+	}
+	var addrs []string
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, err := r.query(ctx, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses")
+		}
+		return nil, fmt.Errorf("failed to look up %s with %s: %v", host, r.serverName, lastErr)
+	}
+	return addrs, nil
+}
+
+// query asks the server for the records of one type, returning the addresses
+// of the answer. CNAME records leading to them need no following, as the
+// server answers with the whole chain.
+func (r *secureResolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]string, error) {
+	// DNS over HTTPS asks for ID 0, so responses can be cached
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var response []byte
+	if r.scheme == dnsOverHTTPS {
+		response, err = r.exchangeHTTPS(ctx, query)
+	} else {
+		response, err = r.exchangeTLS(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %v", err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("server answered %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %v", err)
+	}
+	var addrs []string
+	for {
+		answer, err := parser.Answer()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS response: %v", err)
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return addrs, nil
+}
+
+// dialServer connects to the first bootstrap address of the server that
+// accepts the connection
+func (r *secureResolver) dialServer(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	var lastErr error
+	for _, addr := range r.bootstrap {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, r.port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// exchangeHTTPS posts the query to the DNS over HTTPS server
+func (r *secureResolver) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       func(ctx context.Context, _, _ string) (net.Conn, error) { return r.dialServer(ctx) },
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered HTTP %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxDNSMessage))
+}
+
+// exchangeTLS sends the query to the DNS over TLS server, both messages
+// prefixed with their length as over TCP
+func (r *secureResolver) exchangeTLS(ctx context.Context, query []byte) ([]byte, error) {
+	raw, err := r.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: r.serverName, MinVersion: tls.VersionTLS12})
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// dialAddresses connects to the first of the addresses of a host in the IP
+// family of network that accepts the connection
+func dialAddresses(ctx context.Context, dialer *net.Dialer, network string, addrs []string, host, port string) (net.Conn, error) {
+	lastErr := fmt.Errorf("no %s address for %s", network, host)
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if network == "tcp4" && ip.To4() == nil || network == "tcp6" && ip.To4() != nil {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialResolved connects to address (host:port), looking the host up with
+// resolver
+func dialResolved(ctx context.Context, dialer *net.Dialer, resolver Resolver, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddresses(ctx, dialer, network, addrs, host, port)
+}
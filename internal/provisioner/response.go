@@ -0,0 +1,82 @@
+package provisioner
+
+import (
+	"bytes"
+	"maps"
+	"reflect"
+	"strings"
+)
+
+// ResponseFields are the fields of the fleet provisioning responses that the
+// response types do not model, by response, as AWS IoT sent them. AWS IoT may
+// add fields to its responses, such as errors per resource from registration,
+// and they are kept rather than dropped.
+type ResponseFields struct {
+	CreateCertificate map[string]interface{} `json:"createCertificate,omitempty" yaml:"createCertificate,omitempty"`
+	RegisterThing     map[string]interface{} `json:"registerThing,omitempty" yaml:"registerThing,omitempty"`
+}
+
+// clone returns a copy of the fields, or nil if there are none
+func (f *ResponseFields) clone() *ResponseFields {
+	if f == nil || (f.CreateCertificate == nil && f.RegisterThing == nil) {
+		return nil
+	}
+	return &ResponseFields{CreateCertificate: maps.Clone(f.CreateCertificate), RegisterThing: maps.Clone(f.RegisterThing)}
+}
+
+// rawField is a field of a payload left encoded, so the fields a response
+// type models, the private key among them, are not decoded a second time
+type rawField []byte
+
+func (f *rawField) UnmarshalJSON(data []byte) error {
+	*f = bytes.Clone(data)
+	return nil
+}
+
+func (f *rawField) UnmarshalCBOR(data []byte) error {
+	*f = bytes.Clone(data)
+	return nil
+}
+
+// additionalFields decodes the fields of payload that the struct v points to
+// has no field for, returning nil if there are none
+func additionalFields(codec Codec, payload []byte, v interface{}) (map[string]interface{}, error) {
+	var raw map[string]rawField
+	if err := codec.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	known := fieldNames(reflect.TypeOf(v).Elem())
+	var fields map[string]interface{}
+	for name, data := range raw {
+		if known[name] {
+			clear(data)
+			continue
+		}
+		var value interface{}
+		if err := codec.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+// fieldNames returns the names the fields of a struct type are encoded under
+func fieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !field.IsExported():
+		case name == "":
+			names[field.Name] = true
+		default:
+			names[name] = true
+		}
+	}
+	return names
+}
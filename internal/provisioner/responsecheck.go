@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits of the responses AWS IoT sends, so a misbehaving or spoofed broker
+// can neither make the device hold unbounded data nor get garbage written as
+// its credentials. AWS IoT publishes no message larger than 128 KiB, issues a
+// leaf certificate with at most a few CAs after it, and ownership tokens of
+// a few kilobytes.
+const (
+	maxResponsePayload   = 128 << 10
+	maxResponsePacket    = maxResponsePayload + 4<<10 // With the topic and properties
+	maxCertificateBlocks = 4
+	maxOwnershipToken    = 8 << 10
+)
+
+// Certificate IDs are the SHA-256 of the certificate
+var certificateIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// InvalidResponseError is an accepted response AWS IoT would not send, such
+// as a certificate that does not parse or a key that does not match it.
+// Nothing of it is written.
+type InvalidResponseError struct {
+	Op     string // What was requested, such as "certificate creation"
+	Reason string
+}
+
+func (e *InvalidResponseError) Error() string {
+	return fmt.Sprintf("invalid %s response: %s", e.Op, e.Reason)
+}
+
+// checkCertificateResponse checks a certificate creation response before
+// anything of it is written: the certificate must be a chain of a few
+// parsable certificates whose leaf has the certificate ID, the ownership
+// token must be of sane length, and the key must be a single PEM block that
+// pairs with the certificate, or absent when a CSR was signed, whose key the
+// certificate must then certify.
+func checkCertificateResponse(r CreateCertificateResponse, csr []byte) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &InvalidResponseError{Op: "certificate creation", Reason: fmt.Sprintf(format, args...)}
+	}
+	if !certificateIDPattern.MatchString(r.CertificateID) {
+		return invalid("certificate ID %.80q is not a SHA-256", r.CertificateID)
+	}
+	switch token := r.CertificateOwnershipToken; {
+	case token == "":
+		return invalid("no certificate ownership token")
+	case len(token) > maxOwnershipToken:
+		return invalid("certificate ownership token is longer than %d bytes", maxOwnershipToken)
+	case strings.IndexFunc(token, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0:
+		return invalid("certificate ownership token is not printable")
+	}
+
+	blocks, rest, err := pemBlocks([]byte(r.CertificatePem), maxCertificateBlocks)
+	if err != nil {
+		return invalid("certificate: %v", err)
+	}
+	if len(blocks) == 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return invalid("certificate is not PEM")
+	}
+	var leaf *x509.Certificate
+	for i, block := range blocks {
+		if block.Type != "CERTIFICATE" {
+			return invalid("certificate holds a %s block", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return invalid("certificate %d does not parse: %v", i+1, err)
+		}
+		if i == 0 {
+			leaf = cert
+		}
+	}
+	if id := certificateID(leaf); id != r.CertificateID {
+		return invalid("certificate is %s, not %s", id, r.CertificateID)
+	}
+
+	if csr != nil {
+		if len(r.PrivateKey) > 0 {
+			return invalid("a private key came with the certificate of a CSR")
+		}
+		block, _ := pem.Decode(csr)
+		if block == nil {
+			return invalid("CSR is not PEM")
+		}
+		request, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return invalid("failed to parse CSR: %v", err)
+		}
+		if public, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(request.PublicKey) {
+			return invalid("certificate is not for the key of the CSR")
+		}
+		return nil
+	}
+	blocks, rest, err = pemBlocks(r.PrivateKey, 1)
+	clearBlocks(blocks)
+	if err != nil || len(blocks) != 1 || !strings.HasSuffix(blocks[0].Type, "PRIVATE KEY") || len(bytes.TrimSpace(rest)) > 0 {
+		return invalid("private key is not a single PEM private key")
+	}
+	pair, err := tls.X509KeyPair([]byte(r.CertificatePem), r.PrivateKey)
+	if err != nil {
+		return invalid("private key does not match certificate: %v", err)
+	}
+	zeroPrivateKey(&pair)
+	return nil
+}
+
+// checkRegisterResponse checks a thing registration response names a thing
+// as AWS IoT would. The name may be missing, see claimAndRegister.
+func checkRegisterResponse(r RegisterThingResponse) error {
+	if r.ThingName != "" && !thingNamePattern.MatchString(r.ThingName) {
+		return &InvalidResponseError{Op: "thing registration", Reason: fmt.Sprintf("thing name %.80q is not one AWS IoT allows", r.ThingName)}
+	}
+	return nil
+}
+
+// pemBlocks decodes up to limit PEM blocks of data, returning them and the
+// data after them, or an error if it holds more
+func pemBlocks(data []byte, limit int) ([]*pem.Block, []byte, error) {
+	var blocks []*pem.Block
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return blocks, data, nil
+		}
+		if len(blocks) == limit {
+			clearBlocks(blocks)
+			clear(block.Bytes)
+			return nil, nil, fmt.Errorf("more than %d PEM blocks", limit)
+		}
+		blocks, data = append(blocks, block), rest
+	}
+}
+
+// clearBlocks clears decoded PEM blocks, which may hold a private key
+func clearBlocks(blocks []*pem.Block) {
+	for _, block := range blocks {
+		clear(block.Bytes)
+	}
+}
@@ -0,0 +1,170 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Result output formats
+const (
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// Placeholder for the ownership token unless -include-ownership-token is set
+const redacted = "REDACTED"
+
+// Outcome of a successful provisioning run
+type ProvisioningResult struct {
+	ThingName                 string                 `json:"thingName" yaml:"thingName"`
+	CertificateID             string                 `json:"certificateId" yaml:"certificateId"`
+	CertificateArn            string                 `json:"certificateArn,omitempty" yaml:"certificateArn,omitempty"`
+	CertificateOwnershipToken string                 `json:"certificateOwnershipToken,omitempty" yaml:"certificateOwnershipToken,omitempty"`
+	CertificateNotAfter       *time.Time             `json:"certificateNotAfter,omitempty" yaml:"certificateNotAfter,omitempty"`
+	Endpoint                  string                 `json:"endpoint" yaml:"endpoint"`
+	CertificateFile           string                 `json:"certificateFile" yaml:"certificateFile"`
+	PrivateKeyFile            string                 `json:"privateKeyFile,omitempty" yaml:"privateKeyFile,omitempty"`
+	ChainFile                 string                 `json:"chainFile,omitempty" yaml:"chainFile,omitempty"`
+	BundleFile                string                 `json:"bundleFile,omitempty" yaml:"bundleFile,omitempty"`
+	IdentityFile              string                 `json:"identityFile" yaml:"identityFile"`
+	ReceiptFile               string                 `json:"receiptFile,omitempty" yaml:"receiptFile,omitempty"`
+	DeviceConfiguration       map[string]interface{} `json:"deviceConfiguration,omitempty" yaml:"deviceConfiguration,omitempty"`
+	AdditionalFields          *ResponseFields        `json:"additionalResponseFields,omitempty" yaml:"additionalResponseFields,omitempty"` // Response fields not modelled above
+	ClockSkewMS               *int64                 `json:"clockSkewMs,omitempty" yaml:"clockSkewMs,omitempty"`                           // Server time less the device's at registration, see servertime.go
+	DeviceConfigurationValue  interface{}            `json:"-" yaml:"-"`                                                                   // A pointer to the device configuration decoded into Config.ConfigType
+	Stages                    []StageTiming          `json:"stages,omitempty" yaml:"stages,omitempty"`                                     // Stages of the run that provisioned the device
+	Latencies                 *Latencies             `json:"latencies,omitempty" yaml:"latencies,omitempty"`
+	PostStepFailures          []PostStepFailure      `json:"postStepFailures,omitempty" yaml:"postStepFailures,omitempty"` // Of this run, not saved with the result
+}
+
+// Latencies of the network round-trips and persistence in the run that
+// provisioned the device, in milliseconds. Steps a resumed run skipped are 0.
+type Latencies struct {
+	TLSConnectMS        int64 `json:"tlsConnectMs" yaml:"tlsConnectMs"`               // TLS handshake and MQTT connect of the successful attempt
+	SubscribeMS         int64 `json:"subscribeMs" yaml:"subscribeMs"`                 // All response topic subscriptions
+	CreateCertificateMS int64 `json:"createCertificateMs" yaml:"createCertificateMs"` // Request to response
+	RegisterThingMS     int64 `json:"registerThingMs" yaml:"registerThingMs"`         // Request to response of the last attempt
+	PersistMS           int64 `json:"persistMs" yaml:"persistMs"`                     // Writing the credentials, identity, and state
+}
+
+func (l Latencies) String() string {
+	return fmt.Sprintf("tls-connect=%dms subscribe=%dms create-certificate=%dms register-thing=%dms persist=%dms",
+		l.TLSConnectMS, l.SubscribeMS, l.CreateCertificateMS, l.RegisterThingMS, l.PersistMS)
+}
+
+// How long a stage of the provisioning run took
+type StageTiming struct {
+	Stage      Stage     `json:"stage" yaml:"stage"`
+	StartedAt  time.Time `json:"startedAt" yaml:"startedAt"`
+	DurationMS int64     `json:"durationMs" yaml:"durationMs"`
+}
+
+// stageTimer records stage timings from progress reports. A stage lasts
+// until the next one is reported.
+type stageTimer struct {
+	stages    []StageTiming
+	latencies Latencies
+}
+
+func (t *stageTimer) record(stage Stage, _ string) {
+	now := time.Now().UTC()
+	if n := len(t.stages); n > 0 {
+		t.stages[n-1].DurationMS = now.Sub(t.stages[n-1].StartedAt).Milliseconds()
+	}
+	if stage != StageComplete {
+		t.stages = append(t.stages, StageTiming{Stage: stage, StartedAt: now})
+	}
+}
+
+// newRunResult describes the device a run just provisioned, including the
+// ownership token it registered with and the stage timings and latencies, and
+// persists it
+// so later runs return the same result. The token is only known to the run
+// that registered the thing.
+func newRunResult(cfg Config, state *provisioningState, ownershipToken string, timer *stageTimer) *ProvisioningResult {
+	result := newProvisioningResult(cfg, state)
+	result.Stages = timer.stages
+	if timer.latencies != (Latencies{}) {
+		latencies := timer.latencies
+		result.Latencies = &latencies
+		log.Printf("Latencies: %s", latencies)
+	}
+	if ownershipToken != "" {
+		result.CertificateOwnershipToken = redacted
+		if cfg.IncludeOwnershipToken {
+			result.CertificateOwnershipToken = ownershipToken
+		}
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		err = cfg.Files.write(cfg.outputPath(resultFile), data, cfg.IncludeOwnershipToken || holdsSecrets(result.DeviceConfiguration))
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save provisioning result: %v", err)
+	}
+	return result
+}
+
+// storedResult returns the result saved by the run that provisioned the
+// device, or one rebuilt from the state if there is none or the certificate
+// has since been rotated
+func storedResult(cfg Config, state *provisioningState) *ProvisioningResult {
+	data, err := cfg.Files.fs().ReadFile(cfg.outputPath(resultFile))
+	if err == nil {
+		var result ProvisioningResult
+		if err = json.Unmarshal(data, &result); err == nil && result.CertificateID == state.CertificateID {
+			// Numbers are decoded from the state, as the result holds them as
+			// float64, and the certificate's ARN may have been learned since
+			rebuilt := newProvisioningResult(cfg, state)
+			result.CertificateArn = rebuilt.CertificateArn
+			result.DeviceConfiguration = rebuilt.DeviceConfiguration
+			result.DeviceConfigurationValue = rebuilt.DeviceConfigurationValue
+			result.PostStepFailures = rebuilt.PostStepFailures
+			return &result
+		}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to load provisioning result: %v", err)
+	}
+	return newProvisioningResult(cfg, state)
+}
+
+// validateOutputFormat checks a result output format, empty meaning none
+func validateOutputFormat(format string) error {
+	switch format {
+	case "", OutputJSON, OutputYAML:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q: use %s or %s", format, OutputJSON, OutputYAML)
+	}
+}
+
+// writeResult writes the result as a single document in the given format
+func writeResult(w io.Writer, format string, result *ProvisioningResult) error {
+	switch format {
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case OutputYAML:
+		// yaml writes json.Number as a string
+		copied := *result
+		copied.DeviceConfiguration = yamlNumbers(result.DeviceConfiguration)
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(&copied); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return validateOutputFormat(format)
+	}
+}
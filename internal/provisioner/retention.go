@@ -0,0 +1,128 @@
+package provisioner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// AuditRetention bounds the audit log, so the onboarding history of a
+// long-lived gateway cannot fill its flash. Once the log outgrows a bound,
+// its oldest entries are pruned, and a log-pruned entry heading the log
+// carries the chain on from the last of them. Zero leaves a bound unset.
+type AuditRetention struct {
+	MaxEntries int           // Entries kept, the log-pruned entry aside
+	MaxAge     time.Duration // Age of the oldest entry kept
+	MaxBytes   int64         // Size of the log
+}
+
+func (r *AuditRetention) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&r.MaxEntries, "audit-max-entries", r.MaxEntries, "Most entries to keep in the audit log, pruning the oldest; 0 keeps all")
+	fs.DurationVar(&r.MaxAge, "audit-max-age", r.MaxAge, "Prune audit log entries older than this; 0 keeps them")
+	fs.Int64Var(&r.MaxBytes, "audit-max-bytes", r.MaxBytes, "Largest size of the audit log in bytes, pruning the oldest entries beyond it; 0 does not limit it")
+}
+
+func (r AuditRetention) enabled() bool {
+	return r.MaxEntries > 0 || r.MaxAge > 0 || r.MaxBytes > 0
+}
+
+// pruneAuditLog removes the oldest entries of the audit log beyond the
+// retention bounds, returning how many it removed. The newest entry is
+// always kept. The log is rewritten atomically, so a crash leaves either the
+// old or the pruned log. Entry ages are measured on clock, the one the
+// entries were appended with.
+func pruneAuditLog(path string, retention AuditRetention, files FilePermissions, clock Clock) (int, error) {
+	if !retention.enabled() {
+		return 0, nil
+	}
+	f, err := files.fs().OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	type line struct {
+		data  []byte
+		entry auditEntry
+	}
+	var head *auditEntry // Of a log pruned before
+	var lines []line
+	size := int64(0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return 0, fmt.Errorf("failed to prune audit log: entry %d is not valid JSON: %v", len(lines)+1, err)
+		}
+		if head == nil && len(lines) == 0 && entry.Event == AuditLogPruned {
+			head = &entry
+			continue
+		}
+		lines = append(lines, line{data: bytes.Clone(scanner.Bytes()), entry: entry})
+		size += int64(len(scanner.Bytes())) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	// The log-pruned entry is about this long, with its hashes and counts
+	const headSize = 256
+	cutoff := time.Time{}
+	if retention.MaxAge > 0 {
+		cutoff = clock.Now().Add(-retention.MaxAge)
+	}
+	// beyond reports whether the oldest entry kept, lines[drop], is beyond
+	// the bounds
+	beyond := func(drop int) bool {
+		return retention.MaxEntries > 0 && len(lines)-drop > retention.MaxEntries ||
+			retention.MaxAge > 0 && lines[drop].entry.Time.Before(cutoff) ||
+			retention.MaxBytes > 0 && size+headSize > retention.MaxBytes
+	}
+	drop := 0
+	for drop < len(lines)-1 && beyond(drop) {
+		size -= int64(len(lines[drop].data)) + 1
+		drop++
+	}
+	if drop == 0 {
+		return 0, nil
+	}
+
+	marker := auditEntry{Time: clock.Now().UTC(), Event: AuditLogPruned, Pruned: drop, Prev: lines[drop-1].entry.Hash}
+	if head != nil {
+		marker.Pruned += head.Pruned
+	}
+	if marker.Hash, err = marker.hash(); err != nil {
+		return 0, fmt.Errorf("failed to hash audit log entry: %v", err)
+	}
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal audit log entry: %v", err)
+	}
+	data = append(data, '\n')
+	for _, l := range lines[drop:] {
+		data = append(append(data, l.data...), '\n')
+	}
+	if err := files.write(path, data, true); err != nil {
+		return 0, fmt.Errorf("failed to prune audit log: %v", err)
+	}
+	auditHead, err := loadAuditHead(path, files)
+	if err != nil {
+		return drop, err
+	}
+	if auditHead == nil {
+		return drop, nil
+	}
+	auditHead.Pruned = marker.Hash
+	return drop, auditHead.save(path, files)
+}
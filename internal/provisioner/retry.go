@@ -0,0 +1,38 @@
+package provisioner
+
+import (
+	"errors"
+	"time"
+)
+
+// RetryPolicy is how the request of one provisioning stage is retried within
+// a run, over the same connection, when its response times out or AWS IoT
+// rejects it with an error that is not terminal, such as throttling or an
+// internal failure (see ClassifyError). Terminal rejections, such as the
+// pre-provisioning hook of the template refusing the device, fail at once.
+type RetryPolicy struct {
+	Retries int           // Requests after the first, 0 to fail at once
+	Delay   time.Duration // Before the first retry, doubling up to the reconnect maximum
+}
+
+// retryable reports whether a request that failed with err may be sent again,
+// timeout being the error its response timing out wraps
+func (p RetryPolicy) retryable(err, timeout error) bool {
+	if errors.Is(err, timeout) {
+		return true
+	}
+	var rejection *RejectedError
+	return errors.As(err, &rejection) && rejection.Class() != ErrorTerminal
+}
+
+// delay returns how long to wait before retry number attempt (starting at 0)
+// after err. Throttled requests wait as throttled runs do, see
+// Backoff.ThrottledDelay.
+func (p RetryPolicy) delay(cfg Config, attempt int, err error) time.Duration {
+	if isThrottled(err) {
+		return cfg.Reconnect.ThrottledDelay()
+	}
+	backoff := cfg.Reconnect
+	backoff.Min, backoff.Max = p.Delay, max(p.Delay, cfg.Reconnect.Max)
+	return backoff.Delay(attempt)
+}
@@ -0,0 +1,153 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Responses to a certificate creation request
+const (
+	respondNone      = ""
+	respondAccepted  = "accepted" // With a certificate from testCertificate
+	respondInternal  = `{"statusCode":500,"errorCode":"InternalFailure","errorMessage":"internal failure"}`
+	respondThrottled = `{"statusCode":429,"errorCode":"ThrottlingException","errorMessage":"rate exceeded"}`
+	respondInvalid   = `{"statusCode":400,"errorCode":"InvalidPayload","errorMessage":"invalid payload"}`
+)
+
+// sleepRecorder is a ManualClock recording how long it is slept on
+type sleepRecorder struct {
+	*ManualClock
+	slept []time.Duration
+}
+
+func (c *sleepRecorder) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.ManualClock.Sleep(d)
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "timeout", err: errCreateTimeout, want: true},
+		{name: "other timeout", err: errRegisterTimeout},
+		{name: "internal failure", err: &RejectedError{StatusCode: 500, ErrorCode: "InternalFailure"}, want: true},
+		{name: "throttled", err: &RejectedError{StatusCode: 429}, want: true},
+		{name: "terminal", err: &RejectedError{StatusCode: 400, ErrorCode: "InvalidPayload"}},
+		{name: "deadline", err: errDeadline},
+		{name: "connection", err: errors.New("connection lost")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (RetryPolicy{Retries: 3}).retryable(tt.err, errCreateTimeout); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCreateCertificateWithRetry plays the responses of each request on a
+// ManualClock and checks how long the run waits before each retry
+func TestCreateCertificateWithRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		responses  []string
+		wantDelays []time.Duration // Before each retry
+		wantErr    error           // Or a rejection if wantClass is set
+		wantClass  ErrorClass
+	}{
+		{
+			name:      "accepted",
+			policy:    RetryPolicy{Retries: 2, Delay: 2 * time.Second},
+			responses: []string{respondAccepted},
+		},
+		{
+			name:       "retried after a timeout and a failure",
+			policy:     RetryPolicy{Retries: 2, Delay: 2 * time.Second},
+			responses:  []string{respondNone, respondInternal, respondAccepted},
+			wantDelays: []time.Duration{2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:       "throttled waits as throttled runs do",
+			policy:     RetryPolicy{Retries: 1, Delay: 2 * time.Second},
+			responses:  []string{respondThrottled, respondAccepted},
+			wantDelays: []time.Duration{time.Minute},
+		},
+		{
+			name:       "retries exhausted",
+			policy:     RetryPolicy{Retries: 1, Delay: 2 * time.Second},
+			responses:  []string{respondNone, respondNone},
+			wantDelays: []time.Duration{2 * time.Second},
+			wantErr:    errCreateTimeout,
+		},
+		{
+			name:      "no retries",
+			responses: []string{respondInternal},
+			wantClass: ErrorRetryable,
+		},
+		{
+			name:      "terminal rejection",
+			policy:    RetryPolicy{Retries: 3, Delay: 2 * time.Second},
+			responses: []string{respondInvalid},
+			wantClass: ErrorTerminal,
+		},
+		{
+			name:       "delay capped by the reconnect maximum",
+			policy:     RetryPolicy{Retries: 3, Delay: 40 * time.Second},
+			responses:  []string{respondInternal, respondInternal, respondInternal, respondAccepted},
+			wantDelays: []time.Duration{40 * time.Second, time.Minute, time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &sleepRecorder{ManualClock: NewManualClock(testStart)}
+			certPEM, keyPEM, cert := testCertificate(t, testStart, testStart.Add(365*24*time.Hour))
+			accepted, _ := json.Marshal(map[string]string{
+				"certificateId":             certificateID(cert),
+				"certificatePem":            string(certPEM),
+				"privateKey":                string(keyPEM),
+				"certificateOwnershipToken": "token",
+			})
+			transport := newFakeTransport(func(n int, topic string, deliver func(string, []byte)) {
+				switch response := tt.responses[n]; response {
+				case respondNone:
+				case respondAccepted:
+					deliver(topic+"/accepted", accepted)
+				default:
+					deliver(topic+"/rejected", []byte(response))
+				}
+			})
+			s := testSession(transport, clock)
+			// Throttled retries wait the whole reconnect backoff
+			s.cfg.Reconnect.Min = s.cfg.Reconnect.Max
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.createCertificateWithRetry(nil, tt.policy)
+				done <- err
+			}()
+			err := advanceUntilDone(t, clock.ManualClock, done)
+			if !slices.Equal(clock.slept, tt.wantDelays) {
+				t.Errorf("retried after %v, want %v", clock.slept, tt.wantDelays)
+			}
+			switch {
+			case tt.wantClass != "":
+				var rejection *RejectedError
+				if !errors.As(err, &rejection) || rejection.Class() != tt.wantClass {
+					t.Errorf("error = %v, want a %s rejection", err, tt.wantClass)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if published := transport.requests(); published != len(tt.responses) {
+				t.Errorf("%d requests published, want %d", published, len(tt.responses))
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// rotateCertificate replaces the device certificate with a new one. It connects
+// with the current permanent identity, creates a certificate, and registers it
+// through the provisioning template, which attaches it to the existing thing.
+// The files on disk are only replaced once registration succeeded; the old
+// certificate stays active in AWS IoT. With cfg.RotationOverlap the new
+// certificate must connect before the files are replaced, and the old one is
+// kept next to it until retirePreviousCertificate revokes it.
+func rotateCertificate(cfg Config, progress ProgressFunc) error {
+	certFile := cfg.outputPath(permanentCertFile)
+	keyFile := cfg.outputPath(permanentKeyFile)
+	identityPath := cfg.outputPath(identityFile)
+
+	if err := checkDestination(cfg.Files.fs(), cfg.OutputDir); err != nil {
+		return err
+	}
+	// Not while a run provisions, or watchCredentials checks, the credentials
+	unlock, err := lockOutputDir(cfg)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := recoverDeviceCredentials(cfg); err != nil {
+		return err
+	}
+	identity, err := loadIdentity(identityPath, cfg.Files)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return fmt.Errorf("device is not provisioned, nothing to rotate")
+	}
+
+	// A certificate still overlapping from the last rotation would be forgotten
+	if cfg.RotationOverlap > 0 {
+		if err := retirePreviousCertificate(cfg, true); err != nil {
+			return err
+		}
+	}
+
+	params := templateParameters(cfg)
+	if cfg.CheckParameters {
+		if err := checkTemplateParameters(context.Background(), cfg, params); err != nil {
+			return err
+		}
+	}
+
+	progress.report(StageConnect, "Connecting with the current device certificate")
+	cert, err := cfg.permanentIdentity().TLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load device certificates: %w", err)
+	}
+	defer zeroPrivateKey(&cert)
+
+	// Prefer the endpoint that provisioned the device
+	if identity.Endpoint != "" {
+		cfg.Endpoints = append([]string{identity.Endpoint}, cfg.Endpoints...)
+	}
+	transport, err := connectTransport(cfg, cert, identity.ThingName)
+	if err != nil {
+		return fmt.Errorf("failed to create MQTT client: %w", err)
+	}
+	session := newProvisioningSession(transport, cfg)
+	closed := false
+	defer func() {
+		if !closed {
+			session.close()
+		}
+	}()
+
+	progress.report(StageCreateCertificate, "Creating replacement certificate")
+	certResponse, err := session.createCertificateWithRetry(nil, cfg.CreateRetry)
+	if err != nil {
+		return fmt.Errorf("certificate creation failed: %w", err)
+	}
+	log.Printf("Created replacement certificate %s", certResponse.CertificateID)
+	if notAfter := certificateNotAfter([]byte(certResponse.CertificatePem)); notAfter != nil {
+		log.Printf("Replacement certificate is valid until %s", notAfter.Format(time.RFC3339))
+	}
+	defer certResponse.PrivateKey.zero()
+
+	progress.report(StageRegisterThing, "Registering replacement certificate")
+	registerResponse, err := session.registerThingWithRetry(certResponse, params, cfg.RegisterRetry)
+	if err != nil {
+		return fmt.Errorf("thing registration failed: %w", err)
+	}
+	if registerResponse.ThingName == "" {
+		registerResponse.ThingName = identity.ThingName
+	}
+
+	if cfg.RotationOverlap > 0 {
+		// Verification connects with the client ID of the session
+		session.close()
+		closed = true
+		progress.report(StageVerify, "Verifying replacement certificate")
+		replacement, err := tls.X509KeyPair([]byte(certResponse.CertificatePem), certResponse.PrivateKey)
+		if err == nil {
+			err = verifyPermanentIdentity(cfg, replacement, registerResponse.ThingName, nil)
+			zeroPrivateKey(&replacement)
+		}
+		if err != nil {
+			if revoked, revokeErr := revokeCertificate(cfg, certResponse.CertificateID); revokeErr != nil || !revoked {
+				log.Printf("Warning: replacement certificate %s is left active in AWS IoT", certResponse.CertificateID)
+			}
+			return fmt.Errorf("replacement certificate %s failed verification, keeping %s: %w", certResponse.CertificateID, identity.CertificateID, err)
+		}
+		// Keep the old credentials until the overlap ends
+		for _, file := range []struct {
+			from, to string
+			secret   bool
+		}{{certFile, cfg.outputPath(previousCertFile), false}, {keyFile, cfg.outputPath(previousKeyFile), true}} {
+			data, err := cfg.Files.fs().ReadFile(file.from)
+			if err == nil {
+				err = cfg.Files.write(file.to, data, file.secret)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to keep the replaced credentials: %v", err)
+			}
+		}
+	}
+
+	previous := identity.CertificateID
+	identity.ThingName = registerResponse.ThingName
+	identity.CertificateID = certResponse.CertificateID
+	identity.CertificateFingerprint = certificateFingerprint([]byte(certResponse.CertificatePem))
+	identity.CertificateNotAfter = certificateNotAfter([]byte(certResponse.CertificatePem))
+	identity.Endpoint = transport.Endpoint()
+	identity.ProvisionedAt = cfg.clock().Now().UTC()
+	// The identity names the certificate, so it is staged and committed with
+	// the credentials: a failure or crash leaves the old three or the new
+	if err := saveIdentity(identityPath+stagedSuffix, *identity, cfg.Files); err != nil {
+		return err
+	}
+	if err := cfg.Files.stageKeyPair(certFile, keyFile, []byte(certResponse.CertificatePem), certResponse.PrivateKey, identityPath); err != nil {
+		return err
+	}
+	if state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock()); err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		state.CertificateID = certResponse.CertificateID
+		state.CertificateArn = ""
+		state.AttachedPolicies = nil
+		state.Endpoint = identity.Endpoint
+		if cfg.RotationOverlap > 0 {
+			retireAfter := cfg.clock().Now().Add(cfg.RotationOverlap).UTC()
+			state.PreviousCertificateID = previous
+			state.RetirePreviousAfter = &retireAfter
+			log.Printf("Keeping certificate %s active until %s", previous, retireAfter.Format(time.RFC3339))
+		}
+		if err := state.save(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		// The template attaches its policies, the next run retries these
+		if err := attachPolicies(cfg, state); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if err := cfg.Files.finishKeyPair(certFile, keyFile, identityPath); err != nil {
+		return err
+	}
+	if err := writeChain(cfg, []byte(certResponse.CertificatePem), certResponse.PrivateKey); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	recordAudit(cfg, auditEntry{Event: AuditCertificateRotated, CertificateID: certResponse.CertificateID, ThingName: identity.ThingName})
+
+	progress.report(StageComplete, fmt.Sprintf("Rotated certificate %s to %s", previous, certResponse.CertificateID))
+	return nil
+}
+
+// recoverDeviceCredentials completes or discards a rotation of the device
+// credentials and identity that was interrupted, see stageKeyPair
+func recoverDeviceCredentials(cfg Config) error {
+	return cfg.Files.recoverKeyPair(cfg.outputPath(permanentCertFile), cfg.outputPath(permanentKeyFile), cfg.outputPath(identityFile))
+}
+
+// retirePreviousCertificate revokes the certificate replaced by the last
+// rotation once its overlap has ended, or right away with now, and removes its
+// credentials. Missing AWS credentials leave it for the next try, except with
+// now, which leaves it active in AWS IoT for an operator to revoke.
+func retirePreviousCertificate(cfg Config, now bool) error {
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil || state.PreviousCertificateID == "" || !now && !state.retirePreviousDue(cfg.clock().Now()) {
+		return err
+	}
+	previous := state.PreviousCertificateID
+	revoked := false
+	if previous != state.CertificateID {
+		if revoked, err = revokeCertificate(cfg, previous); err != nil {
+			return err
+		}
+		if !revoked && !now {
+			return nil
+		}
+		if !revoked {
+			log.Printf("Warning: certificate %s replaced by rotation is left active in AWS IoT", previous)
+		}
+	}
+
+	fsys := cfg.Files.fs()
+	for _, name := range []string{previousKeyFile, previousCertFile} {
+		path := cfg.outputPath(name)
+		if _, err := fsys.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := shredFile(fsys, path); err != nil {
+			return err
+		}
+	}
+	state.PreviousCertificateID = ""
+	state.RetirePreviousAfter = nil
+	if err := state.save(); err != nil {
+		return err
+	}
+	if revoked {
+		log.Printf("Revoked certificate %s replaced by rotation", previous)
+		recordAudit(cfg, auditEntry{Event: AuditCertificateRevoked, CertificateID: previous, ThingName: state.ThingName})
+	}
+	return nil
+}
+
+// retirePreviousDue reports whether a certificate replaced by rotation is kept
+// and its overlap has ended
+func (s *provisioningState) retirePreviousDue(now time.Time) bool {
+	return s.PreviousCertificateID != "" && (s.RetirePreviousAfter == nil || !now.Before(*s.RetirePreviousAfter))
+}
+
+// How often rotateBeforeExpiry looks at the certificate while rotation is not
+// due, so a certificate replaced in the meantime is noticed, and how long it
+// waits to try again after a failed rotation
+const (
+	rotationCheckInterval = time.Hour
+	rotationRetryInterval = 15 * time.Minute
+)
+
+// rotateBeforeExpiry rotates the device certificate when it is within before
+// of the end of its validity. The end is read from the certificate itself, as
+// AWS IoT or a certificate provider issued it, and a certificate valid for
+// less than twice before is rotated halfway through instead, so a shorter
+// lived certificate is not rotated again as soon as it is issued.
+func (s *apiServer) rotateBeforeExpiry(before time.Duration) {
+	clock := s.cfg.clock()
+	for {
+		s.retirePrevious()
+		due, err := rotationDue(s.cfg, before)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		if due == nil {
+			clock.Sleep(rotationCheckInterval)
+			continue
+		}
+		if wait := due.Sub(clock.Now()); wait > 0 {
+			clock.Sleep(min(wait, rotationCheckInterval))
+			continue
+		}
+		if err := s.begin(); err != nil {
+			clock.Sleep(rotationRetryInterval) // Provisioning or rotating already
+			continue
+		}
+		log.Printf("Device certificate is due for rotation since %s", due.Format(time.RFC3339))
+		sdNotify("STATUS=Rotating device certificate before it expires")
+		err = rotateCertificate(s.cfg, nil)
+		s.end(err)
+		if err != nil {
+			clock.Sleep(rotationRetryInterval)
+		}
+	}
+}
+
+// retirePrevious retires the certificate replaced by the last rotation once
+// its overlap has ended, unless an operation runs
+func (s *apiServer) retirePrevious() {
+	state, err := loadState(s.cfg.outputPath(stateFile), s.cfg.Files, s.cfg.clock())
+	if err != nil || !state.retirePreviousDue(s.cfg.clock().Now()) {
+		return
+	}
+	if err := s.begin(); err != nil {
+		return
+	}
+	s.end(retirePreviousCertificate(s.cfg, false))
+}
+
+// rotationDue returns when the certificate of a provisioned device is due
+// for rotation, nil if the device is not provisioned
+func rotationDue(cfg Config, before time.Duration) (*time.Time, error) {
+	cert, err := deviceCertificate(cfg)
+	if cert == nil {
+		return nil, err
+	}
+	lead := min(before, cert.NotAfter.Sub(cert.NotBefore)/2)
+	due := cert.NotAfter.Add(-lead)
+	return &due, nil
+}
+
+// deviceCertificate returns the certificate of a provisioned device, nil if
+// the device is not provisioned
+func deviceCertificate(cfg Config) (*x509.Certificate, error) {
+	state, err := loadState(cfg.outputPath(stateFile), cfg.Files, cfg.clock())
+	if err != nil || state.State != FlowVerified {
+		return nil, err
+	}
+	certPEM, err := cfg.Files.fs().ReadFile(cfg.outputPath(permanentCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device certificate: %v", err)
+	}
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,33 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// revokeCertificate revokes a certificate in AWS IoT, so it can no longer
+// connect or be activated again. A certificate already deleted counts as
+// revoked. It reports false, revoking nothing, when AWS credentials are
+// missing.
+func revokeCertificate(cfg Config, certificateID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		log.Printf("Warning: not revoking certificate %s yet: %v", certificateID, err)
+		return false, nil
+	}
+	_, err = client.UpdateCertificate(ctx, &iot.UpdateCertificateInput{CertificateId: aws.String(certificateID), NewStatus: types.CertificateStatusRevoked})
+	if err != nil && !isNotFound(err) {
+		return false, fmt.Errorf("failed to revoke certificate %s: %v", certificateID, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate valid from notBefore to
+// notAfter, and its key, PEM encoded
+func testCertificate(t *testing.T, notBefore, notAfter time.Time) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "AWS IoT Certificate"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), cert
+}
+
+// provisionedConfig returns the configuration of a device in memory
+// provisioned with a certificate valid for validity from testStart
+func provisionedConfig(t *testing.T, state FlowState, validity time.Duration) Config {
+	t.Helper()
+	files, mem := memoryFiles()
+	cfg := defaultConfig()
+	cfg.Files = files
+	provisioned, _ := loadState(cfg.outputPath(stateFile), files, cfg.clock())
+	provisioned.State = state
+	if err := provisioned.save(); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, _ := testCertificate(t, testStart, testStart.Add(validity))
+	mem.WriteFile(cfg.outputPath(permanentCertFile), certPEM, 0644)
+	return cfg
+}
+
+func TestRotationDue(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name     string
+		state    FlowState
+		validity time.Duration
+		before   time.Duration
+		want     time.Duration // From testStart, 0 for not due
+	}{
+		{name: "long lived", state: FlowVerified, validity: 365 * day, before: 30 * day, want: 335 * day},
+		{name: "short lived", state: FlowVerified, validity: 20 * day, before: 30 * day, want: 10 * day},
+		{name: "exactly twice before", state: FlowVerified, validity: 60 * day, before: 30 * day, want: 30 * day},
+		{name: "not verified", state: FlowRegistered, validity: 365 * day, before: 30 * day},
+		{name: "not provisioned", state: FlowUnprovisioned, validity: 365 * day, before: 30 * day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := provisionedConfig(t, tt.state, tt.validity)
+			due, err := rotationDue(cfg, tt.before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == 0 && due != nil:
+				t.Errorf("rotation due at %s, want none", due)
+			case tt.want != 0 && due == nil:
+				t.Error("rotation not due")
+			case tt.want != 0 && !due.Equal(testStart.Add(tt.want)):
+				t.Errorf("rotation due %s after the start, want %s", due.Sub(testStart), tt.want)
+			}
+		})
+	}
+
+	cfg := provisionedConfig(t, FlowVerified, 365*day)
+	cfg.Files.fs().Remove(cfg.outputPath(permanentCertFile))
+	if _, err := rotationDue(cfg, 30*day); err == nil {
+		t.Error("rotationDue without a certificate succeeded")
+	}
+}
+
+func TestRetirePreviousDue(t *testing.T) {
+	after := testStart.Add(time.Hour)
+	tests := []struct {
+		name  string
+		state provisioningState
+		now   time.Time
+		want  bool
+	}{
+		{name: "no previous certificate", now: after},
+		{name: "no overlap", state: provisioningState{PreviousCertificateID: "old"}, now: testStart, want: true},
+		{name: "overlapping", state: provisioningState{PreviousCertificateID: "old", RetirePreviousAfter: &after}, now: after.Add(-time.Nanosecond)},
+		{name: "overlap ended", state: provisioningState{PreviousCertificateID: "old", RetirePreviousAfter: &after}, now: after, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.retirePreviousDue(tt.now); got != tt.want {
+				t.Errorf("retirePreviousDue = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRotateBeforeExpiry follows the rotation loop of serve on a ManualClock
+// up to a certificate being due, while another operation keeps it from
+// rotating
+func TestRotateBeforeExpiry(t *testing.T) {
+	const before = 30 * 24 * time.Hour
+	validity := 365 * 24 * time.Hour
+	due := testStart.Add(validity - before)
+
+	cfg := provisionedConfig(t, FlowVerified, validity)
+	clock := NewManualClock(due.Add(-90 * time.Minute))
+	cfg.Clock = clock
+	server := newAPIServer(cfg)
+	server.running = true
+	go server.rotateBeforeExpiry(before)
+
+	// Looks at the certificate every hour until it is due, then retries
+	// while the other operation runs
+	for i, want := range []time.Duration{time.Hour, 30 * time.Minute, rotationRetryInterval, rotationRetryInterval} {
+		if wait := nextWait(t, clock); wait != want {
+			t.Fatalf("wait %d is %s, want %s", i+1, wait, want)
+		}
+		clock.Advance(want)
+	}
+	if !server.busy() {
+		t.Error("rotation ended the other operation")
+	}
+}
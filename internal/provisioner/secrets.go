@@ -0,0 +1,90 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables that take precedence over the credential files
+const (
+	envClaimCert = "CLAIM_CERT"
+	envClaimKey  = "CLAIM_KEY"
+	envRootCA    = "ROOT_CA"
+)
+
+// PEM data and where it was read from
+type secret struct {
+	data   []byte
+	source string // file path or $VARIABLE, used in messages
+	file   bool
+	fs     FileSystem // Holding the file
+	// Key reference, such as pkcs11:... or tpm2:0x81000001, given in place
+	// of a key file, and the signer it resolves to (see secret.resolve)
+	ref    string
+	signer crypto.Signer
+}
+
+// newSecret returns a secret read from the environment variable env if it is
+// set, otherwise from path in fsys. Either may hold PEM or base64 encoded PEM,
+// the form secrets often take in Kubernetes and ECS.
+func newSecret(fsys FileSystem, env, path string) secret {
+	if _, ok := os.LookupEnv(env); ok {
+		return secret{source: "$" + env}
+	}
+	return secret{source: path, file: true, fs: fsys}
+}
+
+// readSecret reads a secret (see newSecret). An empty path with the variable
+// unset returns no data.
+func readSecret(fsys FileSystem, env, path string) (secret, error) {
+	s := newSecret(fsys, env, path)
+	return s, s.read()
+}
+
+// read loads the secret's data
+func (s *secret) read() error {
+	var raw []byte
+	if !s.file {
+		raw = []byte(os.Getenv(strings.TrimPrefix(s.source, "$")))
+	} else if s.source == "" {
+		return nil
+	} else if keyScheme(s.source) != "" {
+		s.ref = strings.TrimSpace(s.source)
+		s.source = redactKeyReference(s.ref)
+		return nil
+	} else {
+		var err error
+		if raw, err = s.fs.ReadFile(s.source); err != nil {
+			return fmt.Errorf("cannot read %s: %v", s.source, err)
+		}
+	}
+
+	if keyScheme(string(raw)) != "" {
+		s.ref = strings.TrimSpace(string(raw))
+		return nil
+	}
+	data, err := decodePEM(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.source, err)
+	}
+	s.data = data
+	return nil
+}
+
+// decodePEM returns data as is if it is PEM, and decodes it otherwise
+func decodePEM(data []byte) ([]byte, error) {
+	// Encrypted claim envelopes are opened by the caller, see secret.open
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) || isEnvelope(data) {
+		return data, nil
+	}
+	// Base64 blobs are often wrapped or carry a trailing newline
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("neither PEM nor base64 encoded PEM")
+	}
+	return decoded, nil
+}
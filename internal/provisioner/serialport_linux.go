@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Baud rates accepted by -baud
+var baudRates = map[int]uint32{
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+// openSerialPort opens a serial device in raw mode, 8N1, at the given baud rate
+func openSerialPort(path string, baud int) (*os.File, error) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	port, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	termios, err := unix.IoctlGetTermios(int(port.Fd()), unix.TCGETS)
+	if err != nil {
+		port.Close()
+		return nil, fmt.Errorf("%s is not a serial port: %v", path, err)
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CBAUD
+	termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+	termios.Ispeed = speed
+	termios.Ospeed = speed
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(port.Fd()), unix.TCSETS, termios); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("failed to configure %s: %v", path, err)
+	}
+	return port, nil
+}
+
+// serial_rs485 of the kernel, see Documentation/driver-api/serial/serial-rs485.rst
+type serialRS485 struct {
+	Flags              uint32
+	DelayRTSBeforeSend uint32 // Milliseconds
+	DelayRTSAfterSend  uint32
+	Padding            [5]uint32
+}
+
+const (
+	serRS485Enabled   = 1 << 0
+	serRS485RTSOnSend = 1 << 1
+)
+
+// enableRS485 puts a serial port in RS-485 half-duplex mode: the driver
+// raises RTS to enable the transceiver's transmitter while sending, and
+// lowers it afterwards to release the bus
+func enableRS485(port *os.File) error {
+	rs485 := serialRS485{Flags: serRS485Enabled | serRS485RTSOnSend}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, port.Fd(), uintptr(unix.TIOCSRS485), uintptr(unsafe.Pointer(&rs485)))
+	if errno != 0 {
+		return fmt.Errorf("failed to enable RS-485 on %s: %v", port.Name(), errno)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package provisioner
+
+import (
+	"fmt"
+	"os"
+)
+
+// openSerialPort is only implemented on Linux
+func openSerialPort(path string, baud int) (*os.File, error) {
+	return nil, fmt.Errorf("serial ports are only supported on Linux")
+}
+
+// enableRS485 is only implemented on Linux
+func enableRS485(port *os.File) error {
+	return fmt.Errorf("RS-485 is only supported on Linux")
+}
@@ -0,0 +1,250 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Provisioning states reported by the local API
+const (
+	StateUnprovisioned = "unprovisioned"
+	StatePending       = "pending"     // Provisioning started, not finished
+	StateQuarantined   = "quarantined" // Refusing to provision after repeated terminal failures
+	StateLockedOut     = "locked-out"  // Refusing to provision after using up the attempt budget
+	StateProvisioning  = "provisioning"
+	StateProvisioned   = "provisioned"
+)
+
+var errBusy = errors.New("provisioning already in progress")
+
+// Status document served on /status
+type Status struct {
+	State         string `json:"state"`
+	FlowState     string `json:"flowState"` // Persisted state of the provisioning flow
+	ThingName     string `json:"thingName,omitempty"`
+	CertificateID string `json:"certificateId,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	// Stable code of the last operation's error, see ErrorCodeOf
+	LastErrorCode string `json:"lastErrorCode,omitempty"`
+	// Quarantine end, RFC 3339, while the state is quarantined
+	QuarantinedUntil string `json:"quarantinedUntil,omitempty"`
+	// Lockout end, RFC 3339, while the state is locked out
+	LockedOutUntil string `json:"lockedOutUntil,omitempty"`
+	// End of the device certificate's validity, RFC 3339, once provisioned
+	CertificateNotAfter string `json:"certificateNotAfter,omitempty"`
+	// MQTT clients found wedged and abandoned since serve started
+	Wedges int64 `json:"wedges,omitempty"`
+}
+
+// Local API for other on-device processes: it reports whether the device is
+// onboarded and can trigger provisioning. Only one operation runs at a time.
+type apiServer struct {
+	cfg Config
+
+	mu            sync.Mutex
+	running       bool
+	lastError     string
+	lastErrorCode ErrorCode
+
+	heartbeats *heartbeatPublisher // Nil unless serve publishes heartbeats
+
+	// Raises an alert once alertAfter operations in a row failed, nil
+	// unless serve sends alerts
+	alerts     *alerter
+	alertAfter int
+	failures   int
+}
+
+func newAPIServer(cfg Config) *apiServer {
+	// The runs it starts count their connections for /healthz, and their
+	// wedged clients for /status
+	cfg.connections = new(atomic.Int32)
+	cfg.wedges = &wedgeCounter{}
+	return &apiServer{cfg: cfg}
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/identity", s.handleIdentity)
+	mux.HandleFunc("/provision", s.handleProvision)
+	return mux
+}
+
+// status derives the provisioning state from the persisted flow state
+func (s *apiServer) status() (Status, error) {
+	s.mu.Lock()
+	status := Status{LastError: s.lastError, LastErrorCode: string(s.lastErrorCode), Wedges: s.cfg.wedges.Total()}
+	running := s.running
+	s.mu.Unlock()
+
+	state, err := loadState(s.cfg.outputPath(stateFile), s.cfg.Files, s.cfg.clock())
+	if err != nil {
+		return status, err
+	}
+
+	now := s.cfg.clock().Now()
+	switch {
+	case running:
+		status.State = StateProvisioning
+	case state.State == FlowVerified:
+		status.State = StateProvisioned
+	case state.quarantine(now) != nil:
+		status.State = StateQuarantined
+		status.QuarantinedUntil = state.QuarantinedUntil.Format(time.RFC3339)
+	case state.lockout(now) != nil:
+		status.State = StateLockedOut
+		status.LockedOutUntil = state.LockedOutUntil.Format(time.RFC3339)
+	case state.State == FlowUnprovisioned:
+		status.State = StateUnprovisioned
+	default:
+		status.State = StatePending
+	}
+	status.FlowState = string(state.State)
+	status.ThingName = state.ThingName
+	status.CertificateID = state.CertificateID
+	if status.LastError == "" {
+		status.LastError = state.LastError
+		status.LastErrorCode = string(state.LastErrorCode)
+	}
+	if identity, err := loadIdentity(s.cfg.outputPath(identityFile), s.cfg.Files); err == nil && identity != nil && identity.CertificateNotAfter != nil {
+		status.CertificateNotAfter = identity.CertificateNotAfter.Format(time.RFC3339)
+	}
+	return status, nil
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := s.status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *apiServer) handleIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity, err := loadIdentity(s.cfg.outputPath(identityFile), s.cfg.Files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if identity == nil {
+		http.Error(w, "device is not provisioned", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, identity)
+}
+
+// handleProvision starts a provisioning run in the background. Progress is
+// reported through /status.
+func (s *apiServer) handleProvision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.begin(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	go func() {
+		_, err := run(s.cfg, nil)
+		s.end(err)
+	}()
+
+	writeJSON(w, http.StatusAccepted, Status{State: StateProvisioning})
+}
+
+// begin marks an operation as running, failing if one already is
+func (s *apiServer) begin() error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return errBusy
+	}
+	s.running = true
+	s.lastError = ""
+	s.lastErrorCode = ""
+	s.mu.Unlock()
+	// The operation connects with the thing name the heartbeats use
+	s.heartbeats.disconnect()
+	return nil
+}
+
+// busy reports whether an operation is running
+func (s *apiServer) busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// end records the outcome of the running operation, alerting on repeated
+// failures
+func (s *apiServer) end(err error) {
+	s.mu.Lock()
+	s.running = false
+	if err != nil {
+		log.Printf("Operation failed [%s]: %v", ErrorCodeOf(err), err)
+		s.lastError = err.Error()
+		s.lastErrorCode = ErrorCodeOf(err)
+		s.failures++
+	} else {
+		s.failures = 0
+	}
+	failures := s.failures
+	s.mu.Unlock()
+
+	switch {
+	case err == nil:
+		s.alerts.resolve(AlertOperationsFailing, "operations succeed again")
+	case s.alertAfter > 0 && failures >= s.alertAfter:
+		s.alerts.raise(AlertOperationsFailing, fmt.Sprintf("%d operations failed in a row", failures), err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listen opens the API listener. Addresses starting with "unix:" are unix socket
+// paths; the socket is only accessible to the owner and group.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return l, nil
+}
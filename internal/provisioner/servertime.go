@@ -0,0 +1,81 @@
+package provisioner
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseServerTime returns the server time of a device configuration, false if
+// it has none. It is an RFC 3339 time or a number of Unix seconds, which a
+// template usually passes on from a parameter and so as a string.
+func parseServerTime(config map[string]interface{}) (time.Time, bool, error) {
+	var seconds float64
+	switch value := config[configServerTime].(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true, nil
+		}
+		var err error
+		if seconds, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+			return time.Time{}, false, fmt.Errorf("device configuration %s must be an RFC 3339 time or Unix seconds", configServerTime)
+		}
+	default:
+		var ok bool
+		if seconds, ok = schemaNumber(value); !ok {
+			return time.Time{}, false, fmt.Errorf("device configuration %s must be an RFC 3339 time or Unix seconds", configServerTime)
+		}
+	}
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return time.Time{}, false, fmt.Errorf("device configuration %s is not a time", configServerTime)
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)), true, nil
+}
+
+// checkServerTime compares the device clock with the server time of the
+// device configuration, taken to be stamped at stamped, halfway through the
+// request that registered the thing. It returns the server time less the
+// device's in milliseconds, positive when the device clock is behind, or nil
+// without a server time. A skew over cfg.MaxClockSkew is logged, and with
+// cfg.SetClock the clock is stepped unless NTP keeps it synchronized. The
+// device is registered by then, so problems are only logged.
+func checkServerTime(cfg Config, config map[string]interface{}, stamped time.Time) *int64 {
+	server, ok, err := parseServerTime(config)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	skew := server.Sub(stamped)
+	skewMS := skew.Milliseconds()
+	if skew.Abs() <= cfg.MaxClockSkew {
+		log.Printf("Device clock is within %s of the server time", skew.Abs().Round(time.Millisecond))
+		return &skewMS
+	}
+	direction := "behind"
+	if skew < 0 {
+		direction = "ahead of"
+	}
+	log.Printf("Warning: device clock is %s %s the server time", skew.Abs().Round(time.Millisecond), direction)
+	if !cfg.SetClock {
+		return &skewMS
+	}
+	if synchronized, err := clockSynchronized(); err == nil && synchronized {
+		log.Printf("Warning: not stepping the clock, which NTP keeps synchronized")
+		return &skewMS
+	}
+	if err := setSystemClock(time.Now().Add(skew)); err != nil {
+		log.Printf("Warning: failed to step the clock: %v", err)
+		return &skewMS
+	}
+	log.Printf("Stepped the clock by %s to the server time", skew.Round(time.Millisecond))
+	return &skewMS
+}
@@ -0,0 +1,148 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Named shadow names AWS IoT accepts
+var shadowNamePattern = regexp.MustCompile(`^[0-9A-Za-z:_-]{1,64}$`)
+
+// Provisioning status reported in the named shadow of -status-shadow, so
+// backends can query onboarding state through the shadow service
+type provisioningStatus struct {
+	Serial          string    `json:"serial"`
+	FirmwareVersion string    `json:"firmwareVersion,omitempty"`
+	ProvisionedAt   time.Time `json:"provisionedAt"`
+	Mode            string    `json:"mode"`
+	Template        string    `json:"template,omitempty"` // Fleet provisioning only
+	CertificateID   string    `json:"certificateId"`
+	Result          string    `json:"result"`
+}
+
+// reportStatusShadow reports the provisioning status in the thing's named
+// shadow over the connection with the permanent identity, and waits for AWS
+// IoT to accept it
+func reportStatusShadow(cfg Config, transport Transport, state *provisioningState) error {
+	status := provisioningStatus{
+		Serial:          cfg.SerialNumber,
+		FirmwareVersion: cfg.FirmwareVersion,
+		ProvisionedAt:   time.Now().UTC(),
+		Mode:            cfg.Mode,
+		CertificateID:   state.CertificateID,
+		Result:          "provisioned",
+	}
+	if status.FirmwareVersion == "" {
+		if version, err := deviceFact(cfg.Files.fs(), FactFirmwareVersion); err == nil {
+			status.FirmwareVersion = version
+		}
+	}
+	if cfg.Mode == ModeFleet {
+		status.Template = cfg.TemplateName
+	}
+	if identity, err := loadIdentity(cfg.outputPath(identityFile), cfg.Files); err == nil && identity != nil {
+		status.ProvisionedAt = identity.ProvisionedAt
+	}
+
+	session := newProvisioningSession(transport, cfg)
+	// The transport is disconnected by the caller
+	defer func() {
+		if len(session.topics) == 0 {
+			return
+		}
+		if err := transport.Unsubscribe(session.topics...); err != nil {
+			log.Printf("Warning: failed to unsubscribe from shadow topics: %v", err)
+		}
+	}()
+	if err := session.updateNamedShadow(state.ThingName, cfg.StatusShadow, status); err != nil {
+		return fmt.Errorf("failed to report provisioning status in shadow %s: %w", cfg.StatusShadow, err)
+	}
+	log.Printf("Provisioning status reported in shadow %s", cfg.StatusShadow)
+	return nil
+}
+
+// updateNamedShadow publishes the reported state to the thing's named shadow
+// and waits for the update to be accepted
+func (s *provisioningSession) updateNamedShadow(thingName, shadowName string, reported interface{}) error {
+	token := newClientToken(s.cfg.random())
+	request, err := s.expect(exchange{
+		op:       "shadow update",
+		qos:      "shadow",
+		topic:    fmt.Sprintf(topicNamedShadowUpdate, thingName, shadowName),
+		accepted: fmt.Sprintf(topicNamedShadowUpdateAccepted, thingName, shadowName),
+		rejected: fmt.Sprintf(topicNamedShadowUpdateRejected, thingName, shadowName),
+		token:    token,
+		rejection: func(payload []byte) error {
+			var rejected shadowError
+			if err := json.Unmarshal(payload, &rejected); err == nil && rejected.Message != "" {
+				return fmt.Errorf("shadow update rejected with %d: %s", rejected.Code, rejected.Message)
+			}
+			return fmt.Errorf("shadow update rejected: %s", string(payload))
+		},
+		timeout: fmt.Errorf("timeout waiting for shadow update response (the policy may not allow the named shadow topics)"),
+	})
+	if err != nil {
+		return err
+	}
+	document, err := json.Marshal(map[string]interface{}{
+		"state":       map[string]interface{}{"reported": reported},
+		"clientToken": token,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal shadow update: %v", err)
+	}
+	_, err = request.send(document)
+	return err
+}
+
+// getNamedShadow returns the reported state of the thing's named shadow, or
+// nil if the shadow does not exist
+func (s *provisioningSession) getNamedShadow(thingName, shadowName string) (map[string]interface{}, error) {
+	token := newClientToken(s.cfg.random())
+	request, err := s.expect(exchange{
+		op:       "shadow get",
+		qos:      "shadow",
+		topic:    fmt.Sprintf(topicNamedShadowGet, thingName, shadowName),
+		accepted: fmt.Sprintf(topicNamedShadowGetAccepted, thingName, shadowName),
+		rejected: fmt.Sprintf(topicNamedShadowGetRejected, thingName, shadowName),
+		token:    token,
+		rejection: func(payload []byte) error {
+			var rejected shadowError
+			if err := json.Unmarshal(payload, &rejected); err == nil && rejected.Code == 404 {
+				return errNoShadow
+			}
+			return fmt.Errorf("shadow get rejected: %s", string(payload))
+		},
+		timeout: fmt.Errorf("timeout waiting for shadow get response (the policy may not allow the named shadow topics)"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(map[string]string{"clientToken": token})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal shadow get request: %v", err)
+	}
+	response, err := request.send(payload)
+	if errors.Is(err, errNoShadow) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var document struct {
+		State struct {
+			Reported map[string]interface{} `json:"reported"`
+		} `json:"state"`
+	}
+	if err := json.Unmarshal(response, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse shadow %s: %v", shadowName, err)
+	}
+	if document.State.Reported == nil {
+		return map[string]interface{}{}, nil
+	}
+	return document.State.Reported, nil
+}
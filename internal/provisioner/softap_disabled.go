@@ -0,0 +1,10 @@
+//go:build nosoftap
+
+package provisioner
+
+import "errors"
+
+// Built without the access point onboarding portal
+func runSoftAPCommand(args []string) error {
+	return errors.New("SoftAP onboarding is not available in this build (built with -tags nosoftap)")
+}
@@ -0,0 +1,183 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A state of the provisioning flow. The flow only moves forward:
+// unprovisioned → claim-connected → cert-created → registered → verified,
+// except that a certificate abandoned at -deadline returns it to
+// claim-connected.
+type FlowState string
+
+const (
+	FlowUnprovisioned  FlowState = "unprovisioned"
+	FlowClaimConnected FlowState = "claim-connected" // Connected with the claim certificate
+	FlowCertCreated    FlowState = "cert-created"    // Permanent certificate created, not yet registered
+	FlowRegistered     FlowState = "registered"      // Thing registered, permanent identity not yet verified
+	FlowVerified       FlowState = "verified"        // Connected with the permanent identity
+)
+
+// Provisioning state, persisted after every transition so a restart resumes
+// from the state the previous run reached. While in cert-created it holds the
+// certificate, key, and ownership token, so the next run resumes registration
+// with the same ownership token instead of minting (and orphaning) another
+// certificate; they are dropped once the thing is registered.
+type provisioningState struct {
+	State                     FlowState              `json:"state"`
+	CertificateID             string                 `json:"certificateId,omitempty"`
+	CertificatePem            string                 `json:"certificatePem,omitempty"`
+	PrivateKey                keyMaterial            `json:"privateKey,omitempty"`
+	CertificateOwnershipToken string                 `json:"certificateOwnershipToken,omitempty"`
+	ThingName                 string                 `json:"thingName,omitempty"`
+	Endpoint                  string                 `json:"endpoint,omitempty"`
+	Product                   string                 `json:"product,omitempty"` // Selected from -products
+	Target                    string                 `json:"target,omitempty"`  // Selected from -targets
+	CertificateArn            string                 `json:"certificateArn,omitempty"`
+	DeviceConfiguration       map[string]interface{} `json:"deviceConfiguration,omitempty"` // Returned by the template
+	ClockSkewMS               *int64                 `json:"clockSkewMs,omitempty"`         // Server time less the device's at registration
+	TemplateParameters        map[string]string      `json:"templateParameters,omitempty"`  // Registered with, see reconcileParameters
+	StepParameters            []string               `json:"stepParameters,omitempty"`      // Set or removed by Config.Steps
+	AdditionalFields          *ResponseFields        `json:"additionalResponseFields,omitempty"`
+	LastError                 string                 `json:"lastError,omitempty"`
+	LastErrorCode             ErrorCode              `json:"lastErrorCode,omitempty"`
+	TerminalFailures          int                    `json:"terminalFailures,omitempty"` // Consecutive, see failed
+	QuarantinedUntil          *time.Time             `json:"quarantinedUntil,omitempty"`
+	FailedAttempts            int                    `json:"failedAttempts,omitempty"` // Since provisioned or locked out, see attemptFailed
+	LockedOutUntil            *time.Time             `json:"lockedOutUntil,omitempty"`
+	RefusedClaims             []string               `json:"refusedClaims,omitempty"`         // Certificate IDs of claims from -claim-dir AWS IoT refused
+	OrphanedCertificates      []string               `json:"orphanedCertificates,omitempty"`  // IDs of certificates abandoned unregistered, see abandonCertificate
+	PreviousCertificateID     string                 `json:"previousCertificateId,omitempty"` // Replaced by rotation, revoked after RetirePreviousAfter
+	AttachedPolicies          []string               `json:"attachedPolicies,omitempty"`      // Attached to the certificate by -attach-policy
+	RetirePreviousAfter       *time.Time             `json:"retirePreviousAfter,omitempty"`
+	UpdatedAt                 time.Time              `json:"updatedAt"`
+
+	path  string
+	files FilePermissions
+	clock Clock
+}
+
+// loadState returns the state persisted at path, or the unprovisioned state if
+// there is none. Saving writes it back with the given permissions, stamped with
+// the time of clock.
+func loadState(path string, files FilePermissions, clock Clock) (*provisioningState, error) {
+	data, err := files.fs().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &provisioningState{State: FlowUnprovisioned, path: path, files: files, clock: clock}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provisioning state: %v", err)
+	}
+
+	state := provisioningState{path: path, files: files, clock: clock}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse provisioning state %s: %v", path, err)
+	}
+	if state.DeviceConfiguration, err = decodeDeviceConfiguration(jsonCodec{}, data); err != nil {
+		return nil, fmt.Errorf("failed to parse provisioning state %s: %v", path, err)
+	}
+	switch state.State {
+	case FlowUnprovisioned, FlowClaimConnected, FlowRegistered, FlowVerified:
+	case FlowCertCreated:
+		if state.CertificateOwnershipToken == "" {
+			return nil, fmt.Errorf("provisioning state %s has no certificate ownership token", path)
+		}
+	default:
+		return nil, fmt.Errorf("provisioning state %s has unknown state %q", path, state.State)
+	}
+	return &state, nil
+}
+
+// save persists the state. The file may hold the private key, so it is written
+// with the key mode.
+func (s *provisioningState) save() error {
+	s.UpdatedAt = s.clock.Now().UTC()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal provisioning state: %v", err)
+	}
+	if err := s.files.write(s.path, data, true); err != nil {
+		return fmt.Errorf("failed to save provisioning state: %v", err)
+	}
+	return nil
+}
+
+// transition moves to the next state and persists it. Progress resets the
+// circuit breaker, and completing the flow the attempt budget.
+func (s *provisioningState) transition(to FlowState) error {
+	s.State = to
+	s.LastError = ""
+	s.LastErrorCode = ""
+	s.clearQuarantine()
+	if to == FlowVerified {
+		s.clearLockout()
+	}
+	return s.save()
+}
+
+// certificateCreated records the created certificate and moves to cert-created
+func (s *provisioningState) certificateCreated(response CreateCertificateResponse) error {
+	s.CertificateID = response.CertificateID
+	s.CertificatePem = response.CertificatePem
+	s.PrivateKey = bytes.Clone(response.PrivateKey)
+	s.CertificateOwnershipToken = response.CertificateOwnershipToken
+	s.CertificateArn = ""
+	s.AttachedPolicies = nil
+	s.AdditionalFields = nil
+	if response.Additional != nil {
+		s.AdditionalFields = &ResponseFields{CreateCertificate: response.Additional}
+	}
+	return s.transition(FlowCertCreated)
+}
+
+// registered records the thing and moves to registered. The key and ownership
+// token are no longer needed.
+func (s *provisioningState) registered(response RegisterThingResponse, endpoint string) error {
+	s.ThingName = response.ThingName
+	s.DeviceConfiguration = response.DeviceConfiguration
+	if response.Additional != nil {
+		if s.AdditionalFields == nil {
+			s.AdditionalFields = &ResponseFields{}
+		}
+		s.AdditionalFields.RegisterThing = response.Additional
+	}
+	s.Endpoint = endpoint
+	s.CertificatePem = ""
+	s.PrivateKey.zero()
+	s.PrivateKey = nil
+	s.CertificateOwnershipToken = ""
+	return s.transition(FlowRegistered)
+}
+
+// certificateResponse rebuilds the certificate creation response from the state
+func (s *provisioningState) certificateResponse() CreateCertificateResponse {
+	return CreateCertificateResponse{
+		CertificateID:             s.CertificateID,
+		CertificatePem:            s.CertificatePem,
+		PrivateKey:                bytes.Clone(s.PrivateKey),
+		CertificateOwnershipToken: s.CertificateOwnershipToken,
+	}
+}
+
+// abandonCertificate gives up on registering the created certificate: its ID
+// is recorded as orphaned, for an operator or cleanup-orphans to deactivate,
+// and the flow returns to claim-connected so the next run creates another.
+// The registration may have gone through after all if its response was lost,
+// so whoever deletes the certificate should check it has no thing attached.
+func (s *provisioningState) abandonCertificate() error {
+	s.OrphanedCertificates = append(s.OrphanedCertificates, s.CertificateID)
+	s.CertificateID = ""
+	s.CertificateArn = ""
+	s.AttachedPolicies = nil
+	s.AdditionalFields = nil
+	s.CertificatePem = ""
+	s.PrivateKey.zero()
+	s.PrivateKey = nil
+	s.CertificateOwnershipToken = ""
+	return s.transition(FlowClaimConnected)
+}
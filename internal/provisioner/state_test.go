@@ -0,0 +1,141 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadStateMissing(t *testing.T) {
+	files, _ := memoryFiles()
+	state, err := loadState(stateFile, files, systemClock{})
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if state.State != FlowUnprovisioned {
+		t.Errorf("state = %s, want %s", state.State, FlowUnprovisioned)
+	}
+}
+
+func TestProvisioningStateTransitions(t *testing.T) {
+	files, mem := memoryFiles()
+	clock := NewManualClock(testStart)
+	state, err := loadState(stateFile, files, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.LastError = "connection refused"
+	state.TerminalFailures = 2
+	if err := state.transition(FlowClaimConnected); err != nil {
+		t.Fatalf("transition: %v", err)
+	}
+	if state.LastError != "" || state.TerminalFailures != 0 {
+		t.Errorf("progress kept the error %q and %d failures", state.LastError, state.TerminalFailures)
+	}
+
+	err = state.certificateCreated(CreateCertificateResponse{
+		CertificateID:             "cert-1",
+		CertificatePem:            "CERT",
+		PrivateKey:                keyMaterial("KEY"),
+		CertificateOwnershipToken: "token",
+		Additional:                map[string]interface{}{"extra": "field"},
+	})
+	if err != nil {
+		t.Fatalf("certificateCreated: %v", err)
+	}
+	if info, _ := mem.Stat(stateFile); info.Mode().Perm() != 0600 {
+		t.Errorf("state mode = %v, want the key mode 0600", info.Mode().Perm())
+	}
+
+	// A restart resumes registration with the same certificate
+	resumed, err := loadState(stateFile, files, clock)
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if resumed.State != FlowCertCreated {
+		t.Fatalf("state = %s, want %s", resumed.State, FlowCertCreated)
+	}
+	response := resumed.certificateResponse()
+	if response.CertificateID != "cert-1" || string(response.PrivateKey) != "KEY" || response.CertificateOwnershipToken != "token" {
+		t.Errorf("resumed certificate = %+v", response)
+	}
+	if resumed.AdditionalFields == nil || resumed.AdditionalFields.CreateCertificate["extra"] != "field" {
+		t.Errorf("additional fields = %+v", resumed.AdditionalFields)
+	}
+
+	config := map[string]interface{}{"id": json.Number("12345678901234567890")}
+	clock.Advance(time.Minute)
+	if err := resumed.registered(RegisterThingResponse{ThingName: "thing-1", DeviceConfiguration: config}, "endpoint"); err != nil {
+		t.Fatalf("registered: %v", err)
+	}
+	data := mustRead(t, mem, stateFile)
+	for _, secret := range []string{"KEY", "token"} {
+		if strings.Contains(data, secret) {
+			t.Errorf("registered state still holds %q", secret)
+		}
+	}
+
+	registered, err := loadState(stateFile, files, clock)
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if registered.State != FlowRegistered || registered.ThingName != "thing-1" || registered.Endpoint != "endpoint" {
+		t.Errorf("registered state = %s %s %s", registered.State, registered.ThingName, registered.Endpoint)
+	}
+	// Large integers keep every digit
+	if got := registered.DeviceConfiguration["id"]; got != json.Number("12345678901234567890") {
+		t.Errorf("device configuration id = %v (%T)", got, got)
+	}
+	if !registered.UpdatedAt.Equal(testStart.Add(time.Minute)) {
+		t.Errorf("UpdatedAt = %s, want the time of the clock when registered", registered.UpdatedAt)
+	}
+}
+
+func TestAbandonCertificate(t *testing.T) {
+	files, _ := memoryFiles()
+	state, _ := loadState(stateFile, files, systemClock{})
+	if err := state.certificateCreated(CreateCertificateResponse{CertificateID: "cert-1", PrivateKey: keyMaterial("KEY"), CertificateOwnershipToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	state.AttachedPolicies = []string{"extra"}
+	if err := state.abandonCertificate(); err != nil {
+		t.Fatalf("abandonCertificate: %v", err)
+	}
+
+	loaded, err := loadState(stateFile, files, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.State != FlowClaimConnected {
+		t.Errorf("state = %s, want %s", loaded.State, FlowClaimConnected)
+	}
+	if loaded.CertificateID != "" || loaded.PrivateKey != nil || loaded.CertificateOwnershipToken != "" || loaded.AttachedPolicies != nil {
+		t.Errorf("abandoned certificate kept: %+v", loaded)
+	}
+	if len(loaded.OrphanedCertificates) != 1 || loaded.OrphanedCertificates[0] != "cert-1" {
+		t.Errorf("orphaned certificates = %v, want [cert-1]", loaded.OrphanedCertificates)
+	}
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "not JSON", content: "{", wantErr: "failed to parse"},
+		{name: "unknown state", content: `{"state":"half-done"}`, wantErr: "unknown state"},
+		{name: "cert-created without token", content: `{"state":"cert-created","certificateId":"c"}`, wantErr: "no certificate ownership token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, mem := memoryFiles()
+			mem.WriteFile(stateFile, []byte(tt.content), 0600)
+			_, err := loadState(stateFile, files, systemClock{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadState error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package provisioner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// statusPort reports a run on a serial port for a factory test fixture, one
+// line per event, terminated by CRLF:
+//
+//	PROV STAGE <stage> <message>
+//	PROV OK <thing name>
+//	PROV FAIL <error class> <error>
+//
+// Every line starts with PROV so fixtures can pick them out of a console
+// shared with other output. Messages are on one line, with secrets redacted.
+type statusPort struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openStatusPort opens -status-port, or returns nil if it is not set. A port
+// that fails to open is only a warning: it doesn't stop the device from being
+// provisioned, and the fixture times out waiting for it.
+func openStatusPort(cfg Config) *statusPort {
+	if cfg.StatusPort == "" {
+		return nil
+	}
+	port, err := openSerialPort(cfg.StatusPort, cfg.StatusBaud)
+	if err != nil {
+		log.Printf("Warning: not reporting status on the serial port: %v", err)
+		return nil
+	}
+	if cfg.StatusRS485 {
+		if err := enableRS485(port); err != nil {
+			port.Close()
+			log.Printf("Warning: not reporting status on the serial port: %v", err)
+			return nil
+		}
+	}
+	return &statusPort{w: port}
+}
+
+// send writes a line, dropping the port if it fails
+func (p *statusPort) send(fields ...string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w == nil {
+		return
+	}
+	line := "PROV " + strings.Join(fields, " ")
+	line = strings.NewReplacer("\r", " ", "\n", " ").Replace(secrets.output(line))
+	if _, err := fmt.Fprintf(p.w, "%s\r\n", line); err != nil {
+		log.Printf("Warning: failed to report status on the serial port: %v", err)
+		p.w.Close()
+		p.w = nil
+	}
+}
+
+// report is a ProgressFunc sending each stage
+func (p *statusPort) report(stage Stage, message string) {
+	p.send("STAGE", string(stage), message)
+}
+
+// finish sends the outcome of the run and closes the port
+func (p *statusPort) finish(result *ProvisioningResult, err error) {
+	if p == nil {
+		return
+	}
+	if err != nil {
+		p.send("FAIL", string(ClassifyError(err)), err.Error())
+	} else {
+		p.send("OK", result.ThingName)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w != nil {
+		p.w.Close()
+		p.w = nil
+	}
+}
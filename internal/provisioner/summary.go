@@ -0,0 +1,187 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summary formats of -summary
+const (
+	SummaryText = "text"
+	SummaryJSON = "json"
+	SummaryNone = "none"
+)
+
+// runSummary collects what provisioning did, for the summary printed when the
+// program exits, so operators don't have to piece it together from the log
+type runSummary struct {
+	Result          string        `json:"result"` // provisioned, already-provisioned, or failed
+	ThingName       string        `json:"thingName,omitempty"`
+	CertificateID   string        `json:"certificateId,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	ErrorClass      ErrorClass    `json:"errorClass,omitempty"`
+	ErrorCode       ErrorCode     `json:"errorCode,omitempty"`
+	DurationMS      int64         `json:"durationMs"`
+	Attempts        int           `json:"attempts"`         // Provisioning runs, the first one included
+	Stages          []StageTiming `json:"stages,omitempty"` // Of the last attempt
+	ConnectFailures int           `json:"connectFailures"`
+	Reconnects      int           `json:"reconnects"`
+	BytesSent       int64         `json:"bytesSent"`     // TLS included
+	BytesReceived   int64         `json:"bytesReceived"` // TLS included
+
+	mu      sync.Mutex
+	started time.Time
+	last    Stage // Reported last
+	traffic Traffic
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{started: time.Now()}
+}
+
+// watch returns cfg with the summary counting its connections and traffic
+func (s *runSummary) watch(cfg Config) Config {
+	next := cfg.OnConnectionEvent
+	cfg.OnConnectionEvent = func(event ConnectionEvent) {
+		s.connection(event)
+		if next != nil {
+			next(event)
+		}
+	}
+	cfg.Traffic = &s.traffic
+	return cfg
+}
+
+// Order of the stages within an attempt
+var stageOrder = []Stage{StageValidate, StageConnect, StageCreateCertificate, StageRegisterThing, StageVerify, StageComplete}
+
+// record is a ProgressFunc timing the stages. A stage reported that does not
+// follow the previous one starts another attempt.
+func (s *runSummary) record(stage Stage, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if s.last == "" || slices.Index(stageOrder, stage) <= slices.Index(stageOrder, s.last) {
+		s.Attempts++
+		s.Stages = nil
+	} else if n := len(s.Stages); n > 0 {
+		s.Stages[n-1].DurationMS = now.Sub(s.Stages[n-1].StartedAt).Milliseconds()
+	}
+	s.last = stage
+	if stage != StageComplete {
+		s.Stages = append(s.Stages, StageTiming{Stage: stage, StartedAt: now})
+	}
+}
+
+// connection counts connection failures and reconnects
+func (s *runSummary) connection(event ConnectionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch event.Type {
+	case ConnectionFailed:
+		s.ConnectFailures++
+	case ConnectionReconnected:
+		s.Reconnects++
+	}
+}
+
+// finish records the outcome of provisioning
+func (s *runSummary) finish(result *ProvisioningResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DurationMS = time.Since(s.started).Milliseconds()
+	s.Attempts = max(s.Attempts, 1)
+	switch {
+	case err != nil:
+		s.Result = "failed"
+		s.Error = err.Error()
+		s.ErrorClass = ClassifyError(err)
+		s.ErrorCode = ErrorCodeOf(err)
+		// The stage provisioning stopped in
+		if n := len(s.Stages); n > 0 {
+			s.Stages[n-1].DurationMS = time.Since(s.Stages[n-1].StartedAt).Milliseconds()
+		}
+	case len(s.Stages) == 0:
+		// Only completion was reported
+		s.Result = "already-provisioned"
+	default:
+		s.Result = "provisioned"
+	}
+	if result != nil {
+		s.ThingName = result.ThingName
+		s.CertificateID = result.CertificateID
+	}
+	s.BytesSent = s.traffic.Sent.Load()
+	s.BytesReceived = s.traffic.Received.Load()
+}
+
+// write prints the summary in the given format
+func (s *runSummary) write(w io.Writer, format string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch format {
+	case SummaryJSON:
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case SummaryText:
+		var b strings.Builder
+		b.WriteString("Provisioning summary\n")
+		switch s.Result {
+		case "failed":
+			fmt.Fprintf(&b, "  Result:      failed (%s, %s): %s\n", s.ErrorClass, s.ErrorCode, s.Error)
+		case "already-provisioned":
+			fmt.Fprintf(&b, "  Result:      already provisioned as %s\n", s.ThingName)
+		default:
+			fmt.Fprintf(&b, "  Result:      provisioned as %s, certificate %s\n", s.ThingName, s.CertificateID)
+		}
+		attempts := "1 attempt"
+		if s.Attempts > 1 {
+			attempts = fmt.Sprintf("%d attempts", s.Attempts)
+		}
+		fmt.Fprintf(&b, "  Duration:    %s over %s\n", (time.Duration(s.DurationMS) * time.Millisecond).Round(time.Millisecond), attempts)
+		if len(s.Stages) > 0 {
+			stages := make([]string, len(s.Stages))
+			for i, stage := range s.Stages {
+				stages[i] = fmt.Sprintf("%s %s", stage.Stage, time.Duration(stage.DurationMS)*time.Millisecond)
+			}
+			fmt.Fprintf(&b, "  Stages:      %s\n", strings.Join(stages, ", "))
+		}
+		fmt.Fprintf(&b, "  Connections: %d failed, %d reconnects\n", s.ConnectFailures, s.Reconnects)
+		fmt.Fprintf(&b, "  Traffic:     %s sent, %s received\n", formatBytes(s.BytesSent), formatBytes(s.BytesReceived))
+		_, err := io.WriteString(w, b.String())
+		return err
+	default:
+		return nil
+	}
+}
+
+// validateSummaryFormat checks a -summary format
+func validateSummaryFormat(format string) error {
+	switch format {
+	case SummaryText, SummaryJSON, SummaryNone:
+		return nil
+	default:
+		return fmt.Errorf("unsupported summary format %q: use %s, %s, or %s", format, SummaryText, SummaryJSON, SummaryNone)
+	}
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+}
@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state update to systemd (see sd_notify(3)). It does nothing
+// when the process isn't run by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading @ (abstract socket) is handled by the net package
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Printf("Warning: failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Warning: failed to notify systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often the systemd watchdog must be pet, or 0 if
+// it isn't enabled for this process. Half of WatchdogSec is used, as systemd
+// recommends.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// petWatchdog tells systemd the process is still making progress
+func petWatchdog() {
+	if watchdogInterval() > 0 {
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// sleepWithWatchdog sleeps for d by clock, petting the watchdog along the way
+// so a long retry backoff isn't mistaken for a hang
+func sleepWithWatchdog(clock Clock, d time.Duration) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		clock.Sleep(d)
+		return
+	}
+	for d > 0 {
+		step := min(d, interval)
+		clock.Sleep(step)
+		d -= step
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// keepWatchdog pets the watchdog for as long as the process runs, for long
+// lived commands that are idle between operations
+func keepWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,283 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways to select the target to provision against, for -target-selection
+const (
+	TargetDefault  = "default"  // The targets file's default
+	TargetAssigned = "assigned" // The first assignment matching the serial number, else the default
+	TargetLatency  = "latency"  // The target whose endpoint answers fastest
+)
+
+// Connections made to each target's endpoint by the latency probe
+const latencyProbes = 3
+
+// A region or account devices can be onboarded to. Fields left empty keep the
+// value of the corresponding flag.
+type Target struct {
+	Name                    string   `json:"name"`
+	Region                  string   `json:"region"`
+	Endpoints               []string `json:"endpoints"`
+	Port                    int      `json:"port,omitempty"`
+	Template                string   `json:"template,omitempty"`
+	ClaimCert               string   `json:"claimCert,omitempty"`
+	ClaimKey                string   `json:"claimKey,omitempty"`
+	RootCA                  string   `json:"rootCa,omitempty"`
+	ClaimBundleURL          string   `json:"claimBundleUrl,omitempty"`
+	ClaimBundleSignatureURL string   `json:"claimBundleSignatureUrl,omitempty"`
+	ClaimBundlePublicKey    string   `json:"claimBundlePublicKey,omitempty"`
+	ClaimBundleKey          string   `json:"claimBundleKey,omitempty"`
+}
+
+// Assigns devices whose serial number matches a pattern (path.Match syntax)
+// to a target
+type targetAssignment struct {
+	Serial string `json:"serial"`
+	Target string `json:"target"`
+}
+
+// Targets file given with -targets
+type targetsFile struct {
+	Default string             `json:"default"`
+	Assign  []targetAssignment `json:"assign,omitempty"`
+	Targets []Target           `json:"targets"`
+}
+
+// loadTargets reads and checks a targets file
+func loadTargets(fsys FileSystem, file string) (*targetsFile, error) {
+	data, err := fsys.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets: %v", err)
+	}
+	var targets targetsFile
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse targets %s: %v", file, err)
+	}
+	if len(targets.Targets) == 0 {
+		return nil, fmt.Errorf("targets %s lists no targets", file)
+	}
+	names := map[string]bool{}
+	for _, target := range targets.Targets {
+		if target.Name == "" || names[target.Name] {
+			return nil, fmt.Errorf("targets %s: target names must be unique and not empty", file)
+		}
+		if target.Region == "" || len(target.Endpoints) == 0 {
+			return nil, fmt.Errorf("targets %s: target %s needs a region and endpoints", file, target.Name)
+		}
+		names[target.Name] = true
+	}
+	if targets.Default == "" {
+		targets.Default = targets.Targets[0].Name
+	}
+	if !names[targets.Default] {
+		return nil, fmt.Errorf("targets %s: unknown default target %q", file, targets.Default)
+	}
+	for _, assignment := range targets.Assign {
+		if _, err := path.Match(assignment.Serial, ""); err != nil || assignment.Serial == "" {
+			return nil, fmt.Errorf("targets %s: invalid serial pattern %q", file, assignment.Serial)
+		}
+		if !names[assignment.Target] {
+			return nil, fmt.Errorf("targets %s: serials %s are assigned to unknown target %q", file, assignment.Serial, assignment.Target)
+		}
+	}
+	return &targets, nil
+}
+
+// target returns the named target
+func (t *targetsFile) target(name string) (Target, error) {
+	i := slices.IndexFunc(t.Targets, func(target Target) bool { return target.Name == name })
+	if i < 0 {
+		return Target{}, fmt.Errorf("unknown target %q", name)
+	}
+	return t.Targets[i], nil
+}
+
+// apply returns cfg set up to provision against the target
+func (t Target) apply(cfg Config) Config {
+	cfg.TargetsFile = ""
+	cfg.Region = t.Region
+	cfg.Endpoints = t.Endpoints
+	if t.Port != 0 {
+		cfg.Port = t.Port
+	}
+	if t.Template != "" {
+		cfg.TemplateName = t.Template
+	}
+	if t.ClaimCert != "" {
+		cfg.ClaimCertFile = t.ClaimCert
+	}
+	if t.ClaimKey != "" {
+		cfg.ClaimKeyFile = t.ClaimKey
+	}
+	if t.RootCA != "" {
+		cfg.RootCAFile = t.RootCA
+	}
+	if t.ClaimBundleURL != "" {
+		cfg.ClaimBundleURL = t.ClaimBundleURL
+		cfg.ClaimBundleSignatureURL = t.ClaimBundleSignatureURL
+	}
+	if t.ClaimBundlePublicKey != "" {
+		cfg.ClaimBundlePublicKey = t.ClaimBundlePublicKey
+	}
+	if t.ClaimBundleKey != "" {
+		cfg.ClaimBundleKey = t.ClaimBundleKey
+	}
+	return cfg
+}
+
+// validateTargets checks the targets file and the configuration each target
+// results in
+func validateTargets(cfg Config) error {
+	targets, err := loadTargets(cfg.Files.fs(), cfg.TargetsFile)
+	if err != nil {
+		return err
+	}
+	switch cfg.TargetSelection {
+	case TargetDefault, TargetAssigned, TargetLatency:
+	default:
+		return fmt.Errorf("unsupported target selection %q: use %s, %s, or %s", cfg.TargetSelection, TargetDefault, TargetAssigned, TargetLatency)
+	}
+	if cfg.Target != "" {
+		if _, err := targets.target(cfg.Target); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets.Targets {
+		targetCfg := target.apply(cfg)
+		if err := targetCfg.validate(); err != nil {
+			return fmt.Errorf("target %s: %v", target.Name, err)
+		}
+	}
+	return nil
+}
+
+// selectTarget returns cfg set up for the target to provision against, and
+// records it in the state. A flow already under way stays with its target:
+// the certificate and thing it created only exist there.
+func selectTarget(cfg Config, state *provisioningState) (Config, error) {
+	targets, err := loadTargets(cfg.Files.fs(), cfg.TargetsFile)
+	if err != nil {
+		return cfg, err
+	}
+	name := state.Target
+	switch {
+	case name != "":
+	case cfg.Target != "":
+		name = cfg.Target
+	case cfg.TargetSelection == TargetAssigned:
+		name = targets.Default
+		for _, assignment := range targets.Assign {
+			if ok, _ := path.Match(assignment.Serial, cfg.SerialNumber); ok {
+				name = assignment.Target
+				break
+			}
+		}
+	case cfg.TargetSelection == TargetLatency:
+		if name, err = fastestTarget(cfg, targets); err != nil {
+			return cfg, err
+		}
+	default:
+		name = targets.Default
+	}
+	target, err := targets.target(name)
+	if err != nil {
+		return cfg, fmt.Errorf("provisioning state: %v", err)
+	}
+	if state.Target == "" {
+		state.Target = name
+	}
+	log.Printf("Provisioning against target %s (%s)", target.Name, target.Region)
+	return target.apply(cfg), nil
+}
+
+// fastestTarget probes each target's first endpoint with TCP connections and
+// returns the target that connected fastest. With GeoDNS, the endpoint a
+// target lists can itself resolve to the nearest region.
+func fastestTarget(cfg Config, targets *targetsFile) (string, error) {
+	latencies := make([]time.Duration, len(targets.Targets))
+	var wg sync.WaitGroup
+	for i, target := range targets.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targetCfg := target.apply(cfg)
+			latencies[i] = probeLatency(net.JoinHostPort(target.Endpoints[0], strconv.Itoa(targetCfg.port())), cfg.ConnectTimeout)
+		}()
+	}
+	wg.Wait()
+
+	best := -1
+	for i, latency := range latencies {
+		if latency < 0 {
+			log.Printf("Target %s is unreachable", targets.Targets[i].Name)
+			continue
+		}
+		log.Printf("Target %s connects in %s", targets.Targets[i].Name, latency.Round(time.Millisecond))
+		if best < 0 || latency < latencies[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", fmt.Errorf("no target is reachable")
+	}
+	return targets.Targets[best].Name, nil
+}
+
+// probeLatency returns the fastest of several TCP connections to address, or
+// -1 if none succeeded
+func probeLatency(address string, timeout time.Duration) time.Duration {
+	fastest := time.Duration(-1)
+	for i := 0; i < latencyProbes; i++ {
+		started := time.Now()
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			continue
+		}
+		elapsed := time.Since(started)
+		conn.Close()
+		if fastest < 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	return fastest
+}
+
+// networkEndpoints returns the endpoints whose resolving shows the network is
+// up: the configured ones, and those of every product and target
+func networkEndpoints(cfg Config) []string {
+	if cfg.ProductsFile != "" {
+		if products, err := loadProducts(cfg.Files.fs(), cfg.ProductsFile); err == nil {
+			var endpoints []string
+			for _, product := range products.Products {
+				for _, endpoint := range networkEndpoints(product.apply(cfg)) {
+					if !slices.Contains(endpoints, endpoint) {
+						endpoints = append(endpoints, endpoint)
+					}
+				}
+			}
+			return endpoints
+		}
+	}
+	endpoints := cfg.Endpoints
+	if cfg.TargetsFile == "" {
+		return endpoints
+	}
+	targets, err := loadTargets(cfg.Files.fs(), cfg.TargetsFile)
+	if err != nil {
+		return endpoints
+	}
+	for _, target := range targets.Targets {
+		endpoints = append(slices.Clip(endpoints), target.Endpoints...)
+	}
+	return endpoints
+}
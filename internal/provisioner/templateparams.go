@@ -0,0 +1,115 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Parameter a provisioning template declares. Parameters without a default
+// must be passed.
+type templateParameter struct {
+	Type          string   `json:"Type"`
+	Default       *string  `json:"Default,omitempty"`
+	AllowedValues []string `json:"AllowedValues,omitempty"`
+}
+
+// TemplateParameterError is returned when the parameters do not satisfy the
+// template, before anything is sent to AWS IoT
+type TemplateParameterError struct {
+	Template string
+	Problems []string
+}
+
+func (e *TemplateParameterError) Error() string {
+	return fmt.Sprintf("parameters do not match template %s: %s", e.Template, strings.Join(e.Problems, "; "))
+}
+
+// templateSchema returns the parameters the template declares, from
+// cfg.TemplateSchemaFile, or else the template's default version in AWS IoT.
+// It returns nil if the template cannot be fetched for lack of AWS
+// credentials.
+func templateSchema(ctx context.Context, cfg Config) (map[string]templateParameter, error) {
+	if cfg.TemplateSchemaFile != "" {
+		data, err := cfg.Files.fs().ReadFile(cfg.TemplateSchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template schema: %v", err)
+		}
+		return parseTemplateParameters(cfg.TemplateSchemaFile, data)
+	}
+	body, err := fetchTemplateBody(ctx, cfg)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	return parseTemplateParameters(cfg.TemplateName, body)
+}
+
+// parseTemplateParameters returns the Parameters section of a template body
+func parseTemplateParameters(name string, body []byte) (map[string]templateParameter, error) {
+	var template struct {
+		Parameters map[string]templateParameter `json:"Parameters"`
+	}
+	if err := json.Unmarshal(body, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	if template.Parameters == nil {
+		template.Parameters = map[string]templateParameter{}
+	}
+	return template.Parameters, nil
+}
+
+// checkTemplateParameters checks params against the parameters the template
+// declares: every parameter without a default must be passed, and values
+// must be of the declared type and among the allowed values
+func checkTemplateParameters(ctx context.Context, cfg Config, params map[string]string) error {
+	schema, err := templateSchema(ctx, cfg)
+	if err != nil || schema == nil {
+		return err
+	}
+	var problems []string
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		declared := schema[name]
+		value, ok := params[name]
+		if !ok {
+			if declared.Default == nil {
+				problems = append(problems, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+		if err := declared.check(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &TemplateParameterError{Template: cfg.TemplateName, Problems: problems}
+	}
+	return nil
+}
+
+// check returns why value is not valid for the parameter
+func (p templateParameter) check(value string) error {
+	switch p.Type {
+	case "Number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+	case "List<Number>":
+		for _, item := range strings.Split(value, ",") {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(item), 64); err != nil {
+				return fmt.Errorf("%q is not a comma-separated list of numbers", value)
+			}
+		}
+	}
+	if len(p.AllowedValues) > 0 && !slices.Contains(p.AllowedValues, value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(p.AllowedValues, ", "))
+	}
+	return nil
+}
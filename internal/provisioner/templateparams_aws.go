@@ -0,0 +1,27 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+)
+
+// fetchTemplateBody returns the body of the template's default version in
+// AWS IoT, or nil if it cannot be fetched for lack of AWS credentials
+func fetchTemplateBody(ctx context.Context, cfg Config) ([]byte, error) {
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		log.Printf("Warning: skipping template parameter check: %v", err)
+		return nil, nil
+	}
+	described, err := client.DescribeProvisioningTemplate(ctx, &iot.DescribeProvisioningTemplateInput{TemplateName: aws.String(cfg.TemplateName)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe template %s: %v", cfg.TemplateName, err)
+	}
+	return []byte(aws.ToString(described.TemplateBody)), nil
+}
@@ -0,0 +1,183 @@
+package provisioner
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Thing naming strategies of bulk provisioning
+const (
+	NamingTemplate = "template" // -thing-name-format with {serial} and template parameters
+	NamingSequence = "sequence" // -thing-name-format followed by a sequence number
+	NamingUUID     = "uuid"     // -thing-name-format followed by a random UUID
+)
+
+// Thing names AWS IoT accepts
+var thingNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_-]{1,128}$`)
+
+// Placeholders of the template naming strategy
+var namePlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Names tried for a device before giving up when they are all taken
+const maxNameAttempts = 100
+
+// File in the station directory holding the next sequence number
+const sequenceFile = "thing-name-sequence"
+
+// thingNamer chooses the thing names of the devices of a batch and passes
+// them to the provisioning template in a parameter, which its ThingName
+// resource refers to. Names already given to a thing, according to fleet
+// indexing, or to an earlier device of the batch, which indexing may not show
+// yet, are skipped, or refused for the template strategy, which cannot pick
+// another.
+type thingNamer struct {
+	cfg      Config
+	strategy string
+	format   string
+	param    string
+	next     int    // Sequence number of the next device
+	path     string // Where the next sequence number is kept
+
+	exists func(name string) (bool, error) // Nil unless names are checked
+	used   map[string]string               // Serial numbers by the names given to them
+}
+
+// validateNaming checks the flags of a naming strategy
+func validateNaming(strategy, format, param string, start int) error {
+	switch strategy {
+	case NamingTemplate:
+		if format == "" {
+			return fmt.Errorf("-thing-names template needs -thing-name-format, such as {Model}-{serial}")
+		}
+	case NamingSequence:
+		if start < 0 {
+			return fmt.Errorf("-thing-name-start must not be negative")
+		}
+	case NamingUUID:
+	default:
+		return fmt.Errorf("unsupported thing naming strategy %q: use template, sequence, or uuid", strategy)
+	}
+	if param == "" {
+		return fmt.Errorf("-thing-name-param must not be empty")
+	}
+	return nil
+}
+
+// newThingNamer returns a namer continuing the sequence kept in dir, if any,
+// and checking names against fleet indexing if check is set
+func newThingNamer(cfg Config, dir, strategy, format, param string, start int, check bool) (*thingNamer, error) {
+	n := &thingNamer{cfg: cfg, strategy: strategy, format: format, param: param, next: start, path: filepath.Join(dir, sequenceFile), used: map[string]string{}}
+	if strategy == NamingSequence {
+		if data, err := cfg.Files.fs().ReadFile(n.path); err == nil {
+			next, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil || next < 0 {
+				return nil, fmt.Errorf("invalid sequence number in %s", n.path)
+			}
+			n.next = next
+		}
+	}
+	if check {
+		exists, err := newThingNameCheck(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check thing names against fleet indexing: %v", err)
+		}
+		n.exists = exists
+	}
+	return n, nil
+}
+
+// name returns the thing name of the device with serial and template
+// parameters params
+func (n *thingNamer) name(serial string, params map[string]string) (string, error) {
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		name, err := n.candidate(serial, params)
+		if err != nil {
+			return "", err
+		}
+		taken, err := n.taken(name, serial)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			n.used[name] = serial
+			return name, nil
+		}
+		if n.strategy == NamingTemplate {
+			return "", fmt.Errorf("thing name %s is already taken", name)
+		}
+		log.Printf("Thing name %s is already taken, trying another", name)
+	}
+	return "", fmt.Errorf("no free thing name found in %d attempts", maxNameAttempts)
+}
+
+// candidate renders the next name of the strategy, advancing the sequence
+func (n *thingNamer) candidate(serial string, params map[string]string) (string, error) {
+	var name string
+	switch n.strategy {
+	case NamingTemplate:
+		var missing []string
+		name = namePlaceholder.ReplaceAllStringFunc(n.format, func(placeholder string) string {
+			key := placeholder[1 : len(placeholder)-1]
+			if key == "serial" {
+				return serial
+			}
+			value, ok := params[key]
+			if !ok {
+				missing = append(missing, key)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			slices.Sort(missing)
+			return "", fmt.Errorf("thing name format %q needs template parameters %s", n.format, strings.Join(slices.Compact(missing), ", "))
+		}
+	case NamingSequence:
+		name = fmt.Sprintf("%s%06d", n.format, n.next)
+		n.next++
+		// Numbers are never handed out twice, even if provisioning fails
+		if err := n.cfg.Files.write(n.path, []byte(strconv.Itoa(n.next)+"\n"), false); err != nil {
+			return "", fmt.Errorf("failed to save sequence number: %v", err)
+		}
+	case NamingUUID:
+		name = n.format + randomUUID(n.cfg.random())
+	}
+	if !thingNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid thing name %q: use 1 to 128 letters, digits, colons, underscores, or hyphens", name)
+	}
+	return name, nil
+}
+
+// taken reports whether another device of the batch or a thing in fleet
+// indexing has the name. A device scanned again after failing keeps its name,
+// which its first attempt may have registered.
+func (n *thingNamer) taken(name, serial string) (bool, error) {
+	if used, ok := n.used[name]; ok {
+		return used != serial, nil
+	}
+	if n.exists == nil {
+		return false, nil
+	}
+	exists, err := n.exists(name)
+	if err != nil {
+		return false, fmt.Errorf("failed to check thing name %s: %v", name, err)
+	}
+	return exists, nil
+}
+
+// randomUUID returns a version 4 UUID drawn from r
+func randomUUID(r Random) string {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], r.Uint64())
+	binary.LittleEndian.PutUint64(b[8:], r.Uint64())
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,44 @@
+//go:build !noaws
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iot"
+	"github.com/aws/aws-sdk-go-v2/service/iot/types"
+)
+
+// newThingNameCheck returns a function reporting whether fleet indexing
+// knows a thing of a name. Indexing lags registration by seconds, so it does
+// not know the things just registered.
+func newThingNameCheck(cfg Config) (func(name string) (bool, error), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := newIoTClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// Thing names need no quoting beyond the quotes, see thingNamePattern
+		page, err := client.SearchIndex(ctx, &iot.SearchIndexInput{
+			IndexName:   aws.String(thingsIndex),
+			QueryString: aws.String(fmt.Sprintf(`thingName:"%s"`, name)),
+			MaxResults:  aws.Int32(1),
+		})
+		var notReady *types.IndexNotReadyException
+		if isNotFound(err) || errors.As(err, &notReady) {
+			return false, fmt.Errorf("fleet indexing of things is not enabled or not ready in %s: %v (enable it, or pass -thing-name-check=false)", cfg.Region, err)
+		}
+		if err != nil {
+			return false, err
+		}
+		return len(page.Things) > 0, nil
+	}, nil
+}
@@ -0,0 +1,25 @@
+package provisioner
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// clockSynchronized reports whether the kernel considers the clock
+// synchronized, which NTP clients such as systemd-timesyncd, chrony, and ntpd
+// tell it once they have set the clock
+func clockSynchronized() (bool, error) {
+	var timex unix.Timex
+	state, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return false, err
+	}
+	return state != unix.TIME_ERROR && timex.Status&unix.STA_UNSYNC == 0, nil
+}
+
+// setSystemClock steps the clock to t, which needs CAP_SYS_TIME
+func setSystemClock(t time.Time) error {
+	tv := unix.NsecToTimeval(t.UnixNano())
+	return unix.Settimeofday(&tv)
+}
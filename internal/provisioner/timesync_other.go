@@ -0,0 +1,18 @@
+//go:build !linux
+
+package provisioner
+
+import (
+	"errors"
+	"time"
+)
+
+// clockSynchronized is only implemented on Linux
+func clockSynchronized() (bool, error) {
+	return false, errors.New("clock synchronization is only checked on Linux")
+}
+
+// setSystemClock is only implemented on Linux
+func setSystemClock(t time.Time) error {
+	return errors.New("the clock is only stepped on Linux")
+}
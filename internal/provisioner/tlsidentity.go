@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// TLSIdentity is a certificate and the key that proves it, which the device
+// authenticates to AWS IoT with. The key is only used through crypto.Signer,
+// so it can be held in memory or stay in a TPM, a PKCS#11 token, or a secure
+// element. (DeviceIdentity is what the device was provisioned as.)
+type TLSIdentity interface {
+	// TLSCertificate returns the certificate chain, leaf first, with a
+	// crypto.Signer as its private key
+	TLSCertificate() (tls.Certificate, error)
+}
+
+// signerIdentity is a parsed certificate chain and the signer of its key
+type signerIdentity struct {
+	cert tls.Certificate
+}
+
+// NewSignerIdentity returns the identity of certPEM, a certificate followed by
+// any intermediates, whose key signer holds. The signer's public key must be
+// the certificate's.
+func NewSignerIdentity(certPEM []byte, signer crypto.Signer) (TLSIdentity, error) {
+	var cert tls.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(leaf.PublicKey) {
+		return nil, errors.New("private key does not match certificate")
+	}
+	cert.PrivateKey = signer
+	cert.Leaf = leaf
+	return signerIdentity{cert: cert}, nil
+}
+
+func (i signerIdentity) TLSCertificate() (tls.Certificate, error) {
+	return i.cert, nil
+}
+
+func (i signerIdentity) String() string {
+	return fmt.Sprintf("%q", i.cert.Leaf.Subject.CommonName)
+}
+
+// fileIdentity is a PEM certificate and an unencrypted PEM key in files, such
+// as the permanent ones provisioning writes. They are read on every call, so
+// a rotated identity is picked up.
+type fileIdentity struct {
+	fs       FileSystem
+	certFile string
+	keyFile  string
+}
+
+// TLSCertificate reads the files as tls.LoadX509KeyPair does. The key's PEM is
+// cleared once parsed.
+func (i fileIdentity) TLSCertificate() (tls.Certificate, error) {
+	certPEM, err := i.fs.ReadFile(i.certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := i.fs.ReadFile(i.keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	defer clear(keyPEM)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (i fileIdentity) String() string {
+	return i.certFile
+}
+
+// permanentIdentity returns the permanent certificate and key in the output
+// directory
+func (c *Config) permanentIdentity() TLSIdentity {
+	return fileIdentity{fs: c.Files.fs(), certFile: c.outputPath(permanentCertFile), keyFile: c.outputPath(permanentKeyFile)}
+}
@@ -0,0 +1,155 @@
+package provisioner
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Serial number sources
+const (
+	SerialFlag = "flag" // -serial
+	SerialTPM  = "tpm"  // Hash of the TPM endorsement key certificate
+)
+
+// Default TPM device, the kernel's resource manager
+const defaultTPMDevice = "/dev/tpmrm0"
+
+// NV indices the TCG EK credential profile stores the endorsement key
+// certificates at, RSA 2048 first
+var ekCertificateIndices = []uint32{0x01c00002, 0x01c0000a}
+
+// TPM 2.0 command codes, tags, and handles, see the TPM 2.0 library
+// specification part 2
+const (
+	tpmSTNoSessions   = 0x8001
+	tpmSTSessions     = 0x8002
+	tpmCCNVRead       = 0x0000014e
+	tpmCCNVReadPublic = 0x00000169
+	tpmRSPassword     = 0x40000009
+	tpmNVReadChunk    = 512 // Below the smallest NV buffer TPMs have
+)
+
+// tpmError is a TPM 2.0 response code other than success
+type tpmError struct {
+	Command      uint32
+	ResponseCode uint32
+}
+
+func (e *tpmError) Error() string {
+	return fmt.Sprintf("TPM command 0x%x failed with response code 0x%x", e.Command, e.ResponseCode)
+}
+
+// tpmSerial returns the SHA-256 of the DER encoded endorsement key
+// certificate of the TPM at device, hex encoded, as the device serial number.
+// The endorsement key is created in the TPM and the certificate signed by its
+// manufacturer, so unlike a MAC address the serial cannot be changed or
+// copied to another device.
+func tpmSerial(device string) (string, error) {
+	tpm, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open TPM: %v", err)
+	}
+	defer tpm.Close()
+	for _, index := range ekCertificateIndices {
+		size, err := tpmNVSize(tpm, index)
+		var refused *tpmError
+		if errors.As(err, &refused) {
+			// The TPM has no certificate for this key type
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read endorsement key certificate: %v", err)
+		}
+		data, err := tpmNVRead(tpm, index, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to read endorsement key certificate: %v", err)
+		}
+		// The index may be larger than the certificate, padded with zeros
+		var certificate asn1.RawValue
+		if _, err := asn1.Unmarshal(data, &certificate); err != nil {
+			return "", fmt.Errorf("invalid endorsement key certificate at NV index 0x%x: %v", index, err)
+		}
+		sum := sha256.Sum256(certificate.FullBytes)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("TPM %s holds no endorsement key certificate", device)
+}
+
+// tpmCommand sends a command to the TPM and returns the response after its
+// header
+func tpmCommand(tpm io.ReadWriter, tag uint16, command uint32, body []byte) ([]byte, error) {
+	request := binary.BigEndian.AppendUint16(nil, tag)
+	request = binary.BigEndian.AppendUint32(request, uint32(10+len(body)))
+	request = binary.BigEndian.AppendUint32(request, command)
+	request = append(request, body...)
+	if _, err := tpm.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 4096)
+	n, err := tpm.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	if n < 10 {
+		return nil, fmt.Errorf("short TPM response")
+	}
+	if code := binary.BigEndian.Uint32(response[6:10]); code != 0 {
+		return nil, &tpmError{Command: command, ResponseCode: code}
+	}
+	return response[10:n], nil
+}
+
+// tpmNVSize returns the size of the NV index, from its public area
+func tpmNVSize(tpm io.ReadWriter, index uint32) (int, error) {
+	response, err := tpmCommand(tpm, tpmSTNoSessions, tpmCCNVReadPublic, binary.BigEndian.AppendUint32(nil, index))
+	if err != nil {
+		return 0, err
+	}
+	// TPM2B_NV_PUBLIC: size, index, name algorithm, attributes, auth policy,
+	// data size
+	if len(response) < 14 {
+		return 0, fmt.Errorf("short NV public area")
+	}
+	policy := int(binary.BigEndian.Uint16(response[12:14]))
+	if len(response) < 16+policy {
+		return 0, fmt.Errorf("short NV public area")
+	}
+	return int(binary.BigEndian.Uint16(response[14+policy : 16+policy])), nil
+}
+
+// tpmNVRead reads size bytes of the NV index, authorized by the index itself
+// with an empty password, as the endorsement key certificate indices allow
+func tpmNVRead(tpm io.ReadWriter, index uint32, size int) ([]byte, error) {
+	var data []byte
+	for len(data) < size {
+		chunk := min(size-len(data), tpmNVReadChunk)
+		body := binary.BigEndian.AppendUint32(nil, index) // Authorization
+		body = binary.BigEndian.AppendUint32(body, index)
+		// Password session with an empty password
+		body = binary.BigEndian.AppendUint32(body, 9)
+		body = binary.BigEndian.AppendUint32(body, tpmRSPassword)
+		body = append(body, 0, 0, 0, 0, 0)
+		body = binary.BigEndian.AppendUint16(body, uint16(chunk))
+		body = binary.BigEndian.AppendUint16(body, uint16(len(data)))
+		response, err := tpmCommand(tpm, tpmSTSessions, tpmCCNVRead, body)
+		if err != nil {
+			return nil, err
+		}
+		// Parameter size, then TPM2B_MAX_NV_BUFFER
+		if len(response) < 6 {
+			return nil, fmt.Errorf("short NV read response")
+		}
+		n := int(binary.BigEndian.Uint16(response[4:6]))
+		if n == 0 || len(response) < 6+n {
+			return nil, fmt.Errorf("short NV read response")
+		}
+		data = append(data, response[6:6+n]...)
+	}
+	return data, nil
+}
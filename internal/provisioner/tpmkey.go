@@ -0,0 +1,248 @@
+package provisioner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TPM 2.0 commands, structures, and algorithms of signing with a key the TPM
+// holds, see the TPM 2.0 library specification part 2
+const (
+	tpmCCReadPublic   = 0x00000173
+	tpmCCSign         = 0x0000015d
+	tpmSTHashCheck    = 0x8024
+	tpmRHNull         = 0x40000007
+	tpmAlgRSA         = 0x0001
+	tpmAlgECC         = 0x0023
+	tpmAlgNull        = 0x0010
+	tpmAlgSHA1        = 0x0004
+	tpmAlgSHA256      = 0x000b
+	tpmAlgSHA384      = 0x000c
+	tpmAlgSHA512      = 0x000d
+	tpmAlgRSASSA      = 0x0014
+	tpmAlgRSAPSS      = 0x0016
+	tpmAlgECDSA       = 0x0018
+	tpmECCNISTP256    = 0x0003
+	tpmECCNISTP384    = 0x0004
+	tpmPersistentMask = 0xff000000
+	tpmPersistent     = 0x81000000
+)
+
+// tpmSigner signs with a persistent key of the TPM at device, authorized with
+// an empty password as keys provisioned for TLS usually are. The TPM is
+// opened for each signature, so it is not held between handshakes.
+type tpmSigner struct {
+	device string
+	handle uint32
+	public crypto.PublicKey
+
+	mu sync.Mutex // TPM commands and responses must not interleave
+}
+
+// newTPMSigner returns the signer of a tpm2:0x81000001 key reference, checking
+// the TPM holds a key at the handle and that it is the certificate's
+func newTPMSigner(device, ref string, public crypto.PublicKey) (crypto.Signer, error) {
+	handle, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(ref), keySchemeTPM2+":"), 0, 32)
+	if err != nil || handle&tpmPersistentMask != tpmPersistent {
+		return nil, fmt.Errorf("%s is not a persistent TPM handle, such as tpm2:0x81000001", ref)
+	}
+	tpm, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TPM: %v", err)
+	}
+	defer tpm.Close()
+	key, err := tpmReadPublic(tpm, uint32(handle))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TPM key 0x%x: %v", handle, err)
+	}
+	if equal, ok := key.(interface{ Equal(crypto.PublicKey) bool }); !ok || !equal.Equal(public) {
+		return nil, fmt.Errorf("TPM key 0x%x does not match certificate", handle)
+	}
+	return &tpmSigner{device: device, handle: uint32(handle), public: key}, nil
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest as crypto.Signer does, with PKCS #1 v1.5 or PSS for
+// RSA keys, and ASN.1 encoded for ECDSA keys
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := tpmHashAlg(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	var scheme uint16
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		scheme = tpmAlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme = tpmAlgRSAPSS
+		}
+	case *ecdsa.PublicKey:
+		scheme = tpmAlgECDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.public)
+	}
+
+	body := binary.BigEndian.AppendUint32(nil, s.handle)
+	// Password session with an empty password
+	body = binary.BigEndian.AppendUint32(body, 9)
+	body = binary.BigEndian.AppendUint32(body, tpmRSPassword)
+	body = append(body, 0, 0, 0, 0, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(digest)))
+	body = append(body, digest...)
+	body = binary.BigEndian.AppendUint16(body, scheme)
+	body = binary.BigEndian.AppendUint16(body, hash)
+	// Null ticket, the digest was not made by the TPM
+	body = binary.BigEndian.AppendUint16(body, tpmSTHashCheck)
+	body = binary.BigEndian.AppendUint32(body, tpmRHNull)
+	body = binary.BigEndian.AppendUint16(body, 0)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tpm, err := os.OpenFile(s.device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TPM: %v", err)
+	}
+	defer tpm.Close()
+	response, err := tpmCommand(tpm, tpmSTSessions, tpmCCSign, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with TPM key 0x%x: %v", s.handle, err)
+	}
+
+	// Parameter size, then TPMT_SIGNATURE: algorithm, hash, and the signature
+	r := &tpmReader{data: response}
+	r.uint32()
+	algorithm := r.uint16()
+	r.uint16()
+	switch algorithm {
+	case tpmAlgRSASSA, tpmAlgRSAPSS:
+		signature := r.sized()
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid TPM signature: %v", r.err)
+		}
+		return signature, nil
+	case tpmAlgECDSA:
+		sigR, sigS := r.sized(), r.sized()
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid TPM signature: %v", r.err)
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sigR), new(big.Int).SetBytes(sigS)})
+	}
+	return nil, fmt.Errorf("unexpected TPM signature algorithm 0x%x", algorithm)
+}
+
+// tpmHashAlg returns the TPM algorithm ID of a hash
+func tpmHashAlg(hash crypto.Hash) (uint16, error) {
+	switch hash {
+	case crypto.SHA1:
+		return tpmAlgSHA1, nil
+	case crypto.SHA256:
+		return tpmAlgSHA256, nil
+	case crypto.SHA384:
+		return tpmAlgSHA384, nil
+	case crypto.SHA512:
+		return tpmAlgSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash %v", hash)
+}
+
+// tpmReadPublic returns the public key of the TPM key at handle
+func tpmReadPublic(tpm io.ReadWriter, handle uint32) (crypto.PublicKey, error) {
+	response, err := tpmCommand(tpm, tpmSTNoSessions, tpmCCReadPublic, binary.BigEndian.AppendUint32(nil, handle))
+	if err != nil {
+		return nil, err
+	}
+	// TPM2B_PUBLIC: size, then TPMT_PUBLIC: type, name algorithm,
+	// attributes, auth policy, parameters, and the unique public key
+	r := &tpmReader{data: response}
+	r.uint16()
+	keyType := r.uint16()
+	r.uint16()
+	r.uint32()
+	r.sized()
+	// Symmetric algorithm of storage keys, with its key size and mode
+	if r.uint16() != tpmAlgNull {
+		r.uint16()
+		r.uint16()
+	}
+	// Signing scheme the key is restricted to, with its hash
+	if r.uint16() != tpmAlgNull {
+		r.uint16()
+	}
+	var key crypto.PublicKey
+	switch keyType {
+	case tpmAlgRSA:
+		r.uint16() // Key size
+		exponent := int(r.uint32())
+		if exponent == 0 {
+			exponent = 65537
+		}
+		modulus := r.sized()
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: exponent}
+	case tpmAlgECC:
+		var curve elliptic.Curve
+		switch r.uint16() {
+		case tpmECCNISTP256:
+			curve = elliptic.P256()
+		case tpmECCNISTP384:
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported ECC curve")
+		}
+		// Key derivation scheme, with its hash
+		if r.uint16() != tpmAlgNull {
+			r.uint16()
+		}
+		x, y := r.sized(), r.sized()
+		key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	default:
+		return nil, fmt.Errorf("unsupported key type 0x%x", keyType)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid public area: %v", r.err)
+	}
+	return key, nil
+}
+
+// tpmReader reads the big-endian fields of a TPM response, remembering the
+// first field that ran past its end
+type tpmReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tpmReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *tpmReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *tpmReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+// sized reads a TPM2B, a buffer after its 16-bit size
+func (r *tpmReader) sized() []byte {
+	return r.next(int(r.uint16()))
+}
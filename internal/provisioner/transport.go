@@ -0,0 +1,220 @@
+package provisioner
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Supported MQTT protocol versions
+const (
+	MQTTVersion311 = "3.1.1"
+	MQTTVersion5   = "5"
+)
+
+// ALPN protocol for MQTT with X.509 client certificates on port 443
+const alpnMQTT = "x-amzn-mqtt-ca"
+
+// Time waited for the MQTT client beyond -connect-timeout, which it enforces
+// itself, before giving up on it
+const connectGrace = 2 * time.Second
+
+// MessageHandler is called for every message received on a subscribed topic
+type MessageHandler func(topic string, payload []byte)
+
+// Transport is the MQTT connection the provisioning flow runs over
+type Transport interface {
+	// Subscribe subscribes to a topic and waits for the broker to acknowledge it
+	Subscribe(topic string, qos byte, handler MessageHandler) error
+	// Unsubscribe removes the subscriptions for the given topics
+	Unsubscribe(topics ...string) error
+	// Publish sends a message, waiting for the acknowledgement when qos is 1
+	Publish(topic string, qos byte, payload []byte) error
+	// IsConnected reports whether the connection to the broker is up
+	IsConnected() bool
+	// Disconnect closes the connection, waiting up to quiesce for in-flight work
+	Disconnect(quiesce time.Duration)
+	// Endpoint returns the AWS IoT endpoint the transport is connected to
+	Endpoint() string
+	// Failed receives an error when the connection fails in a way reconnecting
+	// cannot fix, such as another client using the same client ID
+	Failed() <-chan error
+}
+
+// AckTimeoutError reports that the broker did not acknowledge a packet in time
+type AckTimeoutError struct {
+	Packet  string // CONNACK, SUBACK, UNSUBACK, or PUBACK
+	Topic   string // The endpoint for CONNACK
+	Timeout time.Duration
+}
+
+func (e *AckTimeoutError) Error() string {
+	option := "-subscribe-timeout"
+	switch e.Packet {
+	case "PUBACK":
+		option = "-publish-timeout"
+	case "CONNACK":
+		option = "-connect-timeout"
+	}
+	return fmt.Sprintf("no %s for %s within %s (%s)", e.Packet, e.Topic, e.Timeout, option)
+}
+
+// connectTransport connects to AWS IoT with the given identity using the
+// configured MQTT protocol version. Endpoints are tried in priority order; each
+// gets the configured number of retries before failing over to the next.
+func connectTransport(cfg Config, cert tls.Certificate, clientID string) (Transport, error) {
+	tlsConfig, err := newTLSConfig(cfg, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	attempt := 0
+	throttled := false
+	var lastErr error
+	for i, endpoint := range cfg.Endpoints {
+		for retry := 0; retry <= cfg.ConnectRetries; retry++ {
+			if attempt > 0 {
+				delay := cfg.Reconnect.Delay(attempt - 1)
+				if throttled {
+					delay = cfg.Reconnect.ThrottledDelay()
+				}
+				log.Printf("Retrying in %s", delay.Round(time.Millisecond))
+				sleepWithWatchdog(cfg.clock(), delay)
+			}
+			attempt++
+			petWatchdog()
+
+			started := time.Now()
+			transport, err := connectEndpointFallback(cfg, tlsConfig, endpoint, clientID)
+			if err == nil {
+				if i > 0 {
+					log.Printf("Failed over to endpoint %s", endpoint)
+				}
+				elapsed := time.Since(started)
+				log.Printf("Connected to %s in %s", endpoint, elapsed.Round(time.Millisecond))
+				reportConnection(cfg, ConnectionUp, endpoint, nil)
+				return trackConnection(cfg, limitPublishes(cfg, guardTransport(cfg, transport)), elapsed), nil
+			}
+			event := reportConnection(cfg, ConnectionFailed, endpoint, err)
+			log.Printf("Connection attempt %d to %s failed (%s): %v", retry+1, endpoint, event.Reason, err)
+			lastErr = err
+
+			// The server refused the connection, another endpoint won't accept it
+			// either. Throttling and unavailability pass, so keep retrying.
+			throttled = isThrottled(err)
+			if isTerminal(err) {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to any of %d endpoint(s): %w", len(cfg.Endpoints), lastErr)
+}
+
+// AWS IoT keeps a persistent session this long after the connection drops
+// unless the account's limit is raised. MQTT 5 clients have to ask for it.
+const sessionExpiry = time.Hour
+
+// messageStore returns the directory the in-flight messages of a connection
+// with clientID are kept in, or "" to keep them in memory. Messages left by an
+// earlier connection belong to a flow that has moved on and are removed. The
+// MQTT clients write the directory themselves, bypassing Config.Files.
+func messageStore(cfg Config, clientID string) (string, error) {
+	if cfg.MessageStoreDir == "" {
+		return "", nil
+	}
+	dir := filepath.Join(cfg.MessageStoreDir, url.PathEscape(clientID))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to clear message store: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create message store: %v", err)
+	}
+	return dir, nil
+}
+
+// Endpoints and ports the network was found to block, connected to on port
+// 443 right away from then on
+var blockedPorts sync.Map
+
+// connectEndpointFallback makes a connection attempt to one endpoint, and with
+// cfg.PortFallback, another on port 443 if the network blocks the configured
+// port. AWS IoT has no HTTPS API for fleet provisioning, its HTTPS data plane
+// only publishes, so MQTT is tunnelled through the port HTTPS uses instead,
+// with the ALPN protocol AWS IoT requires there.
+func connectEndpointFallback(cfg Config, tlsConfig *tls.Config, endpoint, clientID string) (Transport, error) {
+	if !cfg.PortFallback || cfg.port() == 443 {
+		return connectEndpoint(cfg, tlsConfig, endpoint, clientID)
+	}
+	address := fmt.Sprintf("%s:%d", endpoint, cfg.port())
+	if _, blocked := blockedPorts.Load(address); !blocked {
+		transport, err := connectEndpoint(cfg, tlsConfig, endpoint, clientID)
+		// Refusals by AWS IoT would be the same on any port
+		if err == nil || connectionReason(err) != ReasonNetwork {
+			return transport, err
+		}
+		log.Printf("Connecting to %s failed (%v), trying port 443", address, err)
+	}
+	fallbackCfg := cfg
+	fallbackCfg.Port = 443
+	fallbackTLS := tlsConfig.Clone()
+	fallbackTLS.NextProtos = []string{alpnMQTT}
+	transport, err := connectEndpoint(fallbackCfg, fallbackTLS, endpoint, clientID)
+	if err == nil {
+		if _, known := blockedPorts.LoadOrStore(address, true); !known {
+			log.Printf("Connected to %s on port 443, the network blocks port %d", endpoint, cfg.port())
+		}
+	}
+	return transport, err
+}
+
+// connectEndpoint makes a single connection attempt to one endpoint
+func connectEndpoint(cfg Config, tlsConfig *tls.Config, endpoint, clientID string) (Transport, error) {
+	switch cfg.MQTTVersion {
+	case MQTTVersion311:
+		return connectMQTT311(cfg, tlsConfig, endpoint, clientID)
+	case MQTTVersion5:
+		return connectMQTT5(cfg, tlsConfig, endpoint, clientID)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version %q", cfg.MQTTVersion)
+	}
+}
+
+// newTLSConfig builds the mutual TLS configuration for the AWS IoT endpoint
+func newTLSConfig(cfg Config, cert tls.Certificate) (*tls.Config, error) {
+	// Load root CAs
+	caCertPool, err := rootCAPool(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create TLS config
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+		ServerName:   cfg.ServerName,
+	}
+	// AWS IoT only accepts MQTT with certificate authentication on port 443 when
+	// the client asks for it with ALPN
+	if cfg.port() == 443 {
+		tlsConfig.NextProtos = []string{alpnMQTT}
+	}
+	return tlsConfig, nil
+}
+
+// loadRootCAs returns the configured root CAs (see readRootCAs), or the
+// built-in root CAs of the region's partition when none are configured
+func loadRootCAs(cfg Config) ([]byte, error) {
+	rootCA, err := readRootCAs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA: %v", err)
+	}
+	if rootCA.data == nil {
+		return cfg.partition().RootCAs, nil
+	}
+	return rootCA.data, nil
+}
@@ -0,0 +1,147 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 3.1.1 transport backed by the paho.mqtt.golang client
+type mqtt311Transport struct {
+	client     mqtt.Client
+	endpoint   string
+	cfg        Config
+	takeover   takeoverDetector
+	failed     chan error
+	reconnects atomic.Int32
+}
+
+func connectMQTT311(cfg Config, tlsConfig *tls.Config, endpoint, clientID string) (*mqtt311Transport, error) {
+	t := &mqtt311Transport{endpoint: endpoint, cfg: cfg, failed: make(chan error, 1)}
+
+	// Create MQTT client options
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("ssl://%s:%d", endpoint, cfg.port()))
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		return dialTLS(context.Background(), cfg, options.TLSConfig, uri.Host)
+	})
+	opts.SetClientID(clientID)
+	opts.SetCleanSession(cfg.CleanSession)
+	store, err := messageStore(cfg, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if store != "" {
+		opts.SetStore(mqtt.NewFileStore(store))
+	}
+	opts.SetKeepAlive(cfg.KeepAlive)
+	opts.SetPingTimeout(cfg.PingTimeout)
+	opts.SetConnectTimeout(cfg.ConnectTimeout)
+	opts.SetAutoReconnect(true)
+
+	// paho doubles the reconnect delay from one second up to this maximum; the
+	// jitter is added before every reconnect attempt since it has no hook for it
+	opts.SetMaxReconnectInterval(cfg.Reconnect.Max)
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		attempt := int(t.reconnects.Add(1)) - 1
+		reportConnection(cfg, ConnectionReconnecting, endpoint, nil)
+		cfg.clock().Sleep(cfg.Reconnect.extraJitter(attempt))
+	})
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		if t.reconnects.Load() > 0 {
+			log.Printf("Reconnected to %s", endpoint)
+			reportConnection(cfg, ConnectionReconnected, endpoint, nil)
+		}
+		t.reconnects.Store(0)
+		t.takeover.connected()
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		event := reportConnection(cfg, ConnectionLost, endpoint, err)
+		log.Printf("MQTT connection lost (%s): %v", event.Reason, err)
+		if t.takeover.lost() {
+			t.fail(&ClientIDConflictError{ClientID: clientID})
+		}
+	})
+
+	// AWS IoT only speaks 3.1.1, falling back to 3.1 would only double the
+	// time a failing connection takes
+	opts.SetProtocolVersion(4)
+
+	// Create and connect client. paho holds the dial and the CONNACK to
+	// -connect-timeout; the token is waited on a little longer so the process
+	// can't hang should it not complete.
+	t.client = mqtt.NewClient(opts)
+	token := t.client.Connect()
+	if !token.WaitTimeout(cfg.ConnectTimeout + connectGrace) {
+		t.client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect: %w", &AckTimeoutError{Packet: "CONNACK", Topic: endpoint, Timeout: cfg.ConnectTimeout})
+	}
+	if token.Error() != nil {
+		// Stop the client so it doesn't keep retrying in the background
+		t.client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect: %w", token.Error())
+	}
+
+	return t, nil
+}
+
+// fail reports an unrecoverable connection error, keeping only the first
+func (t *mqtt311Transport) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
+func (t *mqtt311Transport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	token := t.client.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		handler(msg.Topic(), msg.Payload())
+	})
+	if !token.WaitTimeout(t.cfg.SubscribeTimeout) {
+		return &AckTimeoutError{Packet: "SUBACK", Topic: topic, Timeout: t.cfg.SubscribeTimeout}
+	}
+	return token.Error()
+}
+
+func (t *mqtt311Transport) Unsubscribe(topics ...string) error {
+	token := t.client.Unsubscribe(topics...)
+	if !token.WaitTimeout(t.cfg.SubscribeTimeout) {
+		return &AckTimeoutError{Packet: "UNSUBACK", Topic: strings.Join(topics, ", "), Timeout: t.cfg.SubscribeTimeout}
+	}
+	return token.Error()
+}
+
+func (t *mqtt311Transport) Publish(topic string, qos byte, payload []byte) error {
+	token := t.client.Publish(topic, qos, false, payload)
+	if !token.WaitTimeout(t.cfg.PublishTimeout) {
+		return &AckTimeoutError{Packet: "PUBACK", Topic: topic, Timeout: t.cfg.PublishTimeout}
+	}
+	return token.Error()
+}
+
+func (t *mqtt311Transport) IsConnected() bool {
+	return t.client.IsConnectionOpen()
+}
+
+func (t *mqtt311Transport) Endpoint() string {
+	return t.endpoint
+}
+
+func (t *mqtt311Transport) Failed() <-chan error {
+	return t.failed
+}
+
+func (t *mqtt311Transport) Disconnect(quiesce time.Duration) {
+	if t.client.IsConnected() {
+		t.client.Disconnect(uint(quiesce / time.Millisecond))
+	}
+}
@@ -0,0 +1,509 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/autopaho/queue"
+	filequeue "github.com/eclipse/paho.golang/autopaho/queue/file"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	filestore "github.com/eclipse/paho.golang/paho/store/file"
+)
+
+// MQTT 5 transport backed by the eclipse/paho.golang autopaho connection
+// manager. The connection is re-established automatically, subscriptions are
+// restored after every reconnect, and publishes made while the connection is
+// down are queued until it comes back. Failures reported by the server carry
+// reason codes and properties, see ReasonCodeError.
+type mqtt5Transport struct {
+	cm        *autopaho.ConnectionManager
+	endpoint  string
+	connected atomic.Bool
+	ups       atomic.Int32 // Connections made, the first one included
+	cfg       Config
+	takeover  takeoverDetector
+	failed    chan error
+
+	mu            sync.RWMutex
+	subscriptions map[string]mqtt5Subscription
+	lastErr       error
+}
+
+type mqtt5Subscription struct {
+	qos     byte
+	handler MessageHandler
+}
+
+func connectMQTT5(cfg Config, tlsConfig *tls.Config, endpoint, clientID string) (*mqtt5Transport, error) {
+	serverURL, err := url.Parse(fmt.Sprintf("mqtts://%s:%d", endpoint, cfg.port()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+
+	t := &mqtt5Transport{
+		endpoint:      endpoint,
+		cfg:           cfg,
+		subscriptions: make(map[string]mqtt5Subscription),
+		failed:        make(chan error, 1),
+	}
+	refused := make(chan error, 1)
+
+	// Publishes queued while the connection is down, and those awaiting their
+	// acknowledgement, in the store if there is one
+	var publishQueue queue.Queue
+	var sessionState session.SessionManager
+	var sessionExpiryInterval uint32
+	store, err := messageStore(cfg, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if store != "" {
+		if publishQueue, err = filequeue.New(store, "queue-", ".msg"); err != nil {
+			return nil, fmt.Errorf("failed to open message store: %v", err)
+		}
+		clientStore, err := filestore.New(store, "client-", ".msg")
+		if err != nil {
+			return nil, fmt.Errorf("failed to open message store: %v", err)
+		}
+		serverStore, err := filestore.New(store, "server-", ".msg")
+		if err != nil {
+			return nil, fmt.Errorf("failed to open message store: %v", err)
+		}
+		sessionState = state.New(clientStore, serverStore)
+		sessionExpiryInterval = uint32(sessionExpiry / time.Second)
+	}
+
+	t.cm, err = autopaho.NewConnection(context.Background(), autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     uint16(cfg.KeepAlive / time.Second),
+		CleanStartOnInitialConnection: cfg.CleanSession,
+		SessionExpiryInterval:         sessionExpiryInterval,
+		Queue:                         publishQueue,
+		ReconnectBackoff: func(attempt int) time.Duration {
+			// autopaho asks for a delay before the first attempt too
+			if attempt == 0 {
+				return 0
+			}
+			if t.ups.Load() > 0 {
+				reportConnection(cfg, ConnectionReconnecting, endpoint, nil)
+			}
+			return cfg.Reconnect.Delay(attempt - 1)
+		},
+		ConnectTimeout: cfg.ConnectTimeout,
+		// The broker is asked not to send packets larger than any response
+		// of AWS IoT, see maxResponsePayload
+		ConnectPacketBuilder: func(connect *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if connect.Properties == nil {
+				connect.Properties = &paho.ConnectProperties{}
+			}
+			size := uint32(maxResponsePacket)
+			connect.Properties.MaximumPacketSize = &size
+			return connect, nil
+		},
+		AttemptConnection: func(ctx context.Context, acfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+			conn, err := dialTLS(ctx, cfg, acfg.TlsCfg, u.Host)
+			if err != nil {
+				return nil, err
+			}
+			// paho requires a connection that is safe for concurrent writes
+			return packets.NewThreadSafeConn(conn), nil
+		},
+		OnConnectionUp: t.onConnectionUp,
+		OnConnectError: func(err error) {
+			t.setLastError(err)
+			// connectTransport reports the attempts of the first connection
+			if t.ups.Load() > 0 {
+				reportConnection(cfg, ConnectionFailed, endpoint, err)
+			}
+
+			// The server refused the connection, retrying won't help
+			var connackErr *autopaho.ConnackError
+			if errors.As(err, &connackErr) {
+				select {
+				case refused <- &ReasonCodeError{Op: "connect", ReasonCode: connackErr.ReasonCode, ReasonString: connackErr.Reason}:
+				default:
+				}
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			Session:  sessionState,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				t.route,
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				t.connected.Store(false)
+				err := reasonCodeErrorFromDisconnect(d)
+				event := reportConnection(cfg, ConnectionLost, endpoint, err)
+				log.Printf("Server disconnected (%s): %v", event.Reason, err)
+				// AWS IoT tells the displaced client why it was dropped
+				if t.takeover.lost() || d.ReasonCode == reasonSessionTakenOver {
+					t.fail(&ClientIDConflictError{ClientID: clientID})
+				}
+			},
+			OnClientError: func(err error) {
+				t.connected.Store(false)
+				event := reportConnection(cfg, ConnectionLost, endpoint, err)
+				log.Printf("MQTT connection lost (%s): %v", event.Reason, err)
+				if t.takeover.lost() {
+					t.fail(&ClientIDConflictError{ClientID: clientID})
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection manager: %v", err)
+	}
+
+	// Wait for the first connection
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	connected := make(chan error, 1)
+	go func() {
+		connected <- t.cm.AwaitConnection(ctx)
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.abort()
+			if lastErr := t.lastError(); lastErr != nil {
+				return nil, fmt.Errorf("failed to connect: %w", lastErr)
+			}
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+	case err := <-refused:
+		t.abort()
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	return t, nil
+}
+
+// abort stops the connection manager after a failed connection. A broker that
+// stopped answering can't hold it up for longer than -connect-timeout.
+func (t *mqtt5Transport) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.ConnectTimeout)
+	defer cancel()
+	_ = t.cm.Disconnect(ctx)
+}
+
+// fail reports an unrecoverable connection error, keeping only the first
+func (t *mqtt5Transport) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
+func (t *mqtt5Transport) setLastError(err error) {
+	t.mu.Lock()
+	t.lastErr = err
+	t.mu.Unlock()
+}
+
+func (t *mqtt5Transport) lastError() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lastErr
+}
+
+// onConnectionUp restores the subscriptions after every (re)connection
+func (t *mqtt5Transport) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	t.connected.Store(true)
+	t.takeover.connected()
+	if t.ups.Add(1) > 1 {
+		log.Printf("Reconnected to %s", t.endpoint)
+		reportConnection(t.cfg, ConnectionReconnected, t.endpoint, nil)
+	}
+
+	t.mu.RLock()
+	var subs []paho.SubscribeOptions
+	for topic, sub := range t.subscriptions {
+		subs = append(subs, paho.SubscribeOptions{Topic: topic, QoS: sub.qos})
+	}
+	t.mu.RUnlock()
+
+	if len(subs) == 0 {
+		return
+	}
+	if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subs}); err != nil {
+		log.Printf("Warning: failed to restore subscriptions after reconnect: %v", err)
+	}
+}
+
+// route dispatches an incoming publish to the handler for its topic
+func (t *mqtt5Transport) route(pr paho.PublishReceived) (bool, error) {
+	t.mu.RLock()
+	sub, ok := t.subscriptions[pr.Packet.Topic]
+	t.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	sub.handler(pr.Packet.Topic, pr.Packet.Payload)
+	return true, nil
+}
+
+func (t *mqtt5Transport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	t.mu.Lock()
+	t.subscriptions[topic] = mqtt5Subscription{qos: qos, handler: handler}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.SubscribeTimeout)
+	defer cancel()
+	suback, err := t.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = &AckTimeoutError{Packet: "SUBACK", Topic: topic, Timeout: t.cfg.SubscribeTimeout}
+	}
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		// The subscription is made when the connection comes back
+		return nil
+	}
+	if err != nil {
+		t.mu.Lock()
+		delete(t.subscriptions, topic)
+		t.mu.Unlock()
+		if suback != nil && len(suback.Reasons) > 0 {
+			return reasonCodeErrorFromSuback(suback, topic)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *mqtt5Transport) Unsubscribe(topics ...string) error {
+	t.mu.Lock()
+	for _, topic := range topics {
+		delete(t.subscriptions, topic)
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.SubscribeTimeout)
+	defer cancel()
+	_, err := t.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		// Nothing is restored on reconnect, so the subscriptions are already gone
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &AckTimeoutError{Packet: "UNSUBACK", Topic: strings.Join(topics, ", "), Timeout: t.cfg.SubscribeTimeout}
+	}
+	return err
+}
+
+func (t *mqtt5Transport) Publish(topic string, qos byte, payload []byte) error {
+	publish := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Payload: payload,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.PublishTimeout)
+	defer cancel()
+	resp, err := t.cm.Publish(ctx, publish)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &AckTimeoutError{Packet: "PUBACK", Topic: topic, Timeout: t.cfg.PublishTimeout}
+	}
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		// Queue the message, it is sent once the connection is re-established
+		log.Printf("Connection down, queueing publish to %s", topic)
+		return t.cm.PublishViaQueue(context.Background(), &autopaho.QueuePublish{Publish: publish})
+	}
+	if err != nil {
+		if resp != nil && resp.ReasonCode >= 0x80 {
+			return reasonCodeErrorFromPublishResponse(resp, topic)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *mqtt5Transport) IsConnected() bool {
+	return t.connected.Load()
+}
+
+func (t *mqtt5Transport) Endpoint() string {
+	return t.endpoint
+}
+
+func (t *mqtt5Transport) Failed() <-chan error {
+	return t.failed
+}
+
+func (t *mqtt5Transport) Disconnect(quiesce time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), quiesce)
+	defer cancel()
+	t.connected.Store(false)
+	_ = t.cm.Disconnect(ctx)
+}
+
+// Reason code sent by the server when another client connects with the same client ID
+const reasonSessionTakenOver = 0x8E
+
+// Reason code of a connection refused for its credentials
+const reasonBadUserNameOrPassword = 0x86
+
+// A user property attached to an MQTT 5 packet
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// ReasonCodeError is returned by the MQTT 5 transport when the server rejects an
+// operation. AWS IoT uses the reason code and reason string to explain
+// authorization failures that MQTT 3.1.1 reports as a dropped connection.
+type ReasonCodeError struct {
+	Op             string
+	Topic          string
+	ReasonCode     byte
+	ReasonString   string
+	UserProperties []UserProperty
+}
+
+func (e *ReasonCodeError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Topic != "" {
+		fmt.Fprintf(&b, " %s", e.Topic)
+	}
+	fmt.Fprintf(&b, ": reason code 0x%02X (%s)", e.ReasonCode, reasonCodeName(e.ReasonCode))
+	if e.ReasonString != "" {
+		fmt.Fprintf(&b, ": %s", e.ReasonString)
+	}
+	for _, p := range e.UserProperties {
+		fmt.Fprintf(&b, " [%s=%s]", p.Key, p.Value)
+	}
+	return b.String()
+}
+
+func userProperties(props paho.UserProperties) []UserProperty {
+	var out []UserProperty
+	for _, p := range props {
+		out = append(out, UserProperty{Key: p.Key, Value: p.Value})
+	}
+	return out
+}
+
+func reasonCodeErrorFromSuback(s *paho.Suback, topic string) *ReasonCodeError {
+	e := &ReasonCodeError{Op: "subscribe", Topic: topic, ReasonCode: s.Reasons[0]}
+	if s.Properties != nil {
+		e.ReasonString = s.Properties.ReasonString
+		e.UserProperties = userProperties(s.Properties.User)
+	}
+	return e
+}
+
+func reasonCodeErrorFromPublishResponse(r *paho.PublishResponse, topic string) *ReasonCodeError {
+	e := &ReasonCodeError{Op: "publish", Topic: topic, ReasonCode: r.ReasonCode}
+	if r.Properties != nil {
+		e.ReasonString = r.Properties.ReasonString
+		e.UserProperties = userProperties(r.Properties.User)
+	}
+	return e
+}
+
+func reasonCodeErrorFromDisconnect(d *paho.Disconnect) *ReasonCodeError {
+	e := &ReasonCodeError{Op: "disconnect", ReasonCode: d.ReasonCode}
+	if d.Properties != nil {
+		e.ReasonString = d.Properties.ReasonString
+		e.UserProperties = userProperties(d.Properties.User)
+	}
+	return e
+}
+
+// reasonCodeName returns the MQTT 5 specification name of a reason code
+func reasonCodeName(code byte) string {
+	switch code {
+	case 0x00:
+		return "Success"
+	case 0x10:
+		return "No matching subscribers"
+	case 0x11:
+		return "No subscription existed"
+	case 0x80:
+		return "Unspecified error"
+	case 0x81:
+		return "Malformed Packet"
+	case 0x82:
+		return "Protocol Error"
+	case 0x83:
+		return "Implementation specific error"
+	case 0x84:
+		return "Unsupported Protocol Version"
+	case 0x85:
+		return "Client Identifier not valid"
+	case 0x86:
+		return "Bad User Name or Password"
+	case 0x87:
+		return "Not authorized"
+	case 0x88:
+		return "Server unavailable"
+	case 0x89:
+		return "Server busy"
+	case 0x8A:
+		return "Banned"
+	case 0x8B:
+		return "Server shutting down"
+	case 0x8C:
+		return "Bad authentication method"
+	case 0x8D:
+		return "Keep Alive timeout"
+	case 0x8E:
+		return "Session taken over"
+	case 0x8F:
+		return "Topic Filter invalid"
+	case 0x90:
+		return "Topic Name invalid"
+	case 0x91:
+		return "Packet Identifier in use"
+	case 0x93:
+		return "Receive Maximum exceeded"
+	case 0x94:
+		return "Topic Alias invalid"
+	case 0x95:
+		return "Packet too large"
+	case 0x96:
+		return "Message rate too high"
+	case 0x97:
+		return "Quota exceeded"
+	case 0x98:
+		return "Administrative action"
+	case 0x99:
+		return "Payload format invalid"
+	case 0x9A:
+		return "Retain not supported"
+	case 0x9B:
+		return "QoS not supported"
+	case 0x9C:
+		return "Use another server"
+	case 0x9D:
+		return "Server moved"
+	case 0x9E:
+		return "Shared Subscriptions not supported"
+	case 0x9F:
+		return "Connection rate exceeded"
+	case 0xA0:
+		return "Maximum connect time"
+	case 0xA1:
+		return "Subscription Identifiers not supported"
+	case 0xA2:
+		return "Wildcard Subscriptions not supported"
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,68 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// readRootCAs reads the root CAs of -root-ca or $ROOT_CA. Either may hold
+// several roots concatenated, as during a migration between Amazon CAs, and
+// -root-ca may also name a directory whose .pem and .crt files are all read,
+// in name order. No data means no root CA is configured.
+func readRootCAs(cfg Config) (secret, error) {
+	rootCA := newSecret(cfg.Files.fs(), envRootCA, cfg.RootCAFile)
+	if rootCA.file && rootCA.source != "" {
+		if info, err := cfg.Files.fs().Stat(rootCA.source); err == nil && info.IsDir() {
+			return rootCA, readRootCADir(&rootCA)
+		}
+	}
+	return rootCA, rootCA.read()
+}
+
+// readRootCADir concatenates the certificate files of a directory, such as
+// /etc/ssl/certs or a directory of CAs shipped with the firmware
+func readRootCADir(rootCA *secret) error {
+	entries, err := rootCA.fs.ReadDir(rootCA.source)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", rootCA.source, err)
+	}
+	var data bytes.Buffer
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		file := secret{source: filepath.Join(rootCA.source, entry.Name()), file: true, fs: rootCA.fs}
+		if err := file.read(); err != nil {
+			return err
+		}
+		data.Write(file.data)
+		data.WriteByte('\n')
+	}
+	if data.Len() == 0 {
+		return fmt.Errorf("%s holds no .pem or .crt files", rootCA.source)
+	}
+	rootCA.data = data.Bytes()
+	return nil
+}
+
+// rootCAPool returns the roots the endpoint's certificate is verified
+// against: the configured root CAs or else the built-in ones of the region's
+// partition, and with -system-roots those of the system's trust store
+func rootCAPool(cfg Config) (*x509.CertPool, error) {
+	rootCA, err := loadRootCAs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if cfg.SystemRoots {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("failed to load the system trust store: %v", err)
+		}
+	}
+	pool.AppendCertsFromPEM(rootCA)
+	return pool, nil
+}
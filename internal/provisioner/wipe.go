@@ -0,0 +1,239 @@
+package provisioner
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+// shredFile overwrites a file with random data before removing it. This is best
+// effort: journaling filesystems and flash wear levelling may keep old blocks.
+func shredFile(fsys FileSystem, path string) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for wiping: %v", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	buf := make([]byte, info.Size())
+	if _, err := rand.Read(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to generate random data: %v", err)
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to overwrite %s: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", path, err)
+	}
+
+	if err := fsys.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+	return nil
+}
+
+// wipeClaimCredentials shreds the claim key and certificate files. Credentials
+// passed through the environment and key references have no file to remove,
+// and files already removed by an interrupted run are skipped.
+func wipeClaimCredentials(cert, key secret) error {
+	for _, s := range []secret{key, cert} {
+		if !s.file {
+			log.Printf("Warning: claim credential %s is not a file and cannot be wiped", s.source)
+			continue
+		}
+		if s.ref != "" {
+			log.Printf("Warning: claim private key %s is held by a token and is not wiped", s.source)
+			continue
+		}
+		if _, err := s.fs.Stat(s.source); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := shredFile(s.fs, s.source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroPrivateKey overwrites the private key material held by a TLS certificate
+func zeroPrivateKey(cert *tls.Certificate) {
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		zeroBigInt(key.D)
+		for _, p := range key.Primes {
+			zeroBigInt(p)
+		}
+		zeroBigInt(key.Precomputed.Dp)
+		zeroBigInt(key.Precomputed.Dq)
+		zeroBigInt(key.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		zeroBigInt(key.D)
+	case ed25519.PrivateKey:
+		clear(key)
+	}
+	cert.PrivateKey = nil
+}
+
+// zeroBigInt clears the words backing a big.Int
+func zeroBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	clear(n.Bits())
+	n.SetInt64(0)
+}
+
+// keyMaterial holds a private key as bytes so it can be zeroed once persisted,
+// which a string cannot be. It is a string in JSON, and formats as REDACTED so
+// the key cannot end up in logs, error messages, or debug dumps.
+type keyMaterial []byte
+
+// zero overwrites the key. Slices sharing the backing array see the zeroes.
+func (k keyMaterial) zero() {
+	clear(k)
+}
+
+func (k keyMaterial) String() string {
+	if len(k) == 0 {
+		return ""
+	}
+	return "REDACTED"
+}
+
+func (k keyMaterial) GoString() string {
+	return fmt.Sprintf("keyMaterial(%q)", k.String())
+}
+
+func (k keyMaterial) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(k))
+}
+
+// UnmarshalJSON decodes the JSON string directly into bytes, without the
+// intermediate string json.Unmarshal would leave behind
+func (k *keyMaterial) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*k = nil
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("private key is not a JSON string")
+	}
+	data = data[1 : len(data)-1]
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			out = append(out, data[i])
+			continue
+		}
+		i++
+		if i == len(data) {
+			return fmt.Errorf("private key has an invalid escape")
+		}
+		switch data[i] {
+		case '"', '\\', '/':
+			out = append(out, data[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			// PEM is ASCII, so surrogate pairs never occur
+			if i+4 >= len(data) {
+				return fmt.Errorf("private key has an invalid escape")
+			}
+			r, err := strconv.ParseUint(string(data[i+1:i+5]), 16, 16)
+			if err != nil {
+				return fmt.Errorf("private key has an invalid escape")
+			}
+			out = utf8.AppendRune(out, rune(r))
+			i += 4
+		default:
+			return fmt.Errorf("private key has an invalid escape")
+		}
+	}
+	*k = out
+	return nil
+}
+
+// UnmarshalCBOR decodes the text string AWS IoT sends the key as directly
+// into bytes, like UnmarshalJSON
+func (k *keyMaterial) UnmarshalCBOR(data []byte) error {
+	if len(data) == 1 && (data[0] == 0xf6 || data[0] == 0xf7) { // null or undefined
+		*k = nil
+		return nil
+	}
+	if len(data) == 0 || data[0]>>5 != 3 {
+		return fmt.Errorf("private key is not a CBOR text string")
+	}
+	// The length follows the major type in the head, in up to 8 bytes
+	head, length := 1, uint64(data[0]&0x1f)
+	switch {
+	case length < 24:
+	case length <= 27:
+		head += 1 << (length - 24)
+		if len(data) < head {
+			return fmt.Errorf("private key is truncated")
+		}
+		length = 0
+		for _, b := range data[1:head] {
+			length = length<<8 | uint64(b)
+		}
+	default:
+		return fmt.Errorf("private key is not a definite-length CBOR text string")
+	}
+	if uint64(len(data)-head) != length {
+		return fmt.Errorf("private key is truncated")
+	}
+	*k = append(keyMaterial(nil), data[head:]...)
+	return nil
+}
+
+// removeDeviceFiles shreds the permanent credentials and removes the identity,
+// state, result, and receipt from the output directory
+func removeDeviceFiles(cfg Config) error {
+	fsys := cfg.Files.fs()
+	for _, name := range []string{permanentKeyFile, permanentBundleFile, permanentCertFile, permanentChainFile, previousKeyFile, previousCertFile} {
+		path := cfg.outputPath(name)
+		if _, err := fsys.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := shredFile(fsys, path); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{identityFile, stateFile, resultFile, receiptFile} {
+		if err := fsys.Remove(cfg.outputPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %v", cfg.outputPath(name), err)
+		}
+	}
+	log.Printf("Removed the device credentials from %s", cfg.OutputDir)
+	return nil
+}
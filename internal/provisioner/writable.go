@@ -0,0 +1,120 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// NotWritableError is returned when a directory the run writes to is not
+// writable, checked before AWS IoT is contacted so a read-only root file
+// system cannot fail a run halfway, with a certificate created and nowhere
+// to keep it
+type NotWritableError struct {
+	What string // What is written there, such as "output directory"
+	Dir  string
+	Err  error
+}
+
+func (e *NotWritableError) Error() string {
+	hint := ""
+	if errors.Is(e.Err, syscall.EROFS) {
+		hint = "; on a read-only root file system, point it at a writable partition or a tmpfs"
+	}
+	return fmt.Sprintf("%s %s is not writable: %v%s", e.What, e.Dir, e.Err, hint)
+}
+
+func (e *NotWritableError) Unwrap() error {
+	return e.Err
+}
+
+// A directory the run writes to
+type writableDir struct {
+	what   string
+	dir    string
+	create bool // Created when first written to, rather than expected to exist
+}
+
+// writableDirs returns the directories the run writes to: the output
+// directory for the state, credentials, and audit log, and the directories
+// of the other files it is configured to write
+func (c Config) writableDirs() []writableDir {
+	dir := func(path string) string {
+		return filepath.Dir(filepath.Clean(path))
+	}
+	dirs := []writableDir{{what: "output directory", dir: c.OutputDir, create: true}}
+	if dirs[0].dir == "" {
+		dirs[0].dir = "."
+	}
+	if c.HealthFile != "" {
+		dirs = append(dirs, writableDir{what: "health file directory", dir: dir(c.HealthFile)})
+	}
+	if c.DiagnosticsDir != "" {
+		dirs = append(dirs, writableDir{what: "diagnostics directory", dir: c.DiagnosticsDir, create: true})
+	}
+	if c.MessageStoreDir != "" {
+		dirs = append(dirs, writableDir{what: "message store", dir: c.MessageStoreDir, create: true})
+	}
+	if c.Label.QRFile != "" {
+		dirs = append(dirs, writableDir{what: "QR code directory", dir: dir(c.Label.QRFile)})
+	}
+	if c.Label.ZPLFile != "" && c.Label.ZPLFile != "-" {
+		dirs = append(dirs, writableDir{what: "label directory", dir: dir(c.Label.ZPLFile)})
+	}
+	for _, render := range c.Renders {
+		dirs = append(dirs, writableDir{what: "render directory", dir: dir(render.Output)})
+	}
+	if slices.Contains(c.Appliers.Names, ApplierWPASupplicant) {
+		dirs = append(dirs, writableDir{what: "wpa_supplicant configuration directory", dir: dir(c.Appliers.WPASupplicantConf)})
+	}
+	if slices.Contains(c.Appliers.Names, ApplierChrony) {
+		dirs = append(dirs, writableDir{what: "chrony sources directory", dir: dir(c.Appliers.ChronySources)})
+	}
+	// The claim is shredded in place
+	switch {
+	case !c.WipeClaim:
+	case c.ClaimDir != "":
+		dirs = append(dirs, writableDir{what: "claim directory", dir: c.ClaimDir})
+	default:
+		// Claims from the environment are not wiped
+		for file, env := range map[string]string{c.ClaimCertFile: envClaimCert, c.ClaimKeyFile: envClaimKey} {
+			if file != "" && os.Getenv(env) == "" && keyScheme(file) == "" {
+				dirs = append(dirs, writableDir{what: "claim directory", dir: dir(file)})
+			}
+		}
+	}
+	return dirs
+}
+
+// Prefix of the file written and removed again to check a directory is
+// writable
+const writeProbeFile = ".write-probe-"
+
+// checkWritable checks every directory the run writes to can be written to,
+// by writing and removing a small file in each
+func checkWritable(cfg Config) error {
+	fsys := cfg.Files.fs()
+	checked := map[string]bool{}
+	for _, w := range cfg.writableDirs() {
+		if checked[w.dir] {
+			continue
+		}
+		checked[w.dir] = true
+		if w.create {
+			if err := fsys.MkdirAll(w.dir, 0700); err != nil {
+				return &NotWritableError{What: w.what, Dir: w.dir, Err: err}
+			}
+		}
+		probe := filepath.Join(w.dir, writeProbeFile+randomHex(cfg.random(), 8))
+		if err := fsys.WriteFile(probe, []byte{0}, 0600); err != nil {
+			return &NotWritableError{What: w.what, Dir: w.dir, Err: err}
+		}
+		if err := fsys.Remove(probe); err != nil {
+			return &NotWritableError{What: w.what, Dir: w.dir, Err: err}
+		}
+	}
+	return nil
+}
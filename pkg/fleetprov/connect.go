@@ -0,0 +1,126 @@
+package fleetprov
+
+import (
+	"crypto"
+	"crypto/tls"
+	"time"
+
+	"github.com/humblenginr/aws-claim-provisioning/internal/provisioner"
+)
+
+// Connections to AWS IoT and requests over them, for programs that use the
+// device's identity once it is provisioned
+type (
+	Transport      = provisioner.Transport
+	MessageHandler = provisioner.MessageHandler
+	Requester      = provisioner.Requester
+	Request        = provisioner.Request
+	Resolver       = provisioner.Resolver
+)
+
+// ConnectDevice connects to AWS IoT with the permanent identity of the device
+// provisioned into cfg.OutputDir, using its thing name as the client ID
+func ConnectDevice(cfg Config) (Transport, error) {
+	return provisioner.ConnectDevice(cfg)
+}
+
+// NewRequester returns a Requester over transport, which stays the caller's
+// to disconnect
+func NewRequester(cfg Config, transport Transport) *Requester {
+	return provisioner.NewRequester(cfg, transport)
+}
+
+// Identities and credentials of the device
+type (
+	TLSIdentity            = provisioner.TLSIdentity
+	KeyResolver            = provisioner.KeyResolver
+	DeviceCredentials      = provisioner.DeviceCredentials
+	IoTCredentialsProvider = provisioner.IoTCredentialsProvider
+)
+
+// NewSignerIdentity returns the identity of a certificate whose key signer
+// holds, such as a key in a secure element
+func NewSignerIdentity(certPEM []byte, signer crypto.Signer) (TLSIdentity, error) {
+	return provisioner.NewSignerIdentity(certPEM, signer)
+}
+
+// NewDeviceCredentials loads the permanent certificate and key from
+// cfg.OutputDir
+func NewDeviceCredentials(cfg Config) (*DeviceCredentials, error) {
+	return provisioner.NewDeviceCredentials(cfg)
+}
+
+// NewDeviceCredentialsFromIdentity loads the device identity from another
+// source than the output directory, such as a NewSignerIdentity
+func NewDeviceCredentialsFromIdentity(identity TLSIdentity) (*DeviceCredentials, error) {
+	return provisioner.NewDeviceCredentialsFromIdentity(identity)
+}
+
+// NewIoTCredentialsProvider returns a provider of temporary AWS credentials
+// the device certificate is exchanged for
+func NewIoTCredentialsProvider(cfg Config, cert tls.Certificate, endpoint, roleAlias, thingName string) (*IoTCredentialsProvider, error) {
+	return provisioner.NewIoTCredentialsProvider(cfg, cert, endpoint, roleAlias, thingName)
+}
+
+// Connection events of Config.OnConnectionEvent
+type (
+	ConnectionEvent     = provisioner.ConnectionEvent
+	ConnectionEventType = provisioner.ConnectionEventType
+	ConnectionReason    = provisioner.ConnectionReason
+)
+
+const (
+	ConnectionUp           = provisioner.ConnectionUp
+	ConnectionFailed       = provisioner.ConnectionFailed
+	ConnectionLost         = provisioner.ConnectionLost
+	ConnectionReconnecting = provisioner.ConnectionReconnecting
+	ConnectionReconnected  = provisioner.ConnectionReconnected
+
+	ReasonClientIDConflict = provisioner.ReasonClientIDConflict
+	ReasonNetwork          = provisioner.ReasonNetwork
+	ReasonNotAuthorized    = provisioner.ReasonNotAuthorized
+	ReasonRefused          = provisioner.ReasonRefused
+	ReasonServer           = provisioner.ReasonServer
+	ReasonTLS              = provisioner.ReasonTLS
+	ReasonThrottled        = provisioner.ReasonThrottled
+)
+
+// Resources shared between runs: connections and publish budget
+type (
+	ConnectionPool = provisioner.ConnectionPool
+	PublishLimiter = provisioner.PublishLimiter
+	TokenBucket    = provisioner.TokenBucket
+)
+
+// NewConnectionPool returns a pool keeping up to sessions TLS sessions, and
+// the addresses of a host for dnsTTL
+func NewConnectionPool(sessions int, dnsTTL time.Duration) *ConnectionPool {
+	return provisioner.NewConnectionPool(sessions, dnsTTL)
+}
+
+// NewTokenBucket returns a full token bucket, a PublishLimiter allowing rate
+// messages a second in bursts of up to burst
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return provisioner.NewTokenBucket(rate, burst)
+}
+
+// Time, randomness, and storage of a run, replaceable for tests and
+// embedded targets
+type (
+	Clock       = provisioner.Clock
+	ManualClock = provisioner.ManualClock
+	Random      = provisioner.Random
+	FileSystem  = provisioner.FileSystem
+	File        = provisioner.File
+)
+
+// NewManualClock returns a ManualClock set to start
+func NewManualClock(start time.Time) *ManualClock {
+	return provisioner.NewManualClock(start)
+}
+
+// NewSeededRandom returns a deterministic Random, so runs given the same seed
+// can be reproduced
+func NewSeededRandom(seed uint64) Random {
+	return provisioner.NewSeededRandom(seed)
+}
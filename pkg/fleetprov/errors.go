@@ -0,0 +1,75 @@
+package fleetprov
+
+import "github.com/humblenginr/aws-claim-provisioning/internal/provisioner"
+
+// Classes of errors, telling whether provisioning is worth retrying
+type ErrorClass = provisioner.ErrorClass
+
+const (
+	ErrorRetryable = provisioner.ErrorRetryable
+	ErrorTerminal  = provisioner.ErrorTerminal
+	ErrorThrottled = provisioner.ErrorThrottled
+)
+
+// ClassifyError returns how err should be retried
+func ClassifyError(err error) ErrorClass {
+	return provisioner.ClassifyError(err)
+}
+
+// Stable codes of errors, documented in the README
+type ErrorCode = provisioner.ErrorCode
+
+const (
+	ErrorAckTimeout           = provisioner.ErrorAckTimeout
+	ErrorBusy                 = provisioner.ErrorBusy
+	ErrorCertificateRejected  = provisioner.ErrorCertificateRejected
+	ErrorCertificateTimeout   = provisioner.ErrorCertificateTimeout
+	ErrorClientIDConflict     = provisioner.ErrorClientIDConflict
+	ErrorClientWedged         = provisioner.ErrorClientWedged
+	ErrorCredentialsUnusable  = provisioner.ErrorCredentialsUnusable
+	ErrorDeadlineExceeded     = provisioner.ErrorDeadlineExceeded
+	ErrorDeviceConfiguration  = provisioner.ErrorDeviceConfiguration
+	ErrorFingerprintMismatch  = provisioner.ErrorFingerprintMismatch
+	ErrorInvalidConfiguration = provisioner.ErrorInvalidConfiguration
+	ErrorInvalidResponse      = provisioner.ErrorInvalidResponse
+	ErrorLegacyEndpoint       = provisioner.ErrorLegacyEndpoint
+	ErrorLockedOut            = provisioner.ErrorLockedOut
+	ErrorNotAuthorized        = provisioner.ErrorNotAuthorized
+	ErrorNotWritable          = provisioner.ErrorNotWritable
+	ErrorOperationRefused     = provisioner.ErrorOperationRefused
+	ErrorPostStepsFailed      = provisioner.ErrorPostStepsFailed
+	ErrorQuarantined          = provisioner.ErrorQuarantined
+	ErrorRegistrationRejected = provisioner.ErrorRegistrationRejected
+	ErrorRegistrationTimeout  = provisioner.ErrorRegistrationTimeout
+	ErrorServerBusy           = provisioner.ErrorServerBusy
+	ErrorServerUnavailable    = provisioner.ErrorServerUnavailable
+	ErrorStepFailed           = provisioner.ErrorStepFailed
+	ErrorTemplateParameters   = provisioner.ErrorTemplateParameters
+	ErrorThingNameConflict    = provisioner.ErrorThingNameConflict
+	ErrorUnexpected           = provisioner.ErrorUnexpected
+)
+
+// ErrorCodeOf returns the stable code of err, ErrorUnexpected for errors of
+// no known kind, or empty for nil
+func ErrorCodeOf(err error) ErrorCode {
+	return provisioner.ErrorCodeOf(err)
+}
+
+// Errors to tell apart with errors.As. Other failures are told apart by
+// their ErrorCodeOf.
+type (
+	ConfigError            = provisioner.ConfigError
+	FlowStepError          = provisioner.FlowStepError
+	ReasonCodeError        = provisioner.ReasonCodeError
+	RejectedError          = provisioner.RejectedError
+	RequestRejectedError   = provisioner.RequestRejectedError
+	TemplateParameterError = provisioner.TemplateParameterError
+)
+
+// ErrResponseTimeout is returned, wrapped, when no response to a request
+// arrives in time. The request may still have been carried out.
+var ErrResponseTimeout = provisioner.ErrResponseTimeout
+
+// ErrStepRefused is wrapped by the error of a FlowStep whose service refuses
+// the device, so the flow does not retry it
+var ErrStepRefused = provisioner.ErrStepRefused
@@ -0,0 +1,93 @@
+// Package fleetprov provisions a device with AWS IoT fleet provisioning: it
+// connects with a claim certificate, has AWS IoT create a certificate, and
+// registers the thing through a provisioning template, as the provisioner
+// command does.
+//
+//	cfg := fleetprov.DefaultConfig()
+//	cfg.Endpoints = []string{"<prefix>-ats.iot.eu-west-1.amazonaws.com"}
+//	cfg.TemplateName = "FactoryTemplate"
+//	cfg.SerialNumber = serial
+//	result, err := fleetprov.Provision(cfg, nil)
+//
+// This package is the API of the module that follows semantic versioning.
+// It holds what the README documents for Go programs, and the types needed
+// to implement the interfaces Config takes; everything else stays internal
+// and can change in any release. Its types are those of the internal
+// packages the command is built from, so values pass between them
+// unchanged.
+package fleetprov
+
+import "github.com/humblenginr/aws-claim-provisioning/internal/provisioner"
+
+// Configuration of a run, see DefaultConfig. Its fields are set directly,
+// cfg.Reconnect.Max for example, so the types of most of them are not
+// exported here.
+type Config = provisioner.Config
+
+// DefaultConfig returns the configuration of the command without flags
+func DefaultConfig() Config {
+	return provisioner.DefaultConfig()
+}
+
+// ValidateConfig checks cfg and the files it names without provisioning,
+// returning a *ConfigError listing every problem, or nil
+func ValidateConfig(cfg Config) error {
+	return provisioner.ValidateConfig(cfg)
+}
+
+// Provision provisions the device cfg describes, as the command does,
+// reporting each stage to progress if it is not nil. Calls for different
+// devices, each with its own cfg.OutputDir and client ID, can run
+// concurrently in one process.
+func Provision(cfg Config, progress ProgressFunc) (*ProvisioningResult, error) {
+	return provisioner.Provision(cfg, progress)
+}
+
+// Progress and outcome of a run
+type (
+	ProgressFunc       = provisioner.ProgressFunc
+	Stage              = provisioner.Stage
+	ProvisioningResult = provisioner.ProvisioningResult
+)
+
+// Stages reported to a ProgressFunc
+const (
+	StageValidate          = provisioner.StageValidate
+	StageConnect           = provisioner.StageConnect
+	StageCreateCertificate = provisioner.StageCreateCertificate
+	StageRegisterThing     = provisioner.StageRegisterThing
+	StageVerify            = provisioner.StageVerify
+	StageComplete          = provisioner.StageComplete
+)
+
+// Identity of a provisioned device
+type DeviceIdentity = provisioner.DeviceIdentity
+
+// LoadDeviceIdentity returns the identity of the device provisioned into
+// cfg.OutputDir, or nil if it is not provisioned
+func LoadDeviceIdentity(cfg Config) (*DeviceIdentity, error) {
+	return provisioner.LoadDeviceIdentity(cfg)
+}
+
+// Alert sinks of the serve daemon, Config.Notifiers
+type (
+	Alert    = provisioner.Alert
+	Notifier = provisioner.Notifier
+)
+
+const (
+	AlertCertificateExpiring = provisioner.AlertCertificateExpiring
+	AlertOperationsFailing   = provisioner.AlertOperationsFailing
+)
+
+// Appliers of the device configuration of Config.Appliers.Custom
+type (
+	ConfigApplier  = provisioner.ConfigApplier
+	DeviceSettings = provisioner.DeviceSettings
+)
+
+// Requests of the caller's own in the provisioning flow, Config.Steps
+type (
+	FlowStep    = provisioner.FlowStep
+	StepContext = provisioner.StepContext
+)